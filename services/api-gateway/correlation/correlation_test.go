@@ -0,0 +1,76 @@
+package correlation
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidTraceparent(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		want        bool
+	}{
+		{name: "valid", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", want: true},
+		{name: "not sampled", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", want: true},
+		{name: "empty", traceparent: ""},
+		{name: "other version", traceparent: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "extra field", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-00"},
+		{name: "short trace ID", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01"},
+		{name: "short parent ID", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b-01"},
+		{name: "upper case", traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01"},
+		{name: "not hex", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01"},
+		{name: "zero trace ID", traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "zero parent ID", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "injected", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validTraceparent(tt.traceparent); got != tt.want {
+				t.Errorf("validTraceparent(%q) = %v, want %v", tt.traceparent, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{id: "3f2a9c1e-7b4d", want: true},
+		{id: "job_42.retry", want: true},
+		{id: strings.Repeat("a", 128), want: true},
+		{id: ""},
+		{id: strings.Repeat("a", 129)},
+		{id: "id\nfake log line"},
+		{id: "id with spaces"},
+	}
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("validRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestFromHeaderDropsInvalid(t *testing.T) {
+	header := http.Header{}
+	header.Set(RequestIDHeader, "bad id")
+	header.Set(TraceparentHeader, "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	header.Set(TracestateHeader, "vendor=value")
+	if ids := FromHeader(header); ids != (IDs{}) {
+		t.Errorf("FromHeader() = %+v, want no IDs", ids)
+	}
+}
+
+func TestNextHop(t *testing.T) {
+	ids := IDs{RequestID: "request", Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	next := ids.NextHop()
+	if next.RequestID != ids.RequestID || next.TraceID() != ids.TraceID() {
+		t.Errorf("NextHop() = %+v, want the request ID and trace of %+v", next, ids)
+	}
+	if next.Traceparent == ids.Traceparent || !validTraceparent(next.Traceparent) || !strings.HasSuffix(next.Traceparent, "-01") {
+		t.Errorf("NextHop() traceparent = %s, want a new parent ID", next.Traceparent)
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
-	"encoding/json"
+	"api-gateway/correlation"
+	"api-gateway/routing"
+	"api-gateway/telemetry"
+	"api-gateway/tokens"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,6 +22,15 @@ import (
 
 var logger *zap.Logger
 
+// validator checks the credentials of requests to the form and plugin
+// services.
+var validator *tokens.Validator
+
+// router holds the routes of the routes file.
+var router *routing.Router
+
+const apiKeyPrefix = "ffk_"
+
 func main() {
 	var err error
 	logger, err = zap.NewDevelopment()
@@ -25,94 +39,137 @@ func main() {
 	}
 	logger.With(zap.String("service", "api-gateway"))
 
+	shutdownTracing, err := telemetry.Setup(context.Background(), "api-gateway")
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
+	}
+	defer shutdownTracing(context.Background())
+
+	validator, err = tokens.ValidatorFromEnv(logger)
+	if err != nil {
+		logger.Fatal("Failed to configure token validation", zap.Error(err))
+	}
+
 	r := gin.New()
-	r.Use(ginzap.Ginzap(logger, time.RFC3339, true))
+	r.Use(telemetry.Middleware("api-gateway"))
+	r.Use(correlation.Middleware())
+	r.Use(ginzap.GinzapWithConfig(logger, &ginzap.Config{TimeFormat: time.RFC3339, UTC: true, Context: correlation.LogFields}))
 	r.Use(ginzap.RecoveryWithZap(logger, true))
 
-	v1 := r.Group("/api/v1")
-	v1.Any("/form/*path", isAuthorised, reverseProxy("http://form-service"))
-	v1.Any("/auth/*path", reverseProxy("http://auth-service"))
-	v1.Any("/plugins/*path", isAuthorised, reverseProxy("http://plugin-manager-service"))
+	routesPath := os.Getenv("GATEWAY_ROUTES")
+	if routesPath == "" {
+		routesPath = "config/routes.yaml"
+	}
+	router, err = routing.NewRouter(routesPath, logger)
+	if err != nil {
+		logger.Fatal("Failed to load routes", zap.String("path", routesPath), zap.Error(err))
+	}
+	pollInterval, err := time.ParseDuration(os.Getenv("GATEWAY_ROUTES_POLL_INTERVAL"))
+	if err != nil || pollInterval <= 0 {
+		pollInterval = 5 * time.Second
+	}
+	go router.Watch(pollInterval)
+
+	rateLimitStore, err = rateLimitStoreFromEnv()
+	if err != nil {
+		logger.Fatal("Failed to configure rate limiting", zap.Error(err))
+	}
+
+	r.Any("/*path", proxyRequest)
 
 	r.Run(":80")
 }
 
+// proxyRequest sends the request to the service of its route, once the
+// credentials are checked when the route needs them.
+func proxyRequest(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	route := router.Table().Match(c.Request.URL.Path)
+	if route == nil {
+		logger.Debug("No route", zap.String("path", c.Request.URL.Path))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	telemetry.NameRoute(c.Request.Context(), c.Request.Method, route.Prefix)
+	// the limits by address come first, so requests failing authentication
+	// count against them too
+	results := takeRateLimits(c, route, true)
+	if checkRateLimits(c, route, results); c.IsAborted() {
+		return
+	}
+	if route.Auth {
+		if isAuthorised(c); c.IsAborted() {
+			return
+		}
+		if role := c.GetString("role"); !route.AllowsRole(role) {
+			logger.Warn("Role not allowed on route", zap.String("route", route.Prefix), zap.String("role", role))
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		results = append(results, takeRateLimits(c, route, false)...)
+		if checkRateLimits(c, route, results); c.IsAborted() {
+			return
+		}
+	}
+
+	// services rate limit by the address of the client, it can't be set
+	// by the client
+	c.Request.Header.Set("X-Real-IP", c.RemoteIP())
+	route.ServeHTTP(c.Writer, c.Request)
+}
+
 func isAuthorised(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering isAuthorised function")
-	token := c.GetHeader("Authorization")
-	logger.Debug("Authorisation token", zap.String("token", token))
+	authorization := c.GetHeader("Authorization")
+
+	// API keys come in X-API-Key or as the bearer token
+	apiKey := c.GetHeader("X-API-Key")
+	token, _ := strings.CutPrefix(authorization, "Bearer ")
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		apiKey, token = token, ""
+	}
 
-	if token == "" {
+	if token == "" && apiKey == "" {
 		logger.Warn("No auth token specified")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "No auth token specified"})
 		c.Abort()
 		return
 	}
 
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", "http://auth-service/api/v1/auth/validate", nil)
-	req.Header.Add("Authorization", token)
-	resp, err := client.Do(req)
-
-	if err != nil || resp.StatusCode != 200 {
-		logger.Warn("Failed to validate token", zap.Error(err), zap.Int("status_code", resp.StatusCode))
+	claims, err := validator.Validate(c.Request.Context(), token, apiKey)
+	if errors.Is(err, tokens.ErrUnauthorized) {
+		logger.Warn("Failed to validate token", zap.Error(err))
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		c.Abort()
 		return
 	}
-
-	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		logger.Warn("Failed to read response body", zap.Error(err))
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-		c.Abort()
-		return
-	}
-
-	type JSONResponse struct {
-		Claims struct {
-			ID   int    `json:"id"`
-			Role string `json:"role"`
-		} `json:"claims"`
-		Message string `json:"message"`
-	}
-	var response JSONResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		logger.Warn("Failed to unmarshal response", zap.Error(err))
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		logger.Error("Failed to validate token", zap.Error(err))
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Authentication is temporarily unavailable"})
 		c.Abort()
 		return
 	}
-	logger.Debug("Token validated", zap.Any("response", response))
-
-	id := response.Claims.ID
-	role := response.Claims.Role
-
-	c.Request.Header.Set("X-Id", fmt.Sprint(id))
-	c.Request.Header.Set("X-Role", role)
-	logger.Debug("X-Id and X-Role set", zap.Int("id", id), zap.String("role", role))
-
-	defer resp.Body.Close()
-	c.Next()
-}
-
-func reverseProxy(target string) gin.HandlerFunc {
-	reverseProxyLogger := logger.With(zap.String("target", target))
-	targetURL, err := url.Parse(target)
-
-	if err != nil {
-		reverseProxyLogger.Fatal("Failed to parse target URL", zap.Error(err))
-	}
-
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-	proxy.Director = func(req *http.Request) {
-		req.Header.Set("X-Forwarded-Host", req.Host)
-		req.Header.Set("X-Origin-Host", targetURL.Host)
-		req.URL.Scheme = targetURL.Scheme
-		req.URL.Host = targetURL.Host
-	}
-
-	return func(c *gin.Context) {
-		proxy.ServeHTTP(c.Writer, c.Request)
+	logger.Debug("Token validated", zap.Int("id", claims.ID), zap.String("role", claims.Role))
+
+	c.Request.Header.Set("X-Id", fmt.Sprint(claims.ID))
+	c.Request.Header.Set("X-Role", claims.Role)
+	logger.Debug("X-Id and X-Role set", zap.Int("id", claims.ID), zap.String("role", claims.Role))
+
+	// the active team of the token, never trust the headers sent by clients
+	c.Request.Header.Del("X-Team-Id")
+	c.Request.Header.Del("X-Team-Role")
+	if claims.TeamID != 0 {
+		c.Request.Header.Set("X-Team-Id", fmt.Sprint(claims.TeamID))
+		c.Request.Header.Set("X-Team-Role", claims.TeamRole)
+		logger.Debug("X-Team-Id and X-Team-Role set", zap.Int("team_id", claims.TeamID), zap.String("team_role", claims.TeamRole))
 	}
+	c.Request.Header.Set("X-Permissions", strings.Join(claims.Permissions, ","))
+	c.Request.Header.Del("X-API-Key")
+	c.Request.Header.Set("X-Email-Verified", strconv.FormatBool(claims.EmailVerified))
+	c.Request.Header.Set("X-Phone-Verified", strconv.FormatBool(claims.PhoneVerified))
+	logger.Debug("X-Permissions set", zap.Strings("permissions", claims.Permissions))
+	c.Set("role", claims.Role)
+	c.Set("claims", claims)
 }
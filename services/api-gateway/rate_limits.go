@@ -0,0 +1,118 @@
+package main
+
+import (
+	"api-gateway/correlation"
+	"api-gateway/ratelimit"
+	"api-gateway/routing"
+	"api-gateway/tokens"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// rateLimitStore keeps the buckets of the rate limits of the routes.
+var rateLimitStore ratelimit.Store
+
+// rateLimitStoreFromEnv returns the store selected by RATE_LIMIT_STORE,
+// memory (the default) or redis at REDIS_URL.
+func rateLimitStoreFromEnv() (ratelimit.Store, error) {
+	switch kind := os.Getenv("RATE_LIMIT_STORE"); kind {
+	case "", "memory":
+		store := ratelimit.NewMemoryStore()
+		go func() {
+			for range time.Tick(time.Minute) {
+				store.Cleanup()
+			}
+		}()
+		return store, nil
+	case "redis":
+		options, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		return &ratelimit.RedisStore{Client: redis.NewClient(options), Prefix: "ratelimit:"}, nil
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q", kind)
+	}
+}
+
+// rateLimitClient returns who the key counts the request for, false when the
+// request has none, like the team of a token without an active team.
+func rateLimitClient(c *gin.Context, key ratelimit.Key) (string, bool) {
+	if key == ratelimit.KeyIP {
+		return c.RemoteIP(), true
+	}
+	value, ok := c.Get("claims")
+	if !ok {
+		return "", false
+	}
+	claims := value.(tokens.Claims)
+	switch {
+	case key == ratelimit.KeyUser && claims.Role != "api-key" && claims.ID != 0:
+		return strconv.Itoa(claims.ID), true
+	case key == ratelimit.KeyTeam && claims.TeamID != 0:
+		return strconv.Itoa(claims.TeamID), true
+	case key == ratelimit.KeyAPIKey && claims.APIKeyID != 0:
+		return strconv.Itoa(claims.APIKeyID), true
+	}
+	return "", false
+}
+
+// seconds rounds up, so clients don't retry too early.
+func seconds(duration time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(duration.Seconds())))
+}
+
+// takeRateLimits takes the request from the limits of the route counting by
+// address, or from the limits counting by account when byIP is false. Limits
+// are skipped while the store is unavailable, the gateway doesn't go down
+// with it.
+func takeRateLimits(c *gin.Context, route *routing.Route, byIP bool) []ratelimit.Result {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	var results []ratelimit.Result
+	for i, limit := range route.RateLimits {
+		if (limit.Key == ratelimit.KeyIP) != byIP {
+			continue
+		}
+		client, ok := rateLimitClient(c, limit.Key)
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%s:%d:%s:%s", route.Prefix, i, limit.Key, client)
+		result, err := rateLimitStore.Take(c.Request.Context(), key, limit)
+		if err != nil {
+			logger.Error("Failed to check rate limit", zap.String("route", route.Prefix), zap.String("key", string(limit.Key)), zap.Error(err))
+			continue
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// checkRateLimits sets the RateLimit headers of the limit closest to be used
+// up of the results and aborts with 429 when one is.
+func checkRateLimits(c *gin.Context, route *routing.Route, results []ratelimit.Result) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	result, ok := ratelimit.Tightest(results)
+	if !ok {
+		return
+	}
+
+	c.Header("RateLimit-Limit", strconv.Itoa(result.Limit.Burst))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("RateLimit-Reset", seconds(result.Reset))
+	c.Header("RateLimit-Policy", result.Limit.Policy())
+	if !result.Allowed {
+		logger.Warn("Rate limit exceeded", zap.String("route", route.Prefix), zap.String("key", string(result.Limit.Key)), zap.Duration("retry_after", result.RetryAfter))
+		c.Header("Retry-After", seconds(result.RetryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+		c.Abort()
+	}
+}
@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket is full again, it can be dropped then
+	full time.Time
+}
+
+// MemoryStore keeps the buckets in the process, they are lost on restart and
+// not shared between gateways.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}}
+}
+
+func (store *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	state, ok := store.buckets[key]
+	if !ok {
+		state = &bucket{tokens: float64(limit.Burst), updated: now}
+		store.buckets[key] = state
+	}
+	elapsed := now.Sub(state.updated).Seconds()
+	state.tokens = math.Min(float64(limit.Burst), state.tokens+math.Max(0, elapsed)*limit.rate())
+	state.updated = now
+	allowed := state.tokens >= 1
+	if allowed {
+		state.tokens--
+	}
+	result := limit.result(allowed, state.tokens)
+	state.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// Cleanup drops the buckets which are full again, a new bucket is the same.
+func (store *MemoryStore) Cleanup() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	for key, state := range store.buckets {
+		if !now.Before(state.full) {
+			delete(store.buckets, key)
+		}
+	}
+}
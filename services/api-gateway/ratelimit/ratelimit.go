@@ -0,0 +1,124 @@
+// Package ratelimit limits the rate of requests with token buckets. A
+// bucket holds up to Burst tokens and is refilled at Requests per Per, each
+// request takes a token and is refused when the bucket is empty. The buckets
+// are kept in a Store: in memory for a single gateway, or in Redis when
+// several gateways share the limits.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Key is what a limit counts requests by.
+type Key string
+
+const (
+	KeyIP     Key = "ip"
+	KeyUser   Key = "user"
+	KeyTeam   Key = "team"
+	KeyAPIKey Key = "api-key"
+)
+
+// Limit is a rate limit of a route.
+type Limit struct {
+	// Key is the client the requests are counted for.
+	Key Key `yaml:"key"`
+	// Requests are allowed per Per on average.
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+	// Burst is how many requests may be sent at once, Requests by default.
+	Burst int `yaml:"burst"`
+}
+
+// Validate checks the limit and fills in the defaults.
+func (limit *Limit) Validate() error {
+	switch limit.Key {
+	case KeyIP, KeyUser, KeyTeam, KeyAPIKey:
+	default:
+		return fmt.Errorf("unknown key %q, use ip, user, team or api-key", limit.Key)
+	}
+	if limit.Requests < 1 {
+		return errors.New("requests must be positive")
+	}
+	if limit.Per <= 0 {
+		return errors.New("per must be positive")
+	}
+	if limit.Burst < 0 {
+		return errors.New("burst can't be negative")
+	}
+	if limit.Burst == 0 {
+		limit.Burst = limit.Requests
+	}
+	return nil
+}
+
+// rate returns the tokens added to the bucket per second.
+func (limit Limit) rate() float64 {
+	return float64(limit.Requests) / limit.Per.Seconds()
+}
+
+// Policy describes the limit as in the RateLimit-Policy header.
+func (limit Limit) Policy() string {
+	return strconv.Itoa(limit.Requests) + ";w=" + strconv.Itoa(int(math.Ceil(limit.Per.Seconds()))) + ";burst=" + strconv.Itoa(limit.Burst)
+}
+
+// Result is the state of a bucket after a request took from it.
+type Result struct {
+	Limit   Limit
+	Allowed bool
+	// Remaining is the number of requests the bucket allows now.
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, zero when
+	// one is allowed now.
+	RetryAfter time.Duration
+}
+
+// result returns the result for the tokens left in the bucket.
+func (limit Limit) result(allowed bool, tokens float64) Result {
+	rate := limit.rate()
+	result := Result{
+		Limit:     limit,
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(limit.Burst) - tokens) / rate * float64(time.Second)),
+	}
+	if tokens < 1 {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return result
+}
+
+// Store keeps the buckets.
+type Store interface {
+	// Take takes a token from the bucket of the key, which is filled for the
+	// limit.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// Tightest returns the result with the fewest requests remaining, the one the
+// client runs into first. A refused result always wins over an allowed one.
+func Tightest(results []Result) (Result, bool) {
+	if len(results) == 0 {
+		return Result{}, false
+	}
+	tightest := results[0]
+	for _, result := range results[1:] {
+		switch {
+		case tightest.Allowed && !result.Allowed:
+			tightest = result
+		case tightest.Allowed != result.Allowed:
+		case !result.Allowed && result.RetryAfter > tightest.RetryAfter:
+			tightest = result
+		case result.Allowed && result.Remaining < tightest.Remaining:
+			tightest = result
+		}
+	}
+	return tightest, true
+}
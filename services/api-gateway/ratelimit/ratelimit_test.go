@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimitResult(t *testing.T) {
+	// 10 requests per second, a token every 100ms
+	limit := Limit{Key: KeyIP, Requests: 10, Per: time.Second, Burst: 5}
+	tests := []struct {
+		name           string
+		allowed        bool
+		tokens         float64
+		wantRemaining  int
+		wantReset      time.Duration
+		wantRetryAfter time.Duration
+	}{
+		{name: "full", allowed: true, tokens: 5, wantRemaining: 5},
+		{name: "one taken", allowed: true, tokens: 4, wantRemaining: 4, wantReset: 100 * time.Millisecond},
+		{name: "last taken", allowed: true, tokens: 0, wantRemaining: 0, wantReset: 500 * time.Millisecond, wantRetryAfter: 100 * time.Millisecond},
+		{name: "partly refilled", allowed: false, tokens: 0.5, wantRemaining: 0, wantReset: 450 * time.Millisecond, wantRetryAfter: 50 * time.Millisecond},
+		{name: "fractional tokens round down", allowed: true, tokens: 2.75, wantRemaining: 2, wantReset: 225 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := limit.result(tt.allowed, tt.tokens)
+			if result.Allowed != tt.allowed || result.Remaining != tt.wantRemaining {
+				t.Errorf("result() = allowed %v, remaining %d, want %v, %d", result.Allowed, result.Remaining, tt.allowed, tt.wantRemaining)
+			}
+			if !near(result.Reset, tt.wantReset) {
+				t.Errorf("Reset = %v, want %v", result.Reset, tt.wantReset)
+			}
+			if !near(result.RetryAfter, tt.wantRetryAfter) {
+				t.Errorf("RetryAfter = %v, want %v", result.RetryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+// near allows for the rounding of float durations.
+func near(got, want time.Duration) bool {
+	diff := got - want
+	return diff > -time.Microsecond && diff < time.Microsecond
+}
+
+func TestTightest(t *testing.T) {
+	allowed := func(remaining int) Result { return Result{Allowed: true, Remaining: remaining} }
+	refused := func(retryAfter time.Duration) Result { return Result{RetryAfter: retryAfter} }
+
+	tests := []struct {
+		name    string
+		results []Result
+		want    Result
+		wantOK  bool
+	}{
+		{name: "none"},
+		{name: "single", results: []Result{allowed(3)}, want: allowed(3), wantOK: true},
+		{name: "fewest remaining", results: []Result{allowed(3), allowed(1), allowed(2)}, want: allowed(1), wantOK: true},
+		{name: "refused wins over allowed", results: []Result{allowed(0), refused(time.Second)}, want: refused(time.Second), wantOK: true},
+		{name: "refused first wins over allowed", results: []Result{refused(time.Second), allowed(0)}, want: refused(time.Second), wantOK: true},
+		{name: "longest retry of refused", results: []Result{refused(time.Second), refused(time.Minute), refused(time.Millisecond)}, want: refused(time.Minute), wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Tightest(tt.results)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("Tightest() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Key: KeyIP, Requests: 1, Per: time.Hour, Burst: 2}
+	for i, want := range []bool{true, true, false} {
+		result, err := store.Take(context.Background(), "client", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != want {
+			t.Errorf("request %d allowed = %v, want %v", i+1, result.Allowed, want)
+		}
+	}
+	// the buckets of other clients are separate
+	if result, _ := store.Take(context.Background(), "other", limit); !result.Allowed {
+		t.Error("request of another client refused")
+	}
+}
@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript refills and takes from the bucket in one step, so gateways
+// don't race each other. The time is the one of Redis as the clocks of the
+// gateways may differ. The bucket expires once it would be full again.
+var takeScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1])
+local updated = tonumber(state[2])
+if tokens == nil or updated == nil then
+	tokens = burst
+	updated = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate / 1000)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// RedisStore keeps the buckets in Redis, shared by all gateways.
+type RedisStore struct {
+	Client *redis.Client
+	// Prefix is put before the keys of the buckets.
+	Prefix string
+}
+
+func (store *RedisStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	reply, err := takeScript.Run(ctx, store.Client, []string{store.Prefix + key}, limit.Burst, limit.rate()).Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(reply) != 2 {
+		return Result{}, fmt.Errorf("unexpected reply %v", reply)
+	}
+	allowed, _ := reply[0].(int64)
+	remaining, _ := reply[1].(string)
+	tokens, err := strconv.ParseFloat(remaining, 64)
+	if err != nil {
+		return Result{}, err
+	}
+	return limit.result(allowed == 1, tokens), nil
+}
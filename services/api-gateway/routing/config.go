@@ -0,0 +1,185 @@
+// Package routing maps the paths of requests to the services behind the
+// gateway. The routes and the pools of services they send requests to are
+// read from a YAML (or JSON) file, which is watched
+// and reloaded while the gateway runs; a new file only replaces the routes
+// once it is valid, and requests in flight finish on the routes they
+// started with.
+package routing
+
+import (
+	"api-gateway/ratelimit"
+	"api-gateway/upstream"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http/httputil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultTimeout bounds requests to routes without a timeout.
+const DefaultTimeout = 30 * time.Second
+
+// Route sends the requests under a path prefix to a service.
+type Route struct {
+	// Prefix is matched against the path of requests at segment boundaries,
+	// the longest matching prefix wins.
+	Prefix string `yaml:"prefix"`
+	// Pool is the name of the pool of the service.
+	Pool string `yaml:"pool"`
+	// Auth requires a valid access token or API key.
+	Auth bool `yaml:"auth"`
+	// Roles limits the route to accounts with one of the roles, like user,
+	// team, admin or api-key. Any role is allowed when empty.
+	Roles []string `yaml:"roles"`
+	// Timeout bounds the time until the service responds.
+	Timeout time.Duration `yaml:"timeout"`
+	// Rewrite replaces the prefix in the path sent to the service when set,
+	// the path is passed on unchanged otherwise.
+	Rewrite *string `yaml:"rewrite"`
+	// RateLimits limit the requests of each client to the route, all of
+	// them apply.
+	RateLimits []ratelimit.Limit `yaml:"rate_limits"`
+
+	proxy *httputil.ReverseProxy
+}
+
+// Config is the content of the routes file.
+type Config struct {
+	Pools  map[string]*upstream.Config `yaml:"pools"`
+	Routes []*Route                    `yaml:"routes"`
+}
+
+// AllowsRole reports whether accounts with the role may use the route.
+func (route *Route) AllowsRole(role string) bool {
+	if len(route.Roles) == 0 {
+		return true
+	}
+	for _, allowed := range route.Roles {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the path is the prefix or below it.
+func (route *Route) matches(path string) bool {
+	if route.Prefix == "/" {
+		return true
+	}
+	rest, ok := strings.CutPrefix(path, route.Prefix)
+	return ok && (rest == "" || rest[0] == '/')
+}
+
+// rewrite returns the path to send to the service.
+func (route *Route) rewrite(path string) string {
+	if route.Rewrite == nil {
+		return path
+	}
+	rest := strings.TrimPrefix(path, route.Prefix)
+	if route.Prefix == "/" {
+		rest = path
+	}
+	rewritten := strings.TrimSuffix(*route.Rewrite, "/") + rest
+	if rewritten == "" {
+		return "/"
+	}
+	return rewritten
+}
+
+// validate checks the route and fills in the defaults.
+func (route *Route) validate() error {
+	if !strings.HasPrefix(route.Prefix, "/") {
+		return errors.New("prefix must start with /")
+	}
+	if route.Prefix != "/" {
+		route.Prefix = strings.TrimSuffix(route.Prefix, "/")
+	}
+	if route.Pool == "" {
+		return errors.New("pool is required")
+	}
+	if len(route.Roles) > 0 && !route.Auth {
+		return errors.New("roles need auth")
+	}
+	for _, role := range route.Roles {
+		if role == "" {
+			return errors.New("roles can't be empty")
+		}
+	}
+	if route.Timeout < 0 {
+		return errors.New("timeout can't be negative")
+	}
+	if route.Timeout == 0 {
+		route.Timeout = DefaultTimeout
+	}
+	if route.Rewrite != nil && !strings.HasPrefix(*route.Rewrite, "/") {
+		return errors.New("rewrite must start with /")
+	}
+	for i := range route.RateLimits {
+		limit := &route.RateLimits[i]
+		if err := limit.Validate(); err != nil {
+			return fmt.Errorf("rate limit %d: %w", i+1, err)
+		}
+		if limit.Key != ratelimit.KeyIP && !route.Auth {
+			return fmt.Errorf("rate limit %d: key %s needs auth", i+1, limit.Key)
+		}
+	}
+	return nil
+}
+
+// ParseConfig reads and validates routes, unknown fields are refused so
+// typos don't go unnoticed.
+func ParseConfig(data []byte) (*Config, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var config Config
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	if len(config.Routes) == 0 {
+		return nil, errors.New("no routes configured")
+	}
+	for name, pool := range config.Pools {
+		if pool == nil {
+			return nil, fmt.Errorf("pool %s is empty", name)
+		}
+		if err := pool.Validate(); err != nil {
+			return nil, fmt.Errorf("pool %s: %w", name, err)
+		}
+	}
+	prefixes := map[string]bool{}
+	for i, route := range config.Routes {
+		if route == nil {
+			return nil, fmt.Errorf("route %d is empty", i+1)
+		}
+		if err := route.validate(); err != nil {
+			return nil, fmt.Errorf("route %d (%s): %w", i+1, route.Prefix, err)
+		}
+		if config.Pools[route.Pool] == nil {
+			return nil, fmt.Errorf("route %d (%s): unknown pool %s", i+1, route.Prefix, route.Pool)
+		}
+		if prefixes[route.Prefix] {
+			return nil, fmt.Errorf("route %d: prefix %s is configured twice", i+1, route.Prefix)
+		}
+		prefixes[route.Prefix] = true
+	}
+	// the most specific route is matched first
+	sort.SliceStable(config.Routes, func(i, j int) bool {
+		return len(config.Routes[i].Prefix) > len(config.Routes[j].Prefix)
+	})
+	return &config, nil
+}
+
+// LoadConfig reads the routes file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
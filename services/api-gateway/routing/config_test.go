@@ -0,0 +1,165 @@
+package routing
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPools = `
+pools:
+  form:
+    targets:
+      - http://form-service
+`
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  string
+		wantErr string
+	}{
+		{name: "valid", routes: `
+routes:
+  - prefix: /api/v1/form
+    pool: form
+    auth: true
+    roles: [user, team]
+    rewrite: /
+    rate_limits:
+      - key: user
+        requests: 10
+        per: 1s
+`},
+		{name: "no routes", routes: "routes: []", wantErr: "no routes configured"},
+		{name: "unknown field", routes: `
+routes:
+  - prefix: /api
+    pool: form
+    authenticate: true
+`, wantErr: "authenticate"},
+		{name: "relative prefix", routes: `
+routes:
+  - prefix: api
+    pool: form
+`, wantErr: "prefix must start with /"},
+		{name: "missing pool", routes: `
+routes:
+  - prefix: /api
+`, wantErr: "pool is required"},
+		{name: "unknown pool", routes: `
+routes:
+  - prefix: /api
+    pool: auth
+`, wantErr: "unknown pool auth"},
+		{name: "roles without auth", routes: `
+routes:
+  - prefix: /api
+    pool: form
+    roles: [admin]
+`, wantErr: "roles need auth"},
+		{name: "negative timeout", routes: `
+routes:
+  - prefix: /api
+    pool: form
+    timeout: -1s
+`, wantErr: "timeout can't be negative"},
+		{name: "relative rewrite", routes: `
+routes:
+  - prefix: /api
+    pool: form
+    rewrite: v1
+`, wantErr: "rewrite must start with /"},
+		{name: "user rate limit without auth", routes: `
+routes:
+  - prefix: /api
+    pool: form
+    rate_limits:
+      - key: user
+        requests: 10
+        per: 1s
+`, wantErr: "needs auth"},
+		{name: "prefix configured twice", routes: `
+routes:
+  - prefix: /api
+    pool: form
+  - prefix: /api/
+    pool: form
+`, wantErr: "configured twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ParseConfig([]byte(testPools + tt.routes))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseConfig() failed: %v", err)
+			}
+			if len(config.Routes) == 0 {
+				t.Fatal("ParseConfig() returned no routes")
+			}
+		})
+	}
+}
+
+func TestParseConfigPools(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    string
+		wantErr string
+	}{
+		{name: "no targets", pool: "targets: []", wantErr: "at least one target is required"},
+		{name: "target without scheme", pool: "targets: [form-service]", wantErr: "must be an http or https URL"},
+		{name: "target with path", pool: "targets: [http://form-service/api]", wantErr: "can't have a path"},
+		{name: "unknown balancing", pool: "targets: [http://form-service]\n    balancing: random", wantErr: "unknown balancing"},
+		{name: "failure ratio above 1", pool: "targets: [http://form-service]\n    circuit_breaker:\n      failure_ratio: 2", wantErr: "failure ratio"},
+		{name: "retry without attempts", pool: "targets: [http://form-service]\n    retry: {}", wantErr: "retry attempts must be positive"},
+		{name: "retry of a client error", pool: "targets: [http://form-service]\n    retry:\n      attempts: 1\n      statuses: [404]", wantErr: "isn't a server error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := "pools:\n  form:\n    " + tt.pool + "\nroutes:\n  - prefix: /api\n    pool: form\n"
+			_, err := ParseConfig([]byte(data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ParseConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	config, err := ParseConfig([]byte(testPools + `
+routes:
+  - prefix: /
+    pool: form
+  - prefix: /api/v1/form/
+    pool: form
+    timeout: 5s
+  - prefix: /api
+    pool: form
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prefixes []string
+	for _, route := range config.Routes {
+		prefixes = append(prefixes, route.Prefix)
+	}
+	// the most specific route first, without trailing slashes
+	if got := strings.Join(prefixes, " "); got != "/api/v1/form /api /" {
+		t.Errorf("prefixes = %s, want /api/v1/form /api /", got)
+	}
+	if config.Routes[0].Timeout != 5*time.Second || config.Routes[1].Timeout != DefaultTimeout {
+		t.Errorf("timeouts = %v, %v, want 5s and the default", config.Routes[0].Timeout, config.Routes[1].Timeout)
+	}
+}
+
+func TestLoadConfigShipped(t *testing.T) {
+	if _, err := LoadConfig("../config/routes.yaml"); err != nil {
+		t.Fatalf("the shipped routes don't load: %v", err)
+	}
+}
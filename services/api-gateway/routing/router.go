@@ -0,0 +1,185 @@
+package routing
+
+import (
+	"api-gateway/correlation"
+	"api-gateway/upstream"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Table is a loaded set of routes, it isn't changed once built.
+type Table struct {
+	routes []*Route
+	pools  []*upstream.Pool
+}
+
+// Match returns the route of the path, nil when no route matches.
+func (table *Table) Match(path string) *Route {
+	for _, route := range table.routes {
+		if route.matches(path) {
+			return route
+		}
+	}
+	return nil
+}
+
+// ServeHTTP proxies the request to the service of the route, the caller has
+// already checked the route allows it.
+func (route *Route) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), route.Timeout)
+	defer cancel()
+	route.proxy.ServeHTTP(w, req.WithContext(ctx))
+}
+
+func newTable(config *Config, logger *zap.Logger) *Table {
+	table := &Table{routes: config.Routes}
+	pools := map[string]*upstream.Pool{}
+	for name, poolConfig := range config.Pools {
+		pools[name] = upstream.NewPool(name, poolConfig, logger)
+		table.pools = append(table.pools, pools[name])
+	}
+	for _, route := range config.Routes {
+		route := route
+		routeLogger := logger.With(zap.String("route", route.Prefix))
+		route.proxy = &httputil.ReverseProxy{
+			// the pool picks the target
+			Transport: pools[route.Pool],
+			Director: func(req *http.Request) {
+				req.Header.Set("X-Forwarded-Host", req.Host)
+				if route.Rewrite != nil {
+					req.URL.Path = route.rewrite(req.URL.Path)
+					req.URL.RawPath = ""
+				}
+			},
+			ModifyResponse: func(resp *http.Response) error {
+				// answered by the middleware already
+				resp.Header.Del(correlation.RequestIDHeader)
+				return nil
+			},
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				status := http.StatusBadGateway
+				switch {
+				case errors.Is(err, upstream.ErrNoTarget):
+					status = http.StatusServiceUnavailable
+				case errors.Is(err, context.DeadlineExceeded):
+					status = http.StatusGatewayTimeout
+				}
+				routeLogger.Error("Failed to proxy request", zap.String("pool", route.Pool), zap.String("path", req.URL.Path), zap.Int("status", status), zap.Error(err))
+				w.WriteHeader(status)
+			},
+		}
+	}
+	return table
+}
+
+// start starts the health checks of the pools.
+func (table *Table) start() {
+	for _, pool := range table.pools {
+		pool.Start()
+	}
+}
+
+// stop stops the health checks of the pools once the table is replaced,
+// requests in flight still finish.
+func (table *Table) stop() {
+	for _, pool := range table.pools {
+		pool.Stop()
+	}
+}
+
+// Router holds the routes of the config file, swapping them when the file
+// changes.
+type Router struct {
+	path   string
+	logger *zap.Logger
+	table  atomic.Pointer[Table]
+
+	// mu serialises reloads
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewRouter returns the router of the routes file, which has to be valid.
+func NewRouter(path string, logger *zap.Logger) (*Router, error) {
+	router := &Router{path: path, logger: logger}
+	if err := router.Reload(); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+// Table returns the current routes. A request keeps the table it got even
+// when the routes are reloaded meanwhile.
+func (router *Router) Table() *Table {
+	return router.table.Load()
+}
+
+// Reload reads the routes file again. The current routes are kept when it
+// isn't valid.
+func (router *Router) Reload() error {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	info, err := os.Stat(router.path)
+	if err != nil {
+		return err
+	}
+	config, err := LoadConfig(router.path)
+	if err != nil {
+		// not read again until it changes
+		router.modTime, router.size = info.ModTime(), info.Size()
+		return err
+	}
+	table := newTable(config, router.logger)
+	table.start()
+	if old := router.table.Swap(table); old != nil {
+		old.stop()
+	}
+	router.modTime, router.size = info.ModTime(), info.Size()
+	router.logger.Info("Routes loaded", zap.String("path", router.path), zap.Int("routes", len(config.Routes)))
+	return nil
+}
+
+// changed reports whether the routes file changed since it was read.
+func (router *Router) changed() bool {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	info, err := os.Stat(router.path)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(router.modTime) || info.Size() != router.size
+}
+
+// Watch reloads the routes on SIGHUP and when the file changes, checked
+// every interval. It doesn't return.
+func (router *Router) Watch(interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hangup:
+			router.logger.Info("SIGHUP received, reloading routes")
+		case <-ticker.C:
+			if !router.changed() {
+				continue
+			}
+			router.logger.Info("Routes file changed, reloading routes")
+		}
+		if err := router.Reload(); err != nil {
+			router.logger.Error("Failed to reload routes, keeping the current ones", zap.String("path", router.path), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package telemetry
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts a server span for each request, continuing the trace of
+// its traceparent header. Health checks aren't traced.
+func Middleware(service string) gin.HandlerFunc {
+	return otelgin.Middleware(service, otelgin.WithFilter(func(req *http.Request) bool {
+		return !strings.HasSuffix(req.URL.Path, "/health")
+	}))
+}
+
+// Transport sends the requests with base, or http.DefaultTransport when nil,
+// in client spans and passes their trace context on in the headers.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(base)
+}
+
+// NameRoute names the span of the request after the route it matched, every
+// path has the same handler in the gateway.
+func NameRoute(ctx context.Context, method string, route string) {
+	span := trace.SpanFromContext(ctx)
+	span.SetName(method + " " + route)
+	span.SetAttributes(semconv.HTTPRoute(route))
+}
@@ -0,0 +1,74 @@
+package tokens
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cacheEntry is what the gateway knows of a credential.
+type cacheEntry struct {
+	key    string
+	claims Claims
+	// checkedAt is when the auth service last confirmed the credential, or
+	// when the token was issued for tokens only verified locally so far.
+	checkedAt time.Time
+	// expiresAt is the expiry of the token, zero for API keys.
+	expiresAt time.Time
+}
+
+// claimCache keeps the entries of the most recently used credentials, up to
+// size entries.
+type claimCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newClaimCache(size int) *claimCache {
+	return &claimCache{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (cache *claimCache) get(key string) (cacheEntry, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := element.Value.(cacheEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return cacheEntry{}, false
+	}
+	cache.order.MoveToFront(element)
+	return entry, true
+}
+
+func (cache *claimCache) put(entry cacheEntry) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, ok := cache.entries[entry.key]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[entry.key] = cache.order.PushFront(entry)
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(cacheEntry).key)
+	}
+}
+
+func (cache *claimCache) remove(key string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+	}
+}
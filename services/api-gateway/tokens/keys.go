@@ -0,0 +1,129 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// keyCacheTTL matches the caching the auth service allows for its keys.
+	keyCacheTTL = 5 * time.Minute
+	// keyReloadInterval limits reloads of the keys for unknown key IDs.
+	keyReloadInterval = 10 * time.Second
+	// leeway allows for clock skew between the services.
+	leeway = 30 * time.Second
+)
+
+// errCantVerify is returned when the signature can't be checked locally, the
+// keys couldn't be loaded or the shared secret isn't configured. The token
+// is left to the auth service.
+var errCantVerify = errors.New("token can't be verified locally")
+
+// loadKeys starts loading the keys the auth service publishes. They are
+// refreshed every keyCacheTTL, so retired keys stop being trusted, and for
+// unknown key IDs, so new keys are picked up, at most every
+// keyReloadInterval. The cached keys are kept while the auth service is
+// unavailable.
+func (validator *Validator) loadKeys(ctx context.Context) error {
+	keys, err := keyfunc.NewDefaultOverrideCtx(ctx, []string{validator.JWKSURL}, keyfunc.Override{
+		Client:          validator.HTTPClient,
+		RefreshInterval: keyCacheTTL,
+		RefreshErrorHandlerFunc: func(url string) func(context.Context, error) {
+			return func(_ context.Context, err error) {
+				validator.Logger.Error("Failed to load signing keys", zap.String("url", url), zap.Error(err))
+			}
+		},
+		RefreshUnknownKID: rate.NewLimiter(rate.Every(keyReloadInterval), 1),
+		// tokens with unknown keys go to the auth service rather than
+		// waiting for a reload
+		RateLimitWaitMax: time.Millisecond,
+	})
+	if err != nil {
+		return err
+	}
+	validator.keys = keys
+	return nil
+}
+
+// key returns the key verifying the token, the shared secret for HS256.
+func (validator *Validator) key(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+			if len(validator.Secret) == 0 {
+				return nil, fmt.Errorf("%w: no shared secret", errCantVerify)
+			}
+			return validator.Secret, nil
+		}
+		if validator.keys == nil {
+			return nil, fmt.Errorf("%w: signing keys not loaded", errCantVerify)
+		}
+		key, err := validator.keys.KeyfuncCtx(ctx)(token)
+		if err != nil {
+			// an unknown key is only known to be wrong once keys are loaded
+			if loaded, readErr := validator.keys.Storage().KeyReadAll(ctx); readErr != nil || len(loaded) == 0 {
+				return nil, fmt.Errorf("%w: signing keys not loaded", errCantVerify)
+			}
+			return nil, err
+		}
+		return key, nil
+	}
+}
+
+// accessToken are the claims of an access token as jwt validates them.
+type accessToken struct {
+	Claims
+}
+
+func numericDate(seconds float64) *jwt.NumericDate {
+	if seconds == 0 {
+		return nil
+	}
+	return jwt.NewNumericDate(time.Unix(int64(seconds), 0))
+}
+
+func (token *accessToken) GetExpirationTime() (*jwt.NumericDate, error) {
+	return numericDate(token.ExpiresAt), nil
+}
+
+func (token *accessToken) GetIssuedAt() (*jwt.NumericDate, error) {
+	return numericDate(token.IssuedAt), nil
+}
+
+func (token *accessToken) GetNotBefore() (*jwt.NumericDate, error) {
+	return numericDate(token.NotBefore), nil
+}
+
+func (token *accessToken) GetIssuer() (string, error) { return "", nil }
+
+func (token *accessToken) GetSubject() (string, error) { return "", nil }
+
+func (token *accessToken) GetAudience() (jwt.ClaimStrings, error) { return nil, nil }
+
+// verify returns the claims of the access token once its signature and
+// validity are checked. Revocation is only known to the auth service.
+func (validator *Validator) verify(ctx context.Context, token string) (Claims, error) {
+	var claims accessToken
+	_, err := jwt.ParseWithClaims(token, &claims, validator.key(ctx),
+		// the algorithm has to match the key, so a token can't pick a weaker one
+		jwt.WithValidMethods([]string{"RS256", "EdDSA", "HS256"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(leeway))
+	if errors.Is(err, errCantVerify) {
+		return Claims{}, err
+	}
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	// service tokens are only for internal endpoints
+	if claims.TokenUse != "" || claims.JTI == "" {
+		return Claims{}, fmt.Errorf("%w: not an access token", ErrUnauthorized)
+	}
+	return claims.Claims, nil
+}
@@ -0,0 +1,213 @@
+// Package tokens validates the access tokens and API keys of requests at
+// the gateway. Access tokens are verified locally against the keys the auth
+// service publishes, or the shared secret for HS256. Revocation is only
+// known to the auth service, so each credential is validated there again
+// once per revalidation interval; the claims are cached in between.
+package tokens
+
+import (
+	"api-gateway/correlation"
+	"api-gateway/telemetry"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrUnauthorized is returned for invalid, expired and revoked
+	// credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrUnavailable is returned when the credential can't be checked as
+	// the auth service is unreachable.
+	ErrUnavailable = errors.New("auth service unavailable")
+)
+
+// Claims are the claims of an access token, or of an API key as the auth
+// service answers them.
+type Claims struct {
+	ID            int      `json:"id"`
+	Role          string   `json:"role"`
+	TeamID        int      `json:"team_id"`
+	TeamRole      string   `json:"team_role"`
+	Permissions   []string `json:"permissions"`
+	EmailVerified bool     `json:"email_verified"`
+	PhoneVerified bool     `json:"phone_verified"`
+	APIKeyID      int      `json:"api_key_id"`
+	JTI           string   `json:"jti"`
+	SessionID     string   `json:"sid"`
+	TokenUse      string   `json:"token_use"`
+	IssuedAt      float64  `json:"iat"`
+	ExpiresAt     float64  `json:"exp"`
+	NotBefore     float64  `json:"nbf"`
+}
+
+// Expiry returns when the token expires, zero for API keys.
+func (claims Claims) Expiry() time.Time {
+	if claims.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(claims.ExpiresAt), 0)
+}
+
+// Validator validates credentials, locally when it can and with the auth
+// service otherwise.
+type Validator struct {
+	// ValidateURL is the validate endpoint of the auth service.
+	ValidateURL string
+	JWKSURL     string
+	// Secret verifies HS256 tokens, they are left to the auth service when
+	// empty.
+	Secret     []byte
+	HTTPClient *http.Client
+	// RevalidateInterval is how long a credential is trusted without asking
+	// the auth service, revocations take effect within it.
+	RevalidateInterval time.Duration
+	// OutageGrace is how long cached credentials keep working while the auth
+	// service is unreachable.
+	OutageGrace time.Duration
+	Logger      *zap.Logger
+
+	cache *claimCache
+	keys  keyfunc.Keyfunc
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value >= 0 {
+		return value
+	}
+	return fallback
+}
+
+// ValidatorFromEnv returns the validator of the auth service at AUTH_URL.
+// It revalidates every AUTH_REVALIDATE_INTERVAL (30 seconds by default),
+// tolerates outages of the auth service for AUTH_OUTAGE_GRACE (5 minutes by
+// default) and caches up to AUTH_CACHE_SIZE credentials (10000 by default).
+// With JWT_SIGNING_ALG=HS256 tokens are verified with JWT_SECRET.
+func ValidatorFromEnv(logger *zap.Logger) (*Validator, error) {
+	authURL := strings.TrimSuffix(os.Getenv("AUTH_URL"), "/")
+	if authURL == "" {
+		authURL = "http://auth-service"
+	}
+	size := 10000
+	if value := os.Getenv("AUTH_CACHE_SIZE"); value != "" {
+		var err error
+		if size, err = strconv.Atoi(value); err != nil || size < 1 {
+			return nil, fmt.Errorf("AUTH_CACHE_SIZE must be a positive number, got %q", value)
+		}
+	}
+	validator := &Validator{
+		ValidateURL:        authURL + "/api/v1/auth/validate",
+		JWKSURL:            authURL + "/.well-known/jwks.json",
+		HTTPClient:         &http.Client{Transport: telemetry.Transport(nil), Timeout: 5 * time.Second},
+		RevalidateInterval: durationFromEnv("AUTH_REVALIDATE_INTERVAL", 30*time.Second),
+		OutageGrace:        durationFromEnv("AUTH_OUTAGE_GRACE", 5*time.Minute),
+		Logger:             logger,
+		cache:              newClaimCache(size),
+	}
+	if os.Getenv("JWT_SIGNING_ALG") == "HS256" {
+		validator.Secret = []byte(os.Getenv("JWT_SECRET"))
+		return validator, nil
+	}
+	if err := validator.loadKeys(context.Background()); err != nil {
+		return nil, err
+	}
+	return validator, nil
+}
+
+func cacheKey(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:])
+}
+
+// Validate returns the claims of the access token, or of the API key when
+// apiKey is set.
+func (validator *Validator) Validate(ctx context.Context, token string, apiKey string) (Claims, error) {
+	credential := token
+	if apiKey != "" {
+		credential = apiKey
+	}
+	key := cacheKey(credential)
+	now := time.Now()
+
+	entry, cached := validator.cache.get(key)
+	if apiKey == "" {
+		claims, err := validator.verify(ctx, token)
+		if errors.Is(err, ErrUnauthorized) {
+			validator.cache.remove(key)
+			return Claims{}, err
+		}
+		// a token seen for the first time is as fresh as its issue
+		if err == nil && !cached {
+			entry = cacheEntry{key: key, claims: claims, checkedAt: time.Unix(int64(claims.IssuedAt), 0), expiresAt: claims.Expiry()}
+			cached = true
+			validator.cache.put(entry)
+		}
+	}
+	if cached && now.Sub(entry.checkedAt) < validator.RevalidateInterval {
+		return entry.claims, nil
+	}
+
+	claims, err := validator.validateRemote(ctx, token, apiKey)
+	if errors.Is(err, ErrUnauthorized) {
+		validator.cache.remove(key)
+		return Claims{}, err
+	}
+	if err != nil {
+		if cached && now.Sub(entry.checkedAt) < validator.OutageGrace {
+			validator.Logger.Warn("Auth service unavailable, using cached claims", zap.Duration("age", now.Sub(entry.checkedAt)), zap.Error(err))
+			return entry.claims, nil
+		}
+		return Claims{}, err
+	}
+	validator.cache.put(cacheEntry{key: key, claims: claims, checkedAt: now, expiresAt: claims.Expiry()})
+	return claims, nil
+}
+
+// validateRemote asks the auth service, which also checks revocation.
+func (validator *Validator) validateRemote(ctx context.Context, token string, apiKey string) (Claims, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, validator.ValidateURL, nil)
+	if err != nil {
+		return Claims{}, err
+	}
+	correlation.FromContext(ctx).SetHeader(req.Header)
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := validator.HTTPClient.Do(req)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		// drained so the connection is reused
+		io.Copy(io.Discard, resp.Body)
+		return Claims{}, fmt.Errorf("%w: auth service responded with status code %d", ErrUnauthorized, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		io.Copy(io.Discard, resp.Body)
+		return Claims{}, fmt.Errorf("%w: auth service responded with status code %d", ErrUnavailable, resp.StatusCode)
+	}
+
+	var response struct {
+		Claims Claims `json:"claims"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return Claims{}, fmt.Errorf("%w: failed to decode claims: %v", ErrUnavailable, err)
+	}
+	return response.Claims, nil
+}
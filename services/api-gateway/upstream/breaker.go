@@ -0,0 +1,115 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	closed breakerState = iota
+	open
+	halfOpen
+)
+
+func (state breakerState) String() string {
+	switch state {
+	case open:
+		return "open"
+	case halfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breaker is the circuit breaker of a target, it lets every request through
+// without a config.
+type breaker struct {
+	config *CircuitBreaker
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	// probes are the trial requests in flight while half open
+	probes int
+}
+
+// available reports whether a request could be sent now.
+func (breaker *breaker) available(now time.Time) bool {
+	if breaker.config == nil {
+		return true
+	}
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	switch breaker.state {
+	case open:
+		return now.Sub(breaker.openedAt) >= breaker.config.OpenFor
+	case halfOpen:
+		return breaker.probes < breaker.config.HalfOpenRequests
+	}
+	return true
+}
+
+// acquire lets a request through, a trial request once the circuit has been
+// open long enough. It fails when other requests took the trials meanwhile.
+func (breaker *breaker) acquire(now time.Time) bool {
+	if breaker.config == nil {
+		return true
+	}
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	switch breaker.state {
+	case open:
+		if now.Sub(breaker.openedAt) < breaker.config.OpenFor {
+			return false
+		}
+		breaker.state = halfOpen
+		breaker.probes = 0
+		fallthrough
+	case halfOpen:
+		if breaker.probes >= breaker.config.HalfOpenRequests {
+			return false
+		}
+		breaker.probes++
+	}
+	return true
+}
+
+// record counts the outcome of a request, it returns the new state when the
+// request changed it.
+func (breaker *breaker) record(now time.Time, failed bool) (breakerState, bool) {
+	if breaker.config == nil {
+		return closed, false
+	}
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	switch breaker.state {
+	case halfOpen:
+		breaker.probes--
+		if failed {
+			breaker.state, breaker.openedAt = open, now
+		} else {
+			breaker.state = closed
+			breaker.windowStart, breaker.requests, breaker.failures = now, 0, 0
+		}
+		return breaker.state, true
+	case closed:
+		if now.Sub(breaker.windowStart) >= breaker.config.Window {
+			breaker.windowStart, breaker.requests, breaker.failures = now, 0, 0
+		}
+		breaker.requests++
+		if failed {
+			breaker.failures++
+		}
+		if breaker.requests >= breaker.config.MinRequests && float64(breaker.failures) >= breaker.config.FailureRatio*float64(breaker.requests) {
+			breaker.state, breaker.openedAt = open, now
+			return open, true
+		}
+	}
+	// requests sent before the circuit opened don't count
+	return breaker.state, false
+}
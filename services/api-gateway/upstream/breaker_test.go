@@ -0,0 +1,131 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	config := &CircuitBreaker{FailureRatio: 0.5, MinRequests: 4, Window: 10 * time.Second, OpenFor: 30 * time.Second, HalfOpenRequests: 1}
+	start := time.Unix(1700000000, 0)
+
+	// each step acquires at the time and records the outcome, when acquired
+	type step struct {
+		at          time.Duration
+		failed      bool
+		wantAcquire bool
+		wantState   breakerState
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "stays closed below min requests", steps: []step{
+			{failed: true, wantAcquire: true, wantState: closed},
+			{failed: true, wantAcquire: true, wantState: closed},
+			{failed: true, wantAcquire: true, wantState: closed},
+		}},
+		{name: "stays closed below the failure ratio", steps: []step{
+			{failed: true, wantAcquire: true, wantState: closed},
+			{wantAcquire: true, wantState: closed},
+			{wantAcquire: true, wantState: closed},
+			{wantAcquire: true, wantState: closed},
+		}},
+		{name: "opens at the failure ratio", steps: []step{
+			{failed: true, wantAcquire: true, wantState: closed},
+			{wantAcquire: true, wantState: closed},
+			{failed: true, wantAcquire: true, wantState: closed},
+			{wantAcquire: true, wantState: open},
+			{at: time.Second, wantAcquire: false, wantState: open},
+		}},
+		{name: "window resets the counts", steps: []step{
+			{failed: true, wantAcquire: true, wantState: closed},
+			{failed: true, wantAcquire: true, wantState: closed},
+			{failed: true, wantAcquire: true, wantState: closed},
+			{at: 11 * time.Second, failed: true, wantAcquire: true, wantState: closed},
+		}},
+		{name: "trial success closes", steps: []step{
+			{failed: true, wantAcquire: true, wantState: closed},
+			{failed: true, wantAcquire: true, wantState: closed},
+			{failed: true, wantAcquire: true, wantState: closed},
+			{failed: true, wantAcquire: true, wantState: open},
+			{at: 29 * time.Second, wantAcquire: false, wantState: open},
+			{at: 30 * time.Second, wantAcquire: true, wantState: closed},
+			{at: 31 * time.Second, failed: true, wantAcquire: true, wantState: closed},
+		}},
+		{name: "trial failure opens again", steps: []step{
+			{failed: true, wantAcquire: true, wantState: closed},
+			{failed: true, wantAcquire: true, wantState: closed},
+			{failed: true, wantAcquire: true, wantState: closed},
+			{failed: true, wantAcquire: true, wantState: open},
+			{at: 30 * time.Second, failed: true, wantAcquire: true, wantState: open},
+			{at: 59 * time.Second, wantAcquire: false, wantState: open},
+			{at: 60 * time.Second, wantAcquire: true, wantState: closed},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := breaker{config: config, windowStart: start}
+			for i, step := range tt.steps {
+				now := start.Add(step.at)
+				acquired := b.acquire(now)
+				if acquired != step.wantAcquire {
+					t.Fatalf("step %d: acquire() = %v, want %v", i+1, acquired, step.wantAcquire)
+				}
+				if acquired {
+					b.record(now, step.failed)
+				}
+				if b.state != step.wantState {
+					t.Fatalf("step %d: state = %v, want %v", i+1, b.state, step.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerHalfOpenTrials(t *testing.T) {
+	b := breaker{config: &CircuitBreaker{OpenFor: time.Second, HalfOpenRequests: 1}, state: open}
+	now := time.Unix(1700000000, 0)
+	b.openedAt = now.Add(-time.Second)
+	if !b.available(now) || !b.acquire(now) {
+		t.Fatal("the trial request isn't let through")
+	}
+	if b.state != halfOpen {
+		t.Fatalf("state = %v, want half-open", b.state)
+	}
+	// only one trial is in flight at once
+	if b.available(now) || b.acquire(now) {
+		t.Fatal("a second trial request is let through")
+	}
+}
+
+func TestBreakerWithoutConfig(t *testing.T) {
+	var b breaker
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		b.record(now, true)
+	}
+	if !b.available(now) || !b.acquire(now) {
+		t.Fatal("a breaker without config refuses requests")
+	}
+}
+
+func TestFailed(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: errors.New("connection refused"), want: true},
+		{err: context.Canceled, want: false},
+		{err: fmt.Errorf("request: %w", context.DeadlineExceeded), want: false},
+	}
+	for _, tt := range tests {
+		if got := failed(tt.err); got != tt.want {
+			t.Errorf("failed(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Package upstream spreads the requests of the gateway over the instances of
+// a service. A pool balances over its targets and keeps requests away from
+// unhealthy ones: targets failing active health checks are skipped until
+// they pass again, targets failing requests in a row are ejected for a
+// while, and each target has a circuit breaker which opens on a high failure
+// ratio. Requests with idempotent methods can be retried on another target.
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Balancing picks the target of a request.
+type Balancing string
+
+const (
+	// RoundRobin takes the targets in turn.
+	RoundRobin Balancing = "round-robin"
+	// LeastConnections takes the target with the fewest requests in flight.
+	LeastConnections Balancing = "least-connections"
+)
+
+// HealthCheck requests a path of each target every interval, a target is
+// healthy while it answers 2xx.
+type HealthCheck struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// UnhealthyThreshold is the number of failed checks in a row after which
+	// a target is skipped, HealthyThreshold the number of passed ones after
+	// which it is used again.
+	UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+	HealthyThreshold   int `yaml:"healthy_threshold"`
+}
+
+// OutlierDetection ejects targets failing requests in a row. A failure is an
+// error connecting to the target, responses of the service aren't.
+type OutlierDetection struct {
+	ConsecutiveFailures int `yaml:"consecutive_failures"`
+	// Ejection is how long a target is ejected the first time, each further
+	// ejection in a row adds to it up to ten times as long.
+	Ejection time.Duration `yaml:"ejection"`
+	// MaxEjectionPercent limits the targets ejected at once, one target can
+	// always be ejected while another one is left.
+	MaxEjectionPercent int `yaml:"max_ejection_percent"`
+}
+
+// CircuitBreaker opens the circuit of a target once FailureRatio of its
+// requests in a window failed, with at least MinRequests requests. No
+// requests are sent to it for OpenFor, then HalfOpenRequests trial requests
+// decide whether it is closed again or stays open.
+type CircuitBreaker struct {
+	FailureRatio     float64       `yaml:"failure_ratio"`
+	MinRequests      int           `yaml:"min_requests"`
+	Window           time.Duration `yaml:"window"`
+	OpenFor          time.Duration `yaml:"open_for"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+}
+
+// Retry sends requests with idempotent methods again, to another target when
+// there is one, after connection errors or one of the statuses.
+type Retry struct {
+	// Attempts is the number of retries after the first request.
+	Attempts int           `yaml:"attempts"`
+	Statuses []int         `yaml:"statuses"`
+	Backoff  time.Duration `yaml:"backoff"`
+}
+
+// Config is a pool of the routes file.
+type Config struct {
+	// Targets are the addresses of the instances, like http://form-service.
+	Targets          []string          `yaml:"targets"`
+	Balancing        Balancing         `yaml:"balancing"`
+	HealthCheck      *HealthCheck      `yaml:"health_check"`
+	OutlierDetection *OutlierDetection `yaml:"outlier_detection"`
+	CircuitBreaker   *CircuitBreaker   `yaml:"circuit_breaker"`
+	Retry            *Retry            `yaml:"retry"`
+
+	targets []*url.URL
+}
+
+// Validate checks the pool and fills in the defaults.
+func (config *Config) Validate() error {
+	if len(config.Targets) == 0 {
+		return errors.New("at least one target is required")
+	}
+	config.targets = nil
+	for _, target := range config.Targets {
+		targetURL, err := url.Parse(target)
+		if err != nil {
+			return fmt.Errorf("target %q: %w", target, err)
+		}
+		if (targetURL.Scheme != "http" && targetURL.Scheme != "https") || targetURL.Host == "" {
+			return fmt.Errorf("target %q must be an http or https URL", target)
+		}
+		if strings.Trim(targetURL.Path, "/") != "" || targetURL.RawQuery != "" {
+			return fmt.Errorf("target %q can't have a path, use the rewrite of the route", target)
+		}
+		config.targets = append(config.targets, targetURL)
+	}
+
+	switch config.Balancing {
+	case "":
+		config.Balancing = RoundRobin
+	case RoundRobin, LeastConnections:
+	default:
+		return fmt.Errorf("unknown balancing %q, use round-robin or least-connections", config.Balancing)
+	}
+
+	if check := config.HealthCheck; check != nil {
+		if !strings.HasPrefix(check.Path, "/") {
+			return errors.New("health check path must start with /")
+		}
+		if check.Interval < 0 || check.Timeout < 0 || check.UnhealthyThreshold < 0 || check.HealthyThreshold < 0 {
+			return errors.New("health check settings can't be negative")
+		}
+		defaultDuration(&check.Interval, 10*time.Second)
+		defaultDuration(&check.Timeout, min(2*time.Second, check.Interval))
+		defaultInt(&check.UnhealthyThreshold, 3)
+		defaultInt(&check.HealthyThreshold, 2)
+		if check.Timeout > check.Interval {
+			return errors.New("health check timeout can't be longer than the interval")
+		}
+	}
+
+	if outlier := config.OutlierDetection; outlier != nil {
+		if outlier.ConsecutiveFailures < 0 || outlier.Ejection < 0 {
+			return errors.New("outlier detection settings can't be negative")
+		}
+		if outlier.MaxEjectionPercent < 0 || outlier.MaxEjectionPercent > 100 {
+			return errors.New("max ejection percent must be between 0 and 100")
+		}
+		defaultInt(&outlier.ConsecutiveFailures, 5)
+		defaultDuration(&outlier.Ejection, 30*time.Second)
+		defaultInt(&outlier.MaxEjectionPercent, 50)
+	}
+
+	if breaker := config.CircuitBreaker; breaker != nil {
+		if breaker.FailureRatio < 0 || breaker.FailureRatio > 1 {
+			return errors.New("failure ratio must be between 0 and 1")
+		}
+		if breaker.MinRequests < 0 || breaker.Window < 0 || breaker.OpenFor < 0 || breaker.HalfOpenRequests < 0 {
+			return errors.New("circuit breaker settings can't be negative")
+		}
+		if breaker.FailureRatio == 0 {
+			breaker.FailureRatio = 0.5
+		}
+		defaultInt(&breaker.MinRequests, 20)
+		defaultDuration(&breaker.Window, 10*time.Second)
+		defaultDuration(&breaker.OpenFor, 30*time.Second)
+		defaultInt(&breaker.HalfOpenRequests, 1)
+	}
+
+	if retry := config.Retry; retry != nil {
+		if retry.Attempts < 1 {
+			return errors.New("retry attempts must be positive")
+		}
+		if retry.Backoff < 0 {
+			return errors.New("retry backoff can't be negative")
+		}
+		if len(retry.Statuses) == 0 {
+			retry.Statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+		}
+		for _, status := range retry.Statuses {
+			if status < 500 || status > 599 {
+				return fmt.Errorf("retry status %d isn't a server error", status)
+			}
+		}
+		defaultDuration(&retry.Backoff, 25*time.Millisecond)
+	}
+	return nil
+}
+
+func defaultDuration(value *time.Duration, fallback time.Duration) {
+	if *value == 0 {
+		*value = fallback
+	}
+}
+
+func defaultInt(value *int, fallback int) {
+	if *value == 0 {
+		*value = fallback
+	}
+}
@@ -0,0 +1,238 @@
+package upstream
+
+import (
+	"api-gateway/telemetry"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrNoTarget is returned when every target of the pool is unhealthy,
+// ejected or has an open circuit.
+var ErrNoTarget = errors.New("no healthy target")
+
+// Target is an instance of the service.
+type Target struct {
+	URL *url.URL
+
+	// active is the number of requests in flight
+	active  atomic.Int64
+	breaker breaker
+
+	// guarded by the mutex of the pool
+	healthy             bool
+	checksPassed        int
+	checksFailed        int
+	consecutiveFailures int
+	ejections           int
+	ejectedUntil        time.Time
+}
+
+// Pool balances requests over the targets of a service.
+type Pool struct {
+	Name   string
+	config *Config
+	logger *zap.Logger
+
+	targets   []*Target
+	next      atomic.Uint64
+	transport http.RoundTripper
+	checks    *http.Client
+
+	mu       sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewPool returns the pool of the validated config, the health checks only
+// run once it is started.
+func NewPool(name string, config *Config, logger *zap.Logger) *Pool {
+	pool := &Pool{
+		Name:   name,
+		config: config,
+		logger: logger.With(zap.String("pool", name)),
+		// each attempt is a span of the request
+		transport: telemetry.Transport(nil),
+		stop:      make(chan struct{}),
+	}
+	for _, targetURL := range config.targets {
+		// targets are used until a check fails
+		target := &Target{URL: targetURL, healthy: true}
+		target.breaker.config = config.CircuitBreaker
+		pool.targets = append(pool.targets, target)
+	}
+	if config.HealthCheck != nil {
+		pool.checks = &http.Client{Timeout: config.HealthCheck.Timeout}
+	}
+	return pool
+}
+
+// Start runs the health checks of the pool until it is stopped.
+func (pool *Pool) Start() {
+	if pool.config.HealthCheck == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(pool.config.HealthCheck.Interval)
+		defer ticker.Stop()
+		for {
+			var wg sync.WaitGroup
+			for _, target := range pool.targets {
+				wg.Add(1)
+				go func(target *Target) {
+					defer wg.Done()
+					pool.check(target)
+				}(target)
+			}
+			wg.Wait()
+			select {
+			case <-pool.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends the health checks, requests can still be sent.
+func (pool *Pool) Stop() {
+	pool.stopOnce.Do(func() { close(pool.stop) })
+}
+
+// check requests the health check path of the target.
+func (pool *Pool) check(target *Target) {
+	check := pool.config.HealthCheck
+	passed := false
+	resp, err := pool.checks.Get(target.URL.String() + check.Path)
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		passed = resp.StatusCode >= 200 && resp.StatusCode < 300
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if passed {
+		target.checksPassed++
+		target.checksFailed = 0
+		if !target.healthy && target.checksPassed >= check.HealthyThreshold {
+			target.healthy = true
+			pool.logger.Info("Target healthy again", zap.String("target", target.URL.Host))
+		}
+		return
+	}
+	target.checksFailed++
+	target.checksPassed = 0
+	if target.healthy && target.checksFailed >= check.UnhealthyThreshold {
+		target.healthy = false
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		pool.logger.Warn("Target unhealthy", zap.String("target", target.URL.Host), zap.Int("status", status), zap.Error(err))
+	}
+}
+
+// pick returns the target of the next request. Targets not in tried are
+// preferred, so a retry goes to another target when there is one.
+func (pool *Pool) pick(tried map[*Target]bool) (*Target, error) {
+	for {
+		now := time.Now()
+		var candidates, untried []*Target
+		pool.mu.Lock()
+		for _, target := range pool.targets {
+			if target.healthy && !now.Before(target.ejectedUntil) && target.breaker.available(now) {
+				candidates = append(candidates, target)
+				if !tried[target] {
+					untried = append(untried, target)
+				}
+			}
+		}
+		pool.mu.Unlock()
+		if len(untried) > 0 {
+			candidates = untried
+		}
+		if len(candidates) == 0 {
+			return nil, ErrNoTarget
+		}
+
+		start := int((pool.next.Add(1) - 1) % uint64(len(candidates)))
+		target := candidates[start]
+		if pool.config.Balancing == LeastConnections {
+			// ties go round robin
+			for i := 1; i < len(candidates); i++ {
+				candidate := candidates[(start+i)%len(candidates)]
+				if candidate.active.Load() < target.active.Load() {
+					target = candidate
+				}
+			}
+		}
+		// another request may have taken the last trial of a half open circuit
+		if target.breaker.acquire(now) {
+			return target, nil
+		}
+	}
+}
+
+// report records the outcome of a request to the target.
+func (pool *Pool) report(target *Target, failed bool) {
+	now := time.Now()
+	if state, changed := target.breaker.record(now, failed); changed {
+		pool.logger.Warn("Circuit breaker changed", zap.String("target", target.URL.Host), zap.Stringer("state", state))
+	}
+
+	outlier := pool.config.OutlierDetection
+	if outlier == nil {
+		return
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if !failed {
+		target.consecutiveFailures = 0
+		if now.After(target.ejectedUntil) {
+			target.ejections = 0
+		}
+		return
+	}
+	target.consecutiveFailures++
+	if target.consecutiveFailures < outlier.ConsecutiveFailures || now.Before(target.ejectedUntil) {
+		return
+	}
+	ejected, left := 0, 0
+	for _, other := range pool.targets {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		} else if other != target && other.healthy {
+			left++
+		}
+	}
+	// ejecting the last target would only turn its errors into 503s
+	if left == 0 {
+		return
+	}
+	if ejected > 0 && (ejected+1)*100 > len(pool.targets)*outlier.MaxEjectionPercent {
+		return
+	}
+	target.consecutiveFailures = 0
+	if target.ejections < 10 {
+		target.ejections++
+	}
+	duration := outlier.Ejection * time.Duration(target.ejections)
+	target.ejectedUntil = now.Add(duration)
+	pool.logger.Warn("Target ejected", zap.String("target", target.URL.Host), zap.Duration("duration", duration))
+}
+
+// failed reports whether the outcome of a request counts against the target.
+// Only errors reaching the target do, the responses of the service, even
+// 502, 503 or 504, are answers of a working target. Requests canceled by the
+// client or timed out by the route don't count either.
+func failed(err error) bool {
+	return err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
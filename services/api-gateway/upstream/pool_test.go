@@ -0,0 +1,70 @@
+package upstream
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func testPool(t *testing.T, targets ...string) *Pool {
+	t.Helper()
+	config := &Config{Targets: targets, OutlierDetection: &OutlierDetection{ConsecutiveFailures: 2}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return NewPool("test", config, zap.NewNop())
+}
+
+func TestReportEjection(t *testing.T) {
+	connectionErr := errors.New("connection refused")
+
+	t.Run("ejects after consecutive failures", func(t *testing.T) {
+		pool := testPool(t, "http://a", "http://b")
+		target := pool.targets[0]
+		pool.report(target, failed(connectionErr))
+		if !target.ejectedUntil.IsZero() {
+			t.Fatal("ejected after one failure")
+		}
+		pool.report(target, failed(connectionErr))
+		if !time.Now().Before(target.ejectedUntil) {
+			t.Fatal("not ejected after two failures")
+		}
+		if picked, err := pool.pick(nil); err != nil || picked != pool.targets[1] {
+			t.Fatalf("pick() = %v, %v, want the other target", picked, err)
+		}
+	})
+
+	t.Run("never ejects the last target", func(t *testing.T) {
+		pool := testPool(t, "http://a")
+		for i := 0; i < 5; i++ {
+			pool.report(pool.targets[0], failed(connectionErr))
+		}
+		if _, err := pool.pick(nil); err != nil {
+			t.Fatalf("pick() failed: %v", err)
+		}
+	})
+
+	t.Run("keeps the last target left", func(t *testing.T) {
+		pool := testPool(t, "http://a", "http://b")
+		pool.targets[1].healthy = false
+		for i := 0; i < 5; i++ {
+			pool.report(pool.targets[0], failed(connectionErr))
+		}
+		if picked, err := pool.pick(nil); err != nil || picked != pool.targets[0] {
+			t.Fatalf("pick() = %v, %v, want the healthy target", picked, err)
+		}
+	})
+
+	t.Run("responses don't count", func(t *testing.T) {
+		pool := testPool(t, "http://a", "http://b")
+		for i := 0; i < 5; i++ {
+			// a 503 of the service reaches report as a response without error
+			pool.report(pool.targets[0], failed(nil))
+		}
+		if !pool.targets[0].ejectedUntil.IsZero() {
+			t.Fatal("ejected for responses of the service")
+		}
+	})
+}
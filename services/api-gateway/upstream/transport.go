@@ -0,0 +1,137 @@
+package upstream
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxRetryBody is the largest body kept to be sent again, requests with
+// larger bodies aren't retried.
+const maxRetryBody = 1 << 20
+
+// idempotent reports whether a request with the method can be sent again
+// without changing its effect.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// activeBody counts the request as in flight until its response is read.
+type activeBody struct {
+	io.ReadCloser
+	target *Target
+	done   bool
+}
+
+func (body *activeBody) Close() error {
+	if !body.done {
+		body.done = true
+		body.target.active.Add(-1)
+	}
+	return body.ReadCloser.Close()
+}
+
+// send sends the request to the target.
+func (pool *Pool) send(req *http.Request, target *Target, body []byte) (*http.Response, error) {
+	outreq := req.Clone(req.Context())
+	outreq.URL.Scheme = target.URL.Scheme
+	outreq.URL.Host = target.URL.Host
+	outreq.Header.Set("X-Origin-Host", target.URL.Host)
+	if body != nil {
+		outreq.Body = io.NopCloser(bytes.NewReader(body))
+		outreq.ContentLength = int64(len(body))
+	}
+
+	target.active.Add(1)
+	resp, err := pool.transport.RoundTrip(outreq)
+	if err != nil {
+		target.active.Add(-1)
+		return nil, err
+	}
+	resp.Body = &activeBody{ReadCloser: resp.Body, target: target}
+	return resp, nil
+}
+
+// retryable reports whether the request should be sent again.
+func (pool *Pool) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return failed(err)
+	}
+	for _, status := range pool.config.Retry.Statuses {
+		if resp.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// RoundTrip sends the request to a target of the pool, and again to another
+// one when the retry policy allows it.
+func (pool *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := 0
+	if pool.config.Retry != nil && idempotent(req.Method) {
+		retries = pool.config.Retry.Attempts
+	}
+
+	var body []byte
+	if retries > 0 && req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, maxRetryBody+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > maxRetryBody {
+			// too large to keep, sent once as it comes
+			retries = 0
+			req = req.Clone(req.Context())
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			body = nil
+		} else {
+			req.Body.Close()
+		}
+	}
+
+	target, err := pool.pick(nil)
+	if err != nil {
+		return nil, err
+	}
+	tried := map[*Target]bool{}
+	for attempt := 0; ; attempt++ {
+		resp, err := pool.send(req, target, body)
+		pool.report(target, failed(err))
+		if attempt >= retries || !pool.retryable(resp, err) {
+			return resp, err
+		}
+		tried[target] = true
+
+		timer := time.NewTimer(pool.config.Retry.Backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return resp, err
+		case <-timer.C:
+		}
+		next, pickErr := pool.pick(tried)
+		if pickErr != nil {
+			return resp, err
+		}
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxRetryBody))
+			resp.Body.Close()
+		}
+		pool.logger.Warn("Retrying request", zap.String("target", target.URL.Host), zap.String("next", next.URL.Host), zap.String("method", req.Method), zap.String("path", req.URL.Path), zap.Int("status", status), zap.Error(err))
+		target = next
+	}
+}
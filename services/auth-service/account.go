@@ -0,0 +1,204 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/models"
+	"auth-service/utils"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+// accountDisabled responds with 403 and returns true when an admin disabled
+// the account of the user.
+func accountDisabled(c *gin.Context, user models.User) bool {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	if !user.Disabled() {
+		return false
+	}
+	logger.Warn("Disabled account", zap.Uint("user_id", user.ID))
+	c.JSON(http.StatusForbidden, gin.H{"error": models.ErrAccountDisabled.Error()})
+	return true
+}
+
+// pendingAddress returns the address the channel of the user will have, the
+// pending one when it is being changed.
+func pendingAddress(user models.User, channel models.VerificationChannel) string {
+	if channel == models.PhoneVerification && user.PendingPhone != "" {
+		return user.PendingPhone
+	}
+	if channel == models.EmailVerification && user.PendingEmail != "" {
+		return user.PendingEmail
+	}
+	current, _ := user.VerificationTarget(channel)
+	return current
+}
+
+func GetProfile(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering GetProfile Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+	logger.Debug("Exiting GetProfile Function")
+}
+
+func UpdateProfile(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering UpdateProfile Function")
+	type UpdateProfileRequest struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Phone    string `json:"phone"`
+		// Password confirms changes of the email or phone.
+		Password string `json:"password"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	var updateRequest UpdateProfileRequest
+	if err := c.ShouldBindJSON(&updateRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// an address is changed when it isn't the current or pending one, asking
+	// for the current address cancels a pending change
+	changes := map[models.VerificationChannel]string{}
+	if email := strings.TrimSpace(updateRequest.Email); email != "" && !strings.EqualFold(email, pendingAddress(user, models.EmailVerification)) {
+		changes[models.EmailVerification] = email
+	}
+	if phone := strings.TrimSpace(updateRequest.Phone); phone != "" && phone != pendingAddress(user, models.PhoneVerification) {
+		changes[models.PhoneVerification] = phone
+	}
+	if len(changes) > 0 {
+		if err := user.CheckPassword(updateRequest.Password); err != nil {
+			logger.Warn("Password doesn't match", zap.Uint("user_id", user.ID))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "password is required to change the email or phone"})
+			return
+		}
+	}
+
+	if username := strings.TrimSpace(updateRequest.Username); username != "" && username != user.Username {
+		renamed, err := models.ChangeUsername(c.Request.Context(), user, username)
+		if errors.Is(err, models.ErrUsernameTaken) {
+			logger.Warn("Username taken", zap.Uint("user_id", user.ID))
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to change username", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		user = renamed
+		logger.Info("Username changed", zap.Uint("user_id", user.ID))
+	}
+
+	pending := []models.VerificationChannel{}
+	for _, channel := range []models.VerificationChannel{models.EmailVerification, models.PhoneVerification} {
+		address, ok := changes[channel]
+		if !ok {
+			continue
+		}
+		changed, err := models.RequestAddressChange(c.Request.Context(), user, channel, address)
+		if errors.Is(err, models.ErrEmailTaken) {
+			logger.Warn("Email taken", zap.Uint("user_id", user.ID))
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to change address", zap.String("channel", string(channel)), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		user = changed
+		if current, _ := user.VerificationTarget(channel); pendingAddress(user, channel) == current {
+			logger.Info("Address change cancelled", zap.Uint("user_id", user.ID), zap.String("channel", string(channel)))
+			continue
+		}
+		pending = append(pending, channel)
+		// the code can be requested again if sending fails
+		if err := sendVerificationCode(c.Request.Context(), user, channel); err != nil {
+			logger.Error("Failed to send verification code", zap.Uint("user_id", user.ID), zap.String("channel", string(channel)), zap.Error(err))
+		}
+		logger.Info("Address change requested", zap.Uint("user_id", user.ID), zap.String("channel", string(channel)))
+	}
+
+	message := "Profile updated"
+	if len(pending) > 0 {
+		message = "Profile updated, the new address is used once verified with the code sent to it"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":              message,
+		"user":                 user,
+		"pending_verification": pending,
+	})
+	logger.Debug("Exiting UpdateProfile Function")
+}
+
+func DeleteAccount(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering DeleteAccount Function")
+	type DeleteAccountRequest struct {
+		Password string `json:"password" binding:"required"`
+	}
+
+	claims, err := utils.ValidateJWT(c)
+	if err != nil {
+		logger.Error("Failed to validate JWT", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	var deleteRequest DeleteAccountRequest
+	if err := c.ShouldBindJSON(&deleteRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := user.CheckPassword(deleteRequest.Password); err != nil {
+		logger.Warn("Password doesn't match", zap.Uint("user_id", user.ID))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "password is incorrect"})
+		return
+	}
+
+	err = models.DeleteAccount(c.Request.Context(), user)
+	if errors.Is(err, models.ErrLastTeamOwner) {
+		logger.Warn("Last owner can't delete the account", zap.Uint("user_id", user.ID))
+		c.JSON(http.StatusConflict, gin.H{"error": "transfer the ownership of your teams with other members first"})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to delete account", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		expiresAt = jwt.NewNumericDate(time.Now().Add(utils.AccessTokenTTL))
+	}
+	if err := models.RevokeToken(c.Request.Context(), claims["jti"].(string), expiresAt.Time); err != nil {
+		logger.Error("Failed to revoke token", zap.Error(err))
+	}
+	logger.Info("Account deleted", zap.Uint("user_id", user.ID))
+	auditEvent(c, userAuditEvent(AccountDeletedEvent, user))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+	logger.Debug("Exiting DeleteAccount Function")
+}
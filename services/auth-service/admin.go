@@ -0,0 +1,264 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/models"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// adminUser returns the user of the access token, it responds with 403 and
+// returns false unless the account role grants the permission.
+func adminUser(c *gin.Context, permission string) (models.User, bool) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return models.User{}, false
+	}
+	if !models.PermissionGranted(models.UserRolePermissions[user.Role], permission) {
+		logger.Warn("Permission denied", zap.Uint("user_id", user.ID), zap.String("permission", permission))
+		c.JSON(http.StatusForbidden, gin.H{"error": "missing permission " + permission})
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// targetUserID parses the :user_id parameter, it responds with 400 and
+// returns false when it isn't an ID.
+func targetUserID(c *gin.Context) (uint, bool) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	userId, err := strconv.ParseUint(c.Param("user_id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse user id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	return uint(userId), true
+}
+
+// pagination reads the page and page_size query parameters.
+func pagination(c *gin.Context) (page int, pageSize int, err error) {
+	page, err = strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		return 0, 0, errors.New("page must be a positive integer")
+	}
+	pageSize, err = strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 {
+		return 0, 0, errors.New("page_size must be a positive integer")
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	return page, pageSize, nil
+}
+
+func AdminGetUsers(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering AdminGetUsers Function")
+	if _, ok := adminUser(c, models.UsersReadPermission); !ok {
+		return
+	}
+
+	page, pageSize, err := pagination(c)
+	if err != nil {
+		logger.Warn("Invalid pagination", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	query := models.UserQuery{
+		Text:     c.Query("q"),
+		Role:     models.UserRole(c.Query("role")),
+		Page:     page,
+		PageSize: pageSize,
+	}
+	if query.Role != "" && !query.Role.Valid() {
+		logger.Warn("Invalid role filter", zap.String("role", string(query.Role)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be user, team or admin"})
+		return
+	}
+	if disabled := c.Query("disabled"); disabled != "" {
+		value, err := strconv.ParseBool(disabled)
+		if err != nil {
+			logger.Warn("Invalid disabled filter", zap.String("disabled", disabled))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "disabled must be true or false"})
+			return
+		}
+		query.Disabled = &value
+	}
+
+	users, total, err := models.SearchUsers(c.Request.Context(), query)
+	if err != nil {
+		logger.Error("Failed to search users", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"users":     users,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+	logger.Debug("Exiting AdminGetUsers Function")
+}
+
+func AdminGetUser(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering AdminGetUser Function")
+	if _, ok := adminUser(c, models.UsersReadPermission); !ok {
+		return
+	}
+	userId, ok := targetUserID(c)
+	if !ok {
+		return
+	}
+
+	user, err := models.GetUserById(c.Request.Context(), userId)
+	if err != nil {
+		logger.Error("Failed to get user", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": models.ErrUserNotFound.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+	logger.Debug("Exiting AdminGetUser Function")
+}
+
+func AdminSetUserRole(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering AdminSetUserRole Function")
+	type SetUserRoleRequest struct {
+		Role models.UserRole `json:"role" binding:"required"`
+	}
+
+	admin, ok := adminUser(c, models.UsersManagePermission)
+	if !ok {
+		return
+	}
+	userId, ok := targetUserID(c)
+	if !ok {
+		return
+	}
+	var roleRequest SetUserRoleRequest
+	if err := c.ShouldBindJSON(&roleRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !roleRequest.Role.Valid() {
+		logger.Warn("Invalid role", zap.String("role", string(roleRequest.Role)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be user, team or admin"})
+		return
+	}
+	// another admin has to do it, so the last admin can't be lost
+	if userId == admin.ID {
+		logger.Warn("Admin changing own role", zap.Uint("user_id", admin.ID))
+		c.JSON(http.StatusConflict, gin.H{"error": "you can't change your own role"})
+		return
+	}
+
+	user, err := models.SetUserRole(c.Request.Context(), userId, roleRequest.Role)
+	if errors.Is(err, models.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to change role", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("User role changed", zap.Uint("user_id", user.ID), zap.String("role", string(user.Role)), zap.Uint("admin_id", admin.ID))
+	changed := userAuditEvent(AccountRoleChangedEvent, admin)
+	changed.TargetType, changed.TargetID = "user", strconv.FormatUint(uint64(user.ID), 10)
+	changed.Details = map[string]interface{}{"role": user.Role}
+	auditEvent(c, changed)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role changed, it applies from the next token", "user": user})
+	logger.Debug("Exiting AdminSetUserRole Function")
+}
+
+// AdminSetUserDisabled returns the handler disabling or enabling the user.
+func AdminSetUserDisabled(disabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := correlation.Logger(c.Request.Context(), logger)
+		logger.Debug("Entering AdminSetUserDisabled Function")
+		admin, ok := adminUser(c, models.UsersManagePermission)
+		if !ok {
+			return
+		}
+		userId, ok := targetUserID(c)
+		if !ok {
+			return
+		}
+		if userId == admin.ID {
+			logger.Warn("Admin disabling own account", zap.Uint("user_id", admin.ID))
+			c.JSON(http.StatusConflict, gin.H{"error": "you can't disable your own account"})
+			return
+		}
+
+		user, err := models.SetUserDisabled(c.Request.Context(), userId, disabled)
+		if errors.Is(err, models.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to change account state", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		logger.Info("Account state changed", zap.Uint("user_id", user.ID), zap.Bool("disabled", disabled), zap.Uint("admin_id", admin.ID))
+
+		event, message := AccountEnabledEvent, "Account enabled"
+		if disabled {
+			event, message = AccountDisabledEvent, "Account disabled, its sessions are signed out"
+		}
+		changed := userAuditEvent(event, admin)
+		changed.TargetType, changed.TargetID = "user", strconv.FormatUint(uint64(user.ID), 10)
+		auditEvent(c, changed)
+		c.JSON(http.StatusOK, gin.H{"message": message, "user": user})
+		logger.Debug("Exiting AdminSetUserDisabled Function")
+	}
+}
+
+// promoteAdmins gives the admin role to the users with the usernames, for
+// the promote-admin command.
+func promoteAdmins(usernames []string) error {
+	if len(usernames) == 0 {
+		return errors.New("usage: app promote-admin <username>...")
+	}
+	ctx := context.Background()
+	for _, username := range usernames {
+		user, err := models.PromoteAdmin(ctx, username)
+		if err != nil {
+			return fmt.Errorf("%s: %w", username, err)
+		}
+		logger.Info("Admin promoted", zap.Uint("user_id", user.ID), zap.String("username", user.Username))
+
+		entry := models.AuditEvent{
+			Event:      AccountRoleChangedEvent,
+			Service:    "auth-service",
+			TargetType: "user",
+			TargetID:   strconv.FormatUint(uint64(user.ID), 10),
+			Details:    map[string]interface{}{"role": user.Role, "command": "promote-admin"},
+		}
+		if err := models.RecordAuditEvent(ctx, &entry); err != nil {
+			logger.Error("Failed to record audit event", zap.String("audit_event", entry.Event), zap.Error(err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/models"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// APIKeyRole is the role of requests made with an API key.
+const APIKeyRole = "api-key"
+
+func CreateAPIKey(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering CreateAPIKey Function")
+	type CreateAPIKeyRequest struct {
+		Name        string   `json:"name" binding:"required"`
+		Permissions []string `json:"permissions" binding:"required"`
+		ExpiresIn   string   `json:"expires_in"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.APIKeysManagePermission)
+	if !ok {
+		return
+	}
+
+	var createRequest CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&createRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(createRequest.Permissions) == 0 {
+		logger.Error("No permissions given")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "permissions is required"})
+		return
+	}
+	// a key can't do more than its creator in the team
+	granted := models.TeamRolePermissions[member.Role]
+	for _, permission := range createRequest.Permissions {
+		if !models.PermissionGranted(granted, permission) {
+			logger.Error("Permission not granted to creator", zap.String("permission", permission))
+			c.JSON(http.StatusForbidden, gin.H{"error": "You can't grant the permission " + permission})
+			return
+		}
+	}
+
+	apiKey := models.APIKey{
+		TeamID:      member.TeamID,
+		CreatedBy:   user.ID,
+		Name:        strings.TrimSpace(createRequest.Name),
+		Permissions: createRequest.Permissions,
+	}
+	if createRequest.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(createRequest.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			logger.Error("Invalid expires_in", zap.String("expires_in", createRequest.ExpiresIn), zap.Error(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be a positive duration such as 720h"})
+			return
+		}
+		expiresAt := time.Now().Add(expiresIn)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	key, err := models.CreateAPIKey(c.Request.Context(), &apiKey)
+	if err != nil {
+		logger.Error("Failed to create API key", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("API key created", zap.Uint("team_id", member.TeamID), zap.Uint("api_key_id", apiKey.ID), zap.Strings("permissions", apiKey.Permissions))
+	created := userAuditEvent(APIKeyCreatedEvent, user)
+	created.TeamID = &member.TeamID
+	created.TargetType, created.TargetID = "api_key", strconv.FormatUint(uint64(apiKey.ID), 10)
+	created.Details = map[string]interface{}{"permissions": apiKey.Permissions, "expires_at": apiKey.ExpiresAt}
+	auditEvent(c, created)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "API key created, it is only shown once",
+		"api_key": apiKey,
+		"key":     key,
+	})
+	logger.Debug("Exiting CreateAPIKey Function")
+}
+
+func GetAPIKeys(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering GetAPIKeys Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.APIKeysManagePermission)
+	if !ok {
+		return
+	}
+
+	apiKeys, err := models.GetTeamAPIKeys(c.Request.Context(), member.TeamID)
+	if err != nil {
+		logger.Error("Failed to get API keys", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, apiKeys)
+	logger.Debug("Exiting GetAPIKeys Function")
+}
+
+func RevokeAPIKey(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering RevokeAPIKey Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.APIKeysManagePermission)
+	if !ok {
+		return
+	}
+	keyId, err := strconv.ParseUint(c.Param("key_id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse API key id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = models.RevokeAPIKey(c.Request.Context(), member.TeamID, uint(keyId))
+	if errors.Is(err, models.ErrInvalidAPIKey) {
+		logger.Error("API key not found", zap.Uint64("api_key_id", keyId))
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found or already revoked"})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to revoke API key", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("API key revoked", zap.Uint("team_id", member.TeamID), zap.Uint64("api_key_id", keyId))
+	revoked := userAuditEvent(APIKeyRevokedEvent, user)
+	revoked.TeamID = &member.TeamID
+	revoked.TargetType, revoked.TargetID = "api_key", strconv.FormatUint(keyId, 10)
+	auditEvent(c, revoked)
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+	logger.Debug("Exiting RevokeAPIKey Function")
+}
+
+// validateAPIKey answers Validate for requests with an X-API-Key header. The
+// claims have the same shape as the claims of an access token, acting as the
+// creator of the key for its team.
+func validateAPIKey(c *gin.Context, key string) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	apiKey, err := models.UseAPIKey(c.Request.Context(), key)
+	if errors.Is(err, models.ErrInvalidAPIKey) || errors.Is(err, models.ErrAPIKeyExpired) || errors.Is(err, models.ErrAPIKeyRevoked) {
+		logger.Warn("Failed to validate API key", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to validate API key", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Debug("API key validated", zap.Uint("api_key_id", apiKey.ID), zap.Uint("team_id", apiKey.TeamID))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "API key is valid",
+		"claims": gin.H{
+			"id":          apiKey.CreatedBy,
+			"role":        APIKeyRole,
+			"team_id":     apiKey.TeamID,
+			"team_role":   "",
+			"permissions": apiKey.Permissions,
+			"api_key_id":  apiKey.ID,
+		},
+	})
+}
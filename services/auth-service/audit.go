@@ -0,0 +1,207 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/models"
+	"auth-service/telemetry"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wagslane/go-rabbitmq"
+	"go.uber.org/zap"
+)
+
+// Audit events of security relevant actions, logged with the audit logger
+// so they can be told apart from the rest of the logs and appended to the
+// audit log. The other services send theirs over the message bus.
+const (
+	LoginSucceededEvent     = "login.succeeded"
+	LoginFailedEvent        = "login.failed"
+	LoginLockoutEvent       = "login.lockout"
+	TokenRefreshedEvent     = "token.refreshed"
+	TokenReusedEvent        = "token.reused"
+	TokenRevokedEvent       = "token.revoked"
+	SessionRevokedEvent     = "session.revoked"
+	AccountLinkedEvent      = "account.linked"
+	AccountRoleChangedEvent = "account.role_changed"
+	AccountDisabledEvent    = "account.disabled"
+	AccountEnabledEvent     = "account.enabled"
+	AccountDeletedEvent     = "account.deleted"
+	TeamRoleChangedEvent    = "team.role_changed"
+	TeamMemberRemovedEvent  = "team.member_removed"
+	APIKeyCreatedEvent      = "api_key.created"
+	APIKeyRevokedEvent      = "api_key.revoked"
+)
+
+// auditExchange is where the services publish their audit events.
+const auditExchange = "audit"
+
+// userAuditEvent returns the event of an action of the user, for the active
+// team of the user.
+func userAuditEvent(event string, user models.User) models.AuditEvent {
+	actorID := user.ID
+	return models.AuditEvent{
+		Event:     event,
+		ActorID:   &actorID,
+		ActorType: models.UserAuditActor,
+		TeamID:    user.ActiveTeamID,
+	}
+}
+
+// loginSuccess audits a login of the user with the method.
+func loginSuccess(c *gin.Context, user models.User, method string) {
+	entry := userAuditEvent(LoginSucceededEvent, user)
+	entry.Details = map[string]interface{}{"method": method}
+	auditEvent(c, entry)
+}
+
+// loginFailure audits a refused login of the user for the reason.
+func loginFailure(c *gin.Context, user models.User, reason string) {
+	entry := userAuditEvent(LoginFailedEvent, user)
+	entry.Outcome = models.FailureAuditOutcome
+	entry.Details = map[string]interface{}{"reason": reason}
+	auditEvent(c, entry)
+}
+
+// auditEvent logs the security relevant event of the request and appends it
+// to the audit log. Failing to store it doesn't fail the request.
+func auditEvent(c *gin.Context, entry models.AuditEvent) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	entry.Service = "auth-service"
+	entry.IP = c.ClientIP()
+	entry.UserAgent = c.Request.UserAgent()
+	if err := models.RecordAuditEvent(c.Request.Context(), &entry); err != nil {
+		logger.Error("Failed to record audit event", zap.String("audit_event", entry.Event), zap.Error(err))
+	}
+
+	fields := []zap.Field{
+		zap.String("audit_event", entry.Event),
+		zap.String("outcome", string(entry.Outcome)),
+		zap.String("ip", entry.IP),
+	}
+	if entry.ActorID != nil {
+		fields = append(fields, zap.Uint("user_id", *entry.ActorID))
+	}
+	if entry.TeamID != nil {
+		fields = append(fields, zap.Uint("team_id", *entry.TeamID))
+	}
+	if entry.TargetID != "" {
+		fields = append(fields, zap.String("target", entry.TargetType+":"+entry.TargetID))
+	}
+	if entry.Details != nil {
+		fields = append(fields, zap.Any("details", entry.Details))
+	}
+	if entry.Outcome == models.FailureAuditOutcome {
+		logger.Named("audit").Warn(entry.Event, fields...)
+	} else {
+		logger.Named("audit").Info(entry.Event, fields...)
+	}
+}
+
+// recordServiceAuditEvent appends an audit event of another service received
+// over the message bus.
+func recordServiceAuditEvent(d rabbitmq.Delivery) rabbitmq.Action {
+	ctx, span := telemetry.StartConsume(context.Background(), auditExchange, d)
+	defer span.End()
+	// the request ID and trace of the request the event comes from
+	ids := correlation.FromTable(d.Headers)
+	logger := correlation.Logger(correlation.NewContext(ctx, ids.WithSpan(ctx)), logger)
+	var entry models.AuditEvent
+	if err := json.Unmarshal(d.Body, &entry); err != nil {
+		logger.Error("Failed to unmarshal audit event", zap.Error(err))
+		return rabbitmq.NackDiscard
+	}
+	if entry.Event == "" || entry.Service == "" {
+		logger.Error("Audit event without event or service", zap.ByteString("body", d.Body))
+		return rabbitmq.NackDiscard
+	}
+	entry.ID = 0
+	if err := models.RecordAuditEvent(ctx, &entry); err != nil {
+		// kept on the queue until the database is back
+		logger.Error("Failed to record audit event", zap.String("audit_event", entry.Event), zap.Error(err))
+		span.RecordError(err)
+		return rabbitmq.NackRequeue
+	}
+	logger.Debug("Audit event recorded", zap.String("audit_event", entry.Event), zap.String("service", entry.Service))
+	return rabbitmq.Ack
+}
+
+// parseAuditTime reads a time query parameter in RFC 3339, zero when empty.
+func parseAuditTime(c *gin.Context, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func GetAuditEvents(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering GetAuditEvents Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.AuditReadPermission)
+	if !ok {
+		return
+	}
+
+	page, pageSize, err := pagination(c)
+	if err != nil {
+		logger.Warn("Invalid pagination", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	query := models.AuditQuery{
+		TeamID:   member.TeamID,
+		Event:    c.Query("event"),
+		Outcome:  models.AuditOutcome(c.Query("outcome")),
+		Page:     page,
+		PageSize: pageSize,
+	}
+	if query.From, err = parseAuditTime(c, "from"); err != nil {
+		logger.Warn("Invalid from", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 time"})
+		return
+	}
+	if query.To, err = parseAuditTime(c, "to"); err != nil {
+		logger.Warn("Invalid to", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 time"})
+		return
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		logger.Warn("Empty time range", zap.Time("from", query.From), zap.Time("to", query.To))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+	if actor := c.Query("actor_id"); actor != "" {
+		actorID, err := strconv.ParseUint(actor, 10, 64)
+		if err != nil {
+			logger.Warn("Invalid actor_id", zap.String("actor_id", actor))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "actor_id must be a user ID"})
+			return
+		}
+		id := uint(actorID)
+		query.ActorID = &id
+	}
+
+	events, total, err := models.SearchAuditEvents(c.Request.Context(), query)
+	if err != nil {
+		logger.Error("Failed to search audit events", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events":    events,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+	logger.Debug("Exiting GetAuditEvents Function")
+}
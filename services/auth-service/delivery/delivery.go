@@ -0,0 +1,156 @@
+// Package delivery sends verification codes and other notices to users by
+// email or SMS. Development setups use the log or file sinks instead of a
+// real provider.
+package delivery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twilio/twilio-go"
+	api "github.com/twilio/twilio-go/rest/api/v2010"
+	"go.uber.org/zap"
+)
+
+// Message is sent to an email address or a phone number, Subject is only
+// used for emails.
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body"`
+}
+
+type Sender interface {
+	Send(message Message) error
+}
+
+// FromEnv returns the email and SMS senders selected by EMAIL_DELIVERY
+// (smtp, log or file) and SMS_DELIVERY (twilio, log or file). Both default
+// to log.
+func FromEnv(logger *zap.Logger) (email Sender, sms Sender, err error) {
+	if email, err = senderFromEnv("EMAIL_DELIVERY", "smtp", logger); err != nil {
+		return nil, nil, err
+	}
+	if sms, err = senderFromEnv("SMS_DELIVERY", "twilio", logger); err != nil {
+		return nil, nil, err
+	}
+	return email, sms, nil
+}
+
+func senderFromEnv(key string, provider string, logger *zap.Logger) (Sender, error) {
+	switch kind := os.Getenv(key); kind {
+	case "", "log":
+		return &LogSender{Logger: logger.With(zap.String("channel", key))}, nil
+	case "file":
+		path := os.Getenv("DELIVERY_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("%s=file needs DELIVERY_FILE", key)
+		}
+		return &FileSender{Path: path}, nil
+	case provider:
+		if provider == "smtp" {
+			return &SMTPSender{
+				Addr:     os.Getenv("SMTP_HOST") + ":" + os.Getenv("SMTP_PORT"),
+				Host:     os.Getenv("SMTP_HOST"),
+				Username: os.Getenv("SMTP_USERNAME"),
+				Password: os.Getenv("SMTP_PASSWORD"),
+				From:     os.Getenv("SMTP_FROM"),
+			}, nil
+		}
+		return NewTwilioSender(os.Getenv("TWILIO_ACCOUNT_SID"), os.Getenv("TWILIO_AUTH_TOKEN"), os.Getenv("TWILIO_PHONE_NUMBER")), nil
+	default:
+		return nil, fmt.Errorf("unknown %s %q", key, kind)
+	}
+}
+
+type SMTPSender struct {
+	Addr     string
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPSender) Send(message Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	// header values must not smuggle extra headers
+	subject := strings.NewReplacer("\r", "", "\n", "").Replace(message.Subject)
+	to := strings.NewReplacer("\r", "", "\n", "").Replace(message.To)
+	body := "From: " + s.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + message.Body + "\r\n"
+	return smtp.SendMail(s.Addr, auth, s.From, []string{to}, []byte(body))
+}
+
+type TwilioSender struct {
+	client *twilio.RestClient
+	from   string
+}
+
+func NewTwilioSender(accountSID string, authToken string, from string) *TwilioSender {
+	return &TwilioSender{
+		client: twilio.NewRestClientWithParams(twilio.ClientParams{
+			Username: accountSID,
+			Password: authToken,
+		}),
+		from: from,
+	}
+}
+
+func (s *TwilioSender) Send(message Message) error {
+	params := &api.CreateMessageParams{}
+	params.SetFrom(s.from)
+	params.SetTo(message.To)
+	params.SetBody(message.Body)
+	_, err := s.client.Api.CreateMessage(params)
+	return err
+}
+
+// LogSender logs the messages, codes included, so it must not be used in
+// production.
+type LogSender struct {
+	Logger *zap.Logger
+}
+
+func (s *LogSender) Send(message Message) error {
+	s.Logger.Info("Message delivered to log", zap.String("to", message.To), zap.String("subject", message.Subject), zap.String("body", message.Body))
+	return nil
+}
+
+// FileSender appends the messages as JSON lines to a file, tests read the
+// codes from it.
+type FileSender struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (s *FileSender) Send(message Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	line, err := json.Marshal(struct {
+		Message
+		SentAt time.Time `json:"sent_at"`
+	}{message, time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
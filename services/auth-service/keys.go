@@ -0,0 +1,45 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/models"
+	"auth-service/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func JWKS(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering JWKS Function")
+	// verifiers refetch on an unknown kid, so a short cache is enough
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, utils.JWKS())
+	logger.Debug("Exiting JWKS Function")
+}
+
+// rotateSigningKeys periodically picks up keys rotated by other replicas,
+// replaces the active key once it is older than the rotation interval and
+// drops keys past their overlap.
+func rotateSigningKeys(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if err := utils.LoadSigningKeys(); err != nil {
+			logger.Error("Failed to load signing keys", zap.Error(err))
+			continue
+		}
+		if utils.SigningKeyDue() {
+			if err := utils.RotateSigningKey(); err != nil {
+				logger.Error("Failed to rotate signing key", zap.Error(err))
+				continue
+			}
+			logger.Info("Signing key rotated")
+		}
+		if err := models.DeleteExpiredSigningKeys(); err != nil {
+			logger.Error("Failed to delete expired signing keys", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/database"
+	"auth-service/models"
+	"auth-service/throttle"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Failed logins are throttled per account and per client IP. An IP gets
+// more attempts than an account as clients behind a NAT share it.
+var (
+	accountLimiter = throttle.Limiter{Policy: throttle.Policy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}}
+	ipLimiter = throttle.Limiter{Policy: throttle.Policy{
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}}
+)
+
+// invalidLoginMessage answers every failed login, whether the username
+// exists or not.
+const invalidLoginMessage = "invalid username or password"
+
+// throttleStoreFromEnv returns the store selected by LOGIN_THROTTLE_STORE,
+// memory (the default) or postgres.
+func throttleStoreFromEnv() (throttle.Store, error) {
+	switch kind := os.Getenv("LOGIN_THROTTLE_STORE"); kind {
+	case "", "memory":
+		return throttle.NewMemoryStore(), nil
+	case "postgres":
+		if err := database.DB.AutoMigrate(&throttle.Attempt{}); err != nil {
+			return nil, err
+		}
+		return &throttle.PostgresStore{DB: database.DB}, nil
+	default:
+		return nil, fmt.Errorf("unknown LOGIN_THROTTLE_STORE %q", kind)
+	}
+}
+
+func accountKey(username string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func ipKey(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// loginAllowed responds with 429 and returns false when the account or the
+// IP is blocked after failed logins.
+func loginAllowed(c *gin.Context, username string) bool {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	now := time.Now()
+	wait := time.Duration(0)
+	for _, check := range []struct {
+		limiter throttle.Limiter
+		key     string
+	}{{accountLimiter, accountKey(username)}, {ipLimiter, ipKey(c)}} {
+		keyWait, err := check.limiter.Check(c.Request.Context(), check.key, now)
+		if err != nil {
+			logger.Error("Failed to check login attempts", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+			return false
+		}
+		if keyWait > wait {
+			wait = keyWait
+		}
+	}
+	if wait == 0 {
+		return true
+	}
+
+	logger.Warn("Login throttled", zap.String("username", username), zap.String("ip", c.ClientIP()), zap.Duration("retry_after", wait))
+	c.Header("Retry-After", strconv.Itoa(int(wait.Seconds()+0.999)))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed login attempts, retry later"})
+	return false
+}
+
+// loginFailed records the failure for the account and the IP and responds
+// with 401 and the message.
+func loginFailed(c *gin.Context, username string, message string) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	now := time.Now()
+	for _, record := range []struct {
+		limiter throttle.Limiter
+		key     string
+	}{{accountLimiter, accountKey(username)}, {ipLimiter, ipKey(c)}} {
+		state, locked, err := record.limiter.Fail(c.Request.Context(), record.key, now)
+		if err != nil {
+			logger.Error("Failed to record login attempt", zap.String("key", record.key), zap.Error(err))
+			continue
+		}
+		if locked {
+			auditEvent(c, models.AuditEvent{
+				Event:   LoginLockoutEvent,
+				Outcome: models.FailureAuditOutcome,
+				Details: map[string]interface{}{
+					"key":          record.key,
+					"failures":     state.Failures,
+					"locked_until": state.BlockedUntil,
+				},
+			})
+		}
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+// loginSucceeded forgets the failures of the account. The failures of the
+// IP are kept, a valid account mustn't reset them.
+func loginSucceeded(ctx context.Context, username string) {
+	if err := accountLimiter.Reset(ctx, accountKey(username)); err != nil {
+		correlation.Logger(ctx, logger).Error("Failed to reset login attempts", zap.Error(err))
+	}
+}
+
+// cleanupLoginAttempts periodically drops the state of keys without recent
+// failures.
+func cleanupLoginAttempts(interval time.Duration) {
+	for {
+		before := time.Now().Add(-accountLimiter.Policy.Window)
+		if err := accountLimiter.Store.Cleanup(before); err != nil {
+			logger.Error("Failed to delete login attempts", zap.Error(err))
+		}
+		time.Sleep(interval)
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"auth-service/correlation"
 	"auth-service/database"
+	"auth-service/delivery"
 	"auth-service/models"
+	"auth-service/oidc"
+	"auth-service/telemetry"
 	"auth-service/utils"
+	"context"
+	"errors"
 	"net/http"
 	"os"
 	"strconv"
@@ -12,6 +18,7 @@ import (
 	"github.com/gin-gonic/gin"
 
 	ginzap "github.com/gin-contrib/zap"
+	"github.com/wagslane/go-rabbitmq"
 	"go.uber.org/zap"
 )
 
@@ -23,6 +30,12 @@ func main() {
 	logger, _ = zap.NewDevelopment()
 	logger.With(zap.String("service", "auth-service"))
 
+	shutdownTracing, err := telemetry.Setup(context.Background(), "auth-service")
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
+	}
+	defer shutdownTracing(context.Background())
+
 	_, err = database.ConnectDB(&database.DBConfig{
 		Host:     os.Getenv("DB_HOST"),
 		Port:     os.Getenv("DB_PORT"),
@@ -34,23 +47,112 @@ func main() {
 	if err != nil {
 		logger.Fatal("Failed to connect to database", zap.Error(err))
 	}
+	if err = telemetry.TraceGorm(database.DB); err != nil {
+		logger.Fatal("Failed to trace database queries", zap.Error(err))
+	}
 	logger.Info("Connected to database")
 
 	// create enum user role
 	database.DB.Exec(`DO $$ BEGIN
     IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'user_role') THEN
-      CREATE TYPE user_role AS ENUM ('team', 'user');
+      CREATE TYPE user_role AS ENUM ('team', 'user', 'admin');
     END IF;
   END $$;`)
-	if err := database.DB.AutoMigrate(&models.User{}); err != nil {
+	database.DB.Exec(`ALTER TYPE user_role ADD VALUE IF NOT EXISTS 'admin'`)
+	if err := database.DB.AutoMigrate(&models.User{}, &models.RefreshToken{}, &models.RevokedToken{}, &models.SigningKey{}, &models.Team{}, &models.TeamMember{}, &models.TeamInvitation{}, &models.APIKey{}, &models.VerificationCode{}, &models.PasswordResetToken{}, &models.RecoveryCode{}, &models.MFAChallenge{}, &models.ExternalIdentity{}, &models.OIDCLoginState{}, &models.AuditEvent{}, &models.Session{}); err != nil {
 		logger.Fatal("Failed to migrate database", zap.Error(err))
 	}
-	logger.Info("Database auto migrated", zap.String("table", "user"))
+	logger.Info("Database auto migrated", zap.String("table", "user"), zap.String("table", "refresh_token"), zap.String("table", "revoked_token"), zap.String("table", "signing_key"), zap.String("table", "team"), zap.String("table", "team_member"), zap.String("table", "team_invitation"), zap.String("table", "api_key"), zap.String("table", "verification_code"), zap.String("table", "password_reset_token"), zap.String("table", "recovery_code"), zap.String("table", "mfa_challenge"), zap.String("table", "external_identity"), zap.String("table", "oidc_login_state"), zap.String("table", "audit_event"), zap.String("table", "session"))
+
+	if err := models.MigrateAuditLog(); err != nil {
+		logger.Fatal("Failed to migrate audit log", zap.Error(err))
+	}
+
+	if err := models.MigrateLegacyTeams(); err != nil {
+		logger.Fatal("Failed to migrate team accounts", zap.Error(err))
+	}
+
+	// the first admins are made once with `app promote-admin <username>...`,
+	// they can promote others
+	if len(os.Args) > 1 && os.Args[1] == "promote-admin" {
+		if err := promoteAdmins(os.Args[2:]); err != nil {
+			logger.Fatal("Failed to promote admins", zap.Error(err))
+		}
+		return
+	}
+
+	if err := models.LoadPasswordPolicy(); errors.Is(err, models.ErrBreachedListUnavailable) {
+		logger.Warn("Passwords are not checked against breached passwords", zap.Error(err))
+	} else if err != nil {
+		logger.Fatal("Failed to load password policy", zap.Error(err))
+	}
+
+	emailSender, smsSender, err = delivery.FromEnv(logger)
+	if err != nil {
+		logger.Fatal("Failed to configure delivery", zap.Error(err))
+	}
+
+	oidcProviders, err = oidc.ProvidersFromEnv()
+	if err != nil {
+		logger.Fatal("Failed to configure identity providers", zap.Error(err))
+	}
+
+	serviceAccounts, err = serviceAccountsFromEnv()
+	if err != nil {
+		logger.Fatal("Failed to configure service accounts", zap.Error(err))
+	}
+	logger.Info("Service accounts loaded", zap.Int("count", len(serviceAccounts)))
+
+	if err := utils.LoadSigningKeys(); err != nil {
+		logger.Fatal("Failed to load signing keys", zap.Error(err))
+	}
+	logger.Info("Signing keys loaded", zap.String("algorithm", utils.SigningAlgorithm))
+
+	loginStore, err := throttleStoreFromEnv()
+	if err != nil {
+		logger.Fatal("Failed to configure login throttling", zap.Error(err))
+	}
+	accountLimiter.Store = loginStore
+	ipLimiter.Store = loginStore
+
+	conn, err := rabbitmq.NewConn(
+		os.Getenv("RABBITMQ_URL"),
+		rabbitmq.WithConnectionOptionsLogging,
+	)
+	if err != nil {
+		logger.Fatal("Failed to connect to RabbitMQ", zap.Error(err))
+	}
+	logger.Info("Connected to RabbitMQ")
+	defer conn.Close()
+
+	// the audit events of the other services
+	auditConsumer, err := rabbitmq.NewConsumer(
+		conn,
+		recordServiceAuditEvent,
+		auditExchange,
+		rabbitmq.WithConsumerOptionsRoutingKey(auditExchange),
+		rabbitmq.WithConsumerOptionsExchangeName(auditExchange),
+		rabbitmq.WithConsumerOptionsExchangeDeclare,
+		rabbitmq.WithConsumerOptionsExchangeDurable,
+		rabbitmq.WithConsumerOptionsQueueDurable,
+	)
+	if err != nil {
+		logger.Fatal("Failed to create audit consumer", zap.Error(err))
+	}
+	defer auditConsumer.Close()
+
+	go cleanupExpiredTokens(time.Hour)
+	go cleanupLoginAttempts(10 * time.Minute)
+	go rotateSigningKeys(time.Minute)
 
 	defer database.CloseDB()
 
 	r := gin.New()
-	r.Use(ginzap.Ginzap(logger, time.RFC3339, true))
+	// the gateway passes on the address of the client
+	r.TrustedPlatform = "X-Real-IP"
+	r.Use(telemetry.Middleware("auth-service"))
+	r.Use(correlation.Middleware())
+	r.Use(ginzap.GinzapWithConfig(logger, &ginzap.Config{TimeFormat: time.RFC3339, UTC: true, Context: correlation.LogFields}))
 	r.Use(ginzap.RecoveryWithZap(logger, true))
 
 	api := r.Group("/api/v1/auth")
@@ -58,18 +160,63 @@ func main() {
 	api.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
-	// NOTE: maybe add verification of email and phone later
 	api.POST("/register", Register)
 	api.POST("/login", Login)
+	api.POST("/login/mfa", LoginMFA)
 	api.GET("/validate", Validate)
-
-	// internal endpoint
-	r.GET("/users/:id", getUserById)
+	api.POST("/refresh", Refresh)
+	api.POST("/logout", Logout)
+	api.GET("/.well-known/jwks.json", JWKS)
+	api.GET("/oidc/providers", GetOIDCProviders)
+	api.GET("/oidc/:provider/login", OIDCLogin)
+	api.GET("/oidc/:provider/callback", OIDCCallback)
+
+	api.POST("/teams", CreateTeam)
+	api.GET("/teams", GetTeams)
+	api.POST("/teams/:id/switch", SwitchTeam)
+	api.GET("/teams/:id/members", GetTeamMembers)
+	api.PUT("/teams/:id/members/:user_id", UpdateTeamMember)
+	api.DELETE("/teams/:id/members/:user_id", RemoveTeamMember)
+	api.GET("/teams/:id/invitations", GetTeamInvitations)
+	api.POST("/teams/:id/invitations", InviteTeamMember)
+	api.DELETE("/teams/:id/invitations/:invitation_id", DeleteTeamInvitation)
+	api.PUT("/teams/:id/mfa", SetTeamMFA)
+	api.POST("/invitations/accept", AcceptInvitation)
+	api.POST("/verify/:channel/send", SendVerification)
+	api.POST("/verify/:channel", Verify)
+	api.POST("/password/reset/request", RequestPasswordReset)
+	api.POST("/password/reset", ResetPassword)
+	api.POST("/password/change", ChangePassword)
+	api.POST("/mfa/totp", EnrollTOTP)
+	api.POST("/mfa/totp/confirm", ConfirmTOTP)
+	api.POST("/mfa/totp/disable", DisableTOTP)
+	api.POST("/mfa/recovery-codes", RegenerateRecoveryCodes)
+	api.GET("/me", GetProfile)
+	api.PATCH("/me", UpdateProfile)
+	api.DELETE("/me", DeleteAccount)
+	api.GET("/sessions", GetSessions)
+	api.DELETE("/sessions", RevokeOtherSessions)
+	api.DELETE("/sessions/:session_id", RevokeSession)
+	api.GET("/admin/users", AdminGetUsers)
+	api.GET("/admin/users/:user_id", AdminGetUser)
+	api.PUT("/admin/users/:user_id/role", AdminSetUserRole)
+	api.POST("/admin/users/:user_id/disable", AdminSetUserDisabled(true))
+	api.POST("/admin/users/:user_id/enable", AdminSetUserDisabled(false))
+	api.GET("/teams/:id/api-keys", GetAPIKeys)
+	api.POST("/teams/:id/api-keys", CreateAPIKey)
+	api.DELETE("/teams/:id/api-keys/:key_id", RevokeAPIKey)
+	api.GET("/teams/:id/audit-events", GetAuditEvents)
+
+	// internal endpoints
+	r.POST("/service-token", IssueServiceToken)
+	r.GET("/users/:id", requireServiceScope(UsersReadScope), getUserById)
+	r.GET("/.well-known/jwks.json", JWKS)
 
 	r.Run(":80")
 }
 
 func Register(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering Register Function")
 
 	type RegisterRequest struct {
@@ -88,6 +235,12 @@ func Register(c *gin.Context) {
 		return
 	}
 	logger.Debug("registerRequest", zap.Any("registerRequest", registerRequest))
+	// admins are only made by other admins
+	if registerRequest.Role != "" && registerRequest.Role != models.UserUserRole && registerRequest.Role != models.TeamUserRole {
+		logger.Error("Invalid role", zap.String("role", string(registerRequest.Role)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be user or team"})
+		return
+	}
 
 	user := models.User{
 		Username: registerRequest.Username,
@@ -97,7 +250,10 @@ func Register(c *gin.Context) {
 		Role:     registerRequest.Role,
 	}
 
-	savedUser, err := user.Register()
+	savedUser, err := user.Register(c.Request.Context())
+	if passwordError(c, err) {
+		return
+	}
 	if err != nil {
 		logger.Error("Failed to register user", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -105,6 +261,13 @@ func Register(c *gin.Context) {
 	}
 	logger.Info("User registered", zap.Any("user", savedUser))
 
+	// codes can be requested again if sending fails
+	for _, channel := range []models.VerificationChannel{models.EmailVerification, models.PhoneVerification} {
+		if err := sendVerificationCode(c.Request.Context(), *savedUser, channel); err != nil {
+			logger.Error("Failed to send verification code", zap.Uint("user_id", savedUser.ID), zap.String("channel", string(channel)), zap.Error(err))
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "User registered successfully",
 		"user":    savedUser,
@@ -113,6 +276,7 @@ func Register(c *gin.Context) {
 }
 
 func Login(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering Login Function")
 	type LoginRequest struct {
 		Username string `json:"username"`
@@ -128,40 +292,88 @@ func Login(c *gin.Context) {
 	}
 	logger.Debug("loginRequest", zap.Any("loginRequest", loginRequest))
 
-	user, err := models.GetUserByUsername(loginRequest.Username)
+	if !loginAllowed(c, loginRequest.Username) {
+		return
+	}
+
+	user, err := models.GetUserByUsername(c.Request.Context(), loginRequest.Username)
 	if err != nil {
 		logger.Error("Failed to get user", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	if user.ID == 0 {
+		// take as long as a wrong password so unknown usernames don't show
+		models.CheckUnknownUserPassword(loginRequest.Password)
+		logger.Warn("Login with unknown username", zap.String("username", loginRequest.Username))
+		auditEvent(c, models.AuditEvent{
+			Event:   LoginFailedEvent,
+			Outcome: models.FailureAuditOutcome,
+			Details: map[string]interface{}{"username": loginRequest.Username, "reason": "unknown_user"},
+		})
+		loginFailed(c, loginRequest.Username, invalidLoginMessage)
 		return
 	}
 	logger.Debug("User retrieved", zap.Any("user", user))
 
 	err = user.CheckPassword(loginRequest.Password)
 	if err != nil {
-		logger.Error("Failed to check password", zap.Error(err))
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		logger.Warn("Failed to check password", zap.Uint("user_id", user.ID), zap.Error(err))
+		loginFailure(c, user, "wrong_password")
+		loginFailed(c, loginRequest.Username, invalidLoginMessage)
 		return
 	}
 	logger.Debug("Password matched", zap.Any("user", user))
+	if accountDisabled(c, user) {
+		loginFailure(c, user, "account_disabled")
+		return
+	}
+
+	if user.TOTPEnabled {
+		mfaToken, err := models.CreateMFAChallenge(c.Request.Context(), user.ID)
+		if err != nil {
+			logger.Error("Failed to create MFA challenge", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		logger.Debug("MFA challenge created", zap.Uint("user_id", user.ID))
+
+		// failures are only forgotten once the second factor is checked
+		c.JSON(http.StatusOK, gin.H{
+			"message":      "Two-factor authentication required",
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int(models.MFAChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	loginSucceeded(c.Request.Context(), loginRequest.Username)
 
-	token, err := utils.GenerateJWT(user)
+	tokens, err := issueTokens(c, user)
 	if err != nil {
 		logger.Error("Failed to generate JWT", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	logger.Debug("JWT generated", zap.Any("token", token))
+	logger.Debug("JWT generated", zap.Uint("user_id", user.ID))
+	loginSuccess(c, user, "password")
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Login successful",
-		"user":    user,
-		"token":   token,
-	})
+	tokens["message"] = "Login successful"
+	tokens["user"] = user
+	c.JSON(http.StatusOK, tokens)
 	logger.Debug("Exiting Login Function")
 }
 
 func Validate(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering Validate Function")
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		validateAPIKey(c, key)
+		logger.Debug("Exiting Validate Function")
+		return
+	}
+
 	claims, err := utils.ValidateJWT(c)
 	if err != nil {
 		logger.Error("Failed to validate JWT", zap.Error(err))
@@ -178,6 +390,7 @@ func Validate(c *gin.Context) {
 }
 
 func getUserById(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering getUserById Function")
 	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
@@ -188,7 +401,7 @@ func getUserById(c *gin.Context) {
 	logger.Debug("User id retrieved", zap.Uint64("id", id))
 
 	var user models.User
-	user, err = models.GetUserById(uint(id))
+	user, err = models.GetUserById(c.Request.Context(), uint(id))
 	if err != nil {
 		logger.Error("Failed to get user", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
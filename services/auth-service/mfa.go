@@ -0,0 +1,279 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/models"
+	"auth-service/totp"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// mfaIssuer names the service in authenticator apps.
+var mfaIssuer = issuerFromEnv()
+
+func issuerFromEnv() string {
+	if issuer := os.Getenv("MFA_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "FormFlow"
+}
+
+// mfaError answers the errors of the two-factor models and returns true if
+// it did.
+func mfaError(c *gin.Context, err error) bool {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	switch {
+	case errors.Is(err, models.ErrInvalidMFACode):
+		logger.Warn("Invalid two-factor code", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrInvalidMFAToken):
+		logger.Warn("Invalid two-factor challenge", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrMFAAlreadyEnabled), errors.Is(err, models.ErrMFANotEnabled), errors.Is(err, models.ErrMFANotEnrolled):
+		logger.Warn("Two-factor state conflict", zap.Error(err))
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrTeamRequiresMFA):
+		logger.Warn("Two-factor required by team", zap.Error(err))
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		return false
+	}
+	return true
+}
+
+func LoginMFA(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering LoginMFA Function")
+	type LoginMFARequest struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+
+	var loginRequest LoginMFARequest
+	if err := c.ShouldBindJSON(&loginRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := models.CompleteMFAChallenge(c.Request.Context(), loginRequest.MFAToken, loginRequest.Code)
+	if errors.Is(err, models.ErrInvalidMFACode) {
+		// wrong codes count as failed logins of the account
+		logger.Warn("Invalid two-factor code", zap.Uint("user_id", user.ID))
+		loginFailure(c, user, "invalid_mfa_code")
+		loginFailed(c, user.Username, err.Error())
+		return
+	}
+	if mfaError(c, err) {
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to complete MFA challenge", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if accountDisabled(c, user) {
+		loginFailure(c, user, "account_disabled")
+		return
+	}
+	loginSucceeded(c.Request.Context(), user.Username)
+
+	tokens, err := issueTokens(c, user)
+	if err != nil {
+		logger.Error("Failed to generate JWT", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Debug("JWT generated", zap.Uint("user_id", user.ID))
+	loginSuccess(c, user, "mfa")
+
+	tokens["message"] = "Login successful"
+	tokens["user"] = user
+	c.JSON(http.StatusOK, tokens)
+	logger.Debug("Exiting LoginMFA Function")
+}
+
+func EnrollTOTP(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering EnrollTOTP Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+
+	secret, err := models.StartTOTPEnrolment(c.Request.Context(), user)
+	if mfaError(c, err) {
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to start TOTP enrolment", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("TOTP enrolment started", zap.Uint("user_id", user.ID))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Add the secret to your authenticator app and confirm with a code",
+		"secret":      secret,
+		"otpauth_uri": totp.URI(mfaIssuer, user.Username, secret),
+	})
+	logger.Debug("Exiting EnrollTOTP Function")
+}
+
+func ConfirmTOTP(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering ConfirmTOTP Function")
+	type ConfirmTOTPRequest struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	var confirmRequest ConfirmTOTPRequest
+	if err := c.ShouldBindJSON(&confirmRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := models.ConfirmTOTPEnrolment(c.Request.Context(), user.ID, confirmRequest.Code)
+	if mfaError(c, err) {
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to confirm TOTP enrolment", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("TOTP enabled", zap.Uint("user_id", user.ID))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled, store the recovery codes safely, they are only shown once",
+		"recovery_codes": codes,
+	})
+	logger.Debug("Exiting ConfirmTOTP Function")
+}
+
+func DisableTOTP(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering DisableTOTP Function")
+	type DisableTOTPRequest struct {
+		Password string `json:"password" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	var disableRequest DisableTOTPRequest
+	if err := c.ShouldBindJSON(&disableRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := user.CheckPassword(disableRequest.Password); err != nil {
+		logger.Warn("Password doesn't match", zap.Uint("user_id", user.ID))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "password is incorrect"})
+		return
+	}
+
+	err := models.DisableTOTP(c.Request.Context(), user.ID, disableRequest.Code)
+	if mfaError(c, err) {
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to disable TOTP", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("TOTP disabled", zap.Uint("user_id", user.ID))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+	logger.Debug("Exiting DisableTOTP Function")
+}
+
+func RegenerateRecoveryCodes(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering RegenerateRecoveryCodes Function")
+	type RegenerateRecoveryCodesRequest struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	var regenerateRequest RegenerateRecoveryCodesRequest
+	if err := c.ShouldBindJSON(&regenerateRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := models.RegenerateRecoveryCodes(c.Request.Context(), user.ID, regenerateRequest.Code)
+	if mfaError(c, err) {
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to regenerate recovery codes", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Recovery codes regenerated", zap.Uint("user_id", user.ID))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Recovery codes replaced, the previous ones no longer work",
+		"recovery_codes": codes,
+	})
+	logger.Debug("Exiting RegenerateRecoveryCodes Function")
+}
+
+func SetTeamMFA(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering SetTeamMFA Function")
+	type SetTeamMFARequest struct {
+		RequireMFA *bool `json:"require_mfa" binding:"required"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.TeamManagePermission)
+	if !ok {
+		return
+	}
+	var setRequest SetTeamMFARequest
+	if err := c.ShouldBindJSON(&setRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// otherwise the member would lock themselves out of the team
+	if *setRequest.RequireMFA && !user.TOTPEnabled {
+		logger.Warn("Two-factor not enabled by member requiring it", zap.Uint("user_id", user.ID), zap.Uint("team_id", member.TeamID))
+		c.JSON(http.StatusConflict, gin.H{"error": "Enable two-factor authentication yourself before requiring it"})
+		return
+	}
+
+	if err := models.SetTeamRequireMFA(c.Request.Context(), member.TeamID, *setRequest.RequireMFA); err != nil {
+		logger.Error("Failed to update team", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Team two-factor requirement updated", zap.Uint("team_id", member.TeamID), zap.Bool("require_mfa", *setRequest.RequireMFA))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Team updated",
+		"team_id":     member.TeamID,
+		"require_mfa": *setRequest.RequireMFA,
+	})
+	logger.Debug("Exiting SetTeamMFA Function")
+}
@@ -0,0 +1,261 @@
+package models
+
+import (
+	"auth-service/database"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrUsernameTaken   = errors.New("username is already taken")
+	ErrEmailTaken      = errors.New("email is already used by another account")
+	ErrAccountDisabled = errors.New("account is disabled")
+	ErrUserNotFound    = errors.New("user not found")
+)
+
+// UserQuery filters the users listed to admins, empty fields don't filter.
+type UserQuery struct {
+	// Text matches part of the username or email.
+	Text     string
+	Role     UserRole
+	Disabled *bool
+	Page     int
+	PageSize int
+}
+
+// Disabled reports whether an admin disabled the account.
+func (user User) Disabled() bool {
+	return user.DisabledAt != nil
+}
+
+// checkEmailFree fails with ErrEmailTaken when another user has the email,
+// as current or pending address.
+func checkEmailFree(tx *gorm.DB, userID uint, email string) error {
+	var count int64
+	if err := tx.Unscoped().Model(&User{}).
+		Where("id <> ? AND (lower(email) = lower(?) OR lower(pending_email) = lower(?))", userID, email, email).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+// ChangeUsername renames the user.
+func ChangeUsername(ctx context.Context, user User, username string) (User, error) {
+	username = html.EscapeString(strings.TrimSpace(username))
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Unscoped().Model(&User{}).Where("id <> ? AND username = ?", user.ID, username).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrUsernameTaken
+		}
+		return tx.Model(&User{}).Where("id = ?", user.ID).Update("username", username).Error
+	})
+	if err != nil {
+		return User{}, err
+	}
+	user.Username = username
+	return user, nil
+}
+
+// RequestAddressChange keeps the new address of the channel as pending until
+// a code sent to it is verified, the current address stays in use until
+// then. Asking for the current address cancels the pending change.
+func RequestAddressChange(ctx context.Context, user User, channel VerificationChannel, address string) (User, error) {
+	address = strings.TrimSpace(address)
+	current, _ := user.VerificationTarget(channel)
+	pending := address
+	if strings.EqualFold(address, current) {
+		pending = ""
+	}
+
+	column := "pending_email"
+	if channel == PhoneVerification {
+		column = "pending_phone"
+	}
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if channel == EmailVerification && pending != "" {
+			if err := checkEmailFree(tx, user.ID, pending); err != nil {
+				return err
+			}
+		}
+		// codes sent to the previous pending address stop working
+		if err := tx.Where("user_id = ? AND channel = ?", user.ID, channel).Delete(&VerificationCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("id = ?", user.ID).Update(column, pending).Error
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if channel == PhoneVerification {
+		user.PendingPhone = pending
+	} else {
+		user.PendingEmail = pending
+	}
+	return user, nil
+}
+
+// DeleteAccount removes the memberships, API keys and sessions of the user
+// and anonymises it, so the username and email can be used again. It fails with
+// ErrLastTeamOwner while the user is the last owner of a team with other
+// members, a team without other members is kept with its forms.
+func DeleteAccount(ctx context.Context, user User) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var members []TeamMember
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", user.ID).Find(&members).Error; err != nil {
+			return err
+		}
+		for _, member := range members {
+			if err := revokeCreatorAPIKeys(tx, member.TeamID, user.ID); err != nil {
+				return err
+			}
+			if member.Role != OwnerTeamRole {
+				continue
+			}
+			var others int64
+			if err := tx.Model(&TeamMember{}).Where("team_id = ? AND user_id <> ?", member.TeamID, user.ID).Count(&others).Error; err != nil {
+				return err
+			}
+			if others == 0 {
+				continue
+			}
+			if err := checkOwnerLeft(tx, member.TeamID, user.ID); err != nil {
+				return err
+			}
+		}
+
+		for _, model := range []interface{}{&TeamMember{}, &ExternalIdentity{}, &VerificationCode{}, &PasswordResetToken{}, &RecoveryCode{}, &MFAChallenge{}} {
+			if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := revokeUserSessions(tx, user.ID); err != nil {
+			return err
+		}
+
+		anonymous := fmt.Sprintf("deleted-%d", user.ID)
+		if err := tx.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"username":       anonymous,
+			"email":          anonymous + "@invalid",
+			"phone":          "",
+			"pending_email":  "",
+			"pending_phone":  "",
+			"active_team_id": nil,
+			"totp_secret":    "",
+			"totp_enabled":   false,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&User{}, user.ID).Error
+	})
+}
+
+// SearchUsers returns a page of the users matching the query, ordered by ID,
+// and the number of matching users.
+func SearchUsers(ctx context.Context, query UserQuery) ([]User, int64, error) {
+	db := database.DB.WithContext(ctx).Model(&User{})
+	if query.Text != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query.Text) + "%"
+		db = db.Where("username ILIKE ? OR email ILIKE ?", pattern, pattern)
+	}
+	if query.Role != "" {
+		db = db.Where("role = ?", query.Role)
+	}
+	if query.Disabled != nil {
+		if *query.Disabled {
+			db = db.Where("disabled_at IS NOT NULL")
+		} else {
+			db = db.Where("disabled_at IS NULL")
+		}
+	}
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	users := []User{}
+	err := db.Order("id").Limit(query.PageSize).Offset((query.Page - 1) * query.PageSize).Find(&users).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// SetUserDisabled disables or enables the user, disabling signs out every
+// session by revoking the refresh tokens.
+func SetUserDisabled(ctx context.Context, userID uint, disabled bool) (User, error) {
+	var user User
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !disabled {
+			user.DisabledAt = nil
+			return tx.Model(&user).Update("disabled_at", nil).Error
+		}
+		if user.DisabledAt != nil {
+			return nil
+		}
+		now := time.Now()
+		user.DisabledAt = &now
+		if err := tx.Model(&user).Update("disabled_at", now).Error; err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, userID)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// SetUserRole changes the account role of the user.
+func SetUserRole(ctx context.Context, userID uint, role UserRole) (User, error) {
+	var user User
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		user.Role = role
+		return tx.Model(&user).Update("role", role).Error
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// PromoteAdmin gives the admin role to the user with the username, so the
+// first admin doesn't need to be made in the database.
+func PromoteAdmin(ctx context.Context, username string) (User, error) {
+	var user User
+	err := database.DB.WithContext(ctx).Where("username = ?", username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return SetUserRole(ctx, user.ID, AdminUserRole)
+}
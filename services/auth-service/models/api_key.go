@@ -0,0 +1,142 @@
+package models
+
+import (
+	"auth-service/database"
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIKeyPrefix starts every API key so they are easy to tell apart from
+// access tokens and to find in leaked secrets.
+const APIKeyPrefix = "ffk_"
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrAPIKeyExpired = errors.New("API key expired")
+	ErrAPIKeyRevoked = errors.New("API key revoked")
+)
+
+// APIKey lets machines act for a team with a subset of the permissions of
+// the member creating it. Only the hash of the key is stored, Prefix is the
+// start of the key to recognise it in listings.
+type APIKey struct {
+	gorm.Model
+	TeamID      uint       `gorm:"not null;index" json:"team_id"`
+	CreatedBy   uint       `gorm:"not null" json:"created_by"`
+	Name        string     `gorm:"size:255;not null" json:"name"`
+	Prefix      string     `gorm:"size:16;not null" json:"prefix"`
+	KeyHash     string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Permissions []string   `gorm:"serializer:json;not null" json:"permissions"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	UsageCount  int64      `gorm:"not null;default:0" json:"usage_count"`
+}
+
+// CreateAPIKey returns the plain key, it can't be recovered later.
+func CreateAPIKey(ctx context.Context, apiKey *APIKey) (string, error) {
+	secret, err := RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	key := APIKeyPrefix + secret
+	apiKey.Prefix = key[:len(APIKeyPrefix)+8]
+	apiKey.KeyHash = HashToken(key)
+	if err := database.DB.WithContext(ctx).Create(apiKey).Error; err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func GetTeamAPIKeys(ctx context.Context, teamID uint) ([]APIKey, error) {
+	apiKeys := []APIKey{}
+	err := database.DB.WithContext(ctx).Where("team_id = ?", teamID).Order("created_at").Find(&apiKeys).Error
+	return apiKeys, err
+}
+
+func RevokeAPIKey(ctx context.Context, teamID uint, id uint) error {
+	result := database.DB.WithContext(ctx).Model(&APIKey{}).
+		Where("team_id = ? AND id = ? AND revoked_at IS NULL", teamID, id).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidAPIKey
+	}
+	return nil
+}
+
+// creatorPermissions narrows the permissions of the key to those the creator
+// still has in the team, so a demoted creator demotes the key. It fails with
+// ErrAPIKeyRevoked once the creator left the team or was disabled.
+func creatorPermissions(tx *gorm.DB, apiKey APIKey) ([]string, error) {
+	var member TeamMember
+	err := tx.Preload("User").Where("team_id = ? AND user_id = ?", apiKey.TeamID, apiKey.CreatedBy).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAPIKeyRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+	if member.User == nil || member.User.ID == 0 || member.User.Disabled() {
+		return nil, ErrAPIKeyRevoked
+	}
+
+	granted := TeamRolePermissions[member.Role]
+	permissions := []string{}
+	for _, permission := range apiKey.Permissions {
+		if PermissionGranted(granted, permission) {
+			permissions = append(permissions, permission)
+		}
+	}
+	return permissions, nil
+}
+
+// revokeCreatorAPIKeys revokes the keys the user created for the team.
+func revokeCreatorAPIKeys(tx *gorm.DB, teamID uint, userID uint) error {
+	return tx.Model(&APIKey{}).
+		Where("team_id = ? AND created_by = ? AND revoked_at IS NULL", teamID, userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// UseAPIKey returns the API key matching the plain key and records its use.
+// The permissions of the returned key are those its creator still has.
+func UseAPIKey(ctx context.Context, key string) (APIKey, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	var apiKey APIKey
+	err := database.DB.WithContext(ctx).Where("key_hash = ?", HashToken(key)).First(&apiKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	if apiKey.RevokedAt != nil {
+		return APIKey{}, ErrAPIKeyRevoked
+	}
+	if apiKey.ExpiresAt != nil && time.Now().After(*apiKey.ExpiresAt) {
+		return APIKey{}, ErrAPIKeyExpired
+	}
+	if apiKey.Permissions, err = creatorPermissions(database.DB.WithContext(ctx), apiKey); err != nil {
+		return APIKey{}, err
+	}
+
+	now := time.Now()
+	if err := database.DB.WithContext(ctx).Model(&apiKey).UpdateColumns(map[string]interface{}{
+		"last_used_at": now,
+		"usage_count":  gorm.Expr("usage_count + 1"),
+	}).Error; err != nil {
+		return APIKey{}, err
+	}
+	apiKey.LastUsedAt = &now
+	apiKey.UsageCount++
+	return apiKey, nil
+}
@@ -0,0 +1,125 @@
+package models
+
+import (
+	"auth-service/database"
+	"context"
+	"strings"
+	"time"
+)
+
+// AuditOutcome tells whether the audited action was allowed.
+type AuditOutcome string
+
+const (
+	SuccessAuditOutcome AuditOutcome = "success"
+	FailureAuditOutcome AuditOutcome = "failure"
+)
+
+// Actor types of audit events.
+const (
+	UserAuditActor    = "user"
+	APIKeyAuditActor  = "api-key"
+	ServiceAuditActor = "service"
+)
+
+// AuditEvent is an entry of the audit log of security relevant actions, of
+// the auth service and of the services sending theirs over the message bus.
+// The log is append-only, the table refuses updates and deletes.
+type AuditEvent struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	OccurredAt time.Time `gorm:"not null;index;index:idx_audit_events_team_time,priority:2" json:"occurred_at"`
+	Event      string    `gorm:"not null;index" json:"event"`
+	// Service is the service the action happened in.
+	Service string `gorm:"not null" json:"service"`
+	// ActorID is the acting user, the creator for API keys. It is nil when
+	// unknown, like for a login with an unknown username, and for services.
+	ActorID   *uint  `gorm:"index" json:"actor_id,omitempty"`
+	ActorType string `json:"actor_type,omitempty"`
+	// TeamID is the team the action was done for, the active team of the
+	// user for logins and sessions.
+	TeamID     *uint                  `gorm:"index:idx_audit_events_team_time,priority:1" json:"team_id,omitempty"`
+	TargetType string                 `json:"target_type,omitempty"`
+	TargetID   string                 `json:"target_id,omitempty"`
+	IP         string                 `json:"ip,omitempty"`
+	UserAgent  string                 `json:"user_agent,omitempty"`
+	Outcome    AuditOutcome           `gorm:"not null" json:"outcome"`
+	Details    map[string]interface{} `gorm:"serializer:json;type:jsonb" json:"details,omitempty"`
+}
+
+// AuditQuery filters the audit events of a team, empty fields don't filter.
+type AuditQuery struct {
+	TeamID uint
+	From   time.Time
+	To     time.Time
+	// Event is an event name, or a prefix like "login.*".
+	Event    string
+	ActorID  *uint
+	Outcome  AuditOutcome
+	Page     int
+	PageSize int
+}
+
+// MigrateAuditLog makes the audit table append-only, even for the service
+// itself.
+func MigrateAuditLog() error {
+	for _, statement := range []string{
+		`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'the audit log is append-only';
+END;
+$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events`,
+		`CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+	FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only()`,
+	} {
+		if err := database.DB.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordAuditEvent appends the event to the audit log.
+func RecordAuditEvent(ctx context.Context, event *AuditEvent) error {
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+	if event.Outcome == "" {
+		event.Outcome = SuccessAuditOutcome
+	}
+	return database.DB.WithContext(ctx).Create(event).Error
+}
+
+// SearchAuditEvents returns a page of the events matching the query, the
+// most recent first, and the number of matching events.
+func SearchAuditEvents(ctx context.Context, query AuditQuery) ([]AuditEvent, int64, error) {
+	db := database.DB.WithContext(ctx).Model(&AuditEvent{}).Where("team_id = ?", query.TeamID)
+	if !query.From.IsZero() {
+		db = db.Where("occurred_at >= ?", query.From)
+	}
+	if !query.To.IsZero() {
+		db = db.Where("occurred_at < ?", query.To)
+	}
+	if prefix, ok := strings.CutSuffix(query.Event, "*"); ok {
+		db = db.Where("event LIKE ?", strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)+"%")
+	} else if query.Event != "" {
+		db = db.Where("event = ?", query.Event)
+	}
+	if query.ActorID != nil {
+		db = db.Where("actor_id = ?", *query.ActorID)
+	}
+	if query.Outcome != "" {
+		db = db.Where("outcome = ?", query.Outcome)
+	}
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	events := []AuditEvent{}
+	err := db.Order("occurred_at DESC, id DESC").Limit(query.PageSize).Offset((query.Page - 1) * query.PageSize).Find(&events).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
@@ -0,0 +1,314 @@
+package models
+
+import (
+	"auth-service/database"
+	"auth-service/totp"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	MFAChallengeTTL         = 5 * time.Minute
+	maxMFAChallengeAttempts = 5
+	recoveryCodeCount       = 10
+)
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrMFANotEnrolled    = errors.New("start the two-factor enrolment first")
+	ErrInvalidMFACode    = errors.New("invalid two-factor code")
+	ErrInvalidMFAToken   = errors.New("invalid or expired two-factor challenge, log in again")
+	ErrTeamRequiresMFA   = errors.New("a team you are a member of requires two-factor authentication")
+)
+
+// RecoveryCode replaces a TOTP code once, for users who lost their
+// authenticator. Only the hash of the code is stored.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint       `gorm:"not null;index" json:"user_id"`
+	CodeHash string     `gorm:"size:64;not null" json:"-"`
+	UsedAt   *time.Time `json:"used_at"`
+}
+
+// MFAChallenge is the second step of a login of a user with two-factor
+// authentication, the password was already checked. Only the hash of the
+// challenge token is stored.
+type MFAChallenge struct {
+	gorm.Model
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	TokenHash string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	Attempts  int        `gorm:"not null;default:0" json:"attempts"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+func recoveryCodeHash(userID uint, code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return HashToken(fmt.Sprintf("%d:%s", userID, code))
+}
+
+// replaceRecoveryCodes drops the recovery codes of the user and returns new
+// ones, formatted as xxxx-xxxx.
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+		if err := tx.Create(&RecoveryCode{UserID: userID, CodeHash: recoveryCodeHash(userID, code)}).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// lockUser reloads the user with its row locked until the end of tx.
+func lockUser(tx *gorm.DB, userID uint) (User, error) {
+	var user User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error
+	return user, err
+}
+
+// checkSecondFactor accepts a TOTP code, which can't be used twice, or an
+// unused recovery code of the user. The user row must be locked by tx.
+func checkSecondFactor(tx *gorm.DB, user User, code string) error {
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		if step <= user.TOTPLastStep {
+			return ErrInvalidMFACode
+		}
+		return tx.Model(&User{}).Where("id = ?", user.ID).Update("totp_last_step", step).Error
+	}
+
+	result := tx.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, recoveryCodeHash(user.ID, code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// StartTOTPEnrolment stores a new pending secret for the user, it is only
+// used once confirmed with a code.
+func StartTOTPEnrolment(ctx context.Context, user User) (string, error) {
+	if user.TOTPEnabled {
+		return "", ErrMFAAlreadyEnabled
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	result := database.DB.WithContext(ctx).Model(&User{}).
+		Where("id = ? AND totp_enabled = ?", user.ID, false).
+		Update("totp_secret", secret)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", ErrMFAAlreadyEnabled
+	}
+	return secret, nil
+}
+
+// ConfirmTOTPEnrolment enables two-factor authentication once the code
+// shows the authenticator has the secret, and returns the recovery codes.
+func ConfirmTOTPEnrolment(ctx context.Context, userID uint, code string) ([]string, error) {
+	var codes []string
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		if user.TOTPEnabled {
+			return ErrMFAAlreadyEnabled
+		}
+		if user.TOTPSecret == "" {
+			return ErrMFANotEnrolled
+		}
+		step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+		if !ok {
+			return ErrInvalidMFACode
+		}
+
+		if err := tx.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_last_step": step,
+		}).Error; err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	return codes, err
+}
+
+// DisableTOTP turns two-factor authentication off with a TOTP or recovery
+// code, unless a team of the user requires it.
+func DisableTOTP(ctx context.Context, userID uint, code string) error {
+	required, err := UserRequiresMFA(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if required {
+		return ErrTeamRequiresMFA
+	}
+
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		if !user.TOTPEnabled {
+			return ErrMFANotEnabled
+		}
+		if err := checkSecondFactor(tx, user, code); err != nil {
+			return err
+		}
+
+		if err := tx.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"totp_enabled":   false,
+			"totp_secret":    "",
+			"totp_last_step": 0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error
+	})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user after
+// checking a TOTP or recovery code.
+func RegenerateRecoveryCodes(ctx context.Context, userID uint, code string) ([]string, error) {
+	var codes []string
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		if !user.TOTPEnabled {
+			return ErrMFANotEnabled
+		}
+		if err := checkSecondFactor(tx, user, code); err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	return codes, err
+}
+
+// CreateMFAChallenge returns the token which, with a second factor, completes
+// the login of the user.
+func CreateMFAChallenge(ctx context.Context, userID uint) (string, error) {
+	token, err := RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = database.DB.WithContext(ctx).Create(&MFAChallenge{
+		UserID:    userID,
+		TokenHash: HashToken(token),
+		ExpiresAt: time.Now().Add(MFAChallengeTTL),
+	}).Error
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// CompleteMFAChallenge consumes the challenge when the code is a valid
+// second factor of its user. A challenge allows a few attempts only. The
+// user of the challenge is returned with ErrInvalidMFACode as well.
+func CompleteMFAChallenge(ctx context.Context, token string, code string) (User, error) {
+	var user User
+	mismatch := false
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var challenge MFAChallenge
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND used_at IS NULL", HashToken(token)).
+			First(&challenge).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidMFAToken
+		}
+		if err != nil {
+			return err
+		}
+		if time.Now().After(challenge.ExpiresAt) || challenge.Attempts >= maxMFAChallengeAttempts {
+			return ErrInvalidMFAToken
+		}
+
+		if user, err = lockUser(tx, challenge.UserID); err != nil {
+			return err
+		}
+		err = checkSecondFactor(tx, user, code)
+		if errors.Is(err, ErrInvalidMFACode) {
+			// commit the failed attempt, the error is returned afterwards
+			mismatch = true
+			return tx.Model(&challenge).Update("attempts", gorm.Expr("attempts + 1")).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&challenge).Update("used_at", time.Now()).Error
+	})
+	if err == nil && mismatch {
+		return user, ErrInvalidMFACode
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func TeamRequiresMFA(ctx context.Context, teamID uint) (bool, error) {
+	var team Team
+	if err := database.DB.WithContext(ctx).Select("require_mfa").First(&team, teamID).Error; err != nil {
+		return false, err
+	}
+	return team.RequireMFA, nil
+}
+
+// UserRequiresMFA reports whether a team the user is a member of requires
+// two-factor authentication.
+func UserRequiresMFA(ctx context.Context, userID uint) (bool, error) {
+	var count int64
+	err := database.DB.WithContext(ctx).Model(&TeamMember{}).
+		Joins("JOIN teams ON teams.id = team_members.team_id AND teams.deleted_at IS NULL").
+		Where("team_members.user_id = ? AND teams.require_mfa", userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func SetTeamRequireMFA(ctx context.Context, teamID uint, required bool) error {
+	return database.DB.WithContext(ctx).Model(&Team{}).Where("id = ?", teamID).Update("require_mfa", required).Error
+}
+
+// MFASatisfied reports whether the user may act for the team of the
+// membership, members of teams requiring two-factor authentication need it
+// enabled.
+func (member TeamMember) MFASatisfied(ctx context.Context, user User) (bool, error) {
+	if user.TOTPEnabled {
+		return true, nil
+	}
+	required, err := TeamRequiresMFA(ctx, member.TeamID)
+	return !required, err
+}
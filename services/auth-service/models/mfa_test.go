@@ -0,0 +1,92 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"auth-service/database"
+	"auth-service/totp"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCheckSecondFactor(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := totp.Step(time.Now())
+	code := func(step int64) string {
+		code, err := totp.Code(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		// the step stored as used, 0 when the code isn't a valid TOTP code
+		wantStep int64
+		// the code is looked up as a recovery code, found when true
+		wantRecovery  bool
+		recoveryFound bool
+		wantErr       error
+	}{
+		{name: "current code", code: code(current), lastStep: current - 5, wantStep: current},
+		{name: "code of the previous step", code: code(current - 1), lastStep: current - 5, wantStep: current - 1},
+		{name: "code of the next step", code: code(current + 1), lastStep: current - 5, wantStep: current + 1},
+		{name: "code with spaces", code: code(current)[:3] + " " + code(current)[3:], lastStep: current - 5, wantStep: current},
+		{name: "replayed code", code: code(current), lastStep: current, wantErr: ErrInvalidMFACode},
+		{name: "code older than the last one used", code: code(current - 1), lastStep: current, wantErr: ErrInvalidMFACode},
+		{name: "code outside the window", code: code(current - 2), wantRecovery: true, wantErr: ErrInvalidMFACode},
+		{name: "recovery code", code: "abcd-efgh", wantRecovery: true, recoveryFound: true},
+		{name: "used recovery code", code: "abcd-efgh", wantRecovery: true, wantErr: ErrInvalidMFACode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			if tt.wantStep != 0 {
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta(`UPDATE "users" SET "totp_last_step"=$1,"updated_at"=$2 WHERE id = $3`)).
+					WithArgs(tt.wantStep, sqlmock.AnyArg(), uint(7)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+			if tt.wantRecovery {
+				affected := int64(0)
+				if tt.recoveryFound {
+					affected = 1
+				}
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta(`UPDATE "recovery_codes" SET "used_at"=$1,"updated_at"=$2 WHERE (user_id = $3 AND code_hash = $4 AND used_at IS NULL)`)).
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), uint(7), recoveryCodeHash(7, tt.code)).
+					WillReturnResult(sqlmock.NewResult(0, affected))
+				mock.ExpectCommit()
+			}
+
+			user := User{TOTPSecret: secret, TOTPEnabled: true, TOTPLastStep: tt.lastStep}
+			user.ID = 7
+			if err := checkSecondFactor(database.DB, user, tt.code); !errors.Is(err, tt.wantErr) {
+				t.Errorf("checkSecondFactor() error = %v, want %v", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRecoveryCodeHash(t *testing.T) {
+	hash := recoveryCodeHash(7, "abcd-efgh")
+	if got := recoveryCodeHash(7, " ABCDEFGH "); got != hash {
+		t.Error("the recovery code hash depends on the case, dashes or spaces")
+	}
+	if got := recoveryCodeHash(8, "abcd-efgh"); got == hash {
+		t.Error("the same recovery code of another user has the same hash")
+	}
+}
@@ -0,0 +1,214 @@
+package models
+
+import (
+	"auth-service/database"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const OIDCLoginTTL = 10 * time.Minute
+
+var (
+	ErrInvalidOIDCState     = errors.New("invalid or expired login state, start the login again")
+	ErrExternalEmailMissing = errors.New("the identity provider didn't share an email address")
+	ErrAccountLinkRefused   = errors.New("an account with this email exists, both the identity provider and FormFlow must have verified the email to link them")
+)
+
+// ExternalIdentity links a user to its subject at an OpenID Connect
+// provider.
+type ExternalIdentity struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index" json:"user_id"`
+	Provider string `gorm:"size:64;not null;uniqueIndex:idx_provider_subject" json:"provider"`
+	Subject  string `gorm:"size:255;not null;uniqueIndex:idx_provider_subject" json:"subject"`
+	Email    string `gorm:"size:255" json:"email"`
+}
+
+// OIDCLoginState is a login started at a provider, kept until the provider
+// redirects back. Only the hash of the state is stored, the nonce and the
+// PKCE verifier never leave the service.
+type OIDCLoginState struct {
+	gorm.Model
+	StateHash    string    `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Provider     string    `gorm:"size:64;not null" json:"provider"`
+	Nonce        string    `gorm:"size:64;not null" json:"-"`
+	CodeVerifier string    `gorm:"size:128;not null" json:"-"`
+	ExpiresAt    time.Time `gorm:"not null" json:"expires_at"`
+}
+
+// ExternalClaims are the claims of a verified ID token used to find or
+// provision the user.
+type ExternalClaims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+// ExternalLogin tells how the user of an external login was found.
+type ExternalLogin string
+
+const (
+	// ExistingExternalLogin is a subject which signed in before.
+	ExistingExternalLogin ExternalLogin = "existing"
+	// LinkedExternalLogin is a subject linked to the user with its email.
+	LinkedExternalLogin ExternalLogin = "linked"
+	// CreatedExternalLogin is a subject for which a user was created.
+	CreatedExternalLogin ExternalLogin = "created"
+)
+
+// CreateOIDCLoginState returns the state to send to the provider.
+func CreateOIDCLoginState(ctx context.Context, provider string, nonce string, codeVerifier string) (string, error) {
+	state, err := RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = database.DB.WithContext(ctx).Create(&OIDCLoginState{
+		StateHash:    HashToken(state),
+		Provider:     provider,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		ExpiresAt:    time.Now().Add(OIDCLoginTTL),
+	}).Error
+	if err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+// ConsumeOIDCLoginState returns the login of the state and deletes it, a
+// state can be used once.
+func ConsumeOIDCLoginState(ctx context.Context, provider string, state string) (OIDCLoginState, error) {
+	var login OIDCLoginState
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("state_hash = ? AND provider = ?", HashToken(state), provider).
+			First(&login).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidOIDCState
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(&login).Error; err != nil {
+			return err
+		}
+		if time.Now().After(login.ExpiresAt) {
+			return ErrInvalidOIDCState
+		}
+		return nil
+	})
+	if err != nil {
+		return OIDCLoginState{}, err
+	}
+	return login, nil
+}
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// externalUsername returns a free username derived from the claims.
+func externalUsername(tx *gorm.DB, claims ExternalClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = strings.Trim(usernameInvalidChars.ReplaceAllString(strings.ToLower(base), "_"), "_")
+	if base == "" {
+		base = "user"
+	}
+
+	username := base
+	for i := 0; i < 5; i++ {
+		var count int64
+		if err := tx.Unscoped().Model(&User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return username, nil
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+		username = fmt.Sprintf("%s%04d", base, n.Int64())
+	}
+	return "", errors.New("no free username found")
+}
+
+// ProvisionExternalUser returns the user linked to the subject at the
+// provider. Unknown subjects are linked to the user with the same email when
+// both sides verified it, otherwise a user is created.
+func ProvisionExternalUser(ctx context.Context, provider string, claims ExternalClaims) (user User, login ExternalLogin, err error) {
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var identity ExternalIdentity
+		err := tx.Where("provider = ? AND subject = ?", provider, claims.Subject).First(&identity).Error
+		if err == nil {
+			login = ExistingExternalLogin
+			return tx.First(&user, identity.UserID).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		email := strings.TrimSpace(claims.Email)
+		if email == "" {
+			return ErrExternalEmailMissing
+		}
+		err = tx.Where("lower(email) = lower(?)", email).First(&user).Error
+		if err == nil {
+			// an unverified email could have been registered by anyone
+			if !claims.EmailVerified || !user.EmailVerified {
+				return ErrAccountLinkRefused
+			}
+			login = LinkedExternalLogin
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			username, err := externalUsername(tx, claims)
+			if err != nil {
+				return err
+			}
+			// the account has no usable password until one is reset
+			secret, err := RandomToken(32)
+			if err != nil {
+				return err
+			}
+			passwordHash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+			if err != nil {
+				return err
+			}
+			user = User{
+				Role:          UserUserRole,
+				Username:      username,
+				Email:         email,
+				Password:      string(passwordHash),
+				EmailVerified: claims.EmailVerified,
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			login = CreatedExternalLogin
+		} else {
+			return err
+		}
+
+		return tx.Create(&ExternalIdentity{
+			UserID:   user.ID,
+			Provider: provider,
+			Subject:  claims.Subject,
+			Email:    email,
+		}).Error
+	})
+	if err != nil {
+		return User{}, "", err
+	}
+	return user, login, nil
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestConsumeOIDCLoginState(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		found     bool
+		wantErr   error
+	}{
+		{name: "valid", expiresAt: time.Now().Add(OIDCLoginTTL), found: true},
+		// the state is of another provider or was already used
+		{name: "unknown", wantErr: ErrInvalidOIDCState},
+		{name: "expired", expiresAt: time.Now().Add(-time.Second), found: true, wantErr: ErrInvalidOIDCState},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectBegin()
+			rows := sqlmock.NewRows([]string{"id", "state_hash", "provider", "nonce", "code_verifier", "expires_at"})
+			if tt.found {
+				rows.AddRow(3, HashToken("state"), "google", "nonce", "verifier", tt.expiresAt)
+			}
+			mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "o_id_c_login_states" WHERE (state_hash = $1 AND provider = $2)`)+`.* FOR UPDATE`).
+				WithArgs(HashToken("state"), "google").
+				WillReturnRows(rows)
+			if tt.found {
+				// a state is single use
+				mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "o_id_c_login_states" WHERE "o_id_c_login_states"."id" = $1`)).
+					WithArgs(uint(3)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			if tt.wantErr != nil {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectCommit()
+			}
+
+			login, err := ConsumeOIDCLoginState(context.Background(), "google", "state")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ConsumeOIDCLoginState() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (login.Nonce != "nonce" || login.CodeVerifier != "verifier") {
+				t.Errorf("ConsumeOIDCLoginState() = %+v, want the nonce and code verifier of the login", login)
+			}
+			if tt.wantErr != nil && login.Nonce != "" {
+				t.Errorf("ConsumeOIDCLoginState() returned the nonce of a refused state")
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
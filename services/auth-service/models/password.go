@@ -0,0 +1,229 @@
+package models
+
+import (
+	"auth-service/database"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	PasswordResetTTL     = time.Hour
+	passwordResetDelay   = time.Minute
+	bcryptMaxPasswordLen = 72
+)
+
+var (
+	ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+	// ErrBreachedListUnavailable is returned by LoadPasswordPolicy when the
+	// breached password list can't be read, the rest of the policy applies.
+	ErrBreachedListUnavailable = errors.New("breached password list unavailable")
+)
+
+// PasswordPolicyError tells why a password was refused.
+type PasswordPolicyError struct {
+	Reason string
+}
+
+func (e PasswordPolicyError) Error() string {
+	return "password " + e.Reason
+}
+
+// PasswordPolicy is checked whenever a password is set. Breached holds
+// known leaked passwords, compared case insensitively.
+type PasswordPolicy struct {
+	MinLength int
+	Breached  map[string]bool
+}
+
+var Policy = PasswordPolicy{MinLength: 8, Breached: map[string]bool{}}
+
+// LoadPasswordPolicy reads PASSWORD_MIN_LENGTH and the breached password
+// list from the file at PASSWORD_BREACHED_LIST, one password per line.
+func LoadPasswordPolicy() error {
+	if value := os.Getenv("PASSWORD_MIN_LENGTH"); value != "" {
+		minLength, err := strconv.Atoi(value)
+		if err != nil || minLength < 1 || minLength > bcryptMaxPasswordLen {
+			return fmt.Errorf("PASSWORD_MIN_LENGTH must be between 1 and %d", bcryptMaxPasswordLen)
+		}
+		Policy.MinLength = minLength
+	}
+
+	path := os.Getenv("PASSWORD_BREACHED_LIST")
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBreachedListUnavailable, err)
+	}
+	defer file.Close()
+
+	breached := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); password != "" {
+			breached[strings.ToLower(password)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrBreachedListUnavailable, err)
+	}
+	Policy.Breached = breached
+	return nil
+}
+
+// Check returns a PasswordPolicyError when the password of the user isn't
+// acceptable.
+func (policy PasswordPolicy) Check(password string, user User) error {
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		return PasswordPolicyError{Reason: fmt.Sprintf("must be at least %d characters long", policy.MinLength)}
+	}
+	if len(password) > bcryptMaxPasswordLen {
+		return PasswordPolicyError{Reason: fmt.Sprintf("must be at most %d bytes long", bcryptMaxPasswordLen)}
+	}
+	lower := strings.ToLower(password)
+	if policy.Breached[lower] {
+		return PasswordPolicyError{Reason: "appears in a list of breached passwords, choose another one"}
+	}
+	if (user.Username != "" && lower == strings.ToLower(user.Username)) || (user.Email != "" && lower == strings.ToLower(user.Email)) {
+		return PasswordPolicyError{Reason: "must not be the username or email"}
+	}
+	return nil
+}
+
+// PasswordResetToken lets a user who forgot the password set a new one. It
+// can be used once, only its hash is stored.
+type PasswordResetToken struct {
+	gorm.Model
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	TokenHash string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+// setPassword stores the new password of the user and signs out every
+// session by revoking the refresh tokens. Pending reset tokens stop working.
+func setPassword(tx *gorm.DB, user User, password string) error {
+	if err := Policy.Check(password, user); err != nil {
+		return err
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Model(&User{}).Where("id = ?", user.ID).Update("password", string(passwordHash)).Error; err != nil {
+		return err
+	}
+	if err := revokeUserSessions(tx, user.ID); err != nil {
+		return err
+	}
+	return tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&PasswordResetToken{}).Error
+}
+
+// ChangePassword sets a new password once the current one is confirmed.
+func (user *User) ChangePassword(ctx context.Context, current string, password string) error {
+	if err := user.CheckPassword(current); err != nil {
+		return err
+	}
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return setPassword(tx, *user, password)
+	})
+}
+
+// CreatePasswordResetToken returns a new reset token for the user, earlier
+// tokens stop working. It returns an empty token when one was created less
+// than a minute ago, so the inbox of the user can't be flooded.
+func CreatePasswordResetToken(ctx context.Context, user User) (string, error) {
+	token, err := RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	created := false
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// serialise requests of the same user
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&User{}, user.ID).Error; err != nil {
+			return err
+		}
+
+		var recent int64
+		if err := tx.Unscoped().Model(&PasswordResetToken{}).
+			Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-passwordResetDelay)).
+			Count(&recent).Error; err != nil {
+			return err
+		}
+		if recent > 0 {
+			return nil
+		}
+
+		if err := tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		created = true
+		return tx.Create(&PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: HashToken(token),
+			ExpiresAt: time.Now().Add(PasswordResetTTL),
+		}).Error
+	})
+	if err != nil || !created {
+		return "", err
+	}
+	return token, nil
+}
+
+// ResetPassword consumes the reset token and sets the new password of its
+// user.
+func ResetPassword(ctx context.Context, token string, password string) (User, error) {
+	var user User
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var resetToken PasswordResetToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND used_at IS NULL", HashToken(token)).
+			First(&resetToken).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidResetToken
+		}
+		if err != nil {
+			return err
+		}
+		if time.Now().After(resetToken.ExpiresAt) {
+			return ErrInvalidResetToken
+		}
+
+		if err := tx.Model(&resetToken).Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		if err := tx.First(&user, resetToken.UserID).Error; err != nil {
+			return err
+		}
+		return setPassword(tx, user, password)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// GetUserByEmail returns the user with the email, ID is 0 when there is
+// none.
+func GetUserByEmail(ctx context.Context, email string) (User, error) {
+	var user User
+	err := database.DB.WithContext(ctx).Where("lower(email) = lower(?)", strings.TrimSpace(email)).Find(&user).Error
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"sort"
+	"strings"
+)
+
+// Permissions carried in the access tokens. The services behind the gateway
+// check them with their copy of the permission package.
+const (
+	FormCreatePermission        = "form:create"
+	FormReadPermission          = "form:read"
+	FormUpdatePermission        = "form:update"
+	ResponsesSubmitPermission   = "responses:submit"
+	ResponsesReadPermission     = "responses:read"
+	ResponsesReadOwnPermission  = "responses:read:own"
+	ResponsesExportPermission   = "responses:export"
+	ResponsesImportPermission   = "responses:import"
+	ResponsesReviewPermission   = "responses:review"
+	KeysRotatePermission        = "keys:rotate"
+	PluginsReadPermission       = "plugins:read"
+	PluginsConfigurePermission  = "plugins:configure"
+	PluginsAllActionsPermission = "plugins:action:*"
+	TeamReadPermission          = "team:read"
+	TeamManagePermission        = "team:manage"
+	APIKeysManagePermission     = "api-keys:manage"
+	UsersReadPermission         = "users:read"
+	UsersManagePermission       = "users:manage"
+	AuditReadPermission         = "audit:read"
+)
+
+// UserRolePermissions are granted by the account role, whatever the team.
+var UserRolePermissions = map[UserRole][]string{
+	UserUserRole: {FormReadPermission, ResponsesSubmitPermission, ResponsesReadOwnPermission},
+	TeamUserRole: {},
+	AdminUserRole: {FormReadPermission, ResponsesSubmitPermission, ResponsesReadOwnPermission,
+		UsersReadPermission, UsersManagePermission},
+}
+
+// TeamRolePermissions are granted by the role in the active team and only
+// apply to that team. Each role has the permissions of the roles below it.
+var TeamRolePermissions = map[TeamRole][]string{}
+
+func init() {
+	viewer := []string{FormReadPermission, ResponsesReadPermission, PluginsReadPermission, TeamReadPermission}
+	editor := append(append([]string{}, viewer...),
+		FormCreatePermission, FormUpdatePermission, ResponsesExportPermission, ResponsesImportPermission,
+		ResponsesReviewPermission, PluginsAllActionsPermission)
+	admin := append(append([]string{}, editor...), PluginsConfigurePermission, KeysRotatePermission, TeamManagePermission, APIKeysManagePermission,
+		AuditReadPermission)
+
+	TeamRolePermissions[ViewerTeamRole] = viewer
+	TeamRolePermissions[EditorTeamRole] = editor
+	TeamRolePermissions[AdminTeamRole] = admin
+	TeamRolePermissions[OwnerTeamRole] = admin
+}
+
+// HasPermission reports whether the team role grants the permission.
+func (role TeamRole) HasPermission(permission string) bool {
+	return PermissionGranted(TeamRolePermissions[role], permission)
+}
+
+// UserPermissions returns the permissions of the user acting for the team
+// of the membership, member is nil when the user has no team.
+func UserPermissions(user User, member *TeamMember) []string {
+	set := map[string]bool{}
+	for _, permission := range UserRolePermissions[user.Role] {
+		set[permission] = true
+	}
+	if member != nil {
+		for _, permission := range TeamRolePermissions[member.Role] {
+			set[permission] = true
+		}
+	}
+
+	permissions := make([]string, 0, len(set))
+	for permission := range set {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+// PermissionGranted reports whether the granted permissions include the
+// permission, "plugins:action:*" includes every plugin action.
+func PermissionGranted(granted []string, permission string) bool {
+	for _, g := range granted {
+		if g == permission {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(g, "*"); ok && strings.HasSuffix(prefix, ":") && strings.HasPrefix(permission, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"auth-service/database"
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a login of a user on a device, the family of refresh tokens
+// started by the login. Its ID is the family ID, access tokens carry it as
+// the sid claim and stop working once it is revoked.
+type Session struct {
+	ID         string     `gorm:"primaryKey;size:64" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"-"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `gorm:"size:64" json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `gorm:"not null" json:"last_seen_at"`
+	ExpiresAt  time.Time  `gorm:"not null;index" json:"expires_at"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+// touchSession records a use of the session from the device, the session is
+// created on the first use. Families started before sessions were tracked
+// get theirs on the next refresh.
+func touchSession(tx *gorm.DB, session Session) error {
+	session.LastSeenAt = time.Now()
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_agent", "ip", "last_seen_at", "expires_at"}),
+	}).Create(&session).Error
+}
+
+// StartSession issues the first refresh token of a new session of the user
+// on the device.
+func StartSession(ctx context.Context, userID uint, userAgent string, ip string, ttl time.Duration) (string, *RefreshToken, error) {
+	var token string
+	var refreshToken *RefreshToken
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if token, refreshToken, err = CreateRefreshToken(tx, userID, "", ttl); err != nil {
+			return err
+		}
+		return touchSession(tx, Session{
+			ID:        refreshToken.FamilyID,
+			UserID:    userID,
+			UserAgent: userAgent,
+			IP:        ip,
+			ExpiresAt: refreshToken.ExpiresAt,
+		})
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, refreshToken, nil
+}
+
+// ContinueSession issues a new refresh token of the session of the user and
+// revokes the unused earlier ones, for tokens issued again without signing
+// in, like on a switch of the active team. It fails with ErrSessionNotFound
+// when the session is signed out or expired.
+func ContinueSession(ctx context.Context, userID uint, id string, userAgent string, ip string, ttl time.Duration) (string, *RefreshToken, error) {
+	var token string
+	var refreshToken *RefreshToken
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var session Session
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?", id, userID, time.Now()).
+			First(&session).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&RefreshToken{}).
+			Where("family_id = ? AND used_at IS NULL AND revoked_at IS NULL", id).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		if token, refreshToken, err = CreateRefreshToken(tx, userID, id, ttl); err != nil {
+			return err
+		}
+		session.UserAgent = userAgent
+		session.IP = ip
+		session.ExpiresAt = refreshToken.ExpiresAt
+		return touchSession(tx, session)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, refreshToken, nil
+}
+
+// GetUserSessions returns the sessions of the user which aren't revoked or
+// expired, the most recently used first.
+func GetUserSessions(ctx context.Context, userID uint) ([]Session, error) {
+	sessions := []Session{}
+	err := database.DB.WithContext(ctx).Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").Find(&sessions).Error
+	return sessions, err
+}
+
+// RevokeSession signs the session of the user out.
+func RevokeSession(ctx context.Context, userID uint, id string) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Session{}).
+			Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrSessionNotFound
+		}
+		return tx.Model(&RefreshToken{}).
+			Where("family_id = ? AND revoked_at IS NULL", id).
+			Update("revoked_at", time.Now()).Error
+	})
+}
+
+// RevokeOtherSessions signs out every session of the user but the current
+// one, and returns the IDs of the revoked sessions.
+func RevokeOtherSessions(ctx context.Context, userID uint, currentID string) ([]string, error) {
+	var revoked []string
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&Session{}).
+			Where("user_id = ? AND id <> ? AND revoked_at IS NULL AND expires_at > ?", userID, currentID, now).
+			Pluck("id", &revoked).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Session{}).
+			Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, currentID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&RefreshToken{}).
+			Where("user_id = ? AND family_id <> ? AND revoked_at IS NULL", userID, currentID).
+			Update("revoked_at", now).Error
+	})
+	return revoked, err
+}
+
+// revokeUserSessions signs out every session of the user.
+func revokeUserSessions(tx *gorm.DB, userID uint) error {
+	now := time.Now()
+	if err := tx.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	return tx.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", now).Error
+}
+
+// IsSessionRevoked tells whether the session was signed out. Unknown
+// sessions aren't revoked, they predate session tracking.
+func IsSessionRevoked(ctx context.Context, id string) (bool, error) {
+	var count int64
+	if err := database.DB.WithContext(ctx).Model(&Session{}).Where("id = ? AND revoked_at IS NOT NULL", id).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
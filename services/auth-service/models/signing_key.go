@@ -0,0 +1,64 @@
+package models
+
+import (
+	"auth-service/database"
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SigningKey is a private key used to sign access tokens. The newest key
+// which isn't retired signs new tokens, retired keys keep verifying tokens
+// and stay published in the JWKS until they expire.
+type SigningKey struct {
+	Kid        string     `gorm:"primaryKey;size:64" json:"kid"`
+	Algorithm  string     `gorm:"size:16;not null" json:"alg"`
+	PrivateKey string     `gorm:"type:text;not null" json:"-"` // PKCS #8 PEM
+	CreatedAt  time.Time  `json:"created_at"`
+	RetiredAt  *time.Time `json:"retired_at"`
+	ExpiresAt  *time.Time `gorm:"index" json:"expires_at"`
+}
+
+// GetPublishedSigningKeys returns the keys which are not expired, newest first.
+func GetPublishedSigningKeys(ctx context.Context) ([]SigningKey, error) {
+	var keys []SigningKey
+	err := database.DB.WithContext(ctx).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Order("created_at desc").
+		Find(&keys).Error
+	return keys, err
+}
+
+// ReplaceActiveSigningKey retires the active keys and stores the new one.
+// The advisory lock keeps concurrent replicas from rotating at the same time,
+// rotated is false if another replica holds it.
+func ReplaceActiveSigningKey(ctx context.Context, key *SigningKey, overlap time.Duration) (rotated bool, err error) {
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(hashtext('signing_keys'))").Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+
+		now := time.Now()
+		expiresAt := now.Add(overlap)
+		if err := tx.Model(&SigningKey{}).
+			Where("retired_at IS NULL").
+			Updates(map[string]interface{}{"retired_at": now, "expires_at": expiresAt}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(key).Error; err != nil {
+			return err
+		}
+		rotated = true
+		return nil
+	})
+	return rotated, err
+}
+
+func DeleteExpiredSigningKeys() error {
+	return database.DB.Where("expires_at < ?", time.Now()).Delete(&SigningKey{}).Error
+}
@@ -0,0 +1,290 @@
+package models
+
+import (
+	"auth-service/database"
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type TeamRole string
+
+const (
+	OwnerTeamRole  TeamRole = "owner"
+	AdminTeamRole  TeamRole = "admin"
+	EditorTeamRole TeamRole = "editor"
+	ViewerTeamRole TeamRole = "viewer"
+)
+
+func (role TeamRole) Valid() bool {
+	_, ok := TeamRolePermissions[role]
+	return ok
+}
+
+var (
+	ErrNotTeamMember     = errors.New("you are not a member of this team")
+	ErrLastTeamOwner     = errors.New("a team needs at least one owner")
+	ErrInvalidInvitation = errors.New("invalid or expired invitation")
+	ErrEmailNotVerified  = errors.New("verify your email before accepting the invitation")
+)
+
+// Team is the organisation owning forms and plugins. Form.TeamID and the
+// team_id of events are team IDs.
+type Team struct {
+	gorm.Model
+	Name string `gorm:"size:255;not null" json:"name"`
+	// RequireMFA keeps members without two-factor authentication from
+	// acting for the team.
+	RequireMFA bool         `gorm:"not null;default:false" json:"require_mfa"`
+	Members    []TeamMember `json:"members,omitempty"`
+}
+
+type TeamMember struct {
+	gorm.Model
+	TeamID uint     `gorm:"not null;uniqueIndex:idx_team_member" json:"team_id"`
+	UserID uint     `gorm:"not null;uniqueIndex:idx_team_member;index" json:"user_id"`
+	Role   TeamRole `gorm:"size:16;not null" json:"role"`
+	Team   *Team    `json:"team,omitempty"`
+	User   *User    `json:"user,omitempty"`
+}
+
+// TeamInvitation lets the user with the invited email join the team. Only
+// the hash of the invitation token is stored.
+type TeamInvitation struct {
+	gorm.Model
+	TeamID     uint       `gorm:"not null;index" json:"team_id"`
+	Email      string     `gorm:"size:255;not null" json:"email"`
+	Role       TeamRole   `gorm:"size:16;not null" json:"role"`
+	TokenHash  string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	InvitedBy  uint       `gorm:"not null" json:"invited_by"`
+	ExpiresAt  time.Time  `gorm:"not null" json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at"`
+}
+
+// MigrateLegacyTeams turns every team account without a team into a team
+// with the same ID owned by the account, so existing form and plugin team
+// IDs keep pointing at the right team.
+func MigrateLegacyTeams() error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`WITH legacy AS (
+				INSERT INTO teams (id, created_at, updated_at, name)
+				SELECT u.id, NOW(), NOW(), u.username FROM users u
+				WHERE u.role = 'team' AND u.deleted_at IS NULL AND u.active_team_id IS NULL
+				AND NOT EXISTS (SELECT 1 FROM team_members m WHERE m.user_id = u.id)
+				ON CONFLICT (id) DO NOTHING
+				RETURNING id
+			), members AS (
+				INSERT INTO team_members (created_at, updated_at, team_id, user_id, role)
+				SELECT NOW(), NOW(), id, id, 'owner' FROM legacy
+			)
+			UPDATE users SET active_team_id = id WHERE id IN (SELECT id FROM legacy)`).Error; err != nil {
+			return err
+		}
+		// new teams must not reuse the IDs taken over from team accounts
+		return tx.Exec(`SELECT setval(pg_get_serial_sequence('teams', 'id'),
+			GREATEST((SELECT COALESCE(MAX(id), 0) FROM teams), (SELECT COALESCE(MAX(id), 0) FROM users), 1))`).Error
+	})
+}
+
+// CreateTeam creates a team owned by the user and makes it the active team
+// of the user.
+func CreateTeam(tx *gorm.DB, name string, owner *User) (*Team, error) {
+	team := &Team{Name: strings.TrimSpace(name)}
+	if err := tx.Create(team).Error; err != nil {
+		return nil, err
+	}
+	member := TeamMember{TeamID: team.ID, UserID: owner.ID, Role: OwnerTeamRole}
+	if err := tx.Create(&member).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(owner).Update("active_team_id", team.ID).Error; err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+func GetMembership(ctx context.Context, teamID uint, userID uint) (TeamMember, error) {
+	var member TeamMember
+	err := database.DB.WithContext(ctx).Where("team_id = ? AND user_id = ?", teamID, userID).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return TeamMember{}, ErrNotTeamMember
+	}
+	return member, err
+}
+
+// GetActiveMembership returns the membership of the active team of the user,
+// falling back to the oldest membership when the user left the active team.
+// It returns nil when the user isn't a member of any team.
+func GetActiveMembership(ctx context.Context, user User) (*TeamMember, error) {
+	if user.ActiveTeamID != nil {
+		member, err := GetMembership(ctx, *user.ActiveTeamID, user.ID)
+		if err == nil {
+			return &member, nil
+		}
+		if !errors.Is(err, ErrNotTeamMember) {
+			return nil, err
+		}
+	}
+
+	var member TeamMember
+	err := database.DB.WithContext(ctx).Where("user_id = ?", user.ID).Order("created_at").First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func GetUserMemberships(ctx context.Context, userID uint) ([]TeamMember, error) {
+	members := []TeamMember{}
+	err := database.DB.WithContext(ctx).Preload("Team").Where("user_id = ?", userID).Order("created_at").Find(&members).Error
+	return members, err
+}
+
+func GetTeamMembers(ctx context.Context, teamID uint) ([]TeamMember, error) {
+	members := []TeamMember{}
+	err := database.DB.WithContext(ctx).Preload("User").Where("team_id = ?", teamID).Order("created_at").Find(&members).Error
+	return members, err
+}
+
+// checkOwnerLeft fails when the team would be left without an owner.
+func checkOwnerLeft(tx *gorm.DB, teamID uint, userID uint) error {
+	var owners int64
+	if err := tx.Model(&TeamMember{}).
+		Where("team_id = ? AND user_id <> ? AND role = ?", teamID, userID, OwnerTeamRole).
+		Count(&owners).Error; err != nil {
+		return err
+	}
+	if owners == 0 {
+		return ErrLastTeamOwner
+	}
+	return nil
+}
+
+func UpdateMemberRole(ctx context.Context, teamID uint, userID uint, role TeamRole) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var member TeamMember
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("team_id = ? AND user_id = ?", teamID, userID).First(&member).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotTeamMember
+		}
+		if err != nil {
+			return err
+		}
+		if member.Role == OwnerTeamRole && role != OwnerTeamRole {
+			if err := checkOwnerLeft(tx, teamID, userID); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&member).Update("role", role).Error
+	})
+}
+
+// RemoveMember removes the user from the team and revokes the API keys they
+// created for it.
+func RemoveMember(ctx context.Context, teamID uint, userID uint) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var member TeamMember
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("team_id = ? AND user_id = ?", teamID, userID).First(&member).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotTeamMember
+		}
+		if err != nil {
+			return err
+		}
+		if member.Role == OwnerTeamRole {
+			if err := checkOwnerLeft(tx, teamID, userID); err != nil {
+				return err
+			}
+		}
+		if err := revokeCreatorAPIKeys(tx, teamID, userID); err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&member).Error
+	})
+}
+
+// CreateInvitation returns the plain invitation token, it can't be recovered
+// later.
+func CreateInvitation(ctx context.Context, teamID uint, email string, role TeamRole, invitedBy uint, ttl time.Duration) (string, *TeamInvitation, error) {
+	token, err := RandomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	invitation := &TeamInvitation{
+		TeamID:    teamID,
+		Email:     strings.ToLower(strings.TrimSpace(email)),
+		Role:      role,
+		TokenHash: HashToken(token),
+		InvitedBy: invitedBy,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := database.DB.WithContext(ctx).Create(invitation).Error; err != nil {
+		return "", nil, err
+	}
+	return token, invitation, nil
+}
+
+func GetTeamInvitations(ctx context.Context, teamID uint) ([]TeamInvitation, error) {
+	invitations := []TeamInvitation{}
+	err := database.DB.WithContext(ctx).Where("team_id = ? AND accepted_at IS NULL AND expires_at > ?", teamID, time.Now()).
+		Order("created_at").Find(&invitations).Error
+	return invitations, err
+}
+
+func DeleteInvitation(ctx context.Context, teamID uint, invitationID uint) error {
+	return database.DB.WithContext(ctx).Where("team_id = ? AND id = ?", teamID, invitationID).Delete(&TeamInvitation{}).Error
+}
+
+// AcceptInvitation adds the user to the team of the invitation. The email of
+// the user must match the invited email and be verified.
+func AcceptInvitation(ctx context.Context, token string, user User) (*TeamMember, error) {
+	if !user.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+
+	var member TeamMember
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var invitation TeamInvitation
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("token_hash = ?", HashToken(token)).First(&invitation).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidInvitation
+		}
+		if err != nil {
+			return err
+		}
+		if invitation.AcceptedAt != nil || time.Now().After(invitation.ExpiresAt) ||
+			!strings.EqualFold(invitation.Email, strings.TrimSpace(user.Email)) {
+			return ErrInvalidInvitation
+		}
+
+		// existing members keep their role
+		err = tx.Where("team_id = ? AND user_id = ?", invitation.TeamID, user.ID).First(&member).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			member = TeamMember{TeamID: invitation.TeamID, UserID: user.ID, Role: invitation.Role}
+			err = tx.Create(&member).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&invitation).Update("accepted_at", time.Now()).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func SetActiveTeam(ctx context.Context, user *User, teamID uint) error {
+	if _, err := GetMembership(ctx, teamID, user.ID); err != nil {
+		return err
+	}
+	user.ActiveTeamID = &teamID
+	return database.DB.WithContext(ctx).Model(user).Update("active_team_id", teamID).Error
+}
@@ -0,0 +1,211 @@
+package models
+
+import (
+	"auth-service/database"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected, all sessions of this login are revoked")
+	ErrRefreshTokenRevoked = errors.New("refresh token revoked, the session was signed out")
+)
+
+// RefreshToken is a single use token, each use rotates it to a new token of
+// the same family. Only the hash of the token is stored.
+type RefreshToken struct {
+	gorm.Model
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	FamilyID  string     `gorm:"size:64;not null;index" json:"family_id"`
+	TokenHash string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+// RevokedToken is an access token revoked before its expiry. Entries can be
+// dropped once the token would have expired anyway.
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey;size:64" json:"jti"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RandomToken returns a url safe random string of n random bytes.
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateRefreshToken issues a refresh token of the given family, a new
+// family is started when familyID is empty.
+func CreateRefreshToken(tx *gorm.DB, userID uint, familyID string, ttl time.Duration) (string, *RefreshToken, error) {
+	var err error
+	if familyID == "" {
+		if familyID, err = RandomToken(16); err != nil {
+			return "", nil, err
+		}
+	}
+	token, err := RandomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	refreshToken := &RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: HashToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := tx.Create(refreshToken).Error; err != nil {
+		return "", nil, err
+	}
+	return token, refreshToken, nil
+}
+
+// RotateRefreshToken consumes a refresh token and issues the next one of its
+// family, the session is seen from the device. Presenting a token that was
+// already used revokes the whole family, as it means the token leaked.
+func RotateRefreshToken(ctx context.Context, token string, ttl time.Duration, userAgent string, ip string) (string, *RefreshToken, error) {
+	var newToken string
+	var newRefreshToken *RefreshToken
+	var reused *RefreshToken
+
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var refreshToken RefreshToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("token_hash = ?", HashToken(token)).First(&refreshToken).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+
+		if refreshToken.UsedAt != nil {
+			reused = &refreshToken
+			return ErrRefreshTokenReused
+		}
+		if refreshToken.RevokedAt != nil {
+			return ErrRefreshTokenRevoked
+		}
+		if time.Now().After(refreshToken.ExpiresAt) {
+			return ErrRefreshTokenExpired
+		}
+
+		now := time.Now()
+		if err := tx.Model(&refreshToken).Update("used_at", now).Error; err != nil {
+			return err
+		}
+
+		newToken, newRefreshToken, err = CreateRefreshToken(tx, refreshToken.UserID, refreshToken.FamilyID, ttl)
+		if err != nil {
+			return err
+		}
+		return touchSession(tx, Session{
+			ID:        refreshToken.FamilyID,
+			UserID:    refreshToken.UserID,
+			UserAgent: userAgent,
+			IP:        ip,
+			ExpiresAt: newRefreshToken.ExpiresAt,
+		})
+	})
+
+	if reused != nil {
+		if revokeErr := RevokeTokenFamily(ctx, reused.FamilyID); revokeErr != nil {
+			return "", reused, revokeErr
+		}
+		return "", reused, err
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return newToken, newRefreshToken, nil
+}
+
+// GetRefreshToken returns the stored refresh token matching a plain token.
+func GetRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	var refreshToken RefreshToken
+	err := database.DB.WithContext(ctx).Where("token_hash = ?", HashToken(token)).First(&refreshToken).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return RefreshToken{}, ErrInvalidRefreshToken
+	}
+	return refreshToken, err
+}
+
+// RevokeTokenFamily signs out the session of the family.
+func RevokeTokenFamily(ctx context.Context, familyID string) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&Session{}).
+			Where("id = ? AND revoked_at IS NULL", familyID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&RefreshToken{}).
+			Where("family_id = ? AND revoked_at IS NULL", familyID).
+			Update("revoked_at", now).Error
+	})
+}
+
+func RevokeUserRefreshTokens(ctx context.Context, userID uint) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return revokeUserSessions(tx, userID)
+	})
+}
+
+// RevokeToken adds an access token to the revocation list.
+func RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	return database.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&RevokedToken{
+		JTI:       jti,
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+func IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var count int64
+	if err := database.DB.WithContext(ctx).Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// DeleteExpiredTokens drops revocation entries, password reset tokens, MFA
+// challenges, refresh tokens and sessions which are past their expiry and
+// can no longer be used.
+func DeleteExpiredTokens() error {
+	now := time.Now()
+	if err := database.DB.Where("expires_at < ?", now).Delete(&RevokedToken{}).Error; err != nil {
+		return err
+	}
+	if err := database.DB.Unscoped().Where("expires_at < ?", now).Delete(&PasswordResetToken{}).Error; err != nil {
+		return err
+	}
+	if err := database.DB.Unscoped().Where("expires_at < ?", now).Delete(&MFAChallenge{}).Error; err != nil {
+		return err
+	}
+	if err := database.DB.Unscoped().Where("expires_at < ?", now).Delete(&OIDCLoginState{}).Error; err != nil {
+		return err
+	}
+	if err := database.DB.Unscoped().Where("expires_at < ?", now).Delete(&RefreshToken{}).Error; err != nil {
+		return err
+	}
+	return database.DB.Where("expires_at < ?", now).Delete(&Session{}).Error
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"auth-service/database"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// mockDB replaces the database of the models with a mock for the test.
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: conn}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = previous
+		conn.Close()
+	})
+	return mock
+}
+
+var refreshTokenColumns = []string{"id", "user_id", "family_id", "token_hash", "expires_at", "used_at", "revoked_at"}
+
+func TestRotateRefreshToken(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Minute)
+	tests := []struct {
+		name    string
+		row     []driver.Value // the stored token, none when nil
+		wantErr error
+		// the family is revoked, the reused token leaked
+		wantRevoked bool
+	}{
+		{name: "unknown", wantErr: ErrInvalidRefreshToken},
+		{name: "reused", row: []driver.Value{1, 7, "family", HashToken("token"), now.Add(time.Hour), earlier, nil}, wantErr: ErrRefreshTokenReused, wantRevoked: true},
+		{name: "reused after the family was revoked", row: []driver.Value{1, 7, "family", HashToken("token"), now.Add(time.Hour), earlier, earlier}, wantErr: ErrRefreshTokenReused, wantRevoked: true},
+		{name: "revoked", row: []driver.Value{1, 7, "family", HashToken("token"), now.Add(time.Hour), nil, earlier}, wantErr: ErrRefreshTokenRevoked},
+		{name: "expired", row: []driver.Value{1, 7, "family", HashToken("token"), earlier, nil, nil}, wantErr: ErrRefreshTokenExpired},
+		{name: "rotated", row: []driver.Value{1, 7, "family", HashToken("token"), now.Add(time.Hour), nil, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectBegin()
+			rows := sqlmock.NewRows(refreshTokenColumns)
+			if tt.row != nil {
+				rows.AddRow(tt.row...)
+			}
+			mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_tokens" WHERE token_hash = $1`) + `.* FOR UPDATE`).
+				WithArgs(HashToken("token")).
+				WillReturnRows(rows)
+			if tt.wantErr != nil {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectExec(regexp.QuoteMeta(`UPDATE "refresh_tokens" SET "used_at"=$1`)).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "refresh_tokens"`)).
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), nil, uint(7), "family", sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+				mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "sessions"`) + `.*ON CONFLICT`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+			if tt.wantRevoked {
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta(`UPDATE "sessions" SET "revoked_at"=$1 WHERE id = $2 AND revoked_at IS NULL`)).
+					WithArgs(sqlmock.AnyArg(), "family").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(regexp.QuoteMeta(`UPDATE "refresh_tokens" SET "revoked_at"=$1,"updated_at"=$2 WHERE (family_id = $3 AND revoked_at IS NULL)`)).
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "family").
+					WillReturnResult(sqlmock.NewResult(0, 3))
+				mock.ExpectCommit()
+			}
+
+			token, refreshToken, err := RotateRefreshToken(context.Background(), "token", time.Hour, "agent", "203.0.113.7")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RotateRefreshToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				if token == "" || token == "token" || refreshToken.FamilyID != "family" || refreshToken.TokenHash != HashToken(token) {
+					t.Errorf("RotateRefreshToken() = %q, %+v, want a new token of the family", token, refreshToken)
+				}
+			} else if token != "" {
+				t.Errorf("RotateRefreshToken() returned the token %q with the error", token)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
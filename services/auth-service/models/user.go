@@ -2,8 +2,10 @@ package models
 
 import (
 	"auth-service/database"
+	"context"
 	"html"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
@@ -12,10 +14,16 @@ import (
 type UserRole string
 
 const (
-	TeamUserRole UserRole = "team"
-	UserUserRole UserRole = "user"
+	TeamUserRole  UserRole = "team"
+	UserUserRole  UserRole = "user"
+	AdminUserRole UserRole = "admin"
 )
 
+func (role UserRole) Valid() bool {
+	_, ok := UserRolePermissions[role]
+	return ok
+}
+
 type User struct {
 	gorm.Model
 	Role     UserRole `gorm:"type:user_role;not null;default:'user'" json:"role"`
@@ -23,9 +31,27 @@ type User struct {
 	Email    string   `gorm:"size:255;not null;unique" json:"email"`
 	Phone    string   `gorm:"size:20;not null" json:"phone"`
 	Password string   `gorm:"size:255;not null" json:"-"`
+	// ActiveTeamID is the team carried by the access tokens of the user.
+	ActiveTeamID  *uint `json:"active_team_id"`
+	EmailVerified bool  `gorm:"not null;default:false" json:"email_verified"`
+	PhoneVerified bool  `gorm:"not null;default:false" json:"phone_verified"`
+	// TOTPSecret is set on enrolment, it is only checked once TOTPEnabled.
+	TOTPSecret   string `gorm:"size:64;not null;default:''" json:"-"`
+	TOTPEnabled  bool   `gorm:"not null;default:false" json:"totp_enabled"`
+	TOTPLastStep int64  `gorm:"not null;default:0" json:"-"`
+	// PendingEmail and PendingPhone replace the address once verified.
+	PendingEmail string `gorm:"size:255;not null;default:''" json:"pending_email,omitempty"`
+	PendingPhone string `gorm:"size:20;not null;default:''" json:"pending_phone,omitempty"`
+	// DisabledAt is set when an admin disabled the account, it can't log in.
+	DisabledAt *time.Time `json:"disabled_at"`
 }
 
-func (user *User) Register() (*User, error) {
+// Register creates the user. Team accounts get a team of their own in the
+// same transaction, more members can be invited later.
+func (user *User) Register(ctx context.Context) (*User, error) {
+	if err := Policy.Check(user.Password, *user); err != nil {
+		return nil, err
+	}
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, err
@@ -33,24 +59,33 @@ func (user *User) Register() (*User, error) {
 	user.Password = string(passwordHash)
 	user.Username = html.EscapeString(strings.TrimSpace(user.Username))
 
-	err = database.DB.Create(&user).Error
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		if user.Role == TeamUserRole {
+			_, err := CreateTeam(tx, user.Username, user)
+			return err
+		}
+		return nil
+	})
 	if err != nil {
 		return &User{}, err
 	}
 	return user, nil
 }
 
-func GetUsers(User *[]User) (err error) {
-	err = database.DB.Find(User).Error
+func GetUsers(ctx context.Context, User *[]User) (err error) {
+	err = database.DB.WithContext(ctx).Find(User).Error
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func GetUserByUsername(username string) (User, error) {
+func GetUserByUsername(ctx context.Context, username string) (User, error) {
 	var user User
-	err := database.DB.Where("username=?", username).Find(&user).Error
+	err := database.DB.WithContext(ctx).Where("username=?", username).Find(&user).Error
 	if err != nil {
 		return User{}, err
 	}
@@ -61,25 +96,33 @@ func (user *User) CheckPassword(password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 }
 
-func GetUserById(id uint) (User, error) {
+// unknownUserPasswordHash is compared against when there is no user, so the
+// check takes as long as for an existing user.
+var unknownUserPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+
+func CheckUnknownUserPassword(password string) {
+	bcrypt.CompareHashAndPassword(unknownUserPasswordHash, []byte(password))
+}
+
+func GetUserById(ctx context.Context, id uint) (User, error) {
 	var user User
-	err := database.DB.Where("id=?", id).Find(&user).Error
+	err := database.DB.WithContext(ctx).Where("id=?", id).Find(&user).Error
 	if err != nil {
 		return User{}, err
 	}
 	return user, nil
 }
 
-func GetUser(User *User, id int) (err error) {
-	err = database.DB.Where("id = ?", id).First(User).Error
+func GetUser(ctx context.Context, User *User, id int) (err error) {
+	err = database.DB.WithContext(ctx).Where("id = ?", id).First(User).Error
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func UpdateUser(User *User) (err error) {
-	err = database.DB.Omit("password").Updates(User).Error
+func UpdateUser(ctx context.Context, User *User) (err error) {
+	err = database.DB.WithContext(ctx).Omit("password").Updates(User).Error
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,194 @@
+package models
+
+import (
+	"auth-service/database"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type VerificationChannel string
+
+const (
+	EmailVerification VerificationChannel = "email"
+	PhoneVerification VerificationChannel = "phone"
+)
+
+const (
+	VerificationCodeTTL      = 10 * time.Minute
+	maxVerificationAttempts  = 5
+	verificationResendDelay  = time.Minute
+	maxVerificationsPerHour  = 5
+	verificationCodeMaxValue = 1000000
+)
+
+var (
+	ErrInvalidVerificationCode = errors.New("invalid or expired verification code")
+	ErrTooManyAttempts         = errors.New("too many attempts, request a new code")
+	ErrAlreadyVerified         = errors.New("already verified")
+)
+
+// ErrResendTooSoon tells when a new code can be requested.
+type ErrResendTooSoon struct {
+	RetryAfter time.Duration
+}
+
+func (e ErrResendTooSoon) Error() string {
+	return fmt.Sprintf("a code was sent recently, retry in %d seconds", int(e.RetryAfter.Seconds()+0.5))
+}
+
+// VerificationCode is a one time code sent to the email or phone of a user.
+// Target is the address the code was sent to, the code only verifies that
+// address. Only the hash of the code is stored.
+type VerificationCode struct {
+	gorm.Model
+	UserID     uint                `gorm:"not null;index" json:"user_id"`
+	Channel    VerificationChannel `gorm:"size:16;not null" json:"channel"`
+	Target     string              `gorm:"size:255;not null" json:"target"`
+	CodeHash   string              `gorm:"size:64;not null" json:"-"`
+	ExpiresAt  time.Time           `gorm:"not null" json:"expires_at"`
+	Attempts   int                 `gorm:"not null;default:0" json:"attempts"`
+	ConsumedAt *time.Time          `json:"consumed_at"`
+}
+
+func (channel VerificationChannel) Valid() bool {
+	return channel == EmailVerification || channel == PhoneVerification
+}
+
+// VerificationTarget returns the address of the user for the channel and
+// whether it is verified.
+func (user User) VerificationTarget(channel VerificationChannel) (string, bool) {
+	if channel == PhoneVerification {
+		return user.Phone, user.PhoneVerified
+	}
+	return user.Email, user.EmailVerified
+}
+
+// addressToVerify returns the address codes of the channel are sent to, the
+// pending address when the user is changing it.
+func (user User) addressToVerify(channel VerificationChannel) (string, bool) {
+	if channel == PhoneVerification && user.PendingPhone != "" {
+		return user.PendingPhone, false
+	}
+	if channel == EmailVerification && user.PendingEmail != "" {
+		return user.PendingEmail, false
+	}
+	return user.VerificationTarget(channel)
+}
+
+func randomCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(verificationCodeMaxValue))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// CreateVerificationCode returns a new code for the channel of the user. It
+// fails with ErrResendTooSoon when a code was sent less than a minute ago or
+// too many codes were sent in the last hour. Earlier codes stop working.
+func CreateVerificationCode(ctx context.Context, user User, channel VerificationChannel) (string, *VerificationCode, error) {
+	target, verified := user.addressToVerify(channel)
+	if verified {
+		return "", nil, ErrAlreadyVerified
+	}
+
+	code, err := randomCode()
+	if err != nil {
+		return "", nil, err
+	}
+	verification := &VerificationCode{
+		UserID:    user.ID,
+		Channel:   channel,
+		Target:    target,
+		CodeHash:  HashToken(fmt.Sprintf("%d:%s", user.ID, code)),
+		ExpiresAt: time.Now().Add(VerificationCodeTTL),
+	}
+
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// serialise sends of the same user so the limits hold
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&User{}, user.ID).Error; err != nil {
+			return err
+		}
+
+		var recent []VerificationCode
+		if err := tx.Unscoped().
+			Where("user_id = ? AND channel = ? AND created_at > ?", user.ID, channel, time.Now().Add(-time.Hour)).
+			Order("created_at desc").Find(&recent).Error; err != nil {
+			return err
+		}
+		if len(recent) > 0 {
+			if wait := verificationResendDelay - time.Since(recent[0].CreatedAt); wait > 0 {
+				return ErrResendTooSoon{RetryAfter: wait}
+			}
+		}
+		if len(recent) >= maxVerificationsPerHour {
+			return ErrResendTooSoon{RetryAfter: time.Hour - time.Since(recent[len(recent)-1].CreatedAt)}
+		}
+
+		if err := tx.Where("user_id = ? AND channel = ?", user.ID, channel).Delete(&VerificationCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(verification).Error
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return code, verification, nil
+}
+
+// CheckVerificationCode marks the address the code was sent to as verified
+// when the code matches and the address of the user didn't change since. A
+// pending address replaces the current one.
+func CheckVerificationCode(ctx context.Context, user User, channel VerificationChannel, code string) error {
+	mismatch := false
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var verification VerificationCode
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND channel = ? AND consumed_at IS NULL", user.ID, channel).
+			Order("created_at desc").First(&verification).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidVerificationCode
+		}
+		if err != nil {
+			return err
+		}
+
+		target, _ := user.addressToVerify(channel)
+		if time.Now().After(verification.ExpiresAt) || verification.Target != target {
+			return ErrInvalidVerificationCode
+		}
+		if verification.Attempts >= maxVerificationAttempts {
+			return ErrTooManyAttempts
+		}
+
+		hash := HashToken(fmt.Sprintf("%d:%s", user.ID, code))
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(verification.CodeHash)) != 1 {
+			// commit the failed attempt, the error is returned afterwards
+			mismatch = true
+			return tx.Model(&verification).Update("attempts", gorm.Expr("attempts + 1")).Error
+		}
+
+		if err := tx.Model(&verification).Update("consumed_at", time.Now()).Error; err != nil {
+			return err
+		}
+		updates := map[string]interface{}{"email": target, "email_verified": true, "pending_email": ""}
+		if channel == PhoneVerification {
+			updates = map[string]interface{}{"phone": target, "phone_verified": true, "pending_phone": ""}
+		} else if err := checkEmailFree(tx, user.ID, target); err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("id = ?", user.ID).Updates(updates).Error
+	})
+	if err == nil && mismatch {
+		return ErrInvalidVerificationCode
+	}
+	return err
+}
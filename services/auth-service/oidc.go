@@ -0,0 +1,192 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/models"
+	"auth-service/oidc"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// oidcProviders are the identity providers users can sign in with, by name.
+var oidcProviders map[string]*oidc.Provider
+
+// oidcProvider returns the provider named in the path or responds with 404.
+func oidcProvider(c *gin.Context) (*oidc.Provider, bool) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	provider, ok := oidcProviders[c.Param("provider")]
+	if !ok {
+		logger.Warn("Unknown identity provider", zap.String("provider", c.Param("provider")))
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown identity provider"})
+		return nil, false
+	}
+	return provider, true
+}
+
+func GetOIDCProviders(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering GetOIDCProviders Function")
+	names := make([]string, 0, len(oidcProviders))
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c.JSON(http.StatusOK, gin.H{"providers": names})
+	logger.Debug("Exiting GetOIDCProviders Function")
+}
+
+func OIDCLogin(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering OIDCLogin Function")
+	provider, ok := oidcProvider(c)
+	if !ok {
+		return
+	}
+
+	nonce, err := oidc.NewCodeVerifier()
+	if err != nil {
+		logger.Error("Failed to generate nonce", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	codeVerifier, err := oidc.NewCodeVerifier()
+	if err != nil {
+		logger.Error("Failed to generate code verifier", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	state, err := models.CreateOIDCLoginState(c.Request.Context(), provider.Name, nonce, codeVerifier)
+	if err != nil {
+		logger.Error("Failed to create login state", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(c.Request.Context(), state, nonce, codeVerifier)
+	if err != nil {
+		logger.Error("Failed to discover identity provider", zap.String("provider", provider.Name), zap.Error(err))
+		c.JSON(http.StatusBadGateway, gin.H{"error": oidc.ErrProviderUnavailable.Error()})
+		return
+	}
+	logger.Debug("Redirecting to identity provider", zap.String("provider", provider.Name))
+
+	c.Redirect(http.StatusFound, authURL)
+	logger.Debug("Exiting OIDCLogin Function")
+}
+
+func OIDCCallback(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering OIDCCallback Function")
+	provider, ok := oidcProvider(c)
+	if !ok {
+		return
+	}
+
+	if providerError := c.Query("error"); providerError != "" {
+		logger.Warn("Identity provider refused the login", zap.String("provider", provider.Name), zap.String("error", providerError), zap.String("description", c.Query("error_description")))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "the identity provider refused the login: " + providerError})
+		return
+	}
+	code, state := c.Query("code"), c.Query("state")
+	if code == "" || state == "" {
+		logger.Error("Missing code or state", zap.String("provider", provider.Name))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code and state are required"})
+		return
+	}
+
+	login, err := models.ConsumeOIDCLoginState(c.Request.Context(), provider.Name, state)
+	if errors.Is(err, models.ErrInvalidOIDCState) {
+		logger.Warn("Invalid login state", zap.String("provider", provider.Name))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to get login state", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, err := provider.Exchange(c.Request.Context(), code, login.CodeVerifier, login.Nonce)
+	if errors.Is(err, oidc.ErrInvalidIDToken) {
+		logger.Warn("Failed to verify ID token", zap.String("provider", provider.Name), zap.Error(err))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": oidc.ErrInvalidIDToken.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to exchange code", zap.String("provider", provider.Name), zap.Error(err))
+		c.JSON(http.StatusBadGateway, gin.H{"error": oidc.ErrProviderUnavailable.Error()})
+		return
+	}
+	logger.Debug("ID token verified", zap.String("provider", provider.Name), zap.String("subject", claims.Subject))
+
+	user, external, err := models.ProvisionExternalUser(c.Request.Context(), provider.Name, models.ExternalClaims{
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+	})
+	if errors.Is(err, models.ErrExternalEmailMissing) {
+		logger.Warn("External login without email", zap.String("provider", provider.Name), zap.String("subject", claims.Subject))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, models.ErrAccountLinkRefused) {
+		logger.Warn("Account link refused", zap.String("provider", provider.Name), zap.String("subject", claims.Subject))
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to provision user", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	switch external {
+	case models.LinkedExternalLogin:
+		linked := userAuditEvent(AccountLinkedEvent, user)
+		linked.Details = map[string]interface{}{"provider": provider.Name, "subject": claims.Subject}
+		auditEvent(c, linked)
+	case models.CreatedExternalLogin:
+		logger.Info("User provisioned", zap.Uint("user_id", user.ID), zap.String("provider", provider.Name))
+	}
+	if accountDisabled(c, user) {
+		loginFailure(c, user, "account_disabled")
+		return
+	}
+
+	// the provider proved the first factor, a second one is still asked
+	if user.TOTPEnabled {
+		mfaToken, err := models.CreateMFAChallenge(c.Request.Context(), user.ID)
+		if err != nil {
+			logger.Error("Failed to create MFA challenge", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":      "Two-factor authentication required",
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int(models.MFAChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	tokens, err := issueTokens(c, user)
+	if err != nil {
+		logger.Error("Failed to generate JWT", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Debug("JWT generated", zap.Uint("user_id", user.ID))
+	loginSuccess(c, user, "oidc:"+provider.Name)
+
+	tokens["message"] = "Login successful"
+	tokens["user"] = user
+	c.JSON(http.StatusOK, tokens)
+	logger.Debug("Exiting OIDCCallback Function")
+}
@@ -0,0 +1,237 @@
+// Package oidc signs users in at external OpenID Connect providers with the
+// authorization code flow and PKCE, and verifies the ID tokens the
+// providers return.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"auth-service/telemetry"
+)
+
+var ErrProviderUnavailable = errors.New("the identity provider can't be reached")
+
+// Provider is an identity provider users can sign in with. The endpoints
+// are discovered from the issuer on first use.
+type Provider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// AuthorizationURL replaces the discovered authorization endpoint, for
+	// providers which browsers reach under another address than the
+	// service, such as a mock server in docker.
+	AuthorizationURL string
+	Client           *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      keyCache
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// ProvidersFromEnv returns the providers named in OIDC_PROVIDERS, a comma
+// separated list. Each provider is configured by OIDC_<NAME>_ISSUER,
+// _CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL, _SCOPES (space separated,
+// "openid email profile" by default) and _AUTHORIZATION_URL, with the name
+// in upper case and dashes replaced by underscores.
+func ProvidersFromEnv() (map[string]*Provider, error) {
+	providers := map[string]*Provider{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !providerNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid OIDC provider name %q", name)
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := &Provider{
+			Name:             name,
+			Issuer:           strings.TrimRight(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:         os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret:     os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:      os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:           strings.Fields(os.Getenv(prefix + "SCOPES")),
+			AuthorizationURL: os.Getenv(prefix + "AUTHORIZATION_URL"),
+			Client:           &http.Client{Transport: telemetry.Transport(nil), Timeout: 10 * time.Second},
+		}
+		if provider.Issuer == "" || provider.ClientID == "" || provider.RedirectURL == "" {
+			return nil, fmt.Errorf("OIDC provider %s needs %sISSUER, %sCLIENT_ID and %sREDIRECT_URL", name, prefix, prefix, prefix)
+		}
+		if len(provider.Scopes) == 0 {
+			provider.Scopes = []string{"openid", "email", "profile"}
+		}
+		providers[name] = provider
+	}
+	return providers, nil
+}
+
+// NewCodeVerifier returns a random PKCE code verifier, it is also fit as a
+// nonce.
+func NewCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge returns the S256 PKCE challenge of the verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the address the user is sent to to sign in at the
+// provider.
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, codeVerifier string) (string, error) {
+	config, err := p.configuration(ctx)
+	if err != nil {
+		return "", err
+	}
+	endpoint := config.AuthorizationEndpoint
+	if p.AuthorizationURL != "" {
+		endpoint = p.AuthorizationURL
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", CodeChallenge(codeVerifier))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(endpoint, "?") {
+		separator = "&"
+	}
+	return endpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems the code returned to the redirect URL and returns the
+// claims of the verified ID token.
+func (p *Provider) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (Claims, error) {
+	config, err := p.configuration(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	if p.ClientSecret == "" {
+		// public clients only prove themselves with the code verifier
+		form.Set("client_id", p.ClientID)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Claims{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.do(request, &tokens)
+	if err != nil {
+		return Claims{}, err
+	}
+	if status != http.StatusOK {
+		if tokens.Error != "" {
+			return Claims{}, fmt.Errorf("%w: %s %s", ErrInvalidIDToken, tokens.Error, tokens.ErrorDescription)
+		}
+		return Claims{}, fmt.Errorf("%w: token endpoint answered %d", ErrProviderUnavailable, status)
+	}
+	if tokens.IDToken == "" {
+		return Claims{}, fmt.Errorf("%w: no id_token in the response", ErrInvalidIDToken)
+	}
+	return p.verify(ctx, config, tokens.IDToken, nonce)
+}
+
+// configuration returns the discovered endpoints, read once per provider.
+func (p *Provider) configuration(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var config discovery
+	status, err := p.do(request, &config)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: discovery answered %d", ErrProviderUnavailable, status)
+	}
+	if strings.TrimRight(config.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("provider %s announces issuer %q instead of %q", p.Name, config.Issuer, p.Issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return nil, fmt.Errorf("provider %s announces no authorization, token or JWKS endpoint", p.Name)
+	}
+	p.discovery = &config
+	return p.discovery, nil
+}
+
+// do sends the request and decodes the JSON response into v.
+func (p *Provider) do(request *http.Request, v interface{}) (int, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	if err := json.Unmarshal(body, v); err != nil && response.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("%w: invalid JSON from %s: %v", ErrProviderUnavailable, request.URL.Host, err)
+	}
+	return response.StatusCode, nil
+}
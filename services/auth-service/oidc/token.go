@@ -0,0 +1,223 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidIDToken = errors.New("the identity provider returned an invalid ID token")
+
+// minKeyReload limits how often an unknown kid reloads the keys of a
+// provider.
+const minKeyReload = time.Minute
+
+// Claims are the claims of a verified ID token which identify the user.
+type Claims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+type keyCache struct {
+	mu       sync.RWMutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verify checks the signature, issuer, audience, expiry and nonce of the
+// ID token and returns its claims.
+func (p *Provider) verify(ctx context.Context, config *discovery, idToken string, nonce string) (Claims, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, config.JWKSURI, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "EdDSA"}),
+		jwt.WithIssuer(config.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute))
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return Claims{}, ErrInvalidIDToken
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return Claims{}, fmt.Errorf("%w: nonce doesn't match", ErrInvalidIDToken)
+	}
+	// a token meant for several clients must name us as the authorized party
+	audience, _ := claims.GetAudience()
+	if azp, ok := claims["azp"].(string); (ok || len(audience) > 1) && azp != p.ClientID {
+		return Claims{}, fmt.Errorf("%w: issued to another client", ErrInvalidIDToken)
+	}
+
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		return Claims{}, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+	result := Claims{Subject: subject}
+	result.Email, _ = claims["email"].(string)
+	result.PreferredUsername, _ = claims["preferred_username"].(string)
+	result.Name, _ = claims["name"].(string)
+	// some providers send the flag as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		result.EmailVerified = verified
+	case string:
+		result.EmailVerified = verified == "true"
+	}
+	return result, nil
+}
+
+// key returns the public key of the kid, reloading the JWKS of the provider
+// when it is unknown as the provider may have rotated its keys.
+func (p *Provider) key(ctx context.Context, jwksURI string, kid string) (crypto.PublicKey, error) {
+	p.keys.mu.RLock()
+	key, ok := p.keys.keys[kid]
+	loadedAt := p.keys.loadedAt
+	p.keys.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if time.Since(loadedAt) < minKeyReload {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	p.keys.mu.Lock()
+	defer p.keys.mu.Unlock()
+	if err := p.loadKeys(ctx, jwksURI); err != nil {
+		return nil, err
+	}
+	if key, ok := p.keys.keys[kid]; ok {
+		return key, nil
+	}
+	// tokens may leave out the kid when the provider has a single key
+	if kid == "" && len(p.keys.keys) == 1 {
+		for _, key := range p.keys.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// loadKeys replaces the cached keys by the JWKS of the provider, the caller
+// holds the write lock.
+func (p *Provider) loadKeys(ctx context.Context, jwksURI string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURI, nil)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	status, err := p.do(request, &set)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("%w: JWKS answered %d", ErrProviderUnavailable, status)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// keys of unsupported types are skipped, not fatal
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	p.keys.keys = keys
+	p.keys.loadedAt = time.Now()
+	return nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,168 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testProvider is an identity provider answering the token request with
+// the ID token set by the test.
+type testProvider struct {
+	server  *httptest.Server
+	key     ed25519.PrivateKey
+	idToken string
+	// verifier is the PKCE code verifier the token request carried
+	verifier string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &testProvider{key: private}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(discovery{
+			Issuer:                provider.server.URL,
+			AuthorizationEndpoint: provider.server.URL + "/authorize",
+			TokenEndpoint:         provider.server.URL + "/token",
+			JWKSURI:               provider.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{
+			{Kid: "k1", Kty: "OKP", Crv: "Ed25519", Use: "sig", X: base64.RawURLEncoding.EncodeToString(public)},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		provider.verifier = r.PostFormValue("code_verifier")
+		if r.PostFormValue("code") != "code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": provider.idToken})
+	})
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+// sign returns an ID token of the claims signed with the key of the kid.
+func (provider *testProvider) sign(t *testing.T, kid string, key ed25519.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestExchange(t *testing.T) {
+	idp := newTestProvider(t)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"iss":            idp.server.URL,
+			"aud":            "client",
+			"sub":            "248289761001",
+			"nonce":          "nonce",
+			"email":          "jane@example.com",
+			"email_verified": "true",
+			"name":           "Jane Doe",
+			"iat":            now.Unix(),
+			"exp":            now.Add(time.Hour).Unix(),
+		}
+		if change != nil {
+			change(claims)
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		code    string
+		idToken string
+		wantErr error
+	}{
+		{name: "valid", idToken: idp.sign(t, "k1", idp.key, claims(nil))},
+		{name: "without kid", idToken: idp.sign(t, "", idp.key, claims(nil))},
+		{name: "authorized party", idToken: idp.sign(t, "k1", idp.key, claims(func(c jwt.MapClaims) {
+			c["aud"] = []string{"client", "other"}
+			c["azp"] = "client"
+		}))},
+		// the ID token of another login, replayed
+		{name: "nonce mismatch", wantErr: ErrInvalidIDToken, idToken: idp.sign(t, "k1", idp.key, claims(func(c jwt.MapClaims) { c["nonce"] = "other" }))},
+		{name: "no nonce", wantErr: ErrInvalidIDToken, idToken: idp.sign(t, "k1", idp.key, claims(func(c jwt.MapClaims) { delete(c, "nonce") }))},
+		{name: "other issuer", wantErr: ErrInvalidIDToken, idToken: idp.sign(t, "k1", idp.key, claims(func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }))},
+		{name: "other audience", wantErr: ErrInvalidIDToken, idToken: idp.sign(t, "k1", idp.key, claims(func(c jwt.MapClaims) { c["aud"] = "other" }))},
+		{name: "issued to another client", wantErr: ErrInvalidIDToken, idToken: idp.sign(t, "k1", idp.key, claims(func(c jwt.MapClaims) {
+			c["aud"] = []string{"client", "other"}
+			c["azp"] = "other"
+		}))},
+		{name: "several audiences without authorized party", wantErr: ErrInvalidIDToken, idToken: idp.sign(t, "k1", idp.key, claims(func(c jwt.MapClaims) {
+			c["aud"] = []string{"client", "other"}
+		}))},
+		{name: "expired", wantErr: ErrInvalidIDToken, idToken: idp.sign(t, "k1", idp.key, claims(func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Hour).Unix() }))},
+		{name: "no expiry", wantErr: ErrInvalidIDToken, idToken: idp.sign(t, "k1", idp.key, claims(func(c jwt.MapClaims) { delete(c, "exp") }))},
+		{name: "no subject", wantErr: ErrInvalidIDToken, idToken: idp.sign(t, "k1", idp.key, claims(func(c jwt.MapClaims) { delete(c, "sub") }))},
+		{name: "unknown kid", wantErr: ErrInvalidIDToken, idToken: idp.sign(t, "k2", idp.key, claims(nil))},
+		{name: "signed with another key", wantErr: ErrInvalidIDToken, idToken: idp.sign(t, "k1", otherKey, claims(nil))},
+		{name: "refused code", code: "other", wantErr: ErrInvalidIDToken},
+		{name: "no ID token", wantErr: ErrInvalidIDToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &Provider{Name: "test", Issuer: idp.server.URL, ClientID: "client", RedirectURL: "https://forms.example.com/callback"}
+			idp.idToken = tt.idToken
+			code := tt.code
+			if code == "" {
+				code = "code"
+			}
+
+			got, err := provider.Exchange(context.Background(), code, "verifier", "nonce")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Exchange() error = %v, want %v", err, tt.wantErr)
+			}
+			if idp.verifier != "verifier" {
+				t.Errorf("the token request carried the code verifier %q", idp.verifier)
+			}
+			want := Claims{Subject: "248289761001", Email: "jane@example.com", EmailVerified: true, Name: "Jane Doe"}
+			if tt.wantErr == nil && got != want {
+				t.Errorf("Exchange() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestConfigurationIssuerMismatch(t *testing.T) {
+	idp := newTestProvider(t)
+	// the same server under another name than the issuer it announces
+	issuer := strings.Replace(idp.server.URL, "127.0.0.1", "localhost", 1)
+	provider := &Provider{Name: "test", Issuer: issuer, ClientID: "client"}
+	if _, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier"); err == nil {
+		t.Error("AuthCodeURL() of a provider announcing another issuer didn't fail")
+	}
+}
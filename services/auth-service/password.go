@@ -0,0 +1,183 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/delivery"
+	"auth-service/models"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordError answers with 400 when the password was refused by the
+// policy and returns true if it did.
+func passwordError(c *gin.Context, err error) bool {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	var policyErr models.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		logger.Warn("Password refused by policy", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return true
+	}
+	return false
+}
+
+func RequestPasswordReset(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering RequestPasswordReset Function")
+	type RequestPasswordResetRequest struct {
+		Email   string                     `json:"email" binding:"required"`
+		Channel models.VerificationChannel `json:"channel"`
+	}
+
+	var resetRequest RequestPasswordResetRequest
+	if err := c.ShouldBindJSON(&resetRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if resetRequest.Channel == "" {
+		resetRequest.Channel = models.EmailVerification
+	}
+	if !resetRequest.Channel.Valid() {
+		logger.Error("Invalid reset channel", zap.String("channel", string(resetRequest.Channel)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "channel must be email or phone"})
+		return
+	}
+
+	// the answer is the same whether the account exists or not
+	response := gin.H{"message": "If the account exists, a password reset token was sent"}
+
+	user, err := models.GetUserByEmail(c.Request.Context(), resetRequest.Email)
+	if err != nil {
+		logger.Error("Failed to get user", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	target, verified := user.VerificationTarget(resetRequest.Channel)
+	// codes are only sent by SMS to a phone number known to be the user's
+	if user.ID == 0 || (resetRequest.Channel == models.PhoneVerification && !verified) {
+		logger.Info("Password reset not sent", zap.Uint("user_id", user.ID), zap.String("channel", string(resetRequest.Channel)))
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	token, err := models.CreatePasswordResetToken(c.Request.Context(), user)
+	if err != nil {
+		logger.Error("Failed to create password reset token", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if token == "" {
+		logger.Warn("Password reset requested too soon", zap.Uint("user_id", user.ID))
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	message := delivery.Message{
+		To:   target,
+		Body: fmt.Sprintf("Your FormFlow password reset token is %s. It expires in %d minutes. If you didn't ask for it, ignore this message.", token, int(models.PasswordResetTTL.Minutes())),
+	}
+	sender := smsSender
+	if resetRequest.Channel == models.EmailVerification {
+		message.Subject = "Reset your password"
+		sender = emailSender
+	}
+	if err := sender.Send(message); err != nil {
+		logger.Error("Failed to send password reset token", zap.Uint("user_id", user.ID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send the password reset token"})
+		return
+	}
+	logger.Info("Password reset token sent", zap.Uint("user_id", user.ID), zap.String("channel", string(resetRequest.Channel)))
+
+	c.JSON(http.StatusOK, response)
+	logger.Debug("Exiting RequestPasswordReset Function")
+}
+
+func ResetPassword(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering ResetPassword Function")
+	type ResetPasswordRequest struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	var resetRequest ResetPasswordRequest
+	if err := c.ShouldBindJSON(&resetRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := models.ResetPassword(c.Request.Context(), resetRequest.Token, resetRequest.Password)
+	if errors.Is(err, models.ErrInvalidResetToken) {
+		logger.Warn("Failed to reset password", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if passwordError(c, err) {
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to reset password", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Password reset", zap.Uint("user_id", user.ID))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset, log in with the new password"})
+	logger.Debug("Exiting ResetPassword Function")
+}
+
+func ChangePassword(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering ChangePassword Function")
+	type ChangePasswordRequest struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+
+	var changeRequest ChangePasswordRequest
+	if err := c.ShouldBindJSON(&changeRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := user.ChangePassword(c.Request.Context(), changeRequest.CurrentPassword, changeRequest.NewPassword)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		logger.Warn("Current password doesn't match", zap.Uint("user_id", user.ID))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "current password is incorrect"})
+		return
+	}
+	if passwordError(c, err) {
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to change password", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Password changed", zap.Uint("user_id", user.ID))
+
+	// every refresh token was revoked, keep this session signed in
+	tokens, err := issueTokens(c, user)
+	if err != nil {
+		logger.Error("Failed to generate JWT", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens["message"] = "Password changed, other sessions are signed out"
+	c.JSON(http.StatusOK, tokens)
+	logger.Debug("Exiting ChangePassword Function")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/models"
+	"auth-service/utils"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// UsersReadScope is the scope of service tokens reading user details.
+const UsersReadScope = "users:read"
+
+// serviceAccount is a service allowed to call internal endpoints with the
+// scopes.
+type serviceAccount struct {
+	name       string
+	secretHash [32]byte
+	scopes     []string
+}
+
+var serviceAccounts map[string]serviceAccount
+
+// serviceAccountsFromEnv reads the accounts named in SERVICE_ACCOUNTS, a
+// comma separated list. Each account is configured by
+// SERVICE_ACCOUNT_<NAME>_SECRET and SERVICE_ACCOUNT_<NAME>_SCOPES (space
+// separated), with the name in upper case and dashes replaced by
+// underscores.
+func serviceAccountsFromEnv() (map[string]serviceAccount, error) {
+	accounts := map[string]serviceAccount{}
+	for _, name := range strings.Split(os.Getenv("SERVICE_ACCOUNTS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "SERVICE_ACCOUNT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		secret := os.Getenv(prefix + "SECRET")
+		if len(secret) < 16 {
+			return nil, fmt.Errorf("service account %s needs a %sSECRET of at least 16 characters", name, prefix)
+		}
+		accounts[name] = serviceAccount{
+			name:       name,
+			secretHash: sha256.Sum256([]byte(secret)),
+			scopes:     strings.Fields(os.Getenv(prefix + "SCOPES")),
+		}
+	}
+	return accounts, nil
+}
+
+// authenticateService returns the account of the basic credentials, the
+// secrets are compared in constant time.
+func authenticateService(name string, secret string) (serviceAccount, bool) {
+	account, ok := serviceAccounts[name]
+	hash := sha256.Sum256([]byte(secret))
+	if !ok {
+		return serviceAccount{}, false
+	}
+	return account, subtle.ConstantTimeCompare(hash[:], account.secretHash[:]) == 1
+}
+
+// IssueServiceToken is the internal endpoint services get their tokens from,
+// with the account name and secret as basic credentials. The token carries
+// the requested scopes, all scopes of the account by default, and is only
+// accepted by the service named as audience.
+func IssueServiceToken(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering IssueServiceToken Function")
+	type ServiceTokenRequest struct {
+		Scopes   []string `json:"scopes"`
+		Audience string   `json:"audience"`
+	}
+
+	name, secret, ok := c.Request.BasicAuth()
+	if !ok {
+		logger.Warn("Service token requested without credentials")
+		c.Header("WWW-Authenticate", `Basic realm="service"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "service credentials are required"})
+		return
+	}
+	account, ok := authenticateService(name, secret)
+	if !ok {
+		logger.Warn("Invalid service credentials", zap.String("service", name), zap.String("ip", c.ClientIP()))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid service credentials"})
+		return
+	}
+
+	var tokenRequest ServiceTokenRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&tokenRequest); err != nil {
+			logger.Error("Failed to bind JSON", zap.Error(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if tokenRequest.Audience == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the audience of the token is required"})
+		return
+	}
+	scopes := account.scopes
+	if len(tokenRequest.Scopes) > 0 {
+		for _, scope := range tokenRequest.Scopes {
+			if !models.PermissionGranted(account.scopes, scope) {
+				logger.Warn("Scope not allowed", zap.String("service", name), zap.String("scope", scope))
+				c.JSON(http.StatusForbidden, gin.H{"error": "scope " + scope + " isn't allowed for " + name})
+				return
+			}
+		}
+		scopes = tokenRequest.Scopes
+	}
+
+	token, err := utils.GenerateServiceToken(account.name, scopes, tokenRequest.Audience)
+	if errors.Is(err, utils.ErrServiceTokenDisabled) {
+		logger.Error("Failed to generate service token", zap.Error(err))
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to generate service token", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Debug("Service token issued", zap.String("service", name), zap.String("audience", tokenRequest.Audience), zap.Strings("scopes", scopes))
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"expires_in": int(utils.ServiceTokenTTL.Seconds()),
+		"scopes":     scopes,
+	})
+	logger.Debug("Exiting IssueServiceToken Function")
+}
+
+// requireServiceScope allows internal requests with a service token carrying
+// the scope.
+func requireServiceScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := correlation.Logger(c.Request.Context(), logger)
+		claims, err := utils.ValidateServiceToken(c)
+		if err != nil {
+			logger.Warn("Invalid service token", zap.String("path", c.FullPath()), zap.Error(err))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid service token is required"})
+			c.Abort()
+			return
+		}
+
+		service, _ := claims["sub"].(string)
+		granted := []string{}
+		if scopes, ok := claims["scopes"].([]interface{}); ok {
+			for _, s := range scopes {
+				if s, ok := s.(string); ok {
+					granted = append(granted, s)
+				}
+			}
+		}
+		if !models.PermissionGranted(granted, scope) {
+			logger.Warn("Service scope denied", zap.String("service", service), zap.String("scope", scope))
+			c.JSON(http.StatusForbidden, gin.H{"error": "missing scope " + scope})
+			c.Abort()
+			return
+		}
+		c.Set("service", service)
+		c.Next()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"auth-service/database"
+	"auth-service/utils"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// mockDB replaces the database with a mock for the test.
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: conn}), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = previous
+		conn.Close()
+	})
+	return mock
+}
+
+// useSigningKey loads a new EdDSA signing key from the mocked database and
+// returns its public key.
+func useSigningKey(t *testing.T) ed25519.PublicKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := utils.SigningAlgorithm
+	utils.SigningAlgorithm = "EdDSA"
+	t.Cleanup(func() { utils.SigningAlgorithm = previous })
+
+	mock := mockDB(t)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "signing_keys"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"kid", "algorithm", "private_key", "created_at", "retired_at", "expires_at"}).
+			AddRow("k1", "EdDSA", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), time.Now(), nil, nil))
+	if err := utils.LoadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	return public
+}
+
+func TestIssueServiceToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger = zap.NewNop()
+	previous := serviceAccounts
+	serviceAccounts = map[string]serviceAccount{}
+	t.Cleanup(func() { serviceAccounts = previous })
+	t.Setenv("SERVICE_ACCOUNTS", "form-service")
+	t.Setenv("SERVICE_ACCOUNT_FORM_SERVICE_SECRET", "form-service-secret")
+	t.Setenv("SERVICE_ACCOUNT_FORM_SERVICE_SCOPES", "users:read teams:*")
+	accounts, err := serviceAccountsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceAccounts = accounts
+	public := useSigningKey(t)
+
+	tests := []struct {
+		name       string
+		account    string
+		secret     string
+		body       string
+		wantStatus int
+		wantScopes []string
+	}{
+		{name: "all scopes of the account", account: "form-service", secret: "form-service-secret", body: `{"audience": "auth-service"}`, wantStatus: http.StatusOK, wantScopes: []string{"users:read", "teams:*"}},
+		{name: "requested scopes", account: "form-service", secret: "form-service-secret", body: `{"audience": "auth-service", "scopes": ["teams:read"]}`, wantStatus: http.StatusOK, wantScopes: []string{"teams:read"}},
+		{name: "no credentials", body: `{"audience": "auth-service"}`, wantStatus: http.StatusUnauthorized},
+		{name: "bad secret", account: "form-service", secret: "form-service-secreT", body: `{"audience": "auth-service"}`, wantStatus: http.StatusUnauthorized},
+		{name: "unknown account", account: "analytics-service", secret: "form-service-secret", body: `{"audience": "auth-service"}`, wantStatus: http.StatusUnauthorized},
+		{name: "no audience", account: "form-service", secret: "form-service-secret", body: `{"scopes": ["users:read"]}`, wantStatus: http.StatusBadRequest},
+		{name: "no body", account: "form-service", secret: "form-service-secret", wantStatus: http.StatusBadRequest},
+		{name: "scope beyond the account", account: "form-service", secret: "form-service-secret", body: `{"audience": "auth-service", "scopes": ["users:read", "users:write"]}`, wantStatus: http.StatusForbidden},
+		{name: "wildcard beyond the account", account: "form-service", secret: "form-service-secret", body: `{"audience": "auth-service", "scopes": ["users:*"]}`, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.POST("/service-token", IssueServiceToken)
+			req := httptest.NewRequest("POST", "/service-token", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.account != "" {
+				req.SetBasicAuth(tt.account, tt.secret)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var response struct {
+				Token  string   `json:"token"`
+				Scopes []string `json:"scopes"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(response.Scopes, tt.wantScopes) {
+				t.Errorf("scopes = %q, want %q", response.Scopes, tt.wantScopes)
+			}
+			claims := jwt.MapClaims{}
+			if _, err := jwt.ParseWithClaims(response.Token, claims, func(*jwt.Token) (interface{}, error) { return public, nil },
+				jwt.WithValidMethods([]string{"EdDSA"}), jwt.WithAudience("auth-service"), jwt.WithExpirationRequired()); err != nil {
+				t.Fatalf("invalid service token: %v", err)
+			}
+			if claims["sub"] != "form-service" || claims["token_use"] != utils.ServiceTokenUse {
+				t.Errorf("claims = %v, want a service token of form-service", claims)
+			}
+		})
+	}
+}
+
+func TestServiceAccountsFromEnv(t *testing.T) {
+	t.Setenv("SERVICE_ACCOUNTS", " form-service, ,analytics-service ")
+	t.Setenv("SERVICE_ACCOUNT_FORM_SERVICE_SECRET", "form-service-secret")
+	t.Setenv("SERVICE_ACCOUNT_FORM_SERVICE_SCOPES", "users:read")
+	t.Setenv("SERVICE_ACCOUNT_ANALYTICS_SERVICE_SECRET", "too-short")
+	if _, err := serviceAccountsFromEnv(); err == nil {
+		t.Error("serviceAccountsFromEnv() accepted a secret shorter than 16 characters")
+	}
+
+	t.Setenv("SERVICE_ACCOUNT_ANALYTICS_SERVICE_SECRET", "analytics-service-secret")
+	accounts, err := serviceAccountsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 || !reflect.DeepEqual(accounts["form-service"].scopes, []string{"users:read"}) || len(accounts["analytics-service"].scopes) != 0 {
+		t.Errorf("serviceAccountsFromEnv() = %+v", accounts)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/models"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func GetSessions(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering GetSessions Function")
+	type SessionResponse struct {
+		models.Session
+		Current bool `json:"current"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+
+	sessions, err := models.GetUserSessions(c.Request.Context(), user.ID)
+	if err != nil {
+		logger.Error("Failed to get sessions", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	current := c.GetString("session_id")
+	response := make([]SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, SessionResponse{Session: session, Current: session.ID == current})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": response})
+	logger.Debug("Exiting GetSessions Function")
+}
+
+func RevokeSession(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering RevokeSession Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+
+	sessionID := c.Param("session_id")
+	err := models.RevokeSession(c.Request.Context(), user.ID, sessionID)
+	if errors.Is(err, models.ErrSessionNotFound) {
+		logger.Warn("Session not found", zap.Uint("user_id", user.ID), zap.String("session_id", sessionID))
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found or already signed out"})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to revoke session", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Session revoked", zap.Uint("user_id", user.ID), zap.String("session_id", sessionID))
+	revoked := userAuditEvent(SessionRevokedEvent, user)
+	revoked.TargetType, revoked.TargetID = "session", sessionID
+	auditEvent(c, revoked)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session signed out"})
+	logger.Debug("Exiting RevokeSession Function")
+}
+
+// RevokeOtherSessions signs out every session of the user but the one of
+// the access token.
+func RevokeOtherSessions(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering RevokeOtherSessions Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	current := c.GetString("session_id")
+	if current == "" {
+		logger.Warn("Token without session", zap.Uint("user_id", user.ID))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the token has no session, refresh it first"})
+		return
+	}
+
+	revokedIDs, err := models.RevokeOtherSessions(c.Request.Context(), user.ID, current)
+	if err != nil {
+		logger.Error("Failed to revoke sessions", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Other sessions revoked", zap.Uint("user_id", user.ID), zap.Int("count", len(revokedIDs)))
+	revoked := userAuditEvent(SessionRevokedEvent, user)
+	revoked.Details = map[string]interface{}{"sessions": revokedIDs, "kept": current}
+	auditEvent(c, revoked)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Other sessions signed out",
+		"revoked": len(revokedIDs),
+	})
+	logger.Debug("Exiting RevokeOtherSessions Function")
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/database"
+	"auth-service/models"
+	"auth-service/utils"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const invitationTTL = 7 * 24 * time.Hour
+
+// authenticatedUser returns the user of the access token, it responds with
+// 401 and returns false when the token isn't valid.
+func authenticatedUser(c *gin.Context) (models.User, bool) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	claims, err := utils.ValidateJWT(c)
+	if err != nil {
+		logger.Error("Failed to validate JWT", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return models.User{}, false
+	}
+	user, err := models.GetUserById(c.Request.Context(), uint(claims["id"].(float64)))
+	if err != nil || user.ID == 0 {
+		logger.Error("Failed to get user", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+		return models.User{}, false
+	}
+	if accountDisabled(c, user) {
+		return models.User{}, false
+	}
+	// the session of the token, empty for tokens issued before sessions
+	// were tracked
+	sessionID, _ := claims["sid"].(string)
+	c.Set("session_id", sessionID)
+	return user, true
+}
+
+// teamMembership returns the membership of the user in the team of the :id
+// parameter, it responds with 403 and returns false unless the role of the
+// user in the team grants the permission and the user has two-factor
+// authentication when the team requires it.
+func teamMembership(c *gin.Context, user models.User, permission string) (models.TeamMember, bool) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	teamId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse team id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return models.TeamMember{}, false
+	}
+	member, err := models.GetMembership(c.Request.Context(), uint(teamId), user.ID)
+	if errors.Is(err, models.ErrNotTeamMember) {
+		logger.Error("Not a team member", zap.Uint("user_id", user.ID), zap.Uint64("team_id", teamId))
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return models.TeamMember{}, false
+	}
+	if err != nil {
+		logger.Error("Failed to get membership", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return models.TeamMember{}, false
+	}
+	satisfied, err := member.MFASatisfied(c.Request.Context(), user)
+	if err != nil {
+		logger.Error("Failed to check team two-factor requirement", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return models.TeamMember{}, false
+	}
+	if !satisfied {
+		logger.Warn("Team requires two-factor authentication", zap.Uint("user_id", user.ID), zap.Uint("team_id", member.TeamID))
+		c.JSON(http.StatusForbidden, gin.H{"error": "This team requires two-factor authentication, enable it first"})
+		return models.TeamMember{}, false
+	}
+	if !member.Role.HasPermission(permission) {
+		logger.Error("Permission denied", zap.Uint("user_id", user.ID), zap.String("role", string(member.Role)), zap.String("permission", permission))
+		c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission " + permission})
+		return models.TeamMember{}, false
+	}
+	return member, true
+}
+
+func CreateTeam(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering CreateTeam Function")
+	type CreateTeamRequest struct {
+		Name string `json:"name" binding:"required"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+
+	var createTeamRequest CreateTeamRequest
+	if err := c.ShouldBindJSON(&createTeamRequest); err != nil || strings.TrimSpace(createTeamRequest.Name) == "" {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	team, err := models.CreateTeam(database.DB.WithContext(c.Request.Context()), createTeamRequest.Name, &user)
+	if err != nil {
+		logger.Error("Failed to create team", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Team created", zap.Uint("team_id", team.ID), zap.Uint("owner_id", user.ID))
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Team created and made active, refresh the token to use it",
+		"team":    team,
+	})
+	logger.Debug("Exiting CreateTeam Function")
+}
+
+func GetTeams(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering GetTeams Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+
+	memberships, err := models.GetUserMemberships(c.Request.Context(), user.ID)
+	if err != nil {
+		logger.Error("Failed to get teams", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"active_team_id": user.ActiveTeamID,
+		"teams":          memberships,
+	})
+	logger.Debug("Exiting GetTeams Function")
+}
+
+// SwitchTeam makes the team the active team and returns tokens of the current
+// session carrying it.
+func SwitchTeam(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering SwitchTeam Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.TeamReadPermission)
+	if !ok {
+		return
+	}
+
+	if err := models.SetActiveTeam(c.Request.Context(), &user, member.TeamID); err != nil {
+		logger.Error("Failed to set active team", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	tokens, err := reissueTokens(c, user)
+	if errors.Is(err, models.ErrSessionNotFound) {
+		logger.Warn("Session signed out", zap.Uint("user_id", user.ID), zap.String("session_id", c.GetString("session_id")))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": utils.ErrSessionRevoked.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to generate JWT", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Debug("Active team switched", zap.Uint("user_id", user.ID), zap.Uint("team_id", member.TeamID))
+
+	tokens["message"] = "Active team switched"
+	tokens["team_id"] = member.TeamID
+	tokens["team_role"] = member.Role
+	c.JSON(http.StatusOK, tokens)
+	logger.Debug("Exiting SwitchTeam Function")
+}
+
+func GetTeamMembers(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering GetTeamMembers Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.TeamReadPermission)
+	if !ok {
+		return
+	}
+
+	members, err := models.GetTeamMembers(c.Request.Context(), member.TeamID)
+	if err != nil {
+		logger.Error("Failed to get team members", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+	logger.Debug("Exiting GetTeamMembers Function")
+}
+
+func UpdateTeamMember(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering UpdateTeamMember Function")
+	type UpdateTeamMemberRequest struct {
+		Role models.TeamRole `json:"role"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.TeamManagePermission)
+	if !ok {
+		return
+	}
+
+	var updateRequest UpdateTeamMemberRequest
+	if err := c.ShouldBindJSON(&updateRequest); err != nil || !updateRequest.Role.Valid() {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of owner, admin, editor or viewer"})
+		return
+	}
+	userId, err := strconv.ParseUint(c.Param("user_id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse user id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	target, err := models.GetMembership(c.Request.Context(), member.TeamID, uint(userId))
+	if err != nil {
+		logger.Error("Failed to get membership", zap.Error(err))
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if (target.Role == models.OwnerTeamRole || updateRequest.Role == models.OwnerTeamRole) && member.Role != models.OwnerTeamRole {
+		logger.Error("Only owners can change owners", zap.Uint("user_id", user.ID))
+		c.JSON(http.StatusForbidden, gin.H{"error": "only owners can grant or change the owner role"})
+		return
+	}
+
+	err = models.UpdateMemberRole(c.Request.Context(), member.TeamID, uint(userId), updateRequest.Role)
+	if errors.Is(err, models.ErrLastTeamOwner) {
+		logger.Error("Failed to update member role", zap.Error(err))
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to update member role", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Team member role updated", zap.Uint("team_id", member.TeamID), zap.Uint64("user_id", userId), zap.String("role", string(updateRequest.Role)))
+	changed := userAuditEvent(TeamRoleChangedEvent, user)
+	changed.TeamID = &member.TeamID
+	changed.TargetType, changed.TargetID = "user", strconv.FormatUint(userId, 10)
+	changed.Details = map[string]interface{}{"from": target.Role, "to": updateRequest.Role}
+	auditEvent(c, changed)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Team member updated", "role": updateRequest.Role})
+	logger.Debug("Exiting UpdateTeamMember Function")
+}
+
+// RemoveTeamMember removes a member, members can always remove themselves.
+func RemoveTeamMember(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering RemoveTeamMember Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.TeamReadPermission)
+	if !ok {
+		return
+	}
+	userId, err := strconv.ParseUint(c.Param("user_id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse user id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if uint(userId) != user.ID {
+		target, err := models.GetMembership(c.Request.Context(), member.TeamID, uint(userId))
+		if err != nil {
+			logger.Error("Failed to get membership", zap.Error(err))
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if !member.Role.HasPermission(models.TeamManagePermission) || (target.Role == models.OwnerTeamRole && member.Role != models.OwnerTeamRole) {
+			logger.Error("Team role too low", zap.Uint("user_id", user.ID), zap.String("role", string(member.Role)))
+			c.JSON(http.StatusForbidden, gin.H{"error": "you can't remove this member"})
+			return
+		}
+	}
+
+	err = models.RemoveMember(c.Request.Context(), member.TeamID, uint(userId))
+	if errors.Is(err, models.ErrLastTeamOwner) {
+		logger.Error("Failed to remove member", zap.Error(err))
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to remove member", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Team member removed", zap.Uint("team_id", member.TeamID), zap.Uint64("user_id", userId))
+	removed := userAuditEvent(TeamMemberRemovedEvent, user)
+	removed.TeamID = &member.TeamID
+	removed.TargetType, removed.TargetID = "user", strconv.FormatUint(userId, 10)
+	auditEvent(c, removed)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Team member removed"})
+	logger.Debug("Exiting RemoveTeamMember Function")
+}
+
+func GetTeamInvitations(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering GetTeamInvitations Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.TeamManagePermission)
+	if !ok {
+		return
+	}
+
+	invitations, err := models.GetTeamInvitations(c.Request.Context(), member.TeamID)
+	if err != nil {
+		logger.Error("Failed to get invitations", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, invitations)
+	logger.Debug("Exiting GetTeamInvitations Function")
+}
+
+func InviteTeamMember(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering InviteTeamMember Function")
+	type InviteRequest struct {
+		Email string          `json:"email" binding:"required"`
+		Role  models.TeamRole `json:"role"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.TeamManagePermission)
+	if !ok {
+		return
+	}
+
+	var inviteRequest InviteRequest
+	if err := c.ShouldBindJSON(&inviteRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if inviteRequest.Role == "" {
+		inviteRequest.Role = models.ViewerTeamRole
+	}
+	if !inviteRequest.Role.Valid() {
+		logger.Error("Invalid team role", zap.String("role", string(inviteRequest.Role)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of owner, admin, editor or viewer"})
+		return
+	}
+	if inviteRequest.Role == models.OwnerTeamRole && member.Role != models.OwnerTeamRole {
+		logger.Error("Only owners can invite owners", zap.Uint("user_id", user.ID))
+		c.JSON(http.StatusForbidden, gin.H{"error": "only owners can grant or change the owner role"})
+		return
+	}
+
+	token, invitation, err := models.CreateInvitation(c.Request.Context(), member.TeamID, inviteRequest.Email, inviteRequest.Role, user.ID, invitationTTL)
+	if err != nil {
+		logger.Error("Failed to create invitation", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Team member invited", zap.Uint("team_id", member.TeamID), zap.Uint("invitation_id", invitation.ID))
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":    "Invitation created",
+		"invitation": invitation,
+		"token":      token,
+	})
+	logger.Debug("Exiting InviteTeamMember Function")
+}
+
+func DeleteTeamInvitation(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering DeleteTeamInvitation Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	member, ok := teamMembership(c, user, models.TeamManagePermission)
+	if !ok {
+		return
+	}
+	invitationId, err := strconv.ParseUint(c.Param("invitation_id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse invitation id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.DeleteInvitation(c.Request.Context(), member.TeamID, uint(invitationId)); err != nil {
+		logger.Error("Failed to delete invitation", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation deleted"})
+	logger.Debug("Exiting DeleteTeamInvitation Function")
+}
+
+func AcceptInvitation(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering AcceptInvitation Function")
+	type AcceptRequest struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+
+	var acceptRequest AcceptRequest
+	if err := c.ShouldBindJSON(&acceptRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	member, err := models.AcceptInvitation(c.Request.Context(), acceptRequest.Token, user)
+	if errors.Is(err, models.ErrEmailNotVerified) {
+		logger.Warn("Failed to accept invitation", zap.Uint("user_id", user.ID), zap.Error(err))
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, models.ErrInvalidInvitation) {
+		logger.Warn("Failed to accept invitation", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to accept invitation", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Invitation accepted", zap.Uint("team_id", member.TeamID), zap.Uint("user_id", user.ID))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Invitation accepted",
+		"team_id":   member.TeamID,
+		"team_role": member.Role,
+	})
+	logger.Debug("Exiting AcceptInvitation Function")
+}
@@ -0,0 +1,66 @@
+package telemetry
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// gormSpanKey keeps the span of a statement between its callbacks.
+const gormSpanKey = "telemetry:span"
+
+// TraceGorm records a span for each query of the database. Its parent is the
+// span of the context the query runs with, given with db.WithContext.
+func TraceGorm(db *gorm.DB) error {
+	callbacks := db.Callback()
+	return errors.Join(
+		callbacks.Create().Before("gorm:create").Register("telemetry:before_create", startQuery("insert")),
+		callbacks.Create().After("gorm:create").Register("telemetry:after_create", endQuery),
+		callbacks.Query().Before("gorm:query").Register("telemetry:before_query", startQuery("select")),
+		callbacks.Query().After("gorm:query").Register("telemetry:after_query", endQuery),
+		callbacks.Update().Before("gorm:update").Register("telemetry:before_update", startQuery("update")),
+		callbacks.Update().After("gorm:update").Register("telemetry:after_update", endQuery),
+		callbacks.Delete().Before("gorm:delete").Register("telemetry:before_delete", startQuery("delete")),
+		callbacks.Delete().After("gorm:delete").Register("telemetry:after_delete", endQuery),
+		callbacks.Row().Before("gorm:row").Register("telemetry:before_row", startQuery("row")),
+		callbacks.Row().After("gorm:row").Register("telemetry:after_row", endQuery),
+		callbacks.Raw().Before("gorm:raw").Register("telemetry:before_raw", startQuery("raw")),
+		callbacks.Raw().After("gorm:raw").Register("telemetry:after_raw", endQuery),
+	)
+}
+
+func startQuery(operation string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		_, span := tracer().Start(tx.Statement.Context, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBOperation(operation)),
+		)
+		tx.InstanceSet(gormSpanKey, span)
+	}
+}
+
+// endQuery adds the statement, without its values, to the span. Records
+// not found aren't failures of the database.
+func endQuery(tx *gorm.DB) {
+	value, ok := tx.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(
+		semconv.DBStatement(tx.Statement.SQL.String()),
+		semconv.DBSQLTable(tx.Statement.Table),
+		attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+	)
+	err := tx.Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+	}
+	End(span, err)
+}
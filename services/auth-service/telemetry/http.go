@@ -0,0 +1,28 @@
+package telemetry
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Middleware starts a server span for each request, continuing the trace of
+// its traceparent header. Health checks, polled by the gateway, aren't
+// traced.
+func Middleware(service string) gin.HandlerFunc {
+	return otelgin.Middleware(service, otelgin.WithFilter(func(req *http.Request) bool {
+		return !strings.HasSuffix(req.URL.Path, "/health")
+	}))
+}
+
+// Transport sends the requests with base, or http.DefaultTransport when nil,
+// in client spans and passes their trace context on in the headers.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(base)
+}
@@ -0,0 +1,58 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the state in the process, it is lost on restart and
+// not shared between instances.
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[string]State
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: map[string]State{}}
+}
+
+func (store *MemoryStore) Get(ctx context.Context, key string) (State, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.states[key], nil
+}
+
+func (store *MemoryStore) Fail(ctx context.Context, key string, now time.Time, window time.Duration, block func(failures int) time.Duration) (State, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	state := store.states[key]
+	if now.Sub(state.LastFailure) > window && !now.Before(state.BlockedUntil) {
+		state = State{}
+	}
+	state.Failures++
+	state.LastFailure = now
+	state.BlockedUntil = now.Add(block(state.Failures))
+	store.states[key] = state
+	return state, nil
+}
+
+func (store *MemoryStore) Reset(ctx context.Context, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.states, key)
+	return nil
+}
+
+func (store *MemoryStore) Cleanup(before time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	for key, state := range store.states {
+		if state.LastFailure.Before(before) && !now.Before(state.BlockedUntil) {
+			delete(store.states, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Attempt is the row of a key in the Postgres store.
+type Attempt struct {
+	Key          string    `gorm:"primaryKey;size:255"`
+	Failures     int       `gorm:"not null;default:0"`
+	LastFailure  time.Time `gorm:"not null;index"`
+	BlockedUntil time.Time `gorm:"not null"`
+}
+
+func (Attempt) TableName() string {
+	return "login_attempts"
+}
+
+// PostgresStore shares the state between instances, the row of a key is
+// locked while a failure is recorded.
+type PostgresStore struct {
+	DB *gorm.DB
+}
+
+func (store *PostgresStore) Get(ctx context.Context, key string) (State, error) {
+	var attempt Attempt
+	err := store.DB.WithContext(ctx).Where("key = ?", key).First(&attempt).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return State{}, nil
+	}
+	if err != nil {
+		return State{}, err
+	}
+	return State{Failures: attempt.Failures, LastFailure: attempt.LastFailure, BlockedUntil: attempt.BlockedUntil}, nil
+}
+
+func (store *PostgresStore) Fail(ctx context.Context, key string, now time.Time, window time.Duration, block func(failures int) time.Duration) (State, error) {
+	var state State
+	err := store.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Attempt{Key: key, LastFailure: now, BlockedUntil: now}).Error; err != nil {
+			return err
+		}
+		var attempt Attempt
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&attempt).Error; err != nil {
+			return err
+		}
+
+		if now.Sub(attempt.LastFailure) > window && !now.Before(attempt.BlockedUntil) {
+			attempt.Failures = 0
+		}
+		attempt.Failures++
+		attempt.LastFailure = now
+		attempt.BlockedUntil = now.Add(block(attempt.Failures))
+		if err := tx.Save(&attempt).Error; err != nil {
+			return err
+		}
+		state = State{Failures: attempt.Failures, LastFailure: attempt.LastFailure, BlockedUntil: attempt.BlockedUntil}
+		return nil
+	})
+	return state, err
+}
+
+func (store *PostgresStore) Reset(ctx context.Context, key string) error {
+	return store.DB.WithContext(ctx).Where("key = ?", key).Delete(&Attempt{}).Error
+}
+
+func (store *PostgresStore) Cleanup(before time.Time) error {
+	return store.DB.Where("last_failure < ? AND blocked_until < ?", before, time.Now()).Delete(&Attempt{}).Error
+}
@@ -0,0 +1,94 @@
+// Package throttle slows down and locks out keys, such as an account or a
+// client IP, after repeated failures. The state is kept in a Store: in
+// memory for a single instance, or in Postgres when several instances
+// share it.
+package throttle
+
+import (
+	"context"
+	"time"
+)
+
+// State is the number of recent failures of a key and until when further
+// attempts are refused.
+type State struct {
+	Failures     int
+	LastFailure  time.Time
+	BlockedUntil time.Time
+}
+
+type Store interface {
+	// Get returns the state of the key, the zero State when it has none.
+	Get(ctx context.Context, key string) (State, error)
+	// Fail records a failure of the key. Failures older than window are
+	// forgotten first, unless the key is still blocked. block returns how
+	// long the key is blocked for its new number of failures.
+	Fail(ctx context.Context, key string, now time.Time, window time.Duration, block func(failures int) time.Duration) (State, error)
+	Reset(ctx context.Context, key string) error
+	// Cleanup drops the keys without a failure since before which aren't
+	// blocked anymore.
+	Cleanup(before time.Time) error
+}
+
+// Policy lets a few attempts through, then blocks each further failure for
+// an exponentially growing delay and locks the key out after LockoutAfter
+// failures.
+type Policy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	// Window is how long failures are remembered without a new one.
+	Window time.Duration
+}
+
+// Delay returns how long a key is blocked after its nth failure.
+func (policy Policy) Delay(failures int) time.Duration {
+	if failures >= policy.LockoutAfter {
+		return policy.LockoutDuration
+	}
+	if failures <= policy.FreeAttempts {
+		return 0
+	}
+	delay := policy.BaseDelay
+	for i := policy.FreeAttempts + 1; i < failures && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	return delay
+}
+
+type Limiter struct {
+	Store  Store
+	Policy Policy
+}
+
+// Check returns how long to wait before the key may try again, 0 when it
+// may try now.
+func (limiter Limiter) Check(ctx context.Context, key string, now time.Time) (time.Duration, error) {
+	state, err := limiter.Store.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if wait := state.BlockedUntil.Sub(now); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// Fail records a failure of the key, locked reports whether it locked the
+// key out.
+func (limiter Limiter) Fail(ctx context.Context, key string, now time.Time) (state State, locked bool, err error) {
+	state, err = limiter.Store.Fail(ctx, key, now, limiter.Policy.Window, limiter.Policy.Delay)
+	if err != nil {
+		return State{}, false, err
+	}
+	return state, state.Failures >= limiter.Policy.LockoutAfter, nil
+}
+
+func (limiter Limiter) Reset(ctx context.Context, key string) error {
+	return limiter.Store.Reset(ctx, key)
+}
@@ -0,0 +1,130 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	FreeAttempts:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        10 * time.Second,
+	LockoutAfter:    10,
+	LockoutDuration: 15 * time.Minute,
+	Window:          time.Hour,
+}
+
+func TestPolicyDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 0, want: 0},
+		{failures: 3, want: 0},
+		{failures: 4, want: time.Second},
+		{failures: 5, want: 2 * time.Second},
+		{failures: 6, want: 4 * time.Second},
+		{failures: 7, want: 8 * time.Second},
+		{failures: 8, want: 10 * time.Second},
+		{failures: 9, want: 10 * time.Second},
+		{failures: 10, want: 15 * time.Minute},
+		{failures: 50, want: 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := testPolicy.Delay(tt.failures); got != tt.want {
+			t.Errorf("Delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	limiter := Limiter{Store: NewMemoryStore(), Policy: testPolicy}
+	now := time.Unix(1700000000, 0)
+
+	for i := 1; i <= testPolicy.LockoutAfter; i++ {
+		wait, err := limiter.Check(ctx, "user@example.com", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != 0 {
+			t.Fatalf("Check() before failure %d = %v, want 0", i, wait)
+		}
+		state, locked, err := limiter.Fail(ctx, "user@example.com", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Failures != i || locked != (i == testPolicy.LockoutAfter) {
+			t.Fatalf("Fail() %d = %d failures, locked %v", i, state.Failures, locked)
+		}
+		// wait out the delay of the failure
+		now = now.Add(testPolicy.Delay(i))
+		if i < testPolicy.LockoutAfter {
+			continue
+		}
+		// locked out until the lockout is over
+		if wait, _ := limiter.Check(ctx, "user@example.com", now.Add(-time.Minute)); wait != time.Minute {
+			t.Errorf("Check() while locked out = %v, want 1m", wait)
+		}
+	}
+
+	if wait, _ := limiter.Check(ctx, "other@example.com", now); wait != 0 {
+		t.Errorf("Check() of another key = %v, want 0", wait)
+	}
+
+	// a failure right after the lockout keeps counting
+	state, locked, err := limiter.Fail(ctx, "user@example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Failures != testPolicy.LockoutAfter+1 || !locked {
+		t.Errorf("Fail() after the lockout = %d failures, locked %v", state.Failures, locked)
+	}
+
+	if err := limiter.Reset(ctx, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := limiter.Check(ctx, "user@example.com", now); wait != 0 {
+		t.Errorf("Check() after Reset = %v, want 0", wait)
+	}
+	if state, _, _ := limiter.Fail(ctx, "user@example.com", now); state.Failures != 1 {
+		t.Errorf("Fail() after Reset = %d failures, want 1", state.Failures)
+	}
+}
+
+func TestMemoryStoreWindow(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	now := time.Unix(1700000000, 0)
+	noDelay := func(int) time.Duration { return 0 }
+	lockout := func(int) time.Duration { return 2 * time.Hour }
+
+	store.Fail(ctx, "forgotten", now, time.Hour, noDelay)
+	store.Fail(ctx, "remembered", now, time.Hour, noDelay)
+	store.Fail(ctx, "locked", now, time.Hour, lockout)
+
+	later := now.Add(90 * time.Minute)
+	tests := []struct {
+		key  string
+		want int
+	}{
+		// failures older than the window are forgotten
+		{key: "forgotten", want: 1},
+		// unless the key is still blocked
+		{key: "locked", want: 2},
+	}
+	for _, tt := range tests {
+		state, err := store.Fail(ctx, tt.key, later, time.Hour, noDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Failures != tt.want {
+			t.Errorf("Fail(%q) = %d failures, want %d", tt.key, state.Failures, tt.want)
+		}
+	}
+
+	if state, _ := store.Fail(ctx, "remembered", now.Add(30*time.Minute), time.Hour, noDelay); state.Failures != 2 {
+		t.Errorf("Fail() within the window = %d failures, want 2", state.Failures)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/models"
+	"auth-service/utils"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+// issueTokens starts a new session of the user on the device of the request
+// and returns its access token and refresh token.
+func issueTokens(c *gin.Context, user models.User) (gin.H, error) {
+	refreshToken, stored, err := models.StartSession(c.Request.Context(), user.ID, c.Request.UserAgent(), c.ClientIP(), utils.RefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return sessionTokens(c.Request.Context(), user, refreshToken, stored)
+}
+
+// reissueTokens returns new tokens of the session of the access token of the
+// request, set by authenticatedUser, the earlier refresh token stops working.
+// Tokens issued before sessions were tracked get a new session.
+func reissueTokens(c *gin.Context, user models.User) (gin.H, error) {
+	sessionID := c.GetString("session_id")
+	if sessionID == "" {
+		return issueTokens(c, user)
+	}
+	refreshToken, stored, err := models.ContinueSession(c.Request.Context(), user.ID, sessionID, c.Request.UserAgent(), c.ClientIP(), utils.RefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return sessionTokens(c.Request.Context(), user, refreshToken, stored)
+}
+
+func sessionTokens(ctx context.Context, user models.User, refreshToken string, stored *models.RefreshToken) (gin.H, error) {
+	token, err := utils.GenerateJWT(ctx, user, stored.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(utils.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+func Refresh(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering Refresh Function")
+	type RefreshRequest struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+
+	var refreshRequest RefreshRequest
+	if err := c.ShouldBindJSON(&refreshRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	refreshToken, stored, err := models.RotateRefreshToken(c.Request.Context(), refreshRequest.RefreshToken, utils.RefreshTokenTTL, c.Request.UserAgent(), c.ClientIP())
+	if errors.Is(err, models.ErrRefreshTokenReused) {
+		logger.Warn("Refresh token reuse detected", zap.Uint("user_id", stored.UserID), zap.String("family_id", stored.FamilyID))
+		auditEvent(c, models.AuditEvent{
+			Event:     TokenReusedEvent,
+			ActorID:   &stored.UserID,
+			ActorType: models.UserAuditActor,
+			Outcome:   models.FailureAuditOutcome,
+			Details:   map[string]interface{}{"family_id": stored.FamilyID},
+		})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, models.ErrInvalidRefreshToken) || errors.Is(err, models.ErrRefreshTokenExpired) || errors.Is(err, models.ErrRefreshTokenRevoked) {
+		logger.Warn("Failed to refresh token", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to rotate refresh token", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := models.GetUserById(c.Request.Context(), stored.UserID)
+	if err != nil {
+		logger.Error("Failed to get user", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user.ID == 0 {
+		logger.Warn("Refresh token of a deleted user", zap.Uint("user_id", stored.UserID))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": models.ErrInvalidRefreshToken.Error()})
+		return
+	}
+	if accountDisabled(c, user) {
+		return
+	}
+
+	token, err := utils.GenerateJWT(c.Request.Context(), user, stored.FamilyID)
+	if err != nil {
+		logger.Error("Failed to generate JWT", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Debug("Token refreshed", zap.Uint("user_id", user.ID), zap.String("family_id", stored.FamilyID))
+	refreshed := userAuditEvent(TokenRefreshedEvent, user)
+	refreshed.Details = map[string]interface{}{"family_id": stored.FamilyID}
+	auditEvent(c, refreshed)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Token refreshed",
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(utils.AccessTokenTTL.Seconds()),
+	})
+	logger.Debug("Exiting Refresh Function")
+}
+
+func Logout(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering Logout Function")
+	type LogoutRequest struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	claims, err := utils.ValidateJWT(c)
+	if err != nil {
+		logger.Error("Failed to validate JWT", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	var logoutRequest LogoutRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&logoutRequest); err != nil {
+			logger.Error("Failed to bind JSON", zap.Error(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		expiresAt = jwt.NewNumericDate(time.Now().Add(utils.AccessTokenTTL))
+	}
+	if err := models.RevokeToken(c.Request.Context(), claims["jti"].(string), expiresAt.Time); err != nil {
+		logger.Error("Failed to revoke token", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	revoked := models.AuditEvent{
+		Event:     TokenRevokedEvent,
+		ActorType: models.UserAuditActor,
+		Details:   map[string]interface{}{"jti": claims["jti"]},
+	}
+	// the session of the access token ends, tokens issued before sessions
+	// were tracked name it with the refresh token
+	familyID, _ := claims["sid"].(string)
+	if familyID == "" && logoutRequest.RefreshToken != "" {
+		refreshToken, err := models.GetRefreshToken(c.Request.Context(), logoutRequest.RefreshToken)
+		if err != nil && !errors.Is(err, models.ErrInvalidRefreshToken) {
+			logger.Error("Failed to get refresh token", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err == nil && float64(refreshToken.UserID) == claims["id"].(float64) {
+			familyID = refreshToken.FamilyID
+		}
+	}
+	if familyID != "" {
+		if err := models.RevokeTokenFamily(c.Request.Context(), familyID); err != nil {
+			logger.Error("Failed to revoke refresh token", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		revoked.Details["family_id"] = familyID
+	}
+	logger.Debug("Logged out", zap.Any("id", claims["id"]))
+	actorID := uint(claims["id"].(float64))
+	revoked.ActorID = &actorID
+	if teamID, ok := claims["team_id"].(float64); ok && teamID > 0 {
+		team := uint(teamID)
+		revoked.TeamID = &team
+	}
+	auditEvent(c, revoked)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logout successful"})
+	logger.Debug("Exiting Logout Function")
+}
+
+// cleanupExpiredTokens periodically drops expired revocation entries and
+// refresh tokens.
+func cleanupExpiredTokens(interval time.Duration) {
+	for {
+		if err := models.DeleteExpiredTokens(); err != nil {
+			logger.Error("Failed to delete expired tokens", zap.Error(err))
+		}
+		time.Sleep(interval)
+	}
+}
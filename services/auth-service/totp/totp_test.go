@@ -0,0 +1,95 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the test vectors of RFC 6238,
+// "12345678901234567890" in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// the last 6 digits of the 8 digit codes of RFC 6238 appendix B
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Code() at %d = %q, want %q", tt.unix, got, tt.want)
+		}
+	}
+
+	if got, _ := Code(strings.ToLower(rfcSecret)+"==", 1); got != "287082" {
+		t.Errorf("Code() of a lower case padded secret = %q, want 287082", got)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("Code() of an invalid secret didn't fail")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := Step(now)
+	code := func(step int64) string {
+		code, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current step", code: code(current), wantStep: current, wantOK: true},
+		{name: "previous step", code: code(current - 1), wantStep: current - 1, wantOK: true},
+		{name: "next step", code: code(current + 1), wantStep: current + 1, wantOK: true},
+		{name: "two steps before", code: code(current - 2)},
+		{name: "two steps after", code: code(current + 2)},
+		{name: "with spaces", code: code(current)[:3] + " " + code(current)[3:], wantStep: current, wantOK: true},
+		{name: "too short", code: code(current)[:5]},
+		{name: "too long", code: code(current) + "0"},
+		{name: "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, tt.code, now)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("Validate(%q) = %d, %v, want %d, %v", tt.code, step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Code(secret, 1); err != nil {
+		t.Errorf("Code() of a generated secret: %v", err)
+	}
+	other, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret == other {
+		t.Error("GenerateSecret() returned the same secret twice")
+	}
+}
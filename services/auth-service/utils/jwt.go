@@ -2,9 +2,11 @@ package utils
 
 import (
 	"auth-service/models"
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -15,14 +17,119 @@ import (
 
 var secret = []byte(os.Getenv("JWT_SECRET"))
 
-func GenerateJWT(user models.User) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":   user.ID,
-		"role": user.Role,
-		"iat":  time.Now().Unix(),
-		"eat":  time.Now().Add(24 * time.Hour).Unix(),
+var (
+	AccessTokenTTL  = durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+	RefreshTokenTTL = durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	// ServiceTokenTTL is short, services fetch a new token before expiry.
+	ServiceTokenTTL = durationFromEnv("SERVICE_TOKEN_TTL", 5*time.Minute)
+)
+
+// ServiceTokenUse is the token_use claim of service tokens, so they are
+// never taken for access tokens and the other way round.
+const ServiceTokenUse = "service"
+
+// ServiceTokenAudience is the audience of the service tokens the auth
+// service accepts, tokens minted for other services are refused.
+const ServiceTokenAudience = "auth-service"
+
+var (
+	ErrTokenRevoked         = errors.New("token has been revoked")
+	ErrSessionRevoked       = errors.New("session has been signed out")
+	ErrNotServiceToken      = errors.New("not a service token")
+	ErrServiceTokenDisabled = errors.New("service tokens need JWT_SIGNING_ALG RS256 or EdDSA")
+)
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// GenerateJWT returns an access token of the user in the session, it stops
+// working when the session is signed out.
+func GenerateJWT(ctx context.Context, user models.User, sessionID string) (string, error) {
+	jti, err := models.RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"id":             user.ID,
+		"role":           user.Role,
+		"email_verified": user.EmailVerified,
+		"phone_verified": user.PhoneVerified,
+		"jti":            jti,
+		"sid":            sessionID,
+		"iat":            now.Unix(),
+		"nbf":            now.Unix(),
+		"exp":            now.Add(AccessTokenTTL).Unix(),
+	}
+	member, err := models.GetActiveMembership(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	if member != nil {
+		// members without two-factor authentication can't act for teams
+		// requiring it, they can still sign in to enable it
+		satisfied, err := member.MFASatisfied(ctx, user)
+		if err != nil {
+			return "", err
+		}
+		if !satisfied {
+			member = nil
+		}
+	}
+	if member != nil {
+		claims["team_id"] = member.TeamID
+		claims["team_role"] = member.Role
+	}
+	claims["permissions"] = models.UserPermissions(user, member)
+	if SigningAlgorithm == "HS256" {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	}
+	return signWithActiveKey(claims)
+}
+
+// GenerateServiceToken returns a token of the service account carrying the
+// scopes, only accepted by the audience. The services check it against the
+// JWKS, so it is only signed with the published keys.
+func GenerateServiceToken(name string, scopes []string, audience string) (string, error) {
+	if SigningAlgorithm == "HS256" {
+		return "", ErrServiceTokenDisabled
+	}
+	jti, err := models.RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return signWithActiveKey(jwt.MapClaims{
+		"sub":       name,
+		"aud":       audience,
+		"token_use": ServiceTokenUse,
+		"scopes":    scopes,
+		"jti":       jti,
+		"iat":       now.Unix(),
+		"nbf":       now.Unix(),
+		"exp":       now.Add(ServiceTokenTTL).Unix(),
 	})
-	return token.SignedString(secret)
+}
+
+func signWithActiveKey(claims jwt.MapClaims) (string, error) {
+	key, err := activeKey()
+	if err != nil {
+		// another replica may be creating the first key
+		if err := LoadSigningKeys(); err != nil {
+			return "", err
+		}
+		if key, err = activeKey(); err != nil {
+			return "", err
+		}
+	}
+	token := jwt.NewWithClaims(signingMethod(key.alg), claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.signer)
 }
 
 func ValidateJWT(c *gin.Context) (jwt.MapClaims, error) {
@@ -31,10 +138,48 @@ func ValidateJWT(c *gin.Context) (jwt.MapClaims, error) {
 		return nil, err
 	}
 	claims, ok := token.Claims.(jwt.MapClaims)
-	if ok && token.Valid {
-		return claims, nil
+	if !ok || !token.Valid || claims["token_use"] == ServiceTokenUse {
+		return nil, errors.New("invalid token provided")
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, errors.New("invalid token provided")
 	}
-	return nil, errors.New("invalid token provided")
+	revoked, err := models.IsTokenRevoked(c.Request.Context(), jti)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	if sid, _ := claims["sid"].(string); sid != "" {
+		if revoked, err = models.IsSessionRevoked(c.Request.Context(), sid); err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrSessionRevoked
+		}
+	}
+	return claims, nil
+}
+
+// ValidateServiceToken returns the claims of the service token of the
+// request, minted for the auth service.
+func ValidateServiceToken(c *gin.Context) (jwt.MapClaims, error) {
+	token, err := getToken(c)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || token.Method.Alg() == "HS256" || claims["token_use"] != ServiceTokenUse {
+		return nil, ErrNotServiceToken
+	}
+	audience, err := claims.GetAudience()
+	if err != nil || !slices.Contains(audience, ServiceTokenAudience) {
+		return nil, ErrNotServiceToken
+	}
+	return claims, nil
 }
 
 func CurrentUser(c *gin.Context) models.User {
@@ -44,7 +189,7 @@ func CurrentUser(c *gin.Context) models.User {
 	}
 	userId := uint(claims["id"].(float64))
 
-	user, err := models.GetUserById(userId)
+	user, err := models.GetUserById(c.Request.Context(), userId)
 	if err != nil {
 		return models.User{}
 	}
@@ -54,12 +199,15 @@ func CurrentUser(c *gin.Context) models.User {
 func getToken(c *gin.Context) (*jwt.Token, error) {
 	tokenString := getTokenFromRequest(c)
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if SigningAlgorithm != "HS256" {
+			return verificationKey(token)
+		}
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
 		return secret, nil
-	})
+	}, jwt.WithValidMethods([]string{"RS256", "EdDSA", "HS256"}), jwt.WithExpirationRequired(), jwt.WithIssuedAt())
 	return token, err
 }
 
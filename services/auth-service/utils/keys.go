@@ -0,0 +1,264 @@
+package utils
+
+import (
+	"auth-service/models"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningAlgorithm is one of RS256, EdDSA or HS256. HS256 keeps signing with
+// JWT_SECRET and publishes no keys, it is only meant for existing setups.
+var SigningAlgorithm = signingAlgorithmFromEnv()
+
+var (
+	// KeyRotationInterval is the age after which the active key is replaced.
+	KeyRotationInterval = durationFromEnv("JWT_KEY_ROTATION_INTERVAL", 30*24*time.Hour)
+	// KeyOverlap is how long a replaced key keeps verifying tokens and stays
+	// in the JWKS. It is never shorter than AccessTokenTTL.
+	KeyOverlap = durationFromEnv("JWT_KEY_OVERLAP", 24*time.Hour)
+)
+
+var ErrUnknownKey = errors.New("token signed with an unknown key")
+
+// minReloadInterval limits how often an unknown kid reloads the keys, so
+// tokens with random kids can't hammer the database.
+const minReloadInterval = 10 * time.Second
+
+type signingKey struct {
+	kid       string
+	alg       string
+	signer    crypto.Signer
+	retired   bool
+	createdAt time.Time
+}
+
+type keySet struct {
+	mu       sync.RWMutex
+	keys     []signingKey // newest first
+	loadedAt time.Time
+}
+
+var keys keySet
+
+func signingAlgorithmFromEnv() string {
+	switch alg := os.Getenv("JWT_SIGNING_ALG"); alg {
+	case "HS256", "EdDSA":
+		return alg
+	default:
+		return "RS256"
+	}
+}
+
+func signingMethod(alg string) jwt.SigningMethod {
+	if alg == "EdDSA" {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// LoadSigningKeys reads the published keys from the database, creating the
+// first key when there is none.
+func LoadSigningKeys() error {
+	if SigningAlgorithm == "HS256" {
+		return nil
+	}
+	if err := reloadSigningKeys(); err != nil {
+		return err
+	}
+	if _, err := activeKey(); err != nil {
+		return RotateSigningKey()
+	}
+	return nil
+}
+
+// RotateSigningKey creates a new key which signs all new tokens. The
+// previous keys are retired and keep verifying tokens for the overlap.
+func RotateSigningKey() error {
+	key, err := generateSigningKey(SigningAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	overlap := KeyOverlap
+	if overlap < AccessTokenTTL {
+		overlap = AccessTokenTTL
+	}
+	if _, err := models.ReplaceActiveSigningKey(context.Background(), key, overlap); err != nil {
+		return err
+	}
+	// another replica may have rotated at the same time, use what is stored
+	return reloadSigningKeys()
+}
+
+func reloadSigningKeys() error {
+	stored, err := models.GetPublishedSigningKeys(context.Background())
+	if err != nil {
+		return err
+	}
+
+	loaded := make([]signingKey, 0, len(stored))
+	for _, key := range stored {
+		signer, err := parsePrivateKey(key.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", key.Kid, err)
+		}
+		loaded = append(loaded, signingKey{
+			kid:       key.Kid,
+			alg:       key.Algorithm,
+			signer:    signer,
+			retired:   key.RetiredAt != nil,
+			createdAt: key.CreatedAt,
+		})
+	}
+
+	keys.mu.Lock()
+	keys.keys = loaded
+	keys.loadedAt = time.Now()
+	keys.mu.Unlock()
+	return nil
+}
+
+// SigningKeyDue reports whether the active key is older than the rotation
+// interval.
+func SigningKeyDue() bool {
+	if SigningAlgorithm == "HS256" {
+		return false
+	}
+	key, err := activeKey()
+	return err != nil || time.Since(key.createdAt) >= KeyRotationInterval
+}
+
+func activeKey() (signingKey, error) {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+	for _, key := range keys.keys {
+		if !key.retired && key.alg == SigningAlgorithm {
+			return key, nil
+		}
+	}
+	return signingKey{}, errors.New("no active signing key")
+}
+
+func keyByID(kid string) (signingKey, bool) {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+	for _, key := range keys.keys {
+		if key.kid == kid {
+			return key, true
+		}
+	}
+	return signingKey{}, false
+}
+
+// verificationKey returns the public key for the kid of a token. Unknown
+// kids reload the keys once, they may have been rotated by another replica.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := keyByID(kid)
+	if !ok {
+		keys.mu.RLock()
+		stale := time.Since(keys.loadedAt) > minReloadInterval
+		keys.mu.RUnlock()
+		if stale {
+			if err := reloadSigningKeys(); err != nil {
+				return nil, err
+			}
+			key, ok = keyByID(kid)
+		}
+	}
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.alg {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.signer.Public(), nil
+}
+
+func generateSigningKey(alg string) (*models.SigningKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case "EdDSA":
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := models.RandomToken(12)
+	if err != nil {
+		return nil, err
+	}
+	return &models.SigningKey{
+		Kid:        kid,
+		Algorithm:  alg,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	}, nil
+}
+
+func parsePrivateKey(data string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported key type")
+	}
+	return signer, nil
+}
+
+// JWKS returns the public keys of the published signing keys as a JSON Web
+// Key Set.
+func JWKS() map[string]interface{} {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+
+	set := []map[string]interface{}{}
+	for _, key := range keys.keys {
+		jwk := map[string]interface{}{
+			"kid": key.kid,
+			"alg": key.alg,
+			"use": "sig",
+		}
+		switch public := key.signer.Public().(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		set = append(set, jwk)
+	}
+	return map[string]interface{}{"keys": set}
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"errors"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"auth-service/database"
+	"auth-service/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// mockDB replaces the database of the models with a mock for the test.
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: conn}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = previous
+		conn.Close()
+	})
+	return mock
+}
+
+// testSigningKey returns a new EdDSA key, stored as the database has it.
+func testSigningKey(t *testing.T) (*models.SigningKey, signingKey) {
+	t.Helper()
+	stored, err := generateSigningKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := parsePrivateKey(stored.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored, signingKey{kid: stored.Kid, alg: stored.Algorithm, signer: signer}
+}
+
+// useKeys replaces the loaded keys for the test, loaded at loadedAt.
+func useKeys(t *testing.T, loadedAt time.Time, loaded ...signingKey) {
+	t.Helper()
+	previousAlg := SigningAlgorithm
+	SigningAlgorithm = "EdDSA"
+	keys.mu.Lock()
+	previous, previousLoadedAt := keys.keys, keys.loadedAt
+	keys.keys, keys.loadedAt = loaded, loadedAt
+	keys.mu.Unlock()
+	t.Cleanup(func() {
+		SigningAlgorithm = previousAlg
+		keys.mu.Lock()
+		keys.keys, keys.loadedAt = previous, previousLoadedAt
+		keys.mu.Unlock()
+	})
+}
+
+// serviceTokenOf returns a service token for the auth service signed with
+// the key.
+func serviceTokenOf(t *testing.T, key signingKey) string {
+	t.Helper()
+	now := time.Now()
+	token := jwt.NewWithClaims(signingMethod(key.alg), jwt.MapClaims{
+		"sub":       "forms",
+		"aud":       ServiceTokenAudience,
+		"token_use": ServiceTokenUse,
+		"iat":       now.Unix(),
+		"exp":       now.Add(time.Minute).Unix(),
+	})
+	token.Header["kid"] = key.kid
+	signed, err := token.SignedString(key.signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func validateServiceToken(token string) error {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	c.Request.Header.Set("Authorization", "Bearer "+token)
+	_, err := ValidateServiceToken(c)
+	return err
+}
+
+var signingKeyColumns = []string{"kid", "algorithm", "private_key", "created_at", "retired_at", "expires_at"}
+
+const publishedKeysQuery = `SELECT * FROM "signing_keys" WHERE expires_at IS NULL OR expires_at > $1 ORDER BY created_at desc`
+
+func TestVerificationKey(t *testing.T) {
+	_, active := testSigningKey(t)
+	_, retired := testSigningKey(t)
+	retired.retired = true
+	_, unknown := testSigningKey(t)
+	useKeys(t, time.Now(), active, retired)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "active key", token: serviceTokenOf(t, active)},
+		// tokens signed before a rotation stay valid for the overlap
+		{name: "retired key", token: serviceTokenOf(t, retired)},
+		// the keys were just loaded, they aren't reloaded
+		{name: "unknown key", token: serviceTokenOf(t, unknown), wantErr: ErrUnknownKey},
+		{name: "no kid", token: serviceTokenOf(t, signingKey{alg: unknown.alg, signer: unknown.signer}), wantErr: ErrUnknownKey},
+		// the kid of a key with another private key
+		{name: "forged with a known kid", token: serviceTokenOf(t, signingKey{kid: active.kid, alg: unknown.alg, signer: unknown.signer}), wantErr: jwt.ErrTokenSignatureInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			if err := validateServiceToken(tt.token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ValidateServiceToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestVerificationKeyReload(t *testing.T) {
+	storedActive, active := testSigningKey(t)
+	_, expired := testSigningKey(t)
+	expired.retired = true
+	storedRotated, rotated := testSigningKey(t)
+	// loaded before another replica rotated the key and the retired key
+	// expired
+	useKeys(t, time.Now().Add(-time.Minute), active, expired)
+
+	mock := mockDB(t)
+	now := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta(publishedKeysQuery)).
+		WillReturnRows(sqlmock.NewRows(signingKeyColumns).
+			AddRow(storedRotated.Kid, storedRotated.Algorithm, storedRotated.PrivateKey, now, nil, nil).
+			AddRow(storedActive.Kid, storedActive.Algorithm, storedActive.PrivateKey, now.Add(-time.Hour), now, now.Add(time.Hour)))
+
+	// the unknown kid reloads the keys
+	if err := validateServiceToken(serviceTokenOf(t, rotated)); err != nil {
+		t.Errorf("ValidateServiceToken() of the rotated key: %v", err)
+	}
+	if err := validateServiceToken(serviceTokenOf(t, active)); err != nil {
+		t.Errorf("ValidateServiceToken() of the retired key: %v", err)
+	}
+	// dropped by the reload, the keys aren't reloaded again so soon
+	if err := validateServiceToken(serviceTokenOf(t, expired)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("ValidateServiceToken() of the expired key error = %v, want %v", err, ErrUnknownKey)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	key, err := activeKey()
+	if err != nil || key.kid != rotated.kid {
+		t.Errorf("activeKey() = %q, %v, want the rotated key %q", key.kid, err, rotated.kid)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"auth-service/correlation"
+	"auth-service/delivery"
+	"auth-service/models"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+var emailSender, smsSender delivery.Sender
+
+// sendVerificationCode creates a code for the channel of the user and sends
+// it to the address being verified.
+func sendVerificationCode(ctx context.Context, user models.User, channel models.VerificationChannel) error {
+	code, verification, err := models.CreateVerificationCode(ctx, user, channel)
+	if err != nil {
+		return err
+	}
+
+	message := delivery.Message{
+		To:   verification.Target,
+		Body: fmt.Sprintf("Your FormFlow verification code is %s. It expires in %d minutes.", code, int(models.VerificationCodeTTL.Minutes())),
+	}
+	sender := smsSender
+	if channel == models.EmailVerification {
+		message.Subject = "Verify your email"
+		sender = emailSender
+	}
+	return sender.Send(message)
+}
+
+func SendVerification(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering SendVerification Function")
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	channel := models.VerificationChannel(c.Param("channel"))
+	if !channel.Valid() {
+		logger.Error("Invalid verification channel", zap.String("channel", string(channel)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "channel must be email or phone"})
+		return
+	}
+
+	err := sendVerificationCode(c.Request.Context(), user, channel)
+	var tooSoon models.ErrResendTooSoon
+	if errors.As(err, &tooSoon) {
+		logger.Warn("Verification resend too soon", zap.Uint("user_id", user.ID), zap.String("channel", string(channel)))
+		c.Header("Retry-After", strconv.Itoa(int(tooSoon.RetryAfter.Seconds()+0.5)))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, models.ErrAlreadyVerified) {
+		logger.Warn("Already verified", zap.Uint("user_id", user.ID), zap.String("channel", string(channel)))
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to send verification code", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Verification code sent", zap.Uint("user_id", user.ID), zap.String("channel", string(channel)))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification code sent"})
+	logger.Debug("Exiting SendVerification Function")
+}
+
+func Verify(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering Verify Function")
+	type VerifyRequest struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	user, ok := authenticatedUser(c)
+	if !ok {
+		return
+	}
+	channel := models.VerificationChannel(c.Param("channel"))
+	if !channel.Valid() {
+		logger.Error("Invalid verification channel", zap.String("channel", string(channel)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "channel must be email or phone"})
+		return
+	}
+
+	var verifyRequest VerifyRequest
+	if err := c.ShouldBindJSON(&verifyRequest); err != nil {
+		logger.Error("Failed to bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := models.CheckVerificationCode(c.Request.Context(), user, channel, verifyRequest.Code)
+	if errors.Is(err, models.ErrInvalidVerificationCode) || errors.Is(err, models.ErrTooManyAttempts) {
+		logger.Warn("Failed to verify", zap.Uint("user_id", user.ID), zap.String("channel", string(channel)), zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to verify", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Verified", zap.Uint("user_id", user.ID), zap.String("channel", string(channel)))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verified, refresh the token to use it", "channel": channel})
+	logger.Debug("Exiting Verify Function")
+}
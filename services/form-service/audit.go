@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"form-service/correlation"
+	"form-service/telemetry"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wagslane/go-rabbitmq"
+	"go.uber.org/zap"
+)
+
+// Audit events of reads of responses, the auth service appends them to the
+// audit log of the team.
+const (
+	ResponsesReadEvent   = "responses.read"
+	ResponsesExportEvent = "responses.export"
+	ResponsesSearchEvent = "responses.search"
+	AnswersReadEvent     = "answers.read"
+)
+
+// auditExchange is where the services publish their audit events.
+const auditExchange = "audit"
+
+var auditPublisher *rabbitmq.Publisher
+
+// AuditEvent is an entry of the audit log, as the auth service stores it.
+type AuditEvent struct {
+	OccurredAt time.Time              `json:"occurred_at"`
+	Event      string                 `json:"event"`
+	Service    string                 `json:"service"`
+	ActorID    *uint                  `json:"actor_id,omitempty"`
+	ActorType  string                 `json:"actor_type,omitempty"`
+	TeamID     *uint                  `json:"team_id,omitempty"`
+	TargetType string                 `json:"target_type,omitempty"`
+	TargetID   string                 `json:"target_id,omitempty"`
+	IP         string                 `json:"ip,omitempty"`
+	UserAgent  string                 `json:"user_agent,omitempty"`
+	Outcome    string                 `json:"outcome,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+// publishAudit sends the event of the request, done for the team, to the
+// audit log. The actor is the plugin for service tokens, else the user or
+// the creator of the API key. Failing to publish doesn't fail the request.
+func publishAudit(c *gin.Context, teamID uint, event AuditEvent) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	event.OccurredAt = time.Now()
+	event.Service = "form-service"
+	event.TeamID = &teamID
+	event.IP = c.GetHeader("X-Real-IP")
+	if event.IP == "" {
+		event.IP = c.ClientIP()
+	}
+	event.UserAgent = c.Request.UserAgent()
+	if service := c.GetString("service"); service != "" {
+		event.ActorType = "service"
+		if event.Details == nil {
+			event.Details = map[string]interface{}{}
+		}
+		event.Details["service"] = service
+	} else if id, err := strconv.ParseUint(c.GetHeader("X-Id"), 10, 64); err == nil {
+		actorID := uint(id)
+		event.ActorID = &actorID
+		event.ActorType = "user"
+		if c.GetHeader("X-Role") == "api-key" {
+			event.ActorType = "api-key"
+		}
+	}
+
+	jsonMessage, err := json.Marshal(event)
+	if err == nil {
+		headers := correlation.FromContext(c.Request.Context()).Table()
+		_, span := telemetry.StartPublish(c.Request.Context(), auditExchange, auditExchange, headers)
+		err = auditPublisher.Publish(
+			jsonMessage,
+			[]string{auditExchange},
+			rabbitmq.WithPublishOptionsContentType("application/json"),
+			rabbitmq.WithPublishOptionsExchange(auditExchange),
+			rabbitmq.WithPublishOptionsPersistentDelivery,
+			rabbitmq.WithPublishOptionsHeaders(headers),
+		)
+		telemetry.End(span, err)
+	}
+	if err != nil {
+		logger.Error("Failed to publish audit event", zap.String("audit_event", event.Event), zap.Uint("team_id", teamID), zap.Error(err))
+	}
+}
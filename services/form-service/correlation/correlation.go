@@ -0,0 +1,212 @@
+// Package correlation carries the request ID and the W3C trace context of a
+// request through the services, in HTTP headers and in the headers of the
+// messages on the bus, so the logs of one request can be followed across
+// every service.
+package correlation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	RequestIDHeader   = "X-Request-Id"
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+// IDs identify a request and the trace it belongs to.
+type IDs struct {
+	RequestID   string
+	Traceparent string
+	Tracestate  string
+}
+
+type contextKey struct{}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func isHex(value string) bool {
+	for _, char := range value {
+		if (char < '0' || char > '9') && (char < 'a' || char > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// validRequestID accepts IDs of up to 128 letters, digits, dashes,
+// underscores and dots, so they can't inject anything into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, char := range id {
+		if (char < 'a' || char > 'z') && (char < 'A' || char > 'Z') && (char < '0' || char > '9') && char != '-' && char != '_' && char != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// validTraceparent checks the traceparent is of version 00, with a trace ID
+// and a parent ID which aren't all zeros.
+func validTraceparent(traceparent string) bool {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return false
+	}
+	for _, part := range parts {
+		if !isHex(part) {
+			return false
+		}
+	}
+	return strings.Trim(parts[1], "0") != "" && strings.Trim(parts[2], "0") != ""
+}
+
+// TraceID returns the trace ID of the traceparent, empty without one.
+func (ids IDs) TraceID() string {
+	if len(ids.Traceparent) < 35 {
+		return ""
+	}
+	return ids.Traceparent[3:35]
+}
+
+// Complete fills in a new request ID and starts a new trace when they are
+// missing.
+func (ids IDs) Complete() IDs {
+	if ids.RequestID == "" {
+		ids.RequestID = randomHex(16)
+	}
+	if ids.Traceparent == "" {
+		ids.Traceparent = "00-" + randomHex(16) + "-" + randomHex(8) + "-01"
+		ids.Tracestate = ""
+	}
+	return ids
+}
+
+// recordedSpan returns the span the service records in the context, false
+// when tracing is disabled and the span, if any, is the one of the caller.
+func recordedSpan(ctx context.Context) (trace.SpanContext, bool) {
+	span := trace.SpanContextFromContext(ctx)
+	return span, span.IsValid() && !span.IsRemote()
+}
+
+// WithSpan takes the trace context of the span the service records for the
+// request, so the logs carry the IDs of the exported trace.
+func (ids IDs) WithSpan(ctx context.Context) IDs {
+	span, ok := recordedSpan(ctx)
+	if !ok {
+		return ids
+	}
+	ids.Traceparent = "00-" + span.TraceID().String() + "-" + span.SpanID().String() + "-" + span.TraceFlags().String()
+	ids.Tracestate = span.TraceState().String()
+	return ids
+}
+
+// Fields returns the IDs as log fields.
+func (ids IDs) Fields() []zap.Field {
+	var fields []zap.Field
+	if ids.RequestID != "" {
+		fields = append(fields, zap.String("request_id", ids.RequestID))
+	}
+	if traceID := ids.TraceID(); traceID != "" {
+		fields = append(fields, zap.String("trace_id", traceID))
+	}
+	return fields
+}
+
+// FromHeader returns the IDs of the HTTP headers, invalid ones are dropped.
+func FromHeader(header http.Header) IDs {
+	var ids IDs
+	if id := header.Get(RequestIDHeader); validRequestID(id) {
+		ids.RequestID = id
+	}
+	if traceparent := header.Get(TraceparentHeader); validTraceparent(traceparent) {
+		ids.Traceparent = traceparent
+		ids.Tracestate = header.Get(TracestateHeader)
+	}
+	return ids
+}
+
+// SetHeader sets the IDs as HTTP headers.
+func (ids IDs) SetHeader(header http.Header) {
+	for key, value := range map[string]string{RequestIDHeader: ids.RequestID, TraceparentHeader: ids.Traceparent, TracestateHeader: ids.Tracestate} {
+		if value != "" {
+			header.Set(key, value)
+		} else {
+			header.Del(key)
+		}
+	}
+}
+
+// FromTable returns the IDs of the headers of a message, invalid ones are
+// dropped.
+func FromTable(table map[string]interface{}) IDs {
+	header := http.Header{}
+	for _, key := range []string{RequestIDHeader, TraceparentHeader, TracestateHeader} {
+		if value, ok := table[key].(string); ok {
+			header.Set(key, value)
+		}
+	}
+	return FromHeader(header)
+}
+
+// Table returns the IDs as the headers of a message.
+func (ids IDs) Table() map[string]interface{} {
+	table := map[string]interface{}{}
+	for key, value := range map[string]string{RequestIDHeader: ids.RequestID, TraceparentHeader: ids.Traceparent, TracestateHeader: ids.Tracestate} {
+		if value != "" {
+			table[key] = value
+		}
+	}
+	return table
+}
+
+// NewContext returns a copy of the context carrying the IDs.
+func NewContext(ctx context.Context, ids IDs) context.Context {
+	return context.WithValue(ctx, contextKey{}, ids)
+}
+
+// FromContext returns the IDs of the context, empty without them.
+func FromContext(ctx context.Context) IDs {
+	ids, _ := ctx.Value(contextKey{}).(IDs)
+	return ids
+}
+
+// Logger returns the logger with the IDs of the context.
+func Logger(ctx context.Context, logger *zap.Logger) *zap.Logger {
+	return logger.With(FromContext(ctx).Fields()...)
+}
+
+// Middleware takes the IDs of the request, sent on by the gateway, and
+// starts new ones for requests without them. When tracing is enabled the
+// trace context is the one of the span of the request, so it runs after the
+// tracing middleware. They are kept in the context of the request and the
+// request ID is answered in X-Request-Id.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ids := FromHeader(c.Request.Header).WithSpan(c.Request.Context()).Complete()
+		ids.SetHeader(c.Request.Header)
+		c.Request = c.Request.WithContext(NewContext(c.Request.Context(), ids))
+		c.Header(RequestIDHeader, ids.RequestID)
+		c.Next()
+	}
+}
+
+// LogFields adds the IDs to the request logs of ginzap.
+func LogFields(c *gin.Context) []zapcore.Field {
+	return FromContext(c.Request.Context()).Fields()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"form-service/correlation"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"form-service/models"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const DuplicateDetectedEvent = "duplicate-detected"
+
+// minFingerprintKeySize is the shortest FORM_FINGERPRINT_KEY accepted.
+const minFingerprintKeySize = 32
+
+var (
+	errDuplicateResponse        = errors.New("a response with the same answers was already submitted")
+	errFingerprintNotConfigured = errors.New("duplicate detection is not configured")
+)
+
+// fingerprintKey keys the HMAC of the fingerprints so they can't be brute
+// forced back to the answers, sensitive ones included.
+var fingerprintKey []byte
+
+// loadFingerprintKey reads FORM_FINGERPRINT_KEY. Duplicate detection is
+// disabled when it is not set.
+func loadFingerprintKey() error {
+	key := os.Getenv("FORM_FINGERPRINT_KEY")
+	if key != "" && len(key) < minFingerprintKeySize {
+		return fmt.Errorf("FORM_FINGERPRINT_KEY must be at least %d bytes, got %d", minFingerprintKeySize, len(key))
+	}
+	fingerprintKey = []byte(key)
+	return nil
+}
+
+type DuplicateDetectedData struct {
+	FormID        uint   `json:"form_id"`
+	Title         string `json:"title"`
+	ResponseID    uint   `json:"response_id"`
+	UserID        uint   `json:"user_id"`
+	DuplicateOfID uint   `json:"duplicate_of"`
+	DuplicateUser uint   `json:"duplicate_of_user_id"`
+}
+
+// normalizeFingerprintValue keeps only lower cased letters and digits so
+// "John  Doe" and "john doe" or "+1 234-567" and "1234567" match.
+func normalizeFingerprintValue(value string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(value) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// responseFingerprint computes the HMAC of the answers to the fingerprint
+// questions of the form. It is empty when duplicate detection is not
+// configured, the form has no fingerprint question or none of them were
+// answered.
+func responseFingerprint(form models.Form, answers []models.Answer) string {
+	if len(fingerprintKey) == 0 {
+		return ""
+	}
+
+	var parts []string
+	for _, question := range form.Questions {
+		if !question.Fingerprint {
+			continue
+		}
+		for _, answer := range answers {
+			if answer.QuestionID != question.ID {
+				continue
+			}
+			var value interface{}
+			answer.Value.AssignTo(&value)
+			if normalized := normalizeFingerprintValue(convertInterfaceToString(value)); normalized != "" {
+				parts = append(parts, fmt.Sprintf("%d=%s", question.ID, normalized))
+			}
+			break
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+
+	sort.Strings(parts)
+	mac := hmac.New(sha256.New, fingerprintKey)
+	fmt.Fprintf(mac, "%d|%s", form.ID, strings.Join(parts, "|"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkDuplicate fingerprints a response before it is created and applies the
+// duplicate policy of the form. It returns the earlier response when the new
+// one is flagged, and errDuplicateResponse when the form rejects duplicates.
+// answers must hold the plaintext values. The fingerprint stays locked until
+// tx ends so concurrent submissions of the same answers are seen as
+// duplicates of each other.
+func checkDuplicate(tx *gorm.DB, form models.Form, response *models.Response, answers []models.Answer) (*models.Response, error) {
+	response.Fingerprint = responseFingerprint(form, answers)
+	if response.Fingerprint == "" || form.DuplicatePolicy == "" || form.DuplicatePolicy == models.AllowDuplicates {
+		return nil, nil
+	}
+
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtextextended(?, 0))", "fingerprint:"+response.Fingerprint).Error; err != nil {
+		return nil, err
+	}
+
+	var original models.Response
+	err := tx.Where("form_id = ? AND fingerprint = ?", form.ID, response.Fingerprint).Order("id").First(&original).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if form.DuplicatePolicy == models.RejectDuplicates {
+		return &original, errDuplicateResponse
+	}
+
+	response.Duplicate = true
+	response.DuplicateOfID = &original.ID
+	return &original, nil
+}
+
+// refingerprintResponses recomputes the fingerprints of the responses to the
+// form after its fingerprint questions changed.
+func refingerprintResponses(tx *gorm.DB, form models.Form) error {
+	var responses []models.Response
+	return tx.Preload("Answers").Where("form_id = ?", form.ID).FindInBatches(&responses, 100, func(batch *gorm.DB, _ int) error {
+		for _, response := range responses {
+			if err := decryptAnswers(batch, form.TeamID, response.Answers); err != nil {
+				return err
+			}
+			fingerprint := responseFingerprint(form, response.Answers)
+			if fingerprint == response.Fingerprint {
+				continue
+			}
+			if err := batch.Model(&response).UpdateColumn("fingerprint", fingerprint).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+func publishDuplicateDetected(ctx context.Context, form models.Form, response models.Response, original models.Response) error {
+	return publishEvent(ctx, DuplicateDetectedEvent, form.TeamID, DuplicateDetectedData{
+		FormID:        form.ID,
+		Title:         form.Title,
+		ResponseID:    response.ID,
+		UserID:        response.UserID,
+		DuplicateOfID: original.ID,
+		DuplicateUser: original.UserID,
+	})
+}
+
+func configureDuplicateDetection(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering configureDuplicateDetection function")
+
+	var request struct {
+		Policy      models.DuplicatePolicy `json:"policy"`
+		QuestionIDs []uint                 `json:"question_ids"`
+	}
+	if err := c.BindJSON(&request); err != nil {
+		logger.Error("Failed to bind request", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch request.Policy {
+	case models.AllowDuplicates, models.FlagDuplicates, models.RejectDuplicates:
+	default:
+		logger.Error("Invalid duplicate policy", zap.String("policy", string(request.Policy)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "policy must be one of allow, flag or reject"})
+		return
+	}
+	if len(fingerprintKey) == 0 {
+		logger.Error("Duplicate detection without a fingerprint key configured")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errFingerprintNotConfigured.Error()})
+		return
+	}
+
+	var form models.Form
+	if err := db.WithContext(c.Request.Context()).Preload("Questions").First(&form, c.Param("id")).Error; err != nil {
+		logger.Error("Failed to get form", zap.Error(err))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Form not found"})
+		return
+	}
+	if !isFormTeamMember(c, form) {
+		logger.Error("You can't configure forms not created by your team", zap.Uint("form_id", form.ID))
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't configure forms not created by your team"})
+		return
+	}
+
+	fingerprint := map[uint]bool{}
+	for _, questionID := range request.QuestionIDs {
+		found := false
+		for _, q := range form.Questions {
+			if q.ID == questionID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			logger.Error("Question not found", zap.Uint("question_id", questionID))
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Question id %v not present in the form %v", questionID, form.ID)})
+			return
+		}
+		fingerprint[questionID] = true
+	}
+
+	tx := db.WithContext(c.Request.Context()).Begin()
+	if err := tx.Model(&form).Update("duplicate_policy", request.Policy).Error; err != nil {
+		logger.Error("Failed to update form", zap.Error(err))
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	changed := false
+	for i, q := range form.Questions {
+		if q.Fingerprint == fingerprint[q.ID] {
+			continue
+		}
+		if err := tx.Model(&q).Update("fingerprint", fingerprint[q.ID]).Error; err != nil {
+			logger.Error("Failed to update question", zap.Error(err))
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		form.Questions[i].Fingerprint = fingerprint[q.ID]
+		changed = true
+	}
+	// earlier responses are compared with the new questions
+	if changed {
+		if err := refingerprintResponses(tx, form); err != nil {
+			logger.Error("Failed to recompute fingerprints", zap.Uint("form_id", form.ID), zap.Error(err))
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		logger.Error("Failed to commit transaction", zap.Error(err))
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Debug("Duplicate detection configured", zap.Uint("form_id", form.ID), zap.String("policy", string(request.Policy)), zap.Uints("question_ids", request.QuestionIDs))
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":       "success",
+		"message":      "Duplicate detection configured",
+		"policy":       request.Policy,
+		"question_ids": request.QuestionIDs,
+	})
+	logger.Debug("Exiting configureDuplicateDetection function")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"form-service/models"
+)
+
+func testAnswer(t *testing.T, questionID uint, value interface{}) models.Answer {
+	t.Helper()
+	// answers hold the JSON of the submitted value
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := models.Answer{QuestionID: questionID}
+	if err := answer.Value.Set(encoded); err != nil {
+		t.Fatal(err)
+	}
+	return answer
+}
+
+// testForm has the questions of the ids, the fingerprint ones among them.
+func testForm(id uint, questionIDs []uint, fingerprint ...uint) models.Form {
+	form := models.Form{}
+	form.ID = id
+	for _, questionID := range questionIDs {
+		question := models.Question{}
+		question.ID = questionID
+		for _, f := range fingerprint {
+			question.Fingerprint = question.Fingerprint || f == questionID
+		}
+		form.Questions = append(form.Questions, question)
+	}
+	return form
+}
+
+func TestNormalizeFingerprintValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "John  Doe", want: "johndoe"},
+		{value: " john doe\n", want: "johndoe"},
+		{value: "+1 234-567", want: "1234567"},
+		{value: "Zoë", want: "zoë"},
+		{value: " -- ", want: ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeFingerprintValue(tt.value); got != tt.want {
+			t.Errorf("normalizeFingerprintValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestResponseFingerprint(t *testing.T) {
+	previous := fingerprintKey
+	fingerprintKey = []byte(strings.Repeat("k", minFingerprintKeySize))
+	t.Cleanup(func() { fingerprintKey = previous })
+
+	questions := []uint{1, 2, 3}
+	form := testForm(10, questions, 1, 2)
+	fingerprint := responseFingerprint(form, []models.Answer{
+		testAnswer(t, 1, "John Doe"),
+		testAnswer(t, 2, "+1 234-567"),
+		testAnswer(t, 3, "first comment"),
+	})
+	if len(fingerprint) != 64 {
+		t.Fatalf("fingerprint = %q, want a hex SHA-256", fingerprint)
+	}
+
+	tests := []struct {
+		name     string
+		form     models.Form
+		answers  []models.Answer
+		wantSame bool
+	}{
+		{name: "answers in another order", form: form, wantSame: true, answers: []models.Answer{
+			testAnswer(t, 3, "first comment"),
+			testAnswer(t, 2, "+1 234-567"),
+			testAnswer(t, 1, "John Doe"),
+		}},
+		{name: "case and whitespace", form: form, wantSame: true, answers: []models.Answer{
+			testAnswer(t, 1, "  john   DOE "),
+			testAnswer(t, 2, "1234567"),
+		}},
+		{name: "other answer to a question left out", form: form, wantSame: true, answers: []models.Answer{
+			testAnswer(t, 1, "John Doe"),
+			testAnswer(t, 2, "+1 234-567"),
+			testAnswer(t, 3, "second comment"),
+		}},
+		{name: "other answer", form: form, answers: []models.Answer{
+			testAnswer(t, 1, "Jane Doe"),
+			testAnswer(t, 2, "+1 234-567"),
+		}},
+		{name: "other selected questions", form: testForm(10, questions, 1, 3), answers: []models.Answer{
+			testAnswer(t, 1, "John Doe"),
+			testAnswer(t, 2, "+1 234-567"),
+			testAnswer(t, 3, "first comment"),
+		}},
+		{name: "same answers to another form", form: testForm(11, questions, 1, 2), answers: []models.Answer{
+			testAnswer(t, 1, "John Doe"),
+			testAnswer(t, 2, "+1 234-567"),
+		}},
+		// the values are keyed by question, they can't be swapped
+		{name: "answers swapped between questions", form: testForm(10, []uint{1, 2}, 1, 2), answers: []models.Answer{
+			testAnswer(t, 1, "+1 234-567"),
+			testAnswer(t, 2, "John Doe"),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := responseFingerprint(tt.form, tt.answers)
+			if (got == fingerprint) != tt.wantSame {
+				t.Errorf("responseFingerprint() = %q, same as %q: %v, want %v", got, fingerprint, got == fingerprint, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestResponseFingerprintEmpty(t *testing.T) {
+	previous := fingerprintKey
+	t.Cleanup(func() { fingerprintKey = previous })
+	answers := []models.Answer{testAnswer(t, 1, "John Doe")}
+
+	fingerprintKey = nil
+	if got := responseFingerprint(testForm(10, []uint{1}, 1), answers); got != "" {
+		t.Errorf("without a key, fingerprint = %q, want none", got)
+	}
+
+	fingerprintKey = []byte(strings.Repeat("k", minFingerprintKeySize))
+	if got := responseFingerprint(testForm(10, []uint{1}), answers); got != "" {
+		t.Errorf("without fingerprint questions, fingerprint = %q, want none", got)
+	}
+	if got := responseFingerprint(testForm(10, []uint{1, 2}, 2), answers); got != "" {
+		t.Errorf("without fingerprint answers, fingerprint = %q, want none", got)
+	}
+	if got := responseFingerprint(testForm(10, []uint{1}, 1), []models.Answer{testAnswer(t, 1, " - ")}); got != "" {
+		t.Errorf("with blank answers, fingerprint = %q, want none", got)
+	}
+
+	// the key is part of the HMAC
+	keyed := responseFingerprint(testForm(10, []uint{1}, 1), answers)
+	fingerprintKey = []byte(strings.Repeat("x", minFingerprintKeySize))
+	if got := responseFingerprint(testForm(10, []uint{1}, 1), answers); got == keyed {
+		t.Error("another key gives the same fingerprint")
+	}
+}
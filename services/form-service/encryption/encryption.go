@@ -0,0 +1,150 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// DataKeySize is the size in bytes of the AES-256 keys used for answers.
+const DataKeySize = 32
+
+var ErrNotConfigured = errors.New("encryption is not configured")
+
+// Keyring holds the master keys used to wrap the per-team data keys.
+// Only the active master key wraps new data keys, the others are kept so
+// data keys wrapped before a rotation can still be unwrapped.
+type Keyring struct {
+	masterKeys map[string][]byte
+	active     string
+}
+
+// NewKeyring builds a keyring from a "id:base64key,id:base64key" spec.
+// If active is empty the first key in the spec becomes the active one.
+func NewKeyring(spec string, active string) (*Keyring, error) {
+	keyring := &Keyring{masterKeys: map[string][]byte{}}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, found := strings.Cut(entry, ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("invalid master key entry %q, expected id:base64key", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %q: %w", id, err)
+		}
+		if len(key) != DataKeySize {
+			return nil, fmt.Errorf("master key %q must be %d bytes, got %d", id, DataKeySize, len(key))
+		}
+		keyring.masterKeys[id] = key
+		if keyring.active == "" {
+			keyring.active = id
+		}
+	}
+
+	if active != "" {
+		if _, ok := keyring.masterKeys[active]; !ok {
+			return nil, fmt.Errorf("active master key %q is not configured", active)
+		}
+		keyring.active = active
+	}
+
+	return keyring, nil
+}
+
+// NewKeyringFromEnv reads FORM_MASTER_KEYS and FORM_ACTIVE_MASTER_KEY.
+func NewKeyringFromEnv() (*Keyring, error) {
+	return NewKeyring(os.Getenv("FORM_MASTER_KEYS"), os.Getenv("FORM_ACTIVE_MASTER_KEY"))
+}
+
+func (k *Keyring) Enabled() bool {
+	return k != nil && k.active != ""
+}
+
+func (k *Keyring) ActiveKeyID() string {
+	return k.active
+}
+
+// GenerateDataKey returns a fresh data key along with its wrapped form.
+func (k *Keyring) GenerateDataKey() (plain []byte, wrapped []byte, masterKeyID string, err error) {
+	if !k.Enabled() {
+		return nil, nil, "", ErrNotConfigured
+	}
+	plain = make([]byte, DataKeySize)
+	if _, err = io.ReadFull(rand.Reader, plain); err != nil {
+		return nil, nil, "", err
+	}
+	wrapped, masterKeyID, err = k.Wrap(plain)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return plain, wrapped, masterKeyID, nil
+}
+
+// Wrap encrypts a data key with the active master key.
+func (k *Keyring) Wrap(plain []byte) ([]byte, string, error) {
+	if !k.Enabled() {
+		return nil, "", ErrNotConfigured
+	}
+	wrapped, err := Seal(k.masterKeys[k.active], plain)
+	if err != nil {
+		return nil, "", err
+	}
+	return wrapped, k.active, nil
+}
+
+// Unwrap decrypts a data key with the master key it was wrapped under.
+func (k *Keyring) Unwrap(masterKeyID string, wrapped []byte) ([]byte, error) {
+	if !k.Enabled() {
+		return nil, ErrNotConfigured
+	}
+	masterKey, ok := k.masterKeys[masterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not configured", masterKeyID)
+	}
+	return Open(masterKey, wrapped)
+}
+
+// Seal encrypts plaintext with AES-GCM, the nonce is prepended to the result.
+func Seal(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open reverses Seal.
+func Open(key []byte, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
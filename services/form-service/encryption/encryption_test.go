@@ -0,0 +1,167 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, DataKeySize)
+}
+
+func testSpec(ids ...string) string {
+	var entries []string
+	for i, id := range ids {
+		entries = append(entries, id+":"+base64.StdEncoding.EncodeToString(testKey(byte(i+1))))
+	}
+	return strings.Join(entries, ",")
+}
+
+func TestSealOpen(t *testing.T) {
+	key := testKey(1)
+	plaintext := []byte(`"123-45-6789"`)
+	sealed, err := Seal(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Fatal("the sealed answer contains the plaintext")
+	}
+	opened, err := Open(key, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Open() = %q, want %q", opened, plaintext)
+	}
+
+	// a fresh nonce every time
+	again, err := Seal(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Error("sealing twice gives the same ciphertext")
+	}
+}
+
+func TestOpenFails(t *testing.T) {
+	key := testKey(1)
+	sealed, err := Seal(key, []byte("answer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name       string
+		key        []byte
+		ciphertext []byte
+	}{
+		{name: "tampered ciphertext", key: key, ciphertext: tampered},
+		{name: "other key", key: testKey(2), ciphertext: sealed},
+		{name: "too short", key: key, ciphertext: sealed[:4]},
+		{name: "invalid key size", key: key[:5], ciphertext: sealed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Open(tt.key, tt.ciphertext); err == nil {
+				t.Error("Open() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name       string
+		spec       string
+		active     string
+		wantActive string
+		wantErr    bool
+	}{
+		{name: "first key active", spec: testSpec("k1", "k2"), wantActive: "k1"},
+		{name: "chosen active key", spec: testSpec("k1", "k2"), active: "k2", wantActive: "k2"},
+		{name: "spaces and empty entries", spec: " " + testSpec("k1") + " , ", wantActive: "k1"},
+		{name: "not configured", spec: ""},
+		{name: "missing id", spec: ":" + base64.StdEncoding.EncodeToString(testKey(1)), wantErr: true},
+		{name: "not base64", spec: "k1:not base64", wantErr: true},
+		{name: "short key", spec: "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+		{name: "unknown active key", spec: testSpec("k1"), active: "k9", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring, err := NewKeyring(tt.spec, tt.active)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewKeyring() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyring.ActiveKeyID() != tt.wantActive || keyring.Enabled() != (tt.wantActive != "") {
+				t.Errorf("active key = %q, enabled %v, want %q", keyring.ActiveKeyID(), keyring.Enabled(), tt.wantActive)
+			}
+		})
+	}
+}
+
+func TestKeyringUnwrap(t *testing.T) {
+	// the data key was wrapped before k2 replaced k1 as the active key
+	before, err := NewKeyring(testSpec("k1", "k2"), "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, wrapped, masterKeyID, err := before.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masterKeyID != "k1" || len(plain) != DataKeySize {
+		t.Fatalf("GenerateDataKey() = %d byte key under %q, want %d bytes under k1", len(plain), masterKeyID, DataKeySize)
+	}
+
+	after, err := NewKeyring(testSpec("k1", "k2"), "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := after.Unwrap(masterKeyID, wrapped)
+	if err != nil {
+		t.Fatalf("Unwrap() with the retired key failed: %v", err)
+	}
+	if !bytes.Equal(unwrapped, plain) {
+		t.Error("Unwrap() with the retired key returned another key")
+	}
+
+	rewrapped, newID, err := after.Wrap(unwrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID != "k2" {
+		t.Errorf("Wrap() used %q, want the active key k2", newID)
+	}
+	if unwrapped, err = after.Unwrap(newID, rewrapped); err != nil || !bytes.Equal(unwrapped, plain) {
+		t.Errorf("Unwrap() of the rewrapped key = %v, want the data key", err)
+	}
+
+	if _, err := after.Unwrap("k9", wrapped); err == nil {
+		t.Error("Unwrap() with an unknown master key succeeded")
+	}
+	if _, err := after.Unwrap("k2", wrapped); err == nil {
+		t.Error("Unwrap() with the wrong master key succeeded")
+	}
+}
+
+func TestKeyringNotConfigured(t *testing.T) {
+	var keyring *Keyring
+	if _, _, _, err := keyring.GenerateDataKey(); err != ErrNotConfigured {
+		t.Errorf("GenerateDataKey() error = %v, want ErrNotConfigured", err)
+	}
+	if _, err := keyring.Unwrap("k1", nil); err != ErrNotConfigured {
+		t.Errorf("Unwrap() error = %v, want ErrNotConfigured", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"form-service/correlation"
+	"form-service/models"
+	"form-service/telemetry"
+
+	"github.com/wagslane/go-rabbitmq"
+)
+
+const ResponseSubmissionEvent = "response-submission"
+
+type Message struct {
+	Event  string      `json:"event"`
+	TeamID uint        `json:"team_id"`
+	Data   interface{} `json:"data"`
+}
+
+type ResponseSubmissionData struct {
+	UserID      uint       `json:"user_id"`
+	FormID      uint       `json:"form_id"`
+	ResponseID  uint       `json:"response_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	QnA         [][]string `json:"qna"`
+}
+
+// publishEvent sends an event to the events exchange, the plugin manager
+// routes it to the plugins the team has enabled. The request ID and trace of
+// the context go along in the headers of the message, publishing is a span
+// of the trace.
+func publishEvent(ctx context.Context, event string, teamID uint, data interface{}) error {
+	jsonMessage, err := json.Marshal(Message{
+		Event:  event,
+		TeamID: teamID,
+		Data:   data,
+	})
+	if err != nil {
+		return err
+	}
+	headers := correlation.FromContext(ctx).Table()
+	_, span := telemetry.StartPublish(ctx, "events", "events", headers)
+	err = publisher.Publish(
+		jsonMessage,
+		[]string{"events"},
+		rabbitmq.WithPublishOptionsContentType("application/json"),
+		rabbitmq.WithPublishOptionsExchange("events"),
+		rabbitmq.WithPublishOptionsHeaders(headers),
+	)
+	telemetry.End(span, err)
+	return err
+}
+
+// publishResponseSubmission emits the response-submission event for the
+// plaintext answers of a response.
+func publishResponseSubmission(ctx context.Context, form models.Form, response models.Response, answers []models.Answer) error {
+	data := ResponseSubmissionData{
+		UserID:      response.UserID,
+		FormID:      form.ID,
+		ResponseID:  response.ID,
+		Title:       form.Title,
+		Description: form.Description,
+	}
+
+	for _, question := range form.Questions {
+		didntAnswer := true
+		for _, answer := range answers {
+			if answer.QuestionID == question.ID {
+				var answerValue interface{}
+				switch question.Type {
+				case models.Radio:
+					var valueIdx uint
+					answer.Value.AssignTo(&valueIdx)
+					answerValue = question.Options.Elements[valueIdx].String
+				case models.Checkbox:
+					var valueIdxs []uint
+					answer.Value.AssignTo(&valueIdxs)
+					var value []string
+					for _, idx := range valueIdxs {
+						value = append(value, question.Options.Elements[idx].String)
+					}
+					answerValue = value
+				case models.Text:
+					answer.Value.AssignTo(&answerValue)
+				}
+				if question.Sensitive && !form.IncludeSensitiveInEvents {
+					answerValue = redactedValue
+				}
+				data.QnA = append(data.QnA, []string{question.Text, convertInterfaceToString(answerValue)})
+				didntAnswer = false
+			}
+		}
+		if didntAnswer {
+			data.QnA = append(data.QnA, []string{question.Text, "N/A"})
+		}
+	}
+
+	return publishEvent(ctx, ResponseSubmissionEvent, form.TeamID, data)
+}
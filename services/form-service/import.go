@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"form-service/correlation"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"form-service/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgtype"
+	"go.uber.org/zap"
+)
+
+const (
+	maxImportSize          = 32 << 20
+	defaultImportBatchSize = 100
+	checkboxSeparator      = ";"
+)
+
+type importRow struct {
+	Row    int
+	Values map[string]interface{}
+}
+
+type importError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// readImportRows parses a CSV file with a header line or a NDJSON file with
+// one JSON object per line.
+func readImportRows(file io.Reader, format string) ([]importRow, error) {
+	var rows []importRow
+
+	switch format {
+	case "csv":
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read csv header: %w", err)
+		}
+		for i := 1; ; i++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read csv row %d: %w", i, err)
+			}
+			values := map[string]interface{}{}
+			for j, column := range header {
+				if j < len(record) {
+					values[strings.TrimSpace(column)] = record[j]
+				}
+			}
+			rows = append(rows, importRow{Row: i, Values: values})
+		}
+	case "ndjson":
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), maxImportSize)
+		for i := 1; scanner.Scan(); i++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			values := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(line), &values); err != nil {
+				return nil, fmt.Errorf("failed to parse ndjson line %d: %w", i, err)
+			}
+			rows = append(rows, importRow{Row: i, Values: values})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported import format %q", format)
+	}
+
+	return rows, nil
+}
+
+// optionIndex resolves an imported option, given either as its text or its index.
+func optionIndex(question models.Question, value interface{}) (int, error) {
+	switch v := value.(type) {
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("%v is not an option index of question id %d", v, question.ID)
+		}
+		return int(v), nil
+	case string:
+		v = strings.TrimSpace(v)
+		for i, option := range question.Options.Elements {
+			if strings.EqualFold(option.String, v) {
+				return i, nil
+			}
+		}
+		idx, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not an option of question id %d", v, question.ID)
+		}
+		return idx, nil
+	default:
+		return 0, fmt.Errorf("invalid option %v for question id %d", value, question.ID)
+	}
+}
+
+// importAnswerValue converts an imported cell to the value submitFormResponse
+// expects for the question type. ok is false for empty cells.
+func importAnswerValue(question models.Question, cell interface{}) (value pgtype.JSONB, ok bool, err error) {
+	if cell == nil || cell == "" {
+		return value, false, nil
+	}
+
+	var raw interface{}
+	switch question.Type {
+	case models.Text:
+		if s, isString := cell.(string); isString {
+			raw = s
+		} else {
+			raw = fmt.Sprint(cell)
+		}
+	case models.Radio:
+		if raw, err = optionIndex(question, cell); err != nil {
+			return value, false, err
+		}
+	case models.Checkbox:
+		var items []interface{}
+		switch v := cell.(type) {
+		case []interface{}:
+			items = v
+		case string:
+			for _, item := range strings.Split(v, checkboxSeparator) {
+				items = append(items, item)
+			}
+		default:
+			items = []interface{}{v}
+		}
+		idxs := []int{}
+		for _, item := range items {
+			idx, err := optionIndex(question, item)
+			if err != nil {
+				return value, false, err
+			}
+			idxs = append(idxs, idx)
+		}
+		raw = idxs
+	default:
+		return value, false, fmt.Errorf("unsupported question type %q", question.Type)
+	}
+
+	if err := value.Set(raw); err != nil {
+		return value, false, err
+	}
+	return value, true, nil
+}
+
+func importResponses(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering importResponses function")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+
+	var form models.Form
+	if err := db.WithContext(c.Request.Context()).Preload("Questions").First(&form, c.Param("id")).Error; err != nil {
+		logger.Error("Failed to get form", zap.Error(err))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Form not found"})
+		return
+	}
+	if !isFormTeamMember(c, form) {
+		logger.Error("You can't import responses to forms not created by your team", zap.Uint("form_id", form.ID))
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't import responses to forms not created by your team"})
+		return
+	}
+
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		logger.Error("Failed to get import file", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	// mapping is a JSON object of column name to question id
+	var mapping map[string]uint
+	if err := json.Unmarshal([]byte(c.PostForm("mapping")), &mapping); err != nil || len(mapping) == 0 {
+		logger.Error("Invalid column mapping", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mapping must be a JSON object of column name to question id"})
+		return
+	}
+	questions := map[string]models.Question{}
+	for column, questionID := range mapping {
+		found := false
+		for _, q := range form.Questions {
+			if q.ID == questionID {
+				questions[column] = q
+				found = true
+				break
+			}
+		}
+		if !found {
+			logger.Error("Question not found", zap.Uint("question_id", questionID))
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Question id %v not present in the form %v", questionID, form.ID)})
+			return
+		}
+	}
+
+	format := c.PostForm("format")
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(header.Filename)), ".")
+		if format == "jsonl" {
+			format = "ndjson"
+		}
+	}
+
+	batchSize := defaultImportBatchSize
+	if value := c.PostForm("batch_size"); value != "" {
+		if batchSize, err = strconv.Atoi(value); err != nil || batchSize < 1 {
+			logger.Error("Invalid batch size", zap.String("batch_size", value))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "batch_size must be a positive integer"})
+			return
+		}
+	}
+	emitEvents := c.PostForm("emit_events") == "true"
+	userColumn := c.PostForm("user_id_column")
+	submittedAtColumn := c.PostForm("submitted_at_column")
+
+	rows, err := readImportRows(file, format)
+	if err != nil {
+		logger.Error("Failed to read import file", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Debug("Import file read", zap.Uint("form_id", form.ID), zap.Int("rows", len(rows)), zap.String("format", format))
+
+	type validRow struct {
+		Row      int
+		Response models.Response
+		Answers  []models.Answer
+		Original *models.Response // set when the response is flagged as a duplicate
+	}
+
+	importErrors := []importError{}
+	var valid []validRow
+	for _, row := range rows {
+		response := models.Response{
+			FormID:         form.ID,
+			SubmissionTime: time.Now(),
+		}
+
+		if userColumn != "" {
+			userId, err := strconv.ParseUint(fmt.Sprint(row.Values[userColumn]), 10, 64)
+			if err != nil {
+				importErrors = append(importErrors, importError{Row: row.Row, Error: fmt.Sprintf("invalid user id %v", row.Values[userColumn])})
+				continue
+			}
+			response.UserID = uint(userId)
+		}
+
+		if submittedAtColumn != "" && row.Values[submittedAtColumn] != "" && row.Values[submittedAtColumn] != nil {
+			submittedAt, err := time.Parse(time.RFC3339, fmt.Sprint(row.Values[submittedAtColumn]))
+			if err != nil {
+				importErrors = append(importErrors, importError{Row: row.Row, Error: fmt.Sprintf("invalid submission time %v", row.Values[submittedAtColumn])})
+				continue
+			}
+			response.SubmissionTime = submittedAt
+		}
+
+		var answers []models.Answer
+		var rowErr error
+		for column, question := range questions {
+			value, ok, err := importAnswerValue(question, row.Values[column])
+			if err != nil {
+				rowErr = err
+				break
+			}
+			if !ok {
+				continue
+			}
+			if err := validateAnswer(form, question.ID, string(question.Type), value); err != nil {
+				rowErr = err
+				break
+			}
+			answers = append(answers, models.Answer{
+				QuestionID: question.ID,
+				Type:       string(question.Type),
+				Value:      value,
+			})
+		}
+		if rowErr != nil {
+			importErrors = append(importErrors, importError{Row: row.Row, Error: rowErr.Error()})
+			continue
+		}
+
+		valid = append(valid, validRow{Row: row.Row, Response: response, Answers: answers})
+	}
+
+	var imported []validRow
+	for start := 0; start < len(valid); start += batchSize {
+		end := start + batchSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+		batch := valid[start:end]
+
+		var inserted []validRow
+		var rejected []importError
+		err := func() error {
+			tx := db.WithContext(c.Request.Context()).Begin()
+			for i := range batch {
+				original, err := checkDuplicate(tx, form, &batch[i].Response, batch[i].Answers)
+				if errors.Is(err, errDuplicateResponse) {
+					rejected = append(rejected, importError{Row: batch[i].Row, Error: fmt.Sprintf("%v (response id %d)", err, original.ID)})
+					continue
+				}
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+				batch[i].Original = original
+
+				if err := tx.Create(&batch[i].Response).Error; err != nil {
+					tx.Rollback()
+					return err
+				}
+				for j := range batch[i].Answers {
+					batch[i].Answers[j].ResponseID = batch[i].Response.ID
+				}
+				inserted = append(inserted, batch[i])
+				if len(batch[i].Answers) == 0 {
+					continue
+				}
+				storedAnswers, err := encryptAnswers(tx, form, batch[i].Answers)
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+				if err := tx.Create(&storedAnswers).Error; err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+			return tx.Commit().Error
+		}()
+		if err != nil {
+			logger.Error("Failed to import batch", zap.Int("first_row", batch[0].Row), zap.Int("rows", len(batch)), zap.Error(err))
+			for _, row := range batch {
+				importErrors = append(importErrors, importError{Row: row.Row, Error: err.Error()})
+			}
+			continue
+		}
+		importErrors = append(importErrors, rejected...)
+		imported = append(imported, inserted...)
+	}
+	logger.Info("Responses imported", zap.Uint("form_id", form.ID), zap.Int("imported", len(imported)), zap.Int("failed", len(importErrors)))
+
+	responseIDs := []uint{}
+	eventsFailed := 0
+	for _, row := range imported {
+		responseIDs = append(responseIDs, row.Response.ID)
+		if !emitEvents {
+			continue
+		}
+		if err := publishResponseSubmission(c.Request.Context(), form, row.Response, row.Answers); err != nil {
+			logger.Error("Failed to publish message", zap.Uint("response_id", row.Response.ID), zap.Error(err))
+			eventsFailed++
+		}
+		if row.Response.Duplicate {
+			if err := publishDuplicateDetected(c.Request.Context(), form, row.Response, *row.Original); err != nil {
+				logger.Error("Failed to publish message", zap.Uint("response_id", row.Response.ID), zap.Error(err))
+				eventsFailed++
+			}
+		}
+	}
+
+	sort.Slice(importErrors, func(i, j int) bool { return importErrors[i].Row < importErrors[j].Row })
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":        "success",
+		"message":       "Import finished",
+		"total_rows":    len(rows),
+		"imported":      len(imported),
+		"failed":        len(importErrors),
+		"events_failed": eventsFailed,
+		"response_ids":  responseIDs,
+		"errors":        importErrors,
+	})
+	logger.Debug("Exiting importResponses function")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"form-service/models"
+
+	"github.com/jackc/pgtype"
+)
+
+func TestOptionIndex(t *testing.T) {
+	question := models.Question{Type: models.Radio}
+	question.ID = 7
+	if err := question.Options.Set([]string{"Red", "Green", "Blue"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    int
+		wantErr bool
+	}{
+		{name: "index", value: float64(1), want: 1},
+		{name: "zero index", value: float64(0), want: 0},
+		{name: "fractional index", value: 1.5, wantErr: true},
+		{name: "option text", value: "Blue", want: 2},
+		{name: "option text ignores case and spaces", value: "  green ", want: 1},
+		{name: "index as text", value: "2", want: 2},
+		{name: "unknown text", value: "Purple", wantErr: true},
+		{name: "unsupported type", value: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := optionIndex(question, tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("optionIndex(%v) = %d, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("optionIndex(%v) failed: %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("optionIndex(%v) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportAnswerValueEmpty(t *testing.T) {
+	question := models.Question{Type: models.Text}
+	for _, cell := range []interface{}{nil, ""} {
+		value, ok, err := importAnswerValue(question, cell)
+		if err != nil || ok || value.Status != pgtype.Undefined {
+			t.Errorf("importAnswerValue(%#v) = %v, %v, %v, want nothing", cell, value, ok, err)
+		}
+	}
+}
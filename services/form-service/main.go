@@ -1,7 +1,8 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -10,7 +11,12 @@ import (
 	"strings"
 	"time"
 
+	"form-service/correlation"
+	"form-service/encryption"
 	"form-service/models"
+	"form-service/permission"
+	"form-service/serviceauth"
+	"form-service/telemetry"
 
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/wagslane/go-rabbitmq"
@@ -64,11 +70,21 @@ func main() {
 	// core := ecszap.NewCore(ecszap.NewDefaultEncoderConfig(), os.Stdout, zap.DebugLevel)
 	// logger = zap.New(core, zap.AddCaller()).With(zap.String("service", "form-service"))
 	logger, _ = zap.NewDevelopment()
+	permission.Logger = logger
 	logger.With(zap.String("service", "form-service"))
 
+	shutdownTracing, err := telemetry.Setup(context.Background(), "form-service")
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
+	}
+	defer shutdownTracing(context.Background())
+
 	if db, err = connectToDatabase(); err != nil {
 		logger.Fatal("Failed to connect to database", zap.Error(err))
 	}
+	if err = telemetry.TraceGorm(db); err != nil {
+		logger.Fatal("Failed to trace database queries", zap.Error(err))
+	}
 	logger.Info("Connected to database")
 
 	dbInstance, err := db.DB()
@@ -79,10 +95,34 @@ func main() {
 
 	defer dbInstance.Close()
 
-	if err = db.AutoMigrate(&models.Form{}, &models.Question{}, &models.Answer{}, &models.Response{}); err != nil {
+	if err = db.AutoMigrate(&models.Form{}, &models.Question{}, &models.Answer{}, &models.Response{}, &models.DataKey{}, &models.ReviewNote{}); err != nil {
 		logger.Fatal("Failed to migrate database", zap.Error(err))
 	}
-	logger.Info("Database auto migrated", zap.String("table", "form"), zap.String("table", "question"), zap.String("table", "answer"), zap.String("table", "response"))
+	logger.Info("Database auto migrated", zap.String("table", "form"), zap.String("table", "question"), zap.String("table", "answer"), zap.String("table", "response"), zap.String("table", "data_key"), zap.String("table", "review_note"))
+
+	if err = migrateSearch(); err != nil {
+		logger.Fatal("Failed to migrate search indexes", zap.Error(err))
+	}
+	logger.Info("Search indexes migrated")
+
+	if keyring, err = encryption.NewKeyringFromEnv(); err != nil {
+		logger.Fatal("Failed to load master keys", zap.Error(err))
+	}
+	if keyring.Enabled() {
+		logger.Info("Encryption of sensitive answers enabled", zap.String("master_key_id", keyring.ActiveKeyID()))
+		if err = rewrapDataKeys(); err != nil {
+			logger.Fatal("Failed to rewrap data keys", zap.Error(err))
+		}
+	} else {
+		logger.Warn("No master keys configured, sensitive questions are disabled")
+	}
+
+	if err = loadFingerprintKey(); err != nil {
+		logger.Fatal("Failed to load fingerprint key", zap.Error(err))
+	}
+	if len(fingerprintKey) == 0 {
+		logger.Warn("No fingerprint key configured, duplicate detection is disabled")
+	}
 
 	conn, err = rabbitmq.NewConn(
 		os.Getenv("RABBITMQ_URL"),
@@ -106,8 +146,23 @@ func main() {
 	logger.Info("RabbitMQ publisher created")
 	defer publisher.Close()
 
+	auditPublisher, err = rabbitmq.NewPublisher(
+		conn,
+		rabbitmq.WithPublisherOptionsLogging,
+		rabbitmq.WithPublisherOptionsExchangeName(auditExchange),
+		rabbitmq.WithPublisherOptionsExchangeDeclare,
+		rabbitmq.WithPublisherOptionsExchangeDurable,
+	)
+	if err != nil {
+		logger.Fatal("Failed to create rabbitmq audit publisher", zap.Error(err))
+	}
+	logger.Info("RabbitMQ audit publisher created")
+	defer auditPublisher.Close()
+
 	r := gin.New()
-	r.Use(ginzap.Ginzap(logger, time.RFC3339, true))
+	r.Use(telemetry.Middleware("form-service"))
+	r.Use(correlation.Middleware())
+	r.Use(ginzap.GinzapWithConfig(logger, &ginzap.Config{TimeFormat: time.RFC3339, UTC: true, Context: correlation.LogFields}))
 	r.Use(ginzap.RecoveryWithZap(logger, true))
 
 	v1 := r.Group("/api/v1/form")
@@ -116,14 +171,27 @@ func main() {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
-	v1.POST("/", role("team"), createForm)
-	v1.GET("/:id", role("user", "team"), getFormByID)
-	v1.POST("/responses", role("user"), submitFormResponse)
-	v1.GET("/responses/:id", role("user", "team"), getFormResponseByID)
-	v1.GET("/:id/responses", role("team"), getAllResponsesByFormID)
-	// internal endpoint
-	r.GET("/:id/responses", getAllResponsesByFormID)
-	r.GET("/:id/answers", getTextAnswerForAQuestion)
+	v1.POST("/", permission.Require(permission.FormCreate), createForm)
+	v1.GET("/:id", permission.Require(permission.FormRead), getFormByID)
+	v1.POST("/responses", permission.Require(permission.ResponsesSubmit), submitFormResponse)
+	v1.GET("/responses/:id", permission.RequireAny(permission.ResponsesRead, permission.ResponsesReadOwn), getFormResponseByID)
+	v1.GET("/:id/responses", permission.Require(permission.ResponsesRead), getAllResponsesByFormID)
+	v1.GET("/:id/responses/export", permission.Require(permission.ResponsesExport), exportResponsesByFormID)
+	v1.GET("/search", permission.Require(permission.ResponsesRead), searchResponses)
+	v1.POST("/:id/import", permission.Require(permission.ResponsesImport), importResponses)
+	v1.PUT("/:id/duplicates", permission.Require(permission.FormUpdate), configureDuplicateDetection)
+	v1.POST("/responses/review", permission.Require(permission.ResponsesReview), reviewResponses)
+	v1.GET("/responses/:id/notes", permission.Require(permission.ResponsesRead), getResponseNotes)
+	v1.POST("/responses/:id/notes", permission.Require(permission.ResponsesReview), addResponseNote)
+	v1.POST("/keys/rotate", permission.Require(permission.KeysRotate), rotateDataKey)
+	// internal endpoints, called by plugins with their service token
+	serviceTokens, err := serviceauth.NewVerifier(serviceauth.AuthURL(), "form-service")
+	if err != nil {
+		logger.Fatal("Failed to load service token keys", zap.Error(err))
+	}
+	serviceTokens.Logger = logger
+	r.GET("/:id/responses", serviceTokens.Require(permission.ResponsesRead), getServiceResponsesByFormID)
+	r.GET("/:id/answers", serviceTokens.Require(permission.ResponsesRead), getTextAnswerForAQuestion)
 
 	if err = r.Run(":80"); err != nil {
 		logger.Fatal("Failed to start server", zap.Error(err))
@@ -131,48 +199,42 @@ func main() {
 	logger.Info("Server started", zap.String("address", ":80"))
 }
 
-func role(roles ...string) gin.HandlerFunc {
-
-	return func(c *gin.Context) {
-		userRole := c.Request.Header.Get("X-Role")
-		logger.Debug("Checking user role", zap.String("role", userRole), zap.Any("required_roles", roles))
-
-		roleMatched := false
-		for _, role := range roles {
-			if userRole == role {
-				roleMatched = true
-				break
-			}
-		}
-
-		if !roleMatched {
-			logger.Warn("Not a recognized role", zap.String("role", userRole))
-			c.JSON(http.StatusForbidden, gin.H{"error": "Not a " + strings.Join(roles, ", ")})
-			c.Abort()
-			return
-		}
-
-		c.Next()
+// checkVerifiedRespondent fails when the form requires a verified email or
+// phone the respondent hasn't verified.
+func checkVerifiedRespondent(c *gin.Context, form models.Form) error {
+	if form.RequireVerifiedEmail && c.GetHeader("X-Email-Verified") != "true" {
+		return errors.New("This form requires a verified email, verify it and refresh your token")
+	}
+	if form.RequireVerifiedPhone && c.GetHeader("X-Phone-Verified") != "true" {
+		return errors.New("This form requires a verified phone number, verify it and refresh your token")
 	}
+	return nil
 }
 
 // TODO: for all database inserts and errors
 
 func createForm(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering createForm function")
 	// TODO: general schema validation
 
 	type QuestionJsonBody struct {
-		Type     models.QuestionType `json:"type"`
-		Text     string              `json:"text"`
-		Options  []string            `json:"options"`
-		Required bool                `json:"required"`
+		Type        models.QuestionType `json:"type"`
+		Text        string              `json:"text"`
+		Options     []string            `json:"options"`
+		Required    bool                `json:"required"`
+		Sensitive   bool                `json:"sensitive"`
+		Fingerprint bool                `json:"fingerprint"`
 	}
 
 	type FormJsonBody struct {
-		Title       string             `json:"title"`
-		Description string             `json:"description"`
-		Questions   []QuestionJsonBody `json:"questions"`
+		Title                    string                 `json:"title"`
+		Description              string                 `json:"description"`
+		IncludeSensitiveInEvents bool                   `json:"include_sensitive_in_events"`
+		DuplicatePolicy          models.DuplicatePolicy `json:"duplicate_policy"`
+		RequireVerifiedEmail     bool                   `json:"require_verified_email"`
+		RequireVerifiedPhone     bool                   `json:"require_verified_phone"`
+		Questions                []QuestionJsonBody     `json:"questions"`
 	}
 
 	var formRequest FormJsonBody
@@ -183,19 +245,47 @@ func createForm(c *gin.Context) {
 		return
 	}
 
-	tx := db.Begin()
-	teamId, err := strconv.ParseUint(c.GetHeader("X-Id"), 10, 64)
+	switch formRequest.DuplicatePolicy {
+	case "":
+		formRequest.DuplicatePolicy = models.AllowDuplicates
+	case models.AllowDuplicates, models.FlagDuplicates, models.RejectDuplicates:
+	default:
+		logger.Error("Invalid duplicate policy", zap.String("policy", string(formRequest.DuplicatePolicy)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "duplicate_policy must be one of allow, flag or reject"})
+		return
+	}
+
+	if formRequest.DuplicatePolicy != models.AllowDuplicates && len(fingerprintKey) == 0 {
+		logger.Error("Duplicate policy without a fingerprint key configured", zap.String("policy", string(formRequest.DuplicatePolicy)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "duplicate_policy is not supported: " + errFingerprintNotConfigured.Error()})
+		return
+	}
+
+	for _, q := range formRequest.Questions {
+		if q.Sensitive && !keyring.Enabled() {
+			logger.Error("Sensitive question without encryption configured", zap.String("question", q.Text))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sensitive questions are not supported: " + encryption.ErrNotConfigured.Error()})
+			return
+		}
+	}
+
+	tx := db.WithContext(c.Request.Context()).Begin()
+	teamId, err := strconv.ParseUint(c.GetHeader("X-Team-Id"), 10, 64)
 	if err != nil {
-		logger.Error("Failed to parse X-Id", zap.Error(err))
+		logger.Error("Failed to parse X-Team-Id", zap.Error(err))
 		tx.Rollback()
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	form := models.Form{
-		Title:       formRequest.Title,
-		Description: formRequest.Description,
-		TeamID:      uint(teamId),
+		Title:                    formRequest.Title,
+		Description:              formRequest.Description,
+		TeamID:                   uint(teamId),
+		IncludeSensitiveInEvents: formRequest.IncludeSensitiveInEvents,
+		DuplicatePolicy:          formRequest.DuplicatePolicy,
+		RequireVerifiedEmail:     formRequest.RequireVerifiedEmail,
+		RequireVerifiedPhone:     formRequest.RequireVerifiedPhone,
 	}
 
 	if err := tx.Create(&form).Error; err != nil {
@@ -210,12 +300,14 @@ func createForm(c *gin.Context) {
 		optionArray := pgtype.TextArray{}
 		optionArray.Set(q.Options)
 		questions = append(questions, models.Question{
-			FormID:   form.ID,
-			Order:    uint(i + 1),
-			Type:     q.Type,
-			Text:     q.Text,
-			Options:  optionArray,
-			Required: q.Required,
+			FormID:      form.ID,
+			Order:       uint(i + 1),
+			Type:        q.Type,
+			Text:        q.Text,
+			Options:     optionArray,
+			Required:    q.Required,
+			Sensitive:   q.Sensitive,
+			Fingerprint: q.Fingerprint,
 		})
 	}
 
@@ -244,10 +336,11 @@ func createForm(c *gin.Context) {
 }
 
 func getFormByID(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering getFormByID function")
 	formID := c.Param("id")
 	var form models.Form
-	if err := db.Preload("Questions").First(&form, formID).Error; err != nil {
+	if err := db.WithContext(c.Request.Context()).Preload("Questions").First(&form, formID).Error; err != nil {
 		logger.Error("Failed to get form", zap.Error(err))
 		c.JSON(http.StatusNotFound, gin.H{"error": "Form not found"})
 		return
@@ -255,10 +348,12 @@ func getFormByID(c *gin.Context) {
 	logger.Debug("Form retrieved", zap.Uint("form_id", form.ID))
 
 	response := gin.H{
-		"id":          form.ID,
-		"title":       form.Title,
-		"description": form.Description,
-		"questions":   []map[string]interface{}{},
+		"id":                     form.ID,
+		"title":                  form.Title,
+		"description":            form.Description,
+		"require_verified_email": form.RequireVerifiedEmail,
+		"require_verified_phone": form.RequireVerifiedPhone,
+		"questions":              []map[string]interface{}{},
 	}
 
 	for _, question := range form.Questions {
@@ -275,6 +370,10 @@ func getFormByID(c *gin.Context) {
 			questionData["required"] = true
 		}
 
+		if question.Sensitive {
+			questionData["sensitive"] = true
+		}
+
 		response["questions"] = append(response["questions"].([]map[string]interface{}), questionData)
 	}
 
@@ -283,6 +382,7 @@ func getFormByID(c *gin.Context) {
 }
 
 func submitFormResponse(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering submitFormResponse function")
 	// TODO: Here there generic validation which should follow the required in this
 	// NOTE: improve this to use already existing types
@@ -304,7 +404,7 @@ func submitFormResponse(c *gin.Context) {
 		return
 	}
 
-	tx := db.Begin()
+	tx := db.WithContext(c.Request.Context()).Begin()
 
 	userId, err := strconv.ParseUint(c.GetHeader("X-Id"), 10, 64)
 	if err != nil {
@@ -329,218 +429,202 @@ func submitFormResponse(c *gin.Context) {
 		return
 	}
 
-	if err := tx.Create(&response).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := checkVerifiedRespondent(c, form); err != nil {
+		tx.Rollback()
+		logger.Warn("Respondent not verified", zap.Uint64("user_id", userId), zap.Uint("form_id", form.ID), zap.Error(err))
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 		return
 	}
-	logger.Debug("Response created", zap.Uint("response_id", response.ID))
 
 	var answers []models.Answer
 	for _, a := range responseJSON.Answers {
-		// check if the given question id is in the form
-		for _, q := range form.Questions {
-			if q.ID != a.QuestionID {
-				tx.Rollback()
-        logger.Error("Question not found", zap.Uint("question_id", a.QuestionID))
-				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Question id %v not present in the form %v", a.QuestionID, responseJSON.FormID)})
-				return
-			}
-		}
-
-		// check if the value given is in the range of the array of options if the value is radio or checkbox
-		if a.Answer.Type == "radio" || a.Answer.Type == "checkbox" {
-			var numberOfOptions int
-			logger.Debug("Questions", zap.Any("questions", form.Questions))
-			for _, q := range form.Questions {
-				if q.ID == a.QuestionID {
-					numberOfOptions = len(q.Options.Elements)
-					logger.Debug("Number of options", zap.Int("number_of_options", numberOfOptions))
-					break
-				}
-			}
-			if a.Answer.Type == "radio" {
-				var idx int
-				a.Answer.Value.AssignTo(&idx)
-				if idx >= numberOfOptions {
-					tx.Rollback()
-					logger.Error("Invalid option choice", zap.Uint("question_id", a.QuestionID))
-					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid option choice for question id : %d where option index : %d", a.QuestionID, idx)})
-					return
-				}
-			} else {
-				var idxs []int
-				a.Answer.Value.AssignTo(&idxs)
-				for _, idx := range idxs {
-					if idx >= numberOfOptions {
-						tx.Rollback()
-						logger.Error("Invalid option choice", zap.Uint("question_id", a.QuestionID), zap.Int("option_index", idx), zap.Int("total_options", numberOfOptions))
-						c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid option choice for question id : %d where option index : %d is greater than equal to %d", a.QuestionID, idx, numberOfOptions)})
-						return
-					}
-				}
-			}
+		if err := validateAnswer(form, a.QuestionID, a.Answer.Type, a.Answer.Value); err != nil {
+			tx.Rollback()
+			logger.Error("Invalid answer", zap.Uint("question_id", a.QuestionID), zap.Error(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 		answers = append(answers, models.Answer{
 			QuestionID: a.QuestionID,
-			ResponseID: response.ID,
 			Type:       a.Answer.Type,
 			Value:      a.Answer.Value,
 		})
 	}
 
-	if err := tx.Create(&answers).Error; err != nil {
-		logger.Error("Failed to create answers", zap.Error(err))
+	original, err := checkDuplicate(tx, form, &response, answers)
+	if errors.Is(err, errDuplicateResponse) {
 		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		logger.Warn("Duplicate response rejected", zap.Uint("form_id", form.ID), zap.Uint("duplicate_of", original.ID))
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 		return
 	}
-	logger.Debug("Answers created", zap.Uint("response_id", response.ID), zap.Int("count", len(answers)))
-
-	if err := tx.Commit().Error; err != nil {
-		logger.Error("Failed to commit transaction", zap.Error(err))
+	if err != nil {
+		logger.Error("Failed to check duplicate responses", zap.Error(err))
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	logger.Debug("Response committed to database", zap.Uint("response_id", response.ID))
 
-	type MessageData struct {
-		UserID      uint       `json:"user_id"`
-		FormID      uint       `json:"form_id"`
-		Title       string     `json:"title"`
-		Description string     `json:"description"`
-		QnA         [][]string `json:"qna"`
+	if err := tx.Create(&response).Error; err != nil {
+		logger.Error("Failed to create response", zap.Error(err))
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+	logger.Debug("Response created", zap.Uint("response_id", response.ID), zap.Bool("duplicate", response.Duplicate))
 
-	type Message struct {
-		Event  string      `json:"event"`
-		TeamID uint        `json:"team_id"`
-		Data   MessageData `json:"data"`
+	for i := range answers {
+		answers[i].ResponseID = response.ID
 	}
 
-	message := Message{
-		Event:  "response-submission",
-		TeamID: form.TeamID,
-		Data: MessageData{
-			UserID:      uint(userId),
-			FormID:      form.ID,
-			Title:       form.Title,
-			Description: form.Description,
-		},
+	// answers keeps the plaintext for the event, storedAnswers is what goes to the database
+	storedAnswers, err := encryptAnswers(tx, form, answers)
+	if err != nil {
+		logger.Error("Failed to encrypt answers", zap.Uint("team_id", form.TeamID), zap.Error(err))
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	for _, question := range form.Questions {
-		didntAnswer := true
-		for _, answer := range answers {
-			if answer.QuestionID == question.ID {
-				var answerValue interface{}
-				switch question.Type {
-				case models.Radio:
-					var valueIdx uint
-					answer.Value.AssignTo(&valueIdx)
-					answerValue = question.Options.Elements[valueIdx].String
-				case models.Checkbox:
-					var valueIdxs []uint
-					answer.Value.AssignTo(&valueIdxs)
-					var value []string
-					for _, idx := range valueIdxs {
-						value = append(value, question.Options.Elements[idx].String)
-					}
-					answerValue = value
-				case models.Text:
-					answer.Value.AssignTo(&answerValue)
-				}
-				message.Data.QnA = append(message.Data.QnA, []string{question.Text, convertInterfaceToString(answerValue)})
-				didntAnswer = false
-			}
-		}
-		if didntAnswer {
-			message.Data.QnA = append(message.Data.QnA, []string{question.Text, "N/A"})
-		}
-
+	if err := tx.Create(&storedAnswers).Error; err != nil {
+		logger.Error("Failed to create answers", zap.Error(err))
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+	logger.Debug("Answers created", zap.Uint("response_id", response.ID), zap.Int("count", len(answers)))
 
-	jsonMessage, err := json.Marshal(message)
-	if err != nil {
-		logger.Error("Failed to marshal message", zap.Error(err))
+	if err := tx.Commit().Error; err != nil {
+		logger.Error("Failed to commit transaction", zap.Error(err))
+		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if err = publisher.Publish(jsonMessage, []string{"events"}, rabbitmq.WithPublishOptionsContentType("application/json"), rabbitmq.WithPublishOptionsExchange("events")); err != nil {
-		logger.Error("Failed to publish message", zap.Error(err))
+	logger.Debug("Response committed to database", zap.Uint("response_id", response.ID))
+
+	requestLogger := correlation.Logger(c.Request.Context(), logger)
+	requestLogger.Info("Response submitted", zap.Uint("form_id", form.ID), zap.Uint("response_id", response.ID))
+
+	if err = publishResponseSubmission(c.Request.Context(), form, response, answers); err != nil {
+		requestLogger.Error("Failed to publish message", zap.Uint("response_id", response.ID), zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	if response.Duplicate {
+		if err = publishDuplicateDetected(c.Request.Context(), form, response, *original); err != nil {
+			requestLogger.Error("Failed to publish message", zap.Uint("response_id", response.ID), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	c.JSON(http.StatusCreated, gin.H{
 		"status":      "success",
 		"message":     "Response submitted successfully",
-		"response_id": response.ID},
+		"response_id": response.ID,
+		"duplicate":   response.Duplicate},
 	)
 	logger.Debug("Exiting submitFormResponse function")
 }
 
+// validateAnswer checks an answer against the question it is given for.
+func validateAnswer(form models.Form, questionID uint, answerType string, value pgtype.JSONB) error {
+	// check if the given question id is in the form
+	var question *models.Question
+	for i := range form.Questions {
+		if form.Questions[i].ID == questionID {
+			question = &form.Questions[i]
+			break
+		}
+	}
+	if question == nil {
+		return fmt.Errorf("Question id %v not present in the form %v", questionID, form.ID)
+	}
+
+	// check if the value given is in the range of the array of options if the value is radio or checkbox
+	numberOfOptions := len(question.Options.Elements)
+	switch answerType {
+	case string(models.Radio):
+		var idx int
+		if err := value.AssignTo(&idx); err != nil {
+			return fmt.Errorf("invalid option choice for question id : %d : %v", questionID, err)
+		}
+		if idx < 0 || idx >= numberOfOptions {
+			return fmt.Errorf("invalid option choice for question id : %d where option index : %d", questionID, idx)
+		}
+	case string(models.Checkbox):
+		var idxs []int
+		if err := value.AssignTo(&idxs); err != nil {
+			return fmt.Errorf("invalid option choice for question id : %d : %v", questionID, err)
+		}
+		for _, idx := range idxs {
+			if idx < 0 || idx >= numberOfOptions {
+				return fmt.Errorf("invalid option choice for question id : %d where option index : %d is greater than equal to %d", questionID, idx, numberOfOptions)
+			}
+		}
+	}
+	return nil
+}
+
 func getFormResponseByID(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering getFormResponseByID function")
 	responseID := c.Param("id")
 	var response models.Response
-	if err := db.Preload("Answers").First(&response, responseID).Error; err != nil {
+	if err := db.WithContext(c.Request.Context()).Preload("Answers").First(&response, responseID).Error; err != nil {
 		logger.Error("Failed to get response", zap.Error(err))
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
 	logger.Debug("Response retrieved", zap.Uint("response_id", response.ID))
 	// authorisation
-	if c.GetHeader("X-Role") == "user" {
-		userId, err := strconv.ParseUint(c.GetHeader("X-Id"), 10, 64)
-		if err != nil {
-			logger.Error("Failed to parse X-Id", zap.Error(err))
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		if response.UserID != uint(userId) {
-			logger.Error("You can't access responses not created by you", zap.Uint("userId", uint(userId)), zap.Uint("requiredUserId", response.UserID))
-			c.JSON(http.StatusForbidden, gin.H{"error": "You can't access responses not created by you"})
-			return
-		}
-	} else if c.GetHeader("X-Role") == "team" {
-		var form models.Form
-		if err := db.First(&form, response.FormID).Error; err != nil {
-			logger.Error("Failed to get form", zap.Error(err))
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-			return
-		}
-		logger.Debug("Form retrieved", zap.Uint("form_id", form.ID))
+	var responseForm models.Form
+	if err := db.WithContext(c.Request.Context()).First(&responseForm, response.FormID).Error; err != nil {
+		logger.Error("Failed to get form", zap.Error(err))
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Debug("Form retrieved", zap.Uint("form_id", responseForm.ID))
 
-		teamId, err := strconv.ParseUint(c.GetHeader("X-Id"), 10, 64)
+	if !isFormTeamMember(c, responseForm) || !permission.Has(c, permission.ResponsesRead) {
+		userId, err := strconv.ParseUint(c.GetHeader("X-Id"), 10, 64)
 		if err != nil {
 			logger.Error("Failed to parse X-Id", zap.Error(err))
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		if form.TeamID != uint(teamId) {
-			logger.Error("You can't access responses to forms not created by your team", zap.Uint("teamId", uint(teamId)), zap.Uint("requiredTeamId", form.TeamID))
-			c.JSON(http.StatusForbidden, gin.H{"error": "You can't access responses to forms not created by your team"})
+		if !permission.Has(c, permission.ResponsesReadOwn) || response.UserID != uint(userId) {
+			logger.Error("You can't access responses not created by you or your team", zap.Uint("userId", uint(userId)), zap.Uint("requiredUserId", response.UserID))
+			c.JSON(http.StatusForbidden, gin.H{"error": "You can't access responses not created by you or your team"})
 			return
 		}
-	} else {
-		logger.Error("Access denied", zap.String("role", c.GetHeader("X-Role")), zap.Uint("Id", response.UserID))
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
-		return
 	}
 
 	var form models.Form
-	if err := db.Preload("Questions").First(&form, response.FormID).Error; err != nil {
+	if err := db.WithContext(c.Request.Context()).Preload("Questions").First(&form, response.FormID).Error; err != nil {
 		logger.Error("Failed to get form", zap.Error(err))
 		c.JSON(http.StatusNotFound, gin.H{"error": "Associated form not found"})
 		return
 	}
 	logger.Debug("Form retrieved", zap.Uint("form_id", form.ID))
 
+	teamMember := isFormTeamMember(c, form)
+	if teamMember {
+		if err := decryptAnswers(db, form.TeamID, response.Answers); err != nil {
+			logger.Error("Failed to decrypt answers", zap.Uint("response_id", response.ID), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	responseJSON := map[string]interface{}{
 		"id":              response.ID,
 		"submission_time": response.SubmissionTime,
 		"user_id":         response.UserID,
+		"duplicate":       response.Duplicate,
+		"duplicate_of":    response.DuplicateOfID,
+		"review_status":   response.ReviewStatus,
 		"form": map[string]interface{}{
 			"id":          form.ID,
 			"title":       form.Title,
@@ -549,11 +633,20 @@ func getFormResponseByID(c *gin.Context) {
 		},
 	}
 
+	// tags are internal to the team, notes have their own endpoint
+	if teamMember {
+		responseJSON["tags"] = textArrayToStrings(response.Tags)
+	}
+
 	// TODO: bad code O(n^2) improve
 	for _, question := range form.Questions {
 		var answerValue interface{}
 		for _, answer := range response.Answers {
 			if answer.QuestionID == question.ID {
+				if answer.Encrypted {
+					answerValue = redactedValue
+					break
+				}
 				switch question.Type {
 				case models.Radio:
 					var valueIdx uint
@@ -585,18 +678,47 @@ func getFormResponseByID(c *gin.Context) {
 			questionJSON["options"] = options
 		}
 
+		if question.Sensitive {
+			questionJSON["sensitive"] = true
+		}
+
 		responseJSON["form"].(map[string]interface{})["questions"] = append(
 			responseJSON["form"].(map[string]interface{})["questions"].([]map[string]interface{}),
 			questionJSON,
 		)
 	}
 
+	publishAudit(c, form.TeamID, AuditEvent{
+		Event:      ResponsesReadEvent,
+		TargetType: "response",
+		TargetID:   fmt.Sprint(response.ID),
+		Details:    map[string]interface{}{"form_id": form.ID, "decrypted": teamMember},
+	})
+
 	c.JSON(http.StatusOK, responseJSON)
 	logger.Debug("Exiting getFormResponseByID function")
 }
 
 func getAllResponsesByFormID(c *gin.Context) {
-	logger.Debug("Entering getFormResponsesByFormID function")
+	writeFormResponses(c, false, true)
+}
+
+// exportResponsesByFormID sends the same listing as a file to download.
+func exportResponsesByFormID(c *gin.Context) {
+	writeFormResponses(c, true, true)
+}
+
+// getServiceResponsesByFormID lists the responses of any form for plugins,
+// authorised by their service token instead of a team.
+func getServiceResponsesByFormID(c *gin.Context) {
+	writeFormResponses(c, false, false)
+}
+
+// writeFormResponses lists the responses of the form, teamOnly refuses forms
+// of other teams than the caller's.
+func writeFormResponses(c *gin.Context, export bool, teamOnly bool) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering writeFormResponses function", zap.Bool("export", export))
 	formID := c.Param("id")
 
 	var response struct {
@@ -608,8 +730,13 @@ func getAllResponsesByFormID(c *gin.Context) {
 			Value string `json:"value"`
 		} `json:"questions"`
 		Responses []struct {
-			UserID  uint `json:"user_id"`
-			Answers []struct {
+			ResponseID   uint                `json:"response_id"`
+			UserID       uint                `json:"user_id"`
+			Duplicate    bool                `json:"duplicate"`
+			DuplicateOf  *uint               `json:"duplicate_of,omitempty"`
+			ReviewStatus models.ReviewStatus `json:"review_status"`
+			Tags         []string            `json:"tags"`
+			Answers      []struct {
 				QuestionID uint        `json:"question_id"`
 				Value      interface{} `json:"value"`
 			} `json:"answers"`
@@ -618,12 +745,17 @@ func getAllResponsesByFormID(c *gin.Context) {
 
 	// Retrieve form data
 	var form models.Form
-	if err := db.First(&form, formID).Error; err != nil {
+	if err := db.WithContext(c.Request.Context()).First(&form, formID).Error; err != nil {
 		logger.Error("Failed to get form", zap.Error(err))
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
 	logger.Debug("Form retrieved", zap.Uint("form_id", form.ID))
+	if teamOnly && !isFormTeamMember(c, form) {
+		logger.Error("You can't access responses of forms not created by your team", zap.Uint("form_id", form.ID))
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't access responses of forms not created by your team"})
+		return
+	}
 
 	response.FormID = form.ID
 	response.Title = form.Title
@@ -631,7 +763,7 @@ func getAllResponsesByFormID(c *gin.Context) {
 
 	// Retrieve question data
 	var questions []models.Question
-	if err := db.Where("form_id = ?", form.ID).Find(&questions).Error; err != nil {
+	if err := db.WithContext(c.Request.Context()).Where("form_id = ?", form.ID).Find(&questions).Error; err != nil {
 		logger.Error("Failed to get questions", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -649,25 +781,56 @@ func getAllResponsesByFormID(c *gin.Context) {
 	}
 
 	// Retrieve response data
+	query := db.WithContext(c.Request.Context()).Where("form_id = ?", form.ID)
+	if duplicate := c.Query("duplicate"); duplicate != "" {
+		query = query.Where("duplicate = ?", duplicate == "true")
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("review_status = ?", status)
+	}
+	for _, tag := range c.QueryArray("tag") {
+		query = query.Where("? = ANY(tags)", tag)
+	}
 	var responses []models.Response
-	if err := db.Where("form_id = ?", form.ID).Preload("Answers").Find(&responses).Error; err != nil {
+	if err := query.Preload("Answers").Find(&responses).Error; err != nil {
 		logger.Error("Failed to get responses", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	logger.Debug("Responses retrieved", zap.Uint("form_id", form.ID))
 
+	// sensitive answers are only decrypted for the team owning the form
+	decrypt := isFormTeamMember(c, form)
+
 	for _, resp := range responses {
 		response.Responses = append(response.Responses, struct {
-			UserID  uint `json:"user_id"`
-			Answers []struct {
+			ResponseID   uint                `json:"response_id"`
+			UserID       uint                `json:"user_id"`
+			Duplicate    bool                `json:"duplicate"`
+			DuplicateOf  *uint               `json:"duplicate_of,omitempty"`
+			ReviewStatus models.ReviewStatus `json:"review_status"`
+			Tags         []string            `json:"tags"`
+			Answers      []struct {
 				QuestionID uint        `json:"question_id"`
 				Value      interface{} `json:"value"`
 			} `json:"answers"`
 		}{
-			UserID: resp.UserID,
+			ResponseID:   resp.ID,
+			UserID:       resp.UserID,
+			Duplicate:    resp.Duplicate,
+			DuplicateOf:  resp.DuplicateOfID,
+			ReviewStatus: resp.ReviewStatus,
+			Tags:         textArrayToStrings(resp.Tags),
 		})
 
+		if decrypt {
+			if err := decryptAnswers(db, form.TeamID, resp.Answers); err != nil {
+				logger.Error("Failed to decrypt answers", zap.Uint("response_id", resp.ID), zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
 		for _, answer := range resp.Answers {
 			var question models.Question
 			for _, q := range questions {
@@ -678,13 +841,15 @@ func getAllResponsesByFormID(c *gin.Context) {
 			}
 
 			var answerValue interface{}
-			switch answer.Type {
-			case string(models.Radio):
+			switch {
+			case answer.Encrypted:
+				answerValue = redactedValue
+			case answer.Type == string(models.Radio):
 				var valueIdx uint
 				answer.Value.AssignTo(&valueIdx)
 				logger.Debug("Radio answer", zap.Any("answer", answer.Value))
 				answerValue = question.Options.Elements[valueIdx].String // BUG:
-			case string(models.Checkbox):
+			case answer.Type == string(models.Checkbox):
 				var valueIdxs []uint
 				answer.Value.AssignTo(&valueIdxs)
 				var value []string
@@ -692,7 +857,7 @@ func getAllResponsesByFormID(c *gin.Context) {
 					value = append(value, question.Options.Elements[idx].String)
 				}
 				answerValue = value
-			case string(models.Text):
+			case answer.Type == string(models.Text):
 				answer.Value.AssignTo(&answerValue)
 			}
 			response.Responses[len(response.Responses)-1].Answers = append(response.Responses[len(response.Responses)-1].Answers, struct {
@@ -705,26 +870,58 @@ func getAllResponsesByFormID(c *gin.Context) {
 		}
 	}
 
+	event := ResponsesReadEvent
+	if export {
+		event = ResponsesExportEvent
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="form-%d-responses.json"`, form.ID))
+	}
+	publishAudit(c, form.TeamID, AuditEvent{
+		Event:      event,
+		TargetType: "form",
+		TargetID:   fmt.Sprint(form.ID),
+		Details:    map[string]interface{}{"responses": len(response.Responses), "decrypted": decrypt},
+	})
+
 	c.JSON(http.StatusOK, response)
-	logger.Debug("Exiting getFormResponsesByFormID function")
+	logger.Debug("Exiting writeFormResponses function")
 }
 
 func getTextAnswerForAQuestion(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	responseID := c.Query("response_id")
 	questionID := c.Query("question_id")
 	var answer models.Answer
-	if err := db.Where("response_id = ? AND question_id = ?", responseID, questionID).Find(&answer).Error; err != nil {
+	if err := db.WithContext(c.Request.Context()).Where("response_id = ? AND question_id = ?", responseID, questionID).Find(&answer).Error; err != nil {
 		logger.Error("Failed to get answer", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	if answer.Encrypted {
+		logger.Warn("Answer is sensitive", zap.Uint("answer_id", answer.ID))
+		c.JSON(http.StatusForbidden, gin.H{"error": "Answer is sensitive"})
+		return
+	}
+
 	if answer.Type != string(models.Text) {
 		logger.Warn("Invalid answer type", zap.String("type", answer.Type))
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid answer type"})
 		return
 	}
 
+	var form models.Form
+	if err := db.WithContext(c.Request.Context()).Joins("JOIN responses ON responses.form_id = forms.id").Where("responses.id = ?", answer.ResponseID).First(&form).Error; err != nil {
+		logger.Error("Failed to get form", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	publishAudit(c, form.TeamID, AuditEvent{
+		Event:      AnswersReadEvent,
+		TargetType: "response",
+		TargetID:   fmt.Sprint(answer.ResponseID),
+		Details:    map[string]interface{}{"form_id": form.ID, "question_id": answer.QuestionID},
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"value": answer.Value,
 	})
@@ -15,31 +15,62 @@ const (
 	Checkbox QuestionType = "checkbox"
 )
 
+type DuplicatePolicy string
+
+const (
+	AllowDuplicates  DuplicatePolicy = "allow"
+	FlagDuplicates   DuplicatePolicy = "flag"
+	RejectDuplicates DuplicatePolicy = "reject"
+)
+
+type ReviewStatus string
+
+const (
+	NewReview           ReviewStatus = "new"
+	ApprovedReview      ReviewStatus = "approved"
+	RejectedReview      ReviewStatus = "rejected"
+	NeedsFollowUpReview ReviewStatus = "needs-follow-up"
+)
+
 type Form struct {
 	gorm.Model
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	TeamID      uint   `json:"team_id"`
-	Questions   []Question
+	Title                    string          `json:"title"`
+	Description              string          `json:"description"`
+	TeamID                   uint            `json:"team_id"`
+	IncludeSensitiveInEvents bool            `json:"include_sensitive_in_events"` // team opt-in to send sensitive answers in plaintext events
+	DuplicatePolicy          DuplicatePolicy `json:"duplicate_policy" gorm:"default:allow"`
+	RequireVerifiedEmail     bool            `json:"require_verified_email"` // respondents must have verified their email
+	RequireVerifiedPhone     bool            `json:"require_verified_phone"` // respondents must have verified their phone
+	Questions                []Question
 }
 
 type Question struct {
 	gorm.Model
-	Order    uint             `json:"order"`
-	FormID   uint             `json:"form_id"`
-	Type     QuestionType     `json:"type"`
-	Text     string           `json:"text"`
-	Options  pgtype.TextArray `json:"options" gorm:"type:text[]"`
-	Required bool             `json:"required"`
+	Order       uint             `json:"order"`
+	FormID      uint             `json:"form_id"`
+	Type        QuestionType     `json:"type"`
+	Text        string           `json:"text"`
+	Options     pgtype.TextArray `json:"options" gorm:"type:text[]"`
+	Required    bool             `json:"required"`
+	Sensitive   bool             `json:"sensitive"`   // answers are stored encrypted
+	Fingerprint bool             `json:"fingerprint"` // answers are part of the duplicate detection fingerprint
 }
 
 type Response struct {
 	gorm.Model
-	FormID         uint      `json:"form_id"`
-	UserID         uint      `json:"user_id"`
-	SubmissionTime time.Time `json:"submission_time"`
-	Form           Form      `gorm:"foreignKey:FormID"`
-	Answers        []Answer  // NOTE: you can do some prelaod stuff to it like - `db.Preload("Answers").Find(&form, formID)`
+	FormID         uint             `json:"form_id"`
+	UserID         uint             `json:"user_id"`
+	SubmissionTime time.Time        `json:"submission_time"`
+	Fingerprint    string           `json:"-" gorm:"index"`
+	Duplicate      bool             `json:"duplicate"`
+	DuplicateOfID  *uint            `json:"duplicate_of,omitempty"`
+	ReviewStatus   ReviewStatus     `json:"review_status" gorm:"default:new;index"`
+	Tags           pgtype.TextArray `json:"tags" gorm:"type:text[]"`
+	ReviewedBy     uint             `json:"reviewed_by,omitempty"`
+	ReviewedAt     *time.Time       `json:"reviewed_at,omitempty"`
+	Notes          []ReviewNote     `json:"-"`
+	Form           Form             `gorm:"foreignKey:FormID"`
+	Answers        []Answer         // NOTE: you can do some prelaod stuff to it like - `db.Preload("Answers").Find(&form, formID)`
 }
 
 type Answer struct {
@@ -48,6 +79,28 @@ type Answer struct {
 	QuestionID uint         `json:"question_id"`
 	Type       string       `json:"type"`
 	Value      pgtype.JSONB `json:"value" gorm:"type:jsonb"` // It can have values of type int, []int, string
+	Encrypted  bool         `json:"encrypted"`               // Value holds the base64 ciphertext of the original value
+	DataKeyID  uint         `json:"-"`
 	Response   Response     `gorm:"foreignKey:ResponseID"`
 	Question   Question     `gorm:"foreignKey:QuestionID"`
 }
+
+// ReviewNote is an internal note of the team on a response, it is never
+// shown to the respondent.
+type ReviewNote struct {
+	gorm.Model
+	ResponseID uint   `json:"response_id" gorm:"index"`
+	AuthorID   uint   `json:"author_id"`
+	Text       string `json:"text"`
+}
+
+// DataKey is a per-team key used to encrypt sensitive answers. It is stored
+// wrapped by one of the master keys from the service configuration.
+type DataKey struct {
+	gorm.Model
+	TeamID      uint   `json:"team_id" gorm:"index"`
+	Version     uint   `json:"version"`
+	MasterKeyID string `json:"master_key_id"`
+	WrappedKey  []byte `json:"-"`
+	Active      bool   `json:"active"`
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// mockDB replaces the database of the handlers with a mock for the test.
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockDB, err := gorm.Open(postgres.New(postgres.Config{Conn: conn}), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousDB, previousLogger := db, logger
+	db, logger = mockDB, zap.NewNop()
+	t.Cleanup(func() {
+		db, logger = previousDB, previousLogger
+		conn.Close()
+	})
+	return mock
+}
+
+func TestFormResponsesOfOtherTeam(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		route      string
+		path       string
+		teamID     string
+		handler    gin.HandlerFunc
+		wantStatus int
+	}{
+		{name: "list", route: "/:id/responses", path: "/7/responses", teamID: "2", handler: getAllResponsesByFormID, wantStatus: http.StatusForbidden},
+		{name: "export", route: "/:id/responses/export", path: "/7/responses/export", teamID: "2", handler: exportResponsesByFormID, wantStatus: http.StatusForbidden},
+		{name: "without team", route: "/:id/responses", path: "/7/responses", handler: getAllResponsesByFormID, wantStatus: http.StatusForbidden},
+		// past the team check, the questions fail to load
+		{name: "own team", route: "/:id/responses", path: "/7/responses", teamID: "1", handler: getAllResponsesByFormID, wantStatus: http.StatusInternalServerError},
+		{name: "service token", route: "/:id/responses", path: "/7/responses", handler: getServiceResponsesByFormID, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "forms"`)).
+				WithArgs("7").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "title", "team_id"}).AddRow(7, "Survey", 1))
+			if tt.wantStatus != http.StatusForbidden {
+				mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "questions"`)).WillReturnError(errors.New("questions unavailable"))
+			}
+
+			r := gin.New()
+			r.GET(tt.route, tt.handler)
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("X-Id", "3")
+			if tt.teamID != "" {
+				req.Header.Set("X-Team-Id", tt.teamID)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
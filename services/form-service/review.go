@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"form-service/correlation"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"form-service/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgtype"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const ResponseReviewedEvent = "response-reviewed"
+
+// ResponseReviewedData is sent to every enabled plugin, so it leaves out the
+// tags and notes, which are internal to the team.
+type ResponseReviewedData struct {
+	FormID         uint                `json:"form_id"`
+	Title          string              `json:"title"`
+	ResponseID     uint                `json:"response_id"`
+	UserID         uint                `json:"user_id"`
+	PreviousStatus models.ReviewStatus `json:"previous_status"`
+	Status         models.ReviewStatus `json:"status"`
+}
+
+func validReviewStatus(status models.ReviewStatus) bool {
+	switch status {
+	case models.NewReview, models.ApprovedReview, models.RejectedReview, models.NeedsFollowUpReview:
+		return true
+	}
+	return false
+}
+
+func textArrayToStrings(array pgtype.TextArray) []string {
+	values := []string{}
+	for _, element := range array.Elements {
+		values = append(values, element.String)
+	}
+	return values
+}
+
+// mergeTags adds and removes tags, keeping the existing order.
+func mergeTags(current []string, add []string, remove []string) []string {
+	removed := map[string]bool{}
+	for _, tag := range remove {
+		removed[strings.TrimSpace(tag)] = true
+	}
+
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, tag := range append(current, add...) {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || removed[tag] || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// teamResponses loads the responses with their forms and fails if any of
+// them doesn't belong to a form of the team.
+func teamResponses(tx *gorm.DB, teamID uint, responseIDs []uint) ([]models.Response, error) {
+	var responses []models.Response
+	if err := tx.Preload("Form").Where("id IN ?", responseIDs).Find(&responses).Error; err != nil {
+		return nil, err
+	}
+	found := map[uint]bool{}
+	for _, response := range responses {
+		if response.Form.TeamID != teamID {
+			return nil, fmt.Errorf("response %d is not a response to a form of your team", response.ID)
+		}
+		found[response.ID] = true
+	}
+	for _, id := range responseIDs {
+		if !found[id] {
+			return nil, fmt.Errorf("response %d not found", id)
+		}
+	}
+	return responses, nil
+}
+
+func reviewResponses(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering reviewResponses function")
+
+	var request struct {
+		ResponseIDs []uint              `json:"response_ids"`
+		Status      models.ReviewStatus `json:"status"`
+		AddTags     []string            `json:"add_tags"`
+		RemoveTags  []string            `json:"remove_tags"`
+		Note        string              `json:"note"`
+	}
+	if err := c.BindJSON(&request); err != nil {
+		logger.Error("Failed to bind request", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.ResponseIDs) == 0 {
+		logger.Error("No response ids given")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "response_ids is required"})
+		return
+	}
+	if request.Status != "" && !validReviewStatus(request.Status) {
+		logger.Error("Invalid review status", zap.String("status", string(request.Status)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be one of new, approved, rejected or needs-follow-up"})
+		return
+	}
+
+	teamId, err := strconv.ParseUint(c.GetHeader("X-Team-Id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse X-Team-Id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userId, err := strconv.ParseUint(c.GetHeader("X-Id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse X-Id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx := db.WithContext(c.Request.Context()).Begin()
+
+	responses, err := teamResponses(tx, uint(teamId), request.ResponseIDs)
+	if err != nil {
+		logger.Error("Failed to get responses", zap.Error(err))
+		tx.Rollback()
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	var events []ResponseReviewedData
+	for _, response := range responses {
+		tags := mergeTags(textArrayToStrings(response.Tags), request.AddTags, request.RemoveTags)
+		var tagArray pgtype.TextArray
+		tagArray.Set(tags)
+
+		updates := map[string]interface{}{
+			"tags":        tagArray,
+			"reviewed_by": uint(userId),
+			"reviewed_at": now,
+		}
+		if request.Status != "" {
+			updates["review_status"] = request.Status
+		}
+		if err := tx.Model(&models.Response{}).Where("id = ?", response.ID).Updates(updates).Error; err != nil {
+			logger.Error("Failed to update response", zap.Uint("response_id", response.ID), zap.Error(err))
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if request.Note != "" {
+			note := models.ReviewNote{ResponseID: response.ID, AuthorID: uint(userId), Text: request.Note}
+			if err := tx.Create(&note).Error; err != nil {
+				logger.Error("Failed to create note", zap.Uint("response_id", response.ID), zap.Error(err))
+				tx.Rollback()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if request.Status != "" && request.Status != response.ReviewStatus {
+			events = append(events, ResponseReviewedData{
+				FormID:         response.FormID,
+				Title:          response.Form.Title,
+				ResponseID:     response.ID,
+				UserID:         response.UserID,
+				PreviousStatus: response.ReviewStatus,
+				Status:         request.Status,
+			})
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		logger.Error("Failed to commit transaction", zap.Error(err))
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Debug("Responses reviewed", zap.Uints("response_ids", request.ResponseIDs), zap.String("status", string(request.Status)))
+
+	for _, event := range events {
+		if err := publishEvent(c.Request.Context(), ResponseReviewedEvent, uint(teamId), event); err != nil {
+			logger.Error("Failed to publish message", zap.Uint("response_id", event.ResponseID), zap.Error(err))
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":       "success",
+		"message":      "Responses reviewed",
+		"response_ids": request.ResponseIDs,
+		"transitions":  len(events),
+	})
+	logger.Debug("Exiting reviewResponses function")
+}
+
+func getResponseNotes(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering getResponseNotes function")
+
+	responseId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse response id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	teamId, err := strconv.ParseUint(c.GetHeader("X-Team-Id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse X-Team-Id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := teamResponses(db, uint(teamId), []uint{uint(responseId)}); err != nil {
+		logger.Error("Failed to get response", zap.Error(err))
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	notes := []models.ReviewNote{}
+	if err := db.WithContext(c.Request.Context()).Where("response_id = ?", responseId).Order("created_at").Find(&notes).Error; err != nil {
+		logger.Error("Failed to get notes", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, notes)
+	logger.Debug("Exiting getResponseNotes function")
+}
+
+func addResponseNote(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering addResponseNote function")
+
+	var request struct {
+		Text string `json:"text"`
+	}
+	if err := c.BindJSON(&request); err != nil || strings.TrimSpace(request.Text) == "" {
+		logger.Error("Failed to bind request", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "text is required"})
+		return
+	}
+
+	responseId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse response id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	teamId, err := strconv.ParseUint(c.GetHeader("X-Team-Id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse X-Team-Id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userId, err := strconv.ParseUint(c.GetHeader("X-Id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse X-Id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := teamResponses(db, uint(teamId), []uint{uint(responseId)}); err != nil {
+		logger.Error("Failed to get response", zap.Error(err))
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	note := models.ReviewNote{ResponseID: uint(responseId), AuthorID: uint(userId), Text: request.Text}
+	if err := db.WithContext(c.Request.Context()).Create(&note).Error; err != nil {
+		logger.Error("Failed to create note", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, note)
+	logger.Debug("Exiting addResponseNote function")
+}
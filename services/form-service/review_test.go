@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"form-service/models"
+
+	"github.com/jackc/pgtype"
+)
+
+func TestValidReviewStatus(t *testing.T) {
+	tests := []struct {
+		status models.ReviewStatus
+		want   bool
+	}{
+		{status: models.NewReview, want: true},
+		{status: models.ApprovedReview, want: true},
+		{status: models.RejectedReview, want: true},
+		{status: models.NeedsFollowUpReview, want: true},
+		{status: ""},
+		{status: "Approved"},
+		{status: "needs_follow_up"},
+		{status: " approved"},
+	}
+	for _, tt := range tests {
+		if got := validReviewStatus(tt.status); got != tt.want {
+			t.Errorf("validReviewStatus(%q) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		current []string
+		add     []string
+		remove  []string
+		want    []string
+	}{
+		{name: "nothing", want: []string{}},
+		{name: "add to none", add: []string{"urgent", "vip"}, want: []string{"urgent", "vip"}},
+		{name: "added after the current ones", current: []string{"vip", "urgent"}, add: []string{"follow-up"}, want: []string{"vip", "urgent", "follow-up"}},
+		{name: "trimmed", current: []string{"vip"}, add: []string{"  urgent ", "\tlate"}, want: []string{"vip", "urgent", "late"}},
+		{name: "blank tags dropped", add: []string{"", "  ", "vip"}, want: []string{"vip"}},
+		{name: "already there", current: []string{"vip", "urgent"}, add: []string{"urgent", " vip"}, want: []string{"vip", "urgent"}},
+		{name: "duplicates added once", add: []string{"vip", "vip", " vip "}, want: []string{"vip"}},
+		{name: "removed", current: []string{"vip", "urgent", "late"}, remove: []string{"urgent"}, want: []string{"vip", "late"}},
+		{name: "removed trimmed", current: []string{"vip", "urgent"}, remove: []string{" urgent "}, want: []string{"vip"}},
+		{name: "remove beats add", current: []string{"vip"}, add: []string{"urgent"}, remove: []string{"urgent"}, want: []string{"vip"}},
+		{name: "remove unknown tag", current: []string{"vip"}, remove: []string{"late"}, want: []string{"vip"}},
+		{name: "case kept", current: []string{"VIP"}, add: []string{"vip"}, want: []string{"VIP", "vip"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := append([]string(nil), tt.current...)
+			got := mergeTags(tt.current, tt.add, tt.remove)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeTags() = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.current, current) {
+				t.Errorf("mergeTags() changed the current tags to %q", tt.current)
+			}
+		})
+	}
+}
+
+func TestTextArrayToStrings(t *testing.T) {
+	var tags pgtype.TextArray
+	if got := textArrayToStrings(tags); got == nil || len(got) != 0 {
+		t.Errorf("textArrayToStrings() of no tags = %#v, want an empty slice", got)
+	}
+	if err := tags.Set([]string{"vip", "urgent"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := textArrayToStrings(tags); !reflect.DeepEqual(got, []string{"vip", "urgent"}) {
+		t.Errorf("textArrayToStrings() = %q, want [vip urgent]", got)
+	}
+}
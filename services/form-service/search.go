@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"form-service/correlation"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+	headlineOptions = "StartSel=<mark>, StopSel=</mark>, MaxFragments=3, MaxWords=20, MinWords=5"
+)
+
+// migrateSearch adds the tsvector columns and GIN indexes used by searchResponses.
+// Encrypted answers are never indexed.
+func migrateSearch() error {
+	statements := []string{
+		`ALTER TABLE answers ADD COLUMN IF NOT EXISTS search_vector tsvector
+			GENERATED ALWAYS AS (
+				CASE WHEN type = 'text' AND NOT encrypted
+				THEN to_tsvector('english', coalesce(value #>> '{}', ''))
+				END
+			) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_answers_search_vector ON answers USING GIN (search_vector)`,
+		`ALTER TABLE forms ADD COLUMN IF NOT EXISTS search_vector tsvector
+			GENERATED ALWAYS AS (to_tsvector('english', coalesce(title, ''))) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_forms_search_vector ON forms USING GIN (search_vector)`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pagination reads the page and page_size query parameters.
+func pagination(c *gin.Context) (page int, pageSize int, err error) {
+	page, err = strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		return 0, 0, errors.New("page must be a positive integer")
+	}
+	pageSize, err = strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 {
+		return 0, 0, errors.New("page_size must be a positive integer")
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	return page, pageSize, nil
+}
+
+func searchResponses(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering searchResponses function")
+
+	text := c.Query("q")
+	if text == "" {
+		logger.Warn("Empty search query")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+
+	// websearch syntax already understands "quoted phrases", OR and -exclusions,
+	// phrase=true treats the whole query as a single phrase
+	tsQuery := "websearch_to_tsquery"
+	if c.Query("phrase") == "true" {
+		tsQuery = "phraseto_tsquery"
+	}
+
+	page, pageSize, err := pagination(c)
+	if err != nil {
+		logger.Error("Invalid pagination", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	teamId, err := strconv.ParseUint(c.GetHeader("X-Team-Id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse X-Team-Id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	matches := `
+		WITH q AS (SELECT ` + tsQuery + `('english', @text) AS query)
+		SELECT 'answer' AS kind, f.id AS form_id, f.title AS form_title, r.id AS response_id,
+			qu.id AS question_id, qu.text AS question_text,
+			ts_headline('english', a.value #>> '{}', q.query, @options) AS highlight,
+			ts_rank(a.search_vector, q.query) AS rank
+		FROM answers a
+			JOIN responses r ON r.id = a.response_id AND r.deleted_at IS NULL
+			JOIN forms f ON f.id = r.form_id AND f.deleted_at IS NULL
+			JOIN questions qu ON qu.id = a.question_id,
+			q
+		WHERE f.team_id = @team_id AND a.deleted_at IS NULL AND a.search_vector @@ q.query
+		UNION ALL
+		SELECT 'form', f.id, f.title, NULL, NULL, NULL,
+			ts_headline('english', f.title, q.query, @options),
+			ts_rank(f.search_vector, q.query)
+		FROM forms f, q
+		WHERE f.team_id = @team_id AND f.deleted_at IS NULL AND f.search_vector @@ q.query`
+
+	args := map[string]interface{}{
+		"text":    text,
+		"options": headlineOptions,
+		"team_id": teamId,
+		"limit":   pageSize,
+		"offset":  (page - 1) * pageSize,
+	}
+
+	var total int64
+	if err := db.WithContext(c.Request.Context()).Raw(`SELECT count(*) FROM (`+matches+`) matches`, args).Scan(&total).Error; err != nil {
+		logger.Error("Failed to count search results", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	type SearchResult struct {
+		Kind         string  `json:"kind"`
+		FormID       uint    `json:"form_id"`
+		FormTitle    string  `json:"form_title"`
+		ResponseID   *uint   `json:"response_id,omitempty"`
+		QuestionID   *uint   `json:"question_id,omitempty"`
+		QuestionText *string `json:"question_text,omitempty"`
+		Highlight    string  `json:"highlight"`
+		Rank         float64 `json:"rank"`
+	}
+
+	results := []SearchResult{}
+	if err := db.WithContext(c.Request.Context()).Raw(`SELECT * FROM (`+matches+`) matches
+		ORDER BY rank DESC, form_id, response_id NULLS FIRST, question_id
+		LIMIT @limit OFFSET @offset`, args).Scan(&results).Error; err != nil {
+		logger.Error("Failed to search", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Debug("Search done", zap.String("q", text), zap.Int64("total", total), zap.Int("count", len(results)))
+	publishAudit(c, uint(teamId), AuditEvent{
+		Event:   ResponsesSearchEvent,
+		Details: map[string]interface{}{"query": text, "total": total},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"query":     text,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+		"results":   results,
+	})
+	logger.Debug("Exiting searchResponses function")
+}
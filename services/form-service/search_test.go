@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPagination(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		query        string
+		wantPage     int
+		wantPageSize int
+		wantErr      bool
+	}{
+		{query: "", wantPage: 1, wantPageSize: defaultPageSize},
+		{query: "page=3&page_size=10", wantPage: 3, wantPageSize: 10},
+		{query: "page_size=1000", wantPage: 1, wantPageSize: maxPageSize},
+		{query: "page=0", wantErr: true},
+		{query: "page=-2", wantErr: true},
+		{query: "page=two", wantErr: true},
+		{query: "page=1.5", wantErr: true},
+		{query: "page_size=0", wantErr: true},
+		{query: "page_size=ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/search?"+tt.query, nil)
+			page, pageSize, err := pagination(c)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("pagination() = %d, %d, want an error", page, pageSize)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page != tt.wantPage || pageSize != tt.wantPageSize {
+				t.Errorf("pagination() = %d, %d, want %d, %d", page, pageSize, tt.wantPage, tt.wantPageSize)
+			}
+		})
+	}
+}
+
+func TestSearchResponsesQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name        string
+		query       string
+		wantText    string
+		wantTsQuery string
+	}{
+		{name: "web search", query: "q=oak+-pine", wantText: "oak -pine", wantTsQuery: "websearch_to_tsquery"},
+		{name: "phrase", query: "q=old+oak&phrase=true", wantText: "old oak", wantTsQuery: "phraseto_tsquery"},
+		{name: "phrase only when true", query: "q=old+oak&phrase=1", wantText: "old oak", wantTsQuery: "websearch_to_tsquery"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			// both kinds of matches are limited to the team, the results
+			// fail to count so the request stops there
+			mock.ExpectQuery(`SELECT count\(\*\) FROM .*`+tt.wantTsQuery+`\('english', \$1\).*f\.team_id = \$3 .*f\.team_id = \$5 `).
+				WithArgs(tt.wantText, headlineOptions, uint64(3), headlineOptions, uint64(3)).
+				WillReturnError(errors.New("search unavailable"))
+
+			r := gin.New()
+			r.GET("/search", searchResponses)
+			req := httptest.NewRequest(http.MethodGet, "/search?"+tt.query, nil)
+			req.Header.Set("X-Team-Id", "3")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("status = %d, want %d: %s", w.Code, http.StatusInternalServerError, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSearchResponsesInvalid(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name   string
+		query  string
+		teamID string
+	}{
+		{name: "without query", query: "page=1", teamID: "3"},
+		{name: "invalid page", query: "q=oak&page=0", teamID: "3"},
+		{name: "without team", query: "q=oak"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			r := gin.New()
+			r.GET("/search", searchResponses)
+			req := httptest.NewRequest(http.MethodGet, "/search?"+tt.query, nil)
+			if tt.teamID != "" {
+				req.Header.Set("X-Team-Id", tt.teamID)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"form-service/correlation"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"form-service/encryption"
+	"form-service/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgtype"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const redactedValue = "[redacted]"
+
+var keyring *encryption.Keyring
+
+// unwrapped data keys by DataKey.ID, so a read doesn't unwrap for every answer.
+// Only keys read back from the database are cached.
+var dataKeyCache = struct {
+	sync.RWMutex
+	keys map[uint][]byte
+}{keys: map[uint][]byte{}}
+
+// activeDataKey returns the data key new sensitive answers of a team are
+// encrypted with, creating the first version if the team has none yet.
+func activeDataKey(tx *gorm.DB, teamID uint) (models.DataKey, []byte, error) {
+	var dataKey models.DataKey
+	err := tx.Where("team_id = ? AND active = ?", teamID, true).Order("version desc").First(&dataKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return createDataKey(tx, teamID, 1)
+	}
+	if err != nil {
+		return models.DataKey{}, nil, err
+	}
+
+	key, err := unwrapDataKey(dataKey)
+	if err != nil {
+		return models.DataKey{}, nil, err
+	}
+	return dataKey, key, nil
+}
+
+func createDataKey(tx *gorm.DB, teamID uint, version uint) (models.DataKey, []byte, error) {
+	plain, wrapped, masterKeyID, err := keyring.GenerateDataKey()
+	if err != nil {
+		return models.DataKey{}, nil, err
+	}
+
+	dataKey := models.DataKey{
+		TeamID:      teamID,
+		Version:     version,
+		MasterKeyID: masterKeyID,
+		WrappedKey:  wrapped,
+		Active:      true,
+	}
+	if err := tx.Create(&dataKey).Error; err != nil {
+		return models.DataKey{}, nil, err
+	}
+	logger.Info("Data key created", zap.Uint("team_id", teamID), zap.Uint("version", version), zap.String("master_key_id", masterKeyID))
+
+	// not cached before the transaction commits, unwrapDataKey caches it
+	// on its first use afterwards
+	return dataKey, plain, nil
+}
+
+func unwrapDataKey(dataKey models.DataKey) ([]byte, error) {
+	dataKeyCache.RLock()
+	key, ok := dataKeyCache.keys[dataKey.ID]
+	dataKeyCache.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	key, err := keyring.Unwrap(dataKey.MasterKeyID, dataKey.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKeyCache.Lock()
+	dataKeyCache.keys[dataKey.ID] = key
+	dataKeyCache.Unlock()
+
+	return key, nil
+}
+
+// encryptAnswer replaces the value of the answer with its ciphertext.
+func encryptAnswer(answer *models.Answer, dataKey models.DataKey, key []byte) error {
+	plaintext, err := json.Marshal(answer.Value)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := encryption.Seal(key, plaintext)
+	if err != nil {
+		return err
+	}
+
+	var value pgtype.JSONB
+	if err := value.Set(base64.StdEncoding.EncodeToString(ciphertext)); err != nil {
+		return err
+	}
+	answer.Value = value
+	answer.Encrypted = true
+	answer.DataKeyID = dataKey.ID
+	return nil
+}
+
+// encryptAnswers returns a copy of answers where the answers to sensitive
+// questions of the form are encrypted with the team's active data key.
+func encryptAnswers(tx *gorm.DB, form models.Form, answers []models.Answer) ([]models.Answer, error) {
+	storedAnswers := make([]models.Answer, len(answers))
+	copy(storedAnswers, answers)
+
+	for i := range storedAnswers {
+		sensitive := false
+		for _, q := range form.Questions {
+			if q.ID == storedAnswers[i].QuestionID {
+				sensitive = q.Sensitive
+				break
+			}
+		}
+		if !sensitive {
+			continue
+		}
+
+		dataKey, key, err := activeDataKey(tx, form.TeamID)
+		if err != nil {
+			return nil, err
+		}
+		if err := encryptAnswer(&storedAnswers[i], dataKey, key); err != nil {
+			return nil, err
+		}
+	}
+	return storedAnswers, nil
+}
+
+// decryptAnswers decrypts in place the encrypted answers of a response. It
+// must only be called once the caller is known to be the owning team.
+func decryptAnswers(tx *gorm.DB, teamID uint, answers []models.Answer) error {
+	for i := range answers {
+		if !answers[i].Encrypted {
+			continue
+		}
+
+		var dataKey models.DataKey
+		if err := tx.Where("id = ? AND team_id = ?", answers[i].DataKeyID, teamID).First(&dataKey).Error; err != nil {
+			return err
+		}
+		key, err := unwrapDataKey(dataKey)
+		if err != nil {
+			return err
+		}
+
+		var encoded string
+		if err := answers[i].Value.AssignTo(&encoded); err != nil {
+			return err
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		plaintext, err := encryption.Open(key, ciphertext)
+		if err != nil {
+			return err
+		}
+
+		var value pgtype.JSONB
+		if err := json.Unmarshal(plaintext, &value); err != nil {
+			return err
+		}
+		answers[i].Value = value
+		answers[i].Encrypted = false
+	}
+	return nil
+}
+
+// isFormTeamMember reports whether the request comes from a member of the
+// team owning the form, acting for that team.
+func isFormTeamMember(c *gin.Context, form models.Form) bool {
+	teamId, err := strconv.ParseUint(c.GetHeader("X-Team-Id"), 10, 64)
+	if err != nil {
+		return false
+	}
+	return form.TeamID == uint(teamId)
+}
+
+// rewrapDataKeys moves every data key to the active master key so a retired
+// master key can be removed from the configuration.
+func rewrapDataKeys() error {
+	if !keyring.Enabled() {
+		return nil
+	}
+
+	var dataKeys []models.DataKey
+	if err := db.Where("master_key_id <> ?", keyring.ActiveKeyID()).Find(&dataKeys).Error; err != nil {
+		return err
+	}
+
+	for _, dataKey := range dataKeys {
+		plain, err := keyring.Unwrap(dataKey.MasterKeyID, dataKey.WrappedKey)
+		if err != nil {
+			logger.Warn("Failed to unwrap data key", zap.Uint("data_key_id", dataKey.ID), zap.String("master_key_id", dataKey.MasterKeyID), zap.Error(err))
+			continue
+		}
+		wrapped, masterKeyID, err := keyring.Wrap(plain)
+		if err != nil {
+			return err
+		}
+		if err := db.Model(&dataKey).Updates(map[string]interface{}{"wrapped_key": wrapped, "master_key_id": masterKeyID}).Error; err != nil {
+			return err
+		}
+		logger.Info("Data key rewrapped", zap.Uint("data_key_id", dataKey.ID), zap.String("master_key_id", masterKeyID))
+	}
+	return nil
+}
+
+func rotateDataKey(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	logger.Debug("Entering rotateDataKey function")
+	if !keyring.Enabled() {
+		logger.Error("Encryption is not configured")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": encryption.ErrNotConfigured.Error()})
+		return
+	}
+
+	teamId, err := strconv.ParseUint(c.GetHeader("X-Team-Id"), 10, 64)
+	if err != nil {
+		logger.Error("Failed to parse X-Team-Id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx := db.WithContext(c.Request.Context()).Begin()
+
+	var current models.DataKey
+	if err := tx.Where("team_id = ?", teamId).Order("version desc").Limit(1).Find(&current).Error; err != nil {
+		logger.Error("Failed to get data key", zap.Error(err))
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// old versions stay around to decrypt existing answers
+	if err := tx.Model(&models.DataKey{}).Where("team_id = ?", teamId).Update("active", false).Error; err != nil {
+		logger.Error("Failed to deactivate data keys", zap.Error(err))
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	dataKey, _, err := createDataKey(tx, uint(teamId), current.Version+1)
+	if err != nil {
+		logger.Error("Failed to create data key", zap.Error(err))
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		logger.Error("Failed to commit transaction", zap.Error(err))
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Data key rotated",
+		"version": dataKey.Version,
+	})
+	logger.Debug("Exiting rotateDataKey function")
+}
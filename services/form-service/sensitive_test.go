@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"form-service/encryption"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+// useKeyring replaces the keyring of the handlers for the test.
+func useKeyring(t *testing.T, active string) *encryption.Keyring {
+	t.Helper()
+	spec := "k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, encryption.DataKeySize)) +
+		",k2:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, encryption.DataKeySize))
+	testKeyring, err := encryption.NewKeyring(spec, active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := keyring
+	keyring = testKeyring
+	t.Cleanup(func() { keyring = previous })
+	return testKeyring
+}
+
+func cachedDataKey(id uint) bool {
+	dataKeyCache.RLock()
+	defer dataKeyCache.RUnlock()
+	_, ok := dataKeyCache.keys[id]
+	return ok
+}
+
+func TestRotateDataKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		dataKeyID  uint
+		commitErr  error
+		wantStatus int
+	}{
+		{name: "committed", dataKeyID: 41, wantStatus: http.StatusOK},
+		{name: "commit fails", dataKeyID: 42, commitErr: errors.New("connection lost"), wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useKeyring(t, "k1")
+			mock := mockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "data_keys" WHERE team_id = $1`)).
+				WithArgs(uint64(3)).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "team_id", "version"}).AddRow(40, 3, 1))
+			mock.ExpectExec(regexp.QuoteMeta(`UPDATE "data_keys" SET "active"=$1`)).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "data_keys"`)).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(tt.dataKeyID))
+			if tt.commitErr != nil {
+				mock.ExpectCommit().WillReturnError(tt.commitErr)
+			} else {
+				mock.ExpectCommit()
+			}
+
+			r := gin.New()
+			r.POST("/keys/rotate", rotateDataKey)
+			req := httptest.NewRequest(http.MethodPost, "/keys/rotate", nil)
+			req.Header.Set("X-Team-Id", "3")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK && !strings.Contains(w.Body.String(), `"version":2`) {
+				t.Errorf("body = %s, want version 2", w.Body)
+			}
+			if cachedDataKey(tt.dataKeyID) {
+				t.Error("the new data key is cached before it is read back")
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// wrappedWith matches a data key wrapped under the master key.
+type wrappedWith struct {
+	keyring     *encryption.Keyring
+	masterKeyID string
+	plain       []byte
+}
+
+func (w wrappedWith) Match(value driver.Value) bool {
+	wrapped, ok := value.([]byte)
+	if !ok {
+		return false
+	}
+	plain, err := w.keyring.Unwrap(w.masterKeyID, wrapped)
+	return err == nil && bytes.Equal(plain, w.plain)
+}
+
+func TestRewrapDataKeys(t *testing.T) {
+	before := useKeyring(t, "k1")
+	plain, wrapped, _, err := before.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := useKeyring(t, "k2")
+
+	mock := mockDB(t)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "data_keys" WHERE master_key_id <> $1`)).
+		WithArgs("k2").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "team_id", "master_key_id", "wrapped_key"}).
+			AddRow(7, 3, "k1", wrapped).
+			// its master key was removed, it is skipped
+			AddRow(8, 4, "k0", []byte("unreadable")))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "data_keys" SET`)).
+		WithArgs("k2", wrappedWith{keyring: after, masterKeyID: "k2", plain: plain}, sqlmock.AnyArg(), uint(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := rewrapDataKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,141 @@
+package serviceauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testVerifier returns a verifier for "form-service" trusting the key as
+// "key-1", without the auth service.
+func testVerifier(t *testing.T, key *rsa.PrivateKey) *Verifier {
+	t.Helper()
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "key-1",
+		"alg": "RS256",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyfunc.NewJWKSetJSON(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Verifier{Audience: "form-service", keys: keys}
+}
+
+func TestVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := testVerifier(t, key)
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":       "google-sheets-service",
+			"aud":       "form-service",
+			"exp":       time.Now().Add(5 * time.Minute).Unix(),
+			"token_use": TokenUse,
+			"scopes":    []string{"responses:read"},
+		}
+	}
+	sign := func(method jwt.SigningMethod, kid string, signingKey interface{}, change func(jwt.MapClaims)) string {
+		claims := validClaims()
+		if change != nil {
+			change(claims)
+		}
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(signingKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "valid", token: sign(jwt.SigningMethodRS256, "key-1", key, nil)},
+		{name: "audience in a list", token: sign(jwt.SigningMethodRS256, "key-1", key, func(claims jwt.MapClaims) {
+			claims["aud"] = []string{"auth-service", "form-service"}
+		})},
+		{name: "HMAC algorithm", token: sign(jwt.SigningMethodHS256, "key-1", []byte("secret"), nil), wantErr: true},
+		{name: "none algorithm", token: sign(jwt.SigningMethodNone, "key-1", jwt.UnsafeAllowNoneSignatureType, nil), wantErr: true},
+		{name: "unknown key", token: sign(jwt.SigningMethodRS256, "key-2", key, nil), wantErr: true},
+		{name: "signed by another key", token: sign(jwt.SigningMethodRS256, "key-1", otherKey, nil), wantErr: true},
+		{name: "expired", token: sign(jwt.SigningMethodRS256, "key-1", key, func(claims jwt.MapClaims) {
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+		}), wantErr: true},
+		{name: "missing expiry", token: sign(jwt.SigningMethodRS256, "key-1", key, func(claims jwt.MapClaims) {
+			delete(claims, "exp")
+		}), wantErr: true},
+		{name: "other audience", token: sign(jwt.SigningMethodRS256, "key-1", key, func(claims jwt.MapClaims) {
+			claims["aud"] = "plugin-manager-service"
+		}), wantErr: true},
+		{name: "missing audience", token: sign(jwt.SigningMethodRS256, "key-1", key, func(claims jwt.MapClaims) {
+			delete(claims, "aud")
+		}), wantErr: true},
+		{name: "access token", token: sign(jwt.SigningMethodRS256, "key-1", key, func(claims jwt.MapClaims) {
+			claims["token_use"] = "access"
+		}), wantErr: true},
+		{name: "malformed", token: "not.a.token", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(context.Background(), tt.token)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("Verify() = %v, %v, want ErrInvalidToken", claims, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() failed: %v", err)
+			}
+			if claims.Service != "google-sheets-service" || !claims.HasScope("responses:read") {
+				t.Errorf("Verify() = %+v, want the claims of the token", claims)
+			}
+		})
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	claims := Claims{Scopes: []string{"responses:read", "plugins:*"}}
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{scope: "responses:read", want: true},
+		{scope: "responses:export", want: false},
+		{scope: "plugins:register", want: true},
+		{scope: "pluginsx", want: false},
+	}
+	for _, tt := range tests {
+		if got := claims.HasScope(tt.scope); got != tt.want {
+			t.Errorf("HasScope(%q) = %v, want %v", tt.scope, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package telemetry traces the requests of the service with OpenTelemetry.
+// The spans of HTTP requests, database queries and messages continue the
+// trace of the request they come from, and are exported over OTLP/HTTP to
+// the collector in OTEL_EXPORTER_OTLP_ENDPOINT. Without a collector the
+// spans aren't recorded, only the trace context is passed on, so the service
+// runs and is tested without one.
+package telemetry
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const scope = "form-service/telemetry"
+
+// tracer is looked up from the global provider on each use, so spans go to
+// the provider installed by Setup.
+func tracer() trace.Tracer {
+	return otel.Tracer(scope)
+}
+
+// Enabled reports whether a collector is configured, in
+// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT.
+func Enabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Setup installs the W3C trace context propagator and, when a collector is
+// configured, a tracer provider exporting the spans of the service. The
+// exporter and the sampler are configured with the standard OTEL_*
+// variables, OTEL_SERVICE_NAME overrides the name of the service. The
+// returned function flushes the spans left, it is called on shutdown.
+func Setup(ctx context.Context, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(service)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// End ends the span, marking it failed with the error.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"plugin-manager-service/correlation"
+	"plugin-manager-service/telemetry"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wagslane/go-rabbitmq"
+	"go.uber.org/zap"
+)
+
+// Audit events of changes to the plugins of a team, the auth service
+// appends them to the audit log of the team.
+const (
+	PluginEnabledEvent    = "plugins.enabled"
+	PluginDisabledEvent   = "plugins.disabled"
+	PluginConfiguredEvent = "plugins.configured"
+	PluginActionEvent     = "plugins.action"
+)
+
+// auditExchange is where the services publish their audit events.
+const auditExchange = "audit"
+
+var auditPublisher *rabbitmq.Publisher
+
+// AuditEvent is an entry of the audit log, as the auth service stores it.
+type AuditEvent struct {
+	OccurredAt time.Time              `json:"occurred_at"`
+	Event      string                 `json:"event"`
+	Service    string                 `json:"service"`
+	ActorID    *uint                  `json:"actor_id,omitempty"`
+	ActorType  string                 `json:"actor_type,omitempty"`
+	TeamID     *uint                  `json:"team_id,omitempty"`
+	TargetType string                 `json:"target_type,omitempty"`
+	TargetID   string                 `json:"target_id,omitempty"`
+	IP         string                 `json:"ip,omitempty"`
+	UserAgent  string                 `json:"user_agent,omitempty"`
+	Outcome    string                 `json:"outcome,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+// publishAudit sends the event of the request, done for the team, to the
+// audit log. The actor is the user, or the creator of the API key. Failing
+// to publish doesn't fail the request.
+func publishAudit(c *gin.Context, teamID uint, event AuditEvent) {
+	logger := correlation.Logger(c.Request.Context(), logger)
+	event.OccurredAt = time.Now()
+	event.Service = "plugin-manager-service"
+	event.TeamID = &teamID
+	event.IP = c.GetHeader("X-Real-IP")
+	if event.IP == "" {
+		event.IP = c.ClientIP()
+	}
+	event.UserAgent = c.Request.UserAgent()
+	if id, err := strconv.ParseUint(c.GetHeader("X-Id"), 10, 64); err == nil {
+		actorID := uint(id)
+		event.ActorID = &actorID
+		event.ActorType = "user"
+		if c.GetHeader("X-Role") == "api-key" {
+			event.ActorType = "api-key"
+		}
+	}
+
+	jsonMessage, err := json.Marshal(event)
+	if err == nil {
+		headers := correlation.FromContext(c.Request.Context()).Table()
+		_, span := telemetry.StartPublish(c.Request.Context(), auditExchange, auditExchange, headers)
+		err = auditPublisher.Publish(
+			jsonMessage,
+			[]string{auditExchange},
+			rabbitmq.WithPublishOptionsContentType("application/json"),
+			rabbitmq.WithPublishOptionsExchange(auditExchange),
+			rabbitmq.WithPublishOptionsPersistentDelivery,
+			rabbitmq.WithPublishOptionsHeaders(headers),
+		)
+		telemetry.End(span, err)
+	}
+	if err != nil {
+		logger.Error("Failed to publish audit event", zap.String("audit_event", event.Event), zap.Uint("team_id", teamID), zap.Error(err))
+	}
+}
+
+// proxiedOutcome is the outcome of a request proxied to a plugin, a failure
+// when the plugin refused it.
+func proxiedOutcome(c *gin.Context) string {
+	if c.Writer.Status() >= http.StatusBadRequest {
+		return "failure"
+	}
+	return "success"
+}
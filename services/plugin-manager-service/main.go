@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"log"
@@ -9,10 +10,13 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"plugin-manager-service/correlation"
 	"plugin-manager-service/database"
 	"plugin-manager-service/models"
+	"plugin-manager-service/permission"
+	"plugin-manager-service/serviceauth"
+	"plugin-manager-service/telemetry"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -29,14 +33,37 @@ var logger *zap.Logger
 var publisher *rabbitmq.Publisher
 var consumer *rabbitmq.Consumer
 
+// serviceClient attaches the service token of the plugin manager to the
+// requests proxied to plugins.
+var serviceClient *serviceauth.Client
+
 func main() {
 	var err error
 
 	logger, _ = zap.NewDevelopment()
+	permission.Logger = logger
 	logger.With(zap.String("service", "plugin-manager-service"))
 
+	shutdownTracing, err := telemetry.Setup(context.Background(), "plugin-manager-service")
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
+	}
+	defer shutdownTracing(context.Background())
+
+	serviceClient, err = serviceauth.ClientFromEnv()
+	if err != nil {
+		logger.Fatal("Failed to configure service account", zap.Error(err))
+	}
+	serviceTokens, err := serviceauth.NewVerifier(serviceauth.AuthURL(), "plugin-manager-service")
+	if err != nil {
+		logger.Fatal("Failed to load service token keys", zap.Error(err))
+	}
+	serviceTokens.Logger = logger
+
 	r := gin.New()
-	r.Use(ginzap.Ginzap(logger, time.RFC3339, true))
+	r.Use(telemetry.Middleware("plugin-manager-service"))
+	r.Use(correlation.Middleware())
+	r.Use(ginzap.GinzapWithConfig(logger, &ginzap.Config{TimeFormat: time.RFC3339, UTC: true, Context: correlation.LogFields}))
 	r.Use(ginzap.RecoveryWithZap(logger, true))
 
 	_, err = database.ConnectDB(&database.DBConfig{
@@ -50,6 +77,9 @@ func main() {
 	if err != nil {
 		logger.Fatal("Failed to connect to database", zap.Error(err))
 	}
+	if err = telemetry.TraceGorm(database.DB); err != nil {
+		logger.Fatal("Failed to trace database queries", zap.Error(err))
+	}
 	logger.Info("Connected to database")
 
 	if err = database.DB.AutoMigrate(&models.Plugin{}, &models.Action{}, &models.Event{}, &models.PluginSetting{}); err != nil {
@@ -94,23 +124,36 @@ func main() {
 	logger.Info("RabbitMQ publisher created")
 	defer publisher.Close()
 
+	auditPublisher, err = rabbitmq.NewPublisher(
+		conn,
+		rabbitmq.WithPublisherOptionsLogging,
+		rabbitmq.WithPublisherOptionsExchangeName(auditExchange),
+		rabbitmq.WithPublisherOptionsExchangeDeclare,
+		rabbitmq.WithPublisherOptionsExchangeDurable,
+	)
+	if err != nil {
+		logger.Fatal("Failed to create rabbitmq audit publisher", zap.Error(err))
+	}
+	logger.Info("RabbitMQ audit publisher created")
+	defer auditPublisher.Close()
+
 	v1 := r.Group("/api/v1/plugins")
 
 	// TODO: see if everything is implemented as said in plugin architecture
 
 	teamEndpoint := v1.Group("/")
-	teamEndpoint.Use(role("team"))
 
-	teamEndpoint.GET("/", GetAllPlugins)
-	teamEndpoint.GET("/:id", GetPluginsById)
+	teamEndpoint.GET("/", permission.Require(permission.PluginsRead), GetAllPlugins)
+	teamEndpoint.GET("/:id", permission.Require(permission.PluginsRead), GetPluginsById)
 	// only run below thing when team has enabled that plugin
 	// POST endpoint for enabling disabling plugin
-	teamEndpoint.GET("/:id/settings", GetPluginSettings)
-	teamEndpoint.POST("/:id/status", SetPluginStatus)
-	teamEndpoint.POST("/:id/configure", ConfigurePlugin)
+	teamEndpoint.GET("/:id/settings", permission.Require(permission.PluginsRead), GetPluginSettings)
+	teamEndpoint.POST("/:id/status", permission.Require(permission.PluginsConfigure), SetPluginStatus)
+	teamEndpoint.POST("/:id/configure", permission.Require(permission.PluginsConfigure), ConfigurePlugin)
+	// the permission depends on the action, checked by the handler
 	teamEndpoint.POST("/:id/actions/:action", SendActionToPlugin)
-	// internal endpoint
-	r.POST("/register", RegisterPlugin)
+	// internal endpoint, plugins register with their service token
+	r.POST("/register", serviceTokens.Require(permission.PluginsRegister), RegisterPlugin)
 
 	// send request to /health endpoint to check if plugin is running
 
@@ -166,34 +209,11 @@ func pollEndpoint(endpointURL string, pollingInterval time.Duration, wg *sync.Wa
 	}
 }
 
-func role(roles ...string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		userRole := c.Request.Header.Get("X-Role")
-
-		roleMatched := false
-		for _, role := range roles {
-			if userRole == role {
-				roleMatched = true
-				break
-			}
-		}
-
-		if !roleMatched {
-			logger.Warn("Role doesn't match", zap.String("role", userRole), zap.Strings("required_roles", roles))
-			c.JSON(http.StatusForbidden, gin.H{"error": "Not a " + strings.Join(roles, ", ")})
-			c.Abort()
-			return
-		}
-		logger.Debug("Role matched", zap.String("role", userRole), zap.Strings("required_roles", roles))
-
-		c.Next()
-	}
-}
-
 func GetAllPlugins(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering GetAllPlugins Function")
 	var plugins []models.Plugin
-	if err := database.DB.Preload("Events").Preload("Actions").Find(&plugins).Error; err != nil {
+	if err := database.DB.WithContext(c.Request.Context()).Preload("Events").Preload("Actions").Find(&plugins).Error; err != nil {
 		logger.Error("Failed to get plugins", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -233,12 +253,13 @@ func GetAllPlugins(c *gin.Context) {
 }
 
 func GetPluginsById(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering GetPluginsById Function")
 	id := c.Param("id")
 	logger.Debug("Plugin id received", zap.String("id", id))
 
 	var plugin models.Plugin
-	if err := database.DB.Preload("Events").Preload("Actions").First(&plugin, uuid.MustParse(id)).Error; err != nil {
+	if err := database.DB.WithContext(c.Request.Context()).Preload("Events").Preload("Actions").First(&plugin, uuid.MustParse(id)).Error; err != nil {
 		logger.Error("Failed to get plugin", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -274,11 +295,12 @@ func GetPluginsById(c *gin.Context) {
 	logger.Debug("Exiting GetPluginsById Function")
 }
 func GetPluginSettings(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering GetPluginSettings Function")
 	id := c.Param("id")
 	logger.Debug("Plugin id received", zap.String("id", id))
 
-	teamID, err := strconv.ParseUint(c.Request.Header.Get("X-Id"), 10, 64)
+	teamID, err := strconv.ParseUint(c.Request.Header.Get("X-Team-Id"), 10, 64)
 	if err != nil {
 		logger.Error("Failed to parse team id", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -287,7 +309,7 @@ func GetPluginSettings(c *gin.Context) {
 
 	var pluginSetting models.PluginSetting
 
-	if err := database.DB.FirstOrCreate(&pluginSetting, models.PluginSetting{
+	if err := database.DB.WithContext(c.Request.Context()).FirstOrCreate(&pluginSetting, models.PluginSetting{
 		PluginID: uuid.MustParse(id),
 		TeamID:   uint(teamID),
 	}).Error; err != nil {
@@ -302,6 +324,7 @@ func GetPluginSettings(c *gin.Context) {
 }
 
 func SetPluginStatus(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering SetPluginStatus Function")
 	type Request struct {
 		Enabled bool `json:"enabled"`
@@ -315,7 +338,7 @@ func SetPluginStatus(c *gin.Context) {
 	}
 	logger.Debug("Request body correct", zap.Any("request", request))
 
-	teamID, err := strconv.ParseUint(c.Request.Header.Get("X-Id"), 10, 64)
+	teamID, err := strconv.ParseUint(c.Request.Header.Get("X-Team-Id"), 10, 64)
 	if err != nil {
 		logger.Error("Failed to parse team id", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -329,12 +352,21 @@ func SetPluginStatus(c *gin.Context) {
 		Enabled:  request.Enabled,
 	}
 
-	if err := database.DB.Where("plugin_id = ? AND team_id = ?", pluginSetting.PluginID, pluginSetting.TeamID).Save(&pluginSetting).Error; err != nil {
+	if err := database.DB.WithContext(c.Request.Context()).Where("plugin_id = ? AND team_id = ?", pluginSetting.PluginID, pluginSetting.TeamID).Save(&pluginSetting).Error; err != nil {
 		logger.Error("Failed to set plugin status", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	logger.Debug("Plugin status updated", zap.Any("pluginSetting", pluginSetting))
+	event := PluginDisabledEvent
+	if request.Enabled {
+		event = PluginEnabledEvent
+	}
+	publishAudit(c, uint(teamID), AuditEvent{
+		Event:      event,
+		TargetType: "plugin",
+		TargetID:   pluginSetting.PluginID.String(),
+	})
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Plugin status updated",
@@ -353,18 +385,19 @@ func IsPluginEnabled(db *gorm.DB, pluginID uuid.UUID, teamID uint) (bool, error)
 }
 
 func ConfigurePlugin(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering ConfigurePlugin Function")
 	id := c.Param("id")
 	logger.Debug("Plugin id received", zap.String("id", id))
 
-	teamId, err := strconv.ParseUint(c.Request.Header.Get("X-Id"), 10, 64)
+	teamId, err := strconv.ParseUint(c.Request.Header.Get("X-Team-Id"), 10, 64)
 	if err != nil {
 		logger.Error("Failed to parse team id", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	enabled, err := IsPluginEnabled(database.DB, uuid.MustParse(id), uint(teamId))
+	enabled, err := IsPluginEnabled(database.DB.WithContext(c.Request.Context()), uuid.MustParse(id), uint(teamId))
 	if err != nil || !enabled {
 		logger.Error("Plugin is not enabled", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Plugin is not enabled", "error": err.Error()})
@@ -373,24 +406,35 @@ func ConfigurePlugin(c *gin.Context) {
 	logger.Debug("Plugin is enabled")
 
 	var plugin models.Plugin
-	if err := database.DB.First(&plugin, id).Error; err != nil {
+	if err := database.DB.WithContext(c.Request.Context()).First(&plugin, id).Error; err != nil {
 		logger.Error("Failed to get plugin", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	logger.Debug("Plugin retrieved", zap.Any("plugin", plugin))
 
-	reverseProxy(plugin.Url + "/configure")(c)
+	reverseProxy(plugin.Url+"/configure", plugin.Service)(c)
+	publishAudit(c, uint(teamId), AuditEvent{
+		Event:      PluginConfiguredEvent,
+		TargetType: "plugin",
+		TargetID:   plugin.ID.String(),
+		Outcome:    proxiedOutcome(c),
+		Details:    map[string]interface{}{"name": plugin.Name, "status": c.Writer.Status()},
+	})
 	logger.Debug("Exiting ConfigurePlugin Function")
 }
 
 func SendActionToPlugin(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering SendActionToPlugin Function")
+	if !permission.Check(c, permission.PluginAction(c.Param("action"))) {
+		return
+	}
 
 	id := uuid.MustParse(c.Param("id"))
 	logger.Debug("Plugin id received", zap.Any("id", id))
 
-	teamId, err := strconv.ParseUint(c.Request.Header.Get("X-Id"), 10, 64)
+	teamId, err := strconv.ParseUint(c.Request.Header.Get("X-Team-Id"), 10, 64)
 	if err != nil {
 		logger.Error("Failed to parse team id", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -398,7 +442,7 @@ func SendActionToPlugin(c *gin.Context) {
 	}
 	logger.Debug("Team id correct", zap.Uint64("teamID", teamId))
 
-	enabled, err := IsPluginEnabled(database.DB, id, uint(teamId))
+	enabled, err := IsPluginEnabled(database.DB.WithContext(c.Request.Context()), id, uint(teamId))
 	if err != nil || !enabled {
 		logger.Error("Plugin is not enabled", zap.Error(err))
 		log.Println(err)
@@ -408,18 +452,26 @@ func SendActionToPlugin(c *gin.Context) {
 	logger.Debug("Plugin is enabled")
 
 	var plugin models.Plugin
-	if err := database.DB.First(&plugin, id).Error; err != nil {
+	if err := database.DB.WithContext(c.Request.Context()).First(&plugin, id).Error; err != nil {
 		logger.Error("Failed to get plugin", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	logger.Debug("Plugin retrieved", zap.Any("plugin", plugin))
 
-	reverseProxy(plugin.Url + "/actions/" + c.Param("action"))(c)
+	reverseProxy(plugin.Url+"/actions/"+c.Param("action"), plugin.Service)(c)
+	publishAudit(c, uint(teamId), AuditEvent{
+		Event:      PluginActionEvent,
+		TargetType: "plugin",
+		TargetID:   plugin.ID.String(),
+		Outcome:    proxiedOutcome(c),
+		Details:    map[string]interface{}{"name": plugin.Name, "action": c.Param("action"), "status": c.Writer.Status()},
+	})
 	logger.Debug("Exiting SendActionToPlugin Function")
 }
 
 func RegisterPlugin(c *gin.Context) {
+	logger := correlation.Logger(c.Request.Context(), logger)
 	logger.Debug("Entering RegisterPlugin Function")
 	var request struct {
 		Name        string    `json:"name"`
@@ -437,21 +489,33 @@ func RegisterPlugin(c *gin.Context) {
 	}
 	logger.Debug("JSON received", zap.Any("request", request))
 
+	// the service account the plugin registered with receives its requests
+	service := c.GetString("service")
+
 	existingPlugin := models.Plugin{}
-	if err := database.DB.Where("id = ?", request.Id).First(&existingPlugin).Error; err == nil {
+	if err := database.DB.WithContext(c.Request.Context()).Where("id = ?", request.Id).First(&existingPlugin).Error; err == nil {
 		logger.Error("Plugin already registered", zap.Error(err))
+		if existingPlugin.Service == "" {
+			// registered before the service account was kept
+			if err := database.DB.WithContext(c.Request.Context()).Model(&existingPlugin).Update("service", service).Error; err != nil {
+				logger.Error("Failed to update plugin", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
 		c.JSON(http.StatusOK, gin.H{"message": "Plugin already registered", "plugin": existingPlugin})
 		return
 	}
 	logger.Debug("Plugin not registered", zap.Any("request", request))
 
-	tx := database.DB.Begin()
+	tx := database.DB.WithContext(c.Request.Context()).Begin()
 	logger.Debug("Transaction started")
 
 	plugin := models.Plugin{
 		Name:        request.Name,
 		Description: request.Description,
 		Url:         request.Url,
+		Service:     service,
 		ID:          request.Id,
 		Instances:   1,
 	}
@@ -513,11 +577,16 @@ func RegisterPlugin(c *gin.Context) {
 	logger.Debug("Exiting RegisterPlugin Function")
 }
 
-func reverseProxy(target string) gin.HandlerFunc {
+// reverseProxy forwards the request to the target with a service token minted
+// for the service account of the plugin, so the plugin can't replay it
+// against other services.
+func reverseProxy(target string, audience string) gin.HandlerFunc {
 	reverseProxyLogger := logger.With(zap.String("reverse-proxy", target))
 	targetURL, _ := url.Parse(target)
 
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	// plugins only accept requests of the plugin manager, not user tokens
+	proxy.Transport = serviceClient.AudienceTransport(audience, telemetry.Transport(nil))
 	proxy.Director = func(req *http.Request) {
 		req.Header.Set("X-Forwarded-Host", req.Host)
 		req.Header.Set("X-Origin-Host", targetURL.Host)
@@ -528,6 +597,7 @@ func reverseProxy(target string) gin.HandlerFunc {
 
 	proxy.ModifyResponse = func(res *http.Response) error {
 		// Read the response body
+		reverseProxyLogger := correlation.Logger(res.Request.Context(), reverseProxyLogger)
 		body, err := io.ReadAll(res.Body)
 		if err != nil {
 			reverseProxyLogger.Error("Failed to read response body", zap.Error(err))
@@ -536,6 +606,8 @@ func reverseProxy(target string) gin.HandlerFunc {
 
 		// Create a new io.ReadCloser for the original response body
 		res.Body = io.NopCloser(bytes.NewBuffer(body))
+		// answered by the middleware already
+		res.Header.Del(correlation.RequestIDHeader)
 
 		reverseProxyLogger.Debug("Response body", zap.String("body", string(body)))
 
@@ -544,7 +616,7 @@ func reverseProxy(target string) gin.HandlerFunc {
 
 	return func(c *gin.Context) {
 		proxy.ServeHTTP(c.Writer, c.Request)
-		reverseProxyLogger.Debug("Exiting reverseProxy")
+		correlation.Logger(c.Request.Context(), reverseProxyLogger).Debug("Exiting reverseProxy")
 	}
 }
 
@@ -554,6 +626,11 @@ func routeMessages(d rabbitmq.Delivery) rabbitmq.Action {
 		TeamID uint        `json:"team_id"`
 		Data   interface{} `json:"data"`
 	}
+	// the request ID and trace of the request the event comes from
+	ids := correlation.FromTable(d.Headers)
+	ctx, span := telemetry.StartConsume(context.Background(), "router", d)
+	defer span.End()
+	logger := correlation.Logger(correlation.NewContext(ctx, ids.WithSpan(ctx)), logger)
 	if err := json.Unmarshal(d.Body, &message); err != nil {
 		logger.Error("Failed to unmarshal message", zap.Error(err))
 		return rabbitmq.NackDiscard
@@ -564,7 +641,7 @@ func routeMessages(d rabbitmq.Delivery) rabbitmq.Action {
 	// then see if those plugins are active or not
 	// then see if that team id has enabled that plugin
 	var plugins []models.Plugin
-	if err := database.DB.
+	if err := database.DB.WithContext(ctx).
 		Where("instances > 0").
 		Joins("JOIN events ON plugins.id = events.plugin_id").
 		Where("events.name = ?", message.Event).
@@ -579,7 +656,7 @@ func routeMessages(d rabbitmq.Delivery) rabbitmq.Action {
 	for _, plugin := range plugins {
 		noMatchingPlugin = true
 		var pluginSetting models.PluginSetting
-		if err := database.DB.Where("plugin_id = ? AND team_id = ?", plugin.ID, message.TeamID).First(&pluginSetting).Error; err != nil {
+		if err := database.DB.WithContext(ctx).Where("plugin_id = ? AND team_id = ?", plugin.ID, message.TeamID).First(&pluginSetting).Error; err != nil {
 			logger.Error("Failed to query PluginSetting", zap.Error(err))
 			continue
 		}
@@ -597,7 +674,11 @@ func routeMessages(d rabbitmq.Delivery) rabbitmq.Action {
 				logger.Error("Failed to marshal message", zap.Error(err))
 				return rabbitmq.NackDiscard
 			}
-			if err = publisher.Publish(jsonMessage, []string{plugin.ID.String()}, rabbitmq.WithPublishOptionsContentType("application/json"), rabbitmq.WithPublishOptionsExchange("manager")); err != nil {
+			headers := ids.Table()
+			_, publishSpan := telemetry.StartPublish(ctx, "manager", plugin.ID.String(), headers)
+			err = publisher.Publish(jsonMessage, []string{plugin.ID.String()}, rabbitmq.WithPublishOptionsContentType("application/json"), rabbitmq.WithPublishOptionsExchange("manager"), rabbitmq.WithPublishOptionsHeaders(headers))
+			telemetry.End(publishSpan, err)
+			if err != nil {
 				logger.Error("Failed to publish message", zap.Error(err))
 				return rabbitmq.NackDiscard
 			}
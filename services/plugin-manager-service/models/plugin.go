@@ -11,9 +11,12 @@ type Plugin struct {
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
 	Url         string    `json:"url"`
-	Instances   uint      `json:"instances"`
-	Actions     []Action  `json:"actions"`
-	Events      []Event   `json:"events"`
+	// Service is the service account of the plugin, the requests proxied to
+	// the plugin carry service tokens minted for it.
+	Service   string   `json:"service"`
+	Instances uint     `json:"instances"`
+	Actions   []Action `json:"actions"`
+	Events    []Event  `json:"events"`
 }
 
 type Action struct {
@@ -0,0 +1,106 @@
+// Package permission checks the permissions the api gateway passes on from
+// the access token in the X-Permissions header. The same package is copied
+// into every service behind the gateway, keep the copies in sync.
+package permission
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	FormCreate         = "form:create"
+	FormRead           = "form:read"
+	FormUpdate         = "form:update"
+	ResponsesSubmit    = "responses:submit"
+	ResponsesRead      = "responses:read"
+	ResponsesReadOwn   = "responses:read:own"
+	ResponsesExport    = "responses:export"
+	ResponsesImport    = "responses:import"
+	ResponsesReview    = "responses:review"
+	KeysRotate         = "keys:rotate"
+	PluginsRead        = "plugins:read"
+	PluginsConfigure   = "plugins:configure"
+	PluginsActionScope = "plugins:action"
+)
+
+// Scopes of service tokens only, checked on internal endpoints.
+const (
+	PluginsRegister = "plugins:register"
+	PluginsInvoke   = "plugins:invoke"
+)
+
+// Logger is used to log denied requests, set it from main.
+var Logger = zap.NewNop()
+
+// PluginAction is the permission to run the named plugin action.
+func PluginAction(action string) string {
+	return PluginsActionScope + ":" + action
+}
+
+// FromRequest returns the permissions of the request.
+func FromRequest(c *gin.Context) []string {
+	header := c.GetHeader("X-Permissions")
+	if header == "" {
+		return nil
+	}
+	return strings.Split(header, ",")
+}
+
+// Has reports whether the request has the permission. A granted permission
+// ending in ":*" covers every permission below it, "plugins:action:*" grants
+// all plugin actions.
+func Has(c *gin.Context, permission string) bool {
+	for _, granted := range FromRequest(c) {
+		if granted == permission || granted == "*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(granted, "*"); ok && strings.HasSuffix(prefix, ":") && strings.HasPrefix(permission, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check responds with 403 and returns false unless the request has the
+// permission, for handlers whose permission depends on the request.
+func Check(c *gin.Context, permission string) bool {
+	if Has(c, permission) {
+		return true
+	}
+	Logger.Warn("Permission denied", zap.String("permission", permission), zap.Strings("granted", FromRequest(c)))
+	c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission " + permission})
+	c.Abort()
+	return false
+}
+
+// Require allows requests having all of the permissions.
+func Require(permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, permission := range permissions {
+			if !Check(c, permission) {
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// RequireAny allows requests having at least one of the permissions, the
+// handler decides what each of them gives access to.
+func RequireAny(permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, permission := range permissions {
+			if Has(c, permission) {
+				c.Next()
+				return
+			}
+		}
+		Logger.Warn("Permission denied", zap.Strings("permissions", permissions), zap.Strings("granted", FromRequest(c)))
+		c.JSON(http.StatusForbidden, gin.H{"error": "Missing one of the permissions " + strings.Join(permissions, ", ")})
+		c.Abort()
+	}
+}
@@ -0,0 +1,63 @@
+package telemetry
+
+import (
+	"context"
+
+	"github.com/wagslane/go-rabbitmq"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tableCarrier carries the trace context in the headers of a message.
+type tableCarrier map[string]interface{}
+
+func (carrier tableCarrier) Get(key string) string {
+	value, _ := carrier[key].(string)
+	return value
+}
+
+func (carrier tableCarrier) Set(key string, value string) {
+	carrier[key] = value
+}
+
+func (carrier tableCarrier) Keys() []string {
+	keys := make([]string, 0, len(carrier))
+	for key := range carrier {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// StartPublish starts the span of publishing a message to the exchange and
+// sets its trace context in the headers of the message, replacing the one
+// of the request.
+func StartPublish(ctx context.Context, exchange string, routingKey string, headers map[string]interface{}) (context.Context, trace.Span) {
+	ctx, span := tracer().Start(ctx, exchange+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationPublish,
+			semconv.MessagingDestinationName(exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(routingKey),
+		),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, tableCarrier(headers))
+	return ctx, span
+}
+
+// StartConsume starts the span of handling a message from the queue, which
+// continues the trace of the headers of the message.
+func StartConsume(ctx context.Context, queue string, d rabbitmq.Delivery) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, tableCarrier(d.Headers))
+	return tracer().Start(ctx, queue+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationDeliver,
+			semconv.MessagingDestinationName(d.Exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(d.RoutingKey),
+			semconv.MessagingMessageBodySize(len(d.Body)),
+		),
+	)
+}
@@ -66,11 +66,14 @@ func (gsp *GoogleSheetsPlugin) Do(actionName string, data map[string]interface{}
 	switch actionName {
 	case "export":
 		FormID := strconv.FormatUint(uint64(data["form_id"].(float64)), 10)
-		resp, err := http.Get("http://form-service/" + FormID + "/responses")
+		resp, err := pluginserver.ServiceClient().Get("http://form-service/" + FormID + "/responses")
 		if err != nil {
 			return nil, fmt.Errorf("Error sending GET request: %s", err)
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Form service responded with status code %d", resp.StatusCode)
+		}
 
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
@@ -113,8 +116,11 @@ type RequestJson struct {
 		Value string `json:"value"`
 	} `json:"questions"`
 	Responses []struct {
-		UserID  uint `json:"user_id"`
-		Answers []struct {
+		ResponseID  uint  `json:"response_id"`
+		UserID      uint  `json:"user_id"`
+		Duplicate   bool  `json:"duplicate"`
+		DuplicateOf *uint `json:"duplicate_of"`
+		Answers     []struct {
 			QuestionID uint        `json:"question_id"`
 			Value      interface{} `json:"value"`
 		} `json:"answers"`
@@ -169,17 +175,33 @@ func exportToSpreadsheet(data RequestJson) (string, error) {
 		return "", err
 	}
 
+	// Flagged duplicates get an extra column pointing to the original response
+	hasDuplicates := false
+	for _, response := range data.Responses {
+		if response.Duplicate {
+			hasDuplicates = true
+			break
+		}
+	}
+	columns := len(data.Questions)
+	if hasDuplicates {
+		columns++
+	}
+
 	// Write column headers
 	var values [][]interface{}
-	headers := make([]interface{}, len(data.Questions))
+	headers := make([]interface{}, columns)
 	for i, question := range data.Questions {
 		headers[i] = question.Value
 	}
+	if hasDuplicates {
+		headers[columns-1] = "Duplicate of response"
+	}
 	values = append(values, headers)
 
 	// Write row data
 	for _, response := range data.Responses {
-		row := make([]interface{}, len(data.Questions))
+		row := make([]interface{}, columns)
 		for i, question := range data.Questions {
 			for _, answer := range response.Answers {
 				if answer.QuestionID == question.ID {
@@ -188,10 +210,13 @@ func exportToSpreadsheet(data RequestJson) (string, error) {
 				}
 			}
 		}
+		if response.Duplicate && response.DuplicateOf != nil {
+			row[columns-1] = strconv.FormatUint(uint64(*response.DuplicateOf), 10)
+		}
 		values = append(values, row)
 	}
 
-	writeRange := "Sheet1!A1:" + string(rune('A'+len(data.Questions)-1)) + strconv.Itoa(len(values))
+	writeRange := "Sheet1!A1:" + string(rune('A'+columns-1)) + strconv.Itoa(len(values))
 	valueRange := &sheets.ValueRange{
 		Values: values,
 	}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// The request ID and W3C trace context of the request an event or action
+// comes from, sent by the plugin manager in HTTP and message headers. They
+// are added to the logs so a request can be followed into the plugin.
+const (
+	requestIDHeader   = "X-Request-Id"
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+)
+
+type correlationIDs struct {
+	requestID   string
+	traceparent string
+	tracestate  string
+}
+
+type correlationKey struct{}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, char := range id {
+		if (char < 'a' || char > 'z') && (char < 'A' || char > 'Z') && (char < '0' || char > '9') && char != '-' && char != '_' && char != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func validTraceparent(traceparent string) bool {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return false
+	}
+	for _, part := range parts {
+		for _, char := range part {
+			if (char < '0' || char > '9') && (char < 'a' || char > 'f') {
+				return false
+			}
+		}
+	}
+	return strings.Trim(parts[1], "0") != "" && strings.Trim(parts[2], "0") != ""
+}
+
+// correlationFromHeader returns the IDs of the headers, invalid ones are
+// dropped.
+func correlationFromHeader(header http.Header) correlationIDs {
+	var ids correlationIDs
+	if id := header.Get(requestIDHeader); validRequestID(id) {
+		ids.requestID = id
+	}
+	if traceparent := header.Get(traceparentHeader); validTraceparent(traceparent) {
+		ids.traceparent = traceparent
+		ids.tracestate = header.Get(tracestateHeader)
+	}
+	return ids
+}
+
+// correlationFromTable returns the IDs of the headers of a message.
+func correlationFromTable(table map[string]interface{}) correlationIDs {
+	header := http.Header{}
+	for _, key := range []string{requestIDHeader, traceparentHeader, tracestateHeader} {
+		if value, ok := table[key].(string); ok {
+			header.Set(key, value)
+		}
+	}
+	return correlationFromHeader(header)
+}
+
+// complete fills in a new request ID and starts a new trace when they are
+// missing.
+func (ids correlationIDs) complete() correlationIDs {
+	if ids.requestID == "" {
+		ids.requestID = randomHex(16)
+	}
+	if ids.traceparent == "" {
+		ids.traceparent = "00-" + randomHex(16) + "-" + randomHex(8) + "-01"
+		ids.tracestate = ""
+	}
+	return ids
+}
+
+// withSpan takes the trace context of the span the plugin records for the
+// request, so the logs carry the IDs of the exported trace.
+func (ids correlationIDs) withSpan(ctx context.Context) correlationIDs {
+	span := trace.SpanContextFromContext(ctx)
+	if !span.IsValid() || span.IsRemote() {
+		return ids
+	}
+	ids.traceparent = "00-" + span.TraceID().String() + "-" + span.SpanID().String() + "-" + span.TraceFlags().String()
+	ids.tracestate = span.TraceState().String()
+	return ids
+}
+
+// fields returns the IDs as log fields.
+func (ids correlationIDs) fields() []zap.Field {
+	var fields []zap.Field
+	if ids.requestID != "" {
+		fields = append(fields, zap.String("request_id", ids.requestID))
+	}
+	if len(ids.traceparent) >= 35 {
+		fields = append(fields, zap.String("trace_id", ids.traceparent[3:35]))
+	}
+	return fields
+}
+
+func correlationFromContext(ctx context.Context) correlationIDs {
+	ids, _ := ctx.Value(correlationKey{}).(correlationIDs)
+	return ids
+}
+
+// correlationMiddleware keeps the IDs of the request in its context, and
+// answers the request ID in X-Request-Id. It runs after the tracing
+// middleware, whose span is the trace context of the request when recorded.
+func correlationMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ids := correlationFromHeader(c.Request.Header).withSpan(c.Request.Context()).complete()
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), correlationKey{}, ids))
+		c.Header(requestIDHeader, ids.requestID)
+		c.Next()
+	}
+}
+
+// correlationLogFields adds the IDs to the request logs of ginzap.
+func correlationLogFields(c *gin.Context) []zapcore.Field {
+	return correlationFromContext(c.Request.Context()).fields()
+}
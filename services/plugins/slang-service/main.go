@@ -118,11 +118,14 @@ func getAnswerByFormId(formId uint, responseId uint, questionId uint) (string, e
 	params.Add("question_id", strQuestionId)
 	fullURL := baseURL + "?" + params.Encode()
 
-	response, err := http.Get(fullURL)
+	response, err := pluginserver.ServiceClient().Get(fullURL)
 	if err != nil {
 		return "", nil
 	}
 	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("form service responded with status code %d", response.StatusCode)
+	}
 
 	body, err := io.ReadAll(response.Body)
 	if err != nil {
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	rabbitmq "github.com/wagslane/go-rabbitmq"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// setupTracing installs the W3C trace context propagator and, when a
+// collector is configured in OTEL_EXPORTER_OTLP_ENDPOINT, a tracer provider
+// exporting the spans of the plugin over OTLP/HTTP. Without a collector the
+// spans aren't recorded, so plugins run and are tested without one. The
+// returned function flushes the spans left.
+func setupTracing(ctx context.Context, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(service)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware starts a server span for each request but health checks.
+func tracingMiddleware(service string) gin.HandlerFunc {
+	return otelgin.Middleware(service, otelgin.WithFilter(func(req *http.Request) bool {
+		return !strings.HasSuffix(req.URL.Path, "/health")
+	}))
+}
+
+// tracingTransport sends the requests with base in client spans.
+func tracingTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(base)
+}
+
+// tableCarrier carries the trace context in the headers of a message.
+type tableCarrier map[string]interface{}
+
+func (carrier tableCarrier) Get(key string) string {
+	value, _ := carrier[key].(string)
+	return value
+}
+
+func (carrier tableCarrier) Set(key string, value string) {
+	carrier[key] = value
+}
+
+func (carrier tableCarrier) Keys() []string {
+	keys := make([]string, 0, len(carrier))
+	for key := range carrier {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// startConsume starts the span of handling an event from the queue, which
+// continues the trace of the headers of the message.
+func startConsume(queue string, d rabbitmq.Delivery) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), tableCarrier(d.Headers))
+	return otel.Tracer("plugin-server").Start(ctx, queue+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationDeliver,
+			semconv.MessagingDestinationName(d.Exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(d.RoutingKey),
+			semconv.MessagingMessageBodySize(len(d.Body)),
+		),
+	)
+}
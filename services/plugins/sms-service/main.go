@@ -32,7 +32,7 @@ func (gsp *SmsService) Get() pluginserver.PluginData {
 	description := "Sms notifier on correct data ingestion"
 	url := "http://sms-service"
 	actions := []string{}
-	events := []string{"response-submission"}
+	events := []string{"response-submission", "response-reviewed"}
 	id := uuid.NewSHA1(uuid.Nil, []byte(name))
 
 	return pluginserver.PluginData{
@@ -72,6 +72,7 @@ var plugin *SmsService
 func main() {
 	plugin = New()
 	plugin.On("response-submission", sendSMS)
+	plugin.On("response-reviewed", sendReviewSMS)
 
 	server := pluginserver.New(plugin, "http://plugin-manager-service", os.Getenv("RABBITMQ_URL"))
 	defer server.Close()
@@ -124,31 +125,82 @@ func sendSMS(data interface{}) (interface{}, error) {
 		return nil, fmt.Errorf("Error unmarshaling data to Message: %s", err)
 	}
 
-	userID := fmt.Sprintf("%v", msg.Data.UserID)
-	resp, err := http.Get("http://auth-service/users/" + userID)
+	phone, err := userPhone(msg.Data.UserID)
 	if err != nil {
-		return nil, fmt.Errorf("Error sending GET request: %s", err)
+		return nil, err
+	}
+	msgBody := fmt.Sprintf("\nUser Id : %d\nForm Id : %d\nTitle : %s\nDescription : %s", msg.Data.UserID, msg.Data.FormID, msg.Data.Title, msg.Data.Description)
+	for _, qna := range msg.Data.QnA {
+		msgBody = msgBody + fmt.Sprintf("\nQuestion : %s\nAnswer : %s\n", qna[0], qna[1])
+	}
+	result, err := sms(phone, msgBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func userPhone(id uint) (string, error) {
+	userID := fmt.Sprintf("%v", id)
+	resp, err := pluginserver.ServiceClient().Get("http://auth-service/users/" + userID)
+	if err != nil {
+		return "", fmt.Errorf("Error sending GET request: %s", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Auth service responded with status code %d", resp.StatusCode)
+	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	var userDetails map[string]interface{}
 	err = json.Unmarshal(body, &userDetails)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	msgBody := fmt.Sprintf("\nUser Id : %d\nForm Id : %d\nTitle : %s\nDescription : %s", msg.Data.UserID, msg.Data.FormID, msg.Data.Title, msg.Data.Description)
-	for _, qna := range msg.Data.QnA {
-		msgBody = msgBody + fmt.Sprintf("\nQuestion : %s\nAnswer : %s\n", qna[0], qna[1])
+	phone, ok := userDetails["phone"].(string)
+	if !ok || phone == "" {
+		return "", fmt.Errorf("User %s has no phone number", userID)
+	}
+	if verified, _ := userDetails["phone_verified"].(bool); !verified {
+		return "", fmt.Errorf("User %s hasn't verified the phone number", userID)
 	}
-	result, err := sms(userDetails["phone"].(string), msgBody)
+	return phone, nil
+}
+
+func sendReviewSMS(data interface{}) (interface{}, error) {
+	type MessageData struct {
+		FormID     uint   `json:"form_id"`
+		Title      string `json:"title"`
+		ResponseID uint   `json:"response_id"`
+		UserID     uint   `json:"user_id"`
+		Status     string `json:"status"`
+	}
+
+	type Message struct {
+		Event  string      `json:"event"`
+		TeamID uint        `json:"team_id"`
+		Data   MessageData `json:"data"`
+	}
+	dataBytes, err := json.Marshal(data)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Error marshaling data to JSON: %s", err)
 	}
 
-	return result, nil
+	var msg Message
+	err = json.Unmarshal(dataBytes, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshaling data to Message: %s", err)
+	}
+
+	phone, err := userPhone(msg.Data.UserID)
+	if err != nil {
+		return nil, err
+	}
+	msgBody := fmt.Sprintf("\nYour response %d to %s has been reviewed.\nStatus : %s", msg.Data.ResponseID, msg.Data.Title, msg.Data.Status)
+	return sms(phone, msgBody)
 }
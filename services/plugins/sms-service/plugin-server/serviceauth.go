@@ -0,0 +1,321 @@
+// The service authentication of the serviceauth package of the services,
+// copied into the SDK so plugins get it without another module. Keep it in
+// sync with the services.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// TokenUse is the token_use claim of service tokens, access tokens of users
+// are refused.
+const TokenUse = "service"
+
+const (
+	// refreshMargin is how long before expiry a token is replaced, so it
+	// doesn't expire on the way.
+	refreshMargin = 30 * time.Second
+	// keyCacheTTL matches the caching the auth service allows for its keys.
+	keyCacheTTL = 5 * time.Minute
+	// keyReloadInterval limits reloads of the keys for unknown key IDs.
+	keyReloadInterval = 10 * time.Second
+	// leeway allows for clock skew between the services.
+	leeway = 30 * time.Second
+)
+
+var (
+	ErrMissingCredentials = errors.New("SERVICE_NAME and SERVICE_SECRET are required")
+	ErrInvalidToken       = errors.New("invalid service token")
+)
+
+// AuthURL returns the address of the auth service, from AUTH_URL.
+func AuthURL() string {
+	if url := os.Getenv("AUTH_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "http://auth-service"
+}
+
+// Client obtains service tokens of the service account and attaches them to
+// requests. Each token is minted for the service it is sent to, so the
+// receiving service can't replay it against another one.
+type Client struct {
+	Name    string
+	Secret  string
+	AuthURL string
+	// Scopes narrows the tokens to part of the scopes of the account, they
+	// carry all of them by default.
+	Scopes []string
+	// HTTPClient fetches the tokens.
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}
+
+type cachedToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// ClientFromEnv returns the client of the account named in SERVICE_NAME
+// with the secret in SERVICE_SECRET.
+func ClientFromEnv() (*Client, error) {
+	name, secret := os.Getenv("SERVICE_NAME"), os.Getenv("SERVICE_SECRET")
+	if name == "" || secret == "" {
+		return nil, ErrMissingCredentials
+	}
+	return &Client{
+		Name:       name,
+		Secret:     secret,
+		AuthURL:    AuthURL(),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Token returns the cached token for the audience, or a new one when it is
+// about to expire.
+func (client *Client) Token(ctx context.Context, audience string) (string, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if cached, ok := client.tokens[audience]; ok && time.Until(cached.expiresAt) > refreshMargin {
+		return cached.token, nil
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"scopes": client.Scopes, "audience": audience})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.AuthURL+"/service-token", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(client.Name, client.Secret)
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get service token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get service token: auth service responded with status code %d", resp.StatusCode)
+	}
+	var issued struct {
+		Token     string `json:"token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&issued); err != nil {
+		return "", fmt.Errorf("failed to decode service token: %w", err)
+	}
+
+	if client.tokens == nil {
+		client.tokens = map[string]cachedToken{}
+	}
+	client.tokens[audience] = cachedToken{
+		token:     issued.Token,
+		expiresAt: time.Now().Add(time.Duration(issued.ExpiresIn) * time.Second),
+	}
+	return issued.Token, nil
+}
+
+// Invalidate drops the cached token for the audience, the next request gets
+// a new one.
+func (client *Client) Invalidate(audience string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	delete(client.tokens, audience)
+}
+
+// Transport returns a round tripper sending the requests with base, or
+// http.DefaultTransport when nil, with the token in the Authorization
+// header. The header of the incoming request is replaced, so tokens of users
+// aren't passed on. The tokens are minted for the host of each request, the
+// services are reached under their names.
+func (client *Client) Transport(base http.RoundTripper) http.RoundTripper {
+	return client.AudienceTransport("", base)
+}
+
+// AudienceTransport is Transport with the tokens minted for the audience,
+// for services reached under another host name. An empty audience is the
+// host of the request.
+func (client *Client) AudienceTransport(audience string, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{client: client, audience: audience, base: base}
+}
+
+// HTTP returns an http.Client sending every request with the token, in a
+// span of the trace of the context of the request.
+func (client *Client) HTTP() *http.Client {
+	return &http.Client{Transport: client.Transport(tracingTransport(nil)), Timeout: 30 * time.Second}
+}
+
+type transport struct {
+	client   *Client
+	audience string
+	base     http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	audience := t.audience
+	if audience == "" {
+		audience = req.URL.Hostname()
+	}
+	token, err := t.client.Token(req.Context(), audience)
+	if err != nil {
+		return nil, err
+	}
+	// a round tripper must not change the request it is given
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		// the key may have been rotated out, the next request gets a new token
+		t.client.Invalidate(audience)
+	}
+	return resp, err
+}
+
+// Claims are the claims of a verified service token.
+type Claims struct {
+	// Service is the name of the calling service account.
+	Service   string
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+// HasScope reports whether the token carries the scope. A scope ending in
+// ":*" covers every scope below it.
+func (claims Claims) HasScope(scope string) bool {
+	for _, granted := range claims.Scopes {
+		if granted == scope {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(granted, "*"); ok && strings.HasSuffix(prefix, ":") && strings.HasPrefix(scope, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifier checks service tokens against the keys of the auth service.
+type Verifier struct {
+	// Audience is the name of the service, tokens minted for other services
+	// are refused.
+	Audience string
+	// Logger is used to log refused requests.
+	Logger *zap.Logger
+
+	keys keyfunc.Keyfunc
+}
+
+// NewVerifier returns a verifier of the tokens of the auth service at authURL
+// minted for the audience. The keys are refreshed every keyCacheTTL, so
+// retired keys stop being trusted, and for unknown key IDs, so new keys are
+// picked up, at most every keyReloadInterval.
+func NewVerifier(authURL string, audience string) (*Verifier, error) {
+	if audience == "" {
+		return nil, errors.New("the audience of service tokens is required")
+	}
+	verifier := &Verifier{Audience: audience, Logger: zap.NewNop()}
+	jwksURL := authURL + "/.well-known/jwks.json"
+	keys, err := keyfunc.NewDefaultOverrideCtx(context.Background(), []string{jwksURL}, keyfunc.Override{
+		HTTPTimeout:     10 * time.Second,
+		RefreshInterval: keyCacheTTL,
+		// the cached keys are kept while the auth service is unavailable
+		RefreshErrorHandlerFunc: func(url string) func(context.Context, error) {
+			return func(_ context.Context, err error) {
+				verifier.Logger.Error("Failed to load signing keys", zap.String("url", url), zap.Error(err))
+			}
+		},
+		RefreshUnknownKID: rate.NewLimiter(rate.Every(keyReloadInterval), 1),
+		// tokens with unknown keys are refused rather than waiting for a reload
+		RateLimitWaitMax: time.Millisecond,
+	})
+	if err != nil {
+		return nil, err
+	}
+	verifier.keys = keys
+	return verifier, nil
+}
+
+// tokenClaims are the claims of the service tokens of the auth service.
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	TokenUse string   `json:"token_use"`
+	Scopes   []string `json:"scopes"`
+}
+
+// Verify returns the claims of the token once its signature, validity,
+// audience and use are checked.
+func (verifier *Verifier) Verify(ctx context.Context, token string) (Claims, error) {
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, verifier.keys.KeyfuncCtx(ctx),
+		// the algorithm has to match the key, so a token can't pick a weaker one
+		jwt.WithValidMethods([]string{"RS256", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithAudience(verifier.Audience),
+		jwt.WithLeeway(leeway))
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.TokenUse != TokenUse {
+		return Claims{}, fmt.Errorf("%w: not a service token", ErrInvalidToken)
+	}
+
+	return Claims{Service: claims.Subject, Scopes: claims.Scopes, ExpiresAt: claims.ExpiresAt.Time}, nil
+}
+
+// Require allows requests with a service token carrying all of the scopes.
+// The name of the calling service is set as "service" in the context.
+func (verifier *Verifier) Require(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			verifier.Logger.Warn("Service token missing", zap.String("path", c.FullPath()), zap.String("ip", c.ClientIP()))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "A service token is required"})
+			c.Abort()
+			return
+		}
+		claims, err := verifier.Verify(c.Request.Context(), token)
+		if err != nil {
+			verifier.Logger.Warn("Service token refused", zap.String("path", c.FullPath()), zap.String("ip", c.ClientIP()), zap.Error(err))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid service token"})
+			c.Abort()
+			return
+		}
+		for _, scope := range scopes {
+			if !claims.HasScope(scope) {
+				verifier.Logger.Warn("Service scope denied", zap.String("service", claims.Service), zap.String("scope", scope), zap.Strings("granted", claims.Scopes))
+				c.JSON(http.StatusForbidden, gin.H{"error": "Missing scope " + scope})
+				c.Abort()
+				return
+			}
+		}
+		c.Set("service", claims.Service)
+		c.Next()
+	}
+}
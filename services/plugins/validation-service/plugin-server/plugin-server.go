@@ -2,46 +2,102 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 
 	"slices"
 
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/codes"
 	"go.uber.org/zap"
 
 	rabbitmq "github.com/wagslane/go-rabbitmq"
 )
 
+// PluginsInvokeScope is the scope the plugin manager needs to configure
+// plugins and run their actions.
+const PluginsInvokeScope = "plugins:invoke"
+
+var (
+	serviceClient     *http.Client
+	serviceClientOnce sync.Once
+)
+
+// ServiceClient returns the http.Client plugins call internal endpoints
+// with, like the responses of the form service. It attaches the service
+// token of the account in SERVICE_NAME and SERVICE_SECRET to every request.
+func ServiceClient() *http.Client {
+	serviceClientOnce.Do(func() {
+		client, err := ClientFromEnv()
+		if err != nil {
+			// requests fail with the configuration error
+			serviceClient = &http.Client{Transport: failingTransport{err: err}}
+			return
+		}
+		serviceClient = client.HTTP()
+	})
+	return serviceClient
+}
+
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
 type PluginServer struct {
 	engine           *gin.Engine
 	plugin           Plugin
 	logger           *zap.Logger
+	verifier         *Verifier
 	address          string
 	manager          string
 	msgQ             string
 	rabbitMQConn     *rabbitmq.Conn
 	rabbitMQConsumer *rabbitmq.Consumer
+	shutdownTracing  func(context.Context) error
 }
 
 func New(plugin Plugin, managerUrl string, messageQueueUrl string) *PluginServer {
 	logger, _ := zap.NewDevelopment()
 	logger.With(zap.String("service", plugin.Get().Name))
 
+	shutdownTracing, err := setupTracing(context.Background(), plugin.Get().Name)
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
+	}
+
 	r := gin.New()
-	r.Use(ginzap.Ginzap(logger, time.RFC3339, true))
+	r.Use(tracingMiddleware(plugin.Get().Name))
+	r.Use(correlationMiddleware())
+	r.Use(ginzap.GinzapWithConfig(logger, &ginzap.Config{TimeFormat: time.RFC3339, UTC: true, Context: correlationLogFields}))
 	r.Use(ginzap.RecoveryWithZap(logger, true))
 
+	// the plugin manager mints the tokens of its requests for the service
+	// account of the plugin
+	verifier, err := NewVerifier(AuthURL(), os.Getenv("SERVICE_NAME"))
+	if err != nil {
+		logger.Fatal("Failed to load service token keys", zap.Error(err))
+	}
+	verifier.Logger = logger
+
 	return &PluginServer{
-		engine:  r,
-		plugin:  plugin,
-		logger:  logger,
-		address: ":80",
-		manager: managerUrl,
-		msgQ:    messageQueueUrl,
+		engine:          r,
+		plugin:          plugin,
+		logger:          logger,
+		verifier:        verifier,
+		address:         ":80",
+		manager:         managerUrl,
+		msgQ:            messageQueueUrl,
+		shutdownTracing: shutdownTracing,
 	}
 }
 
@@ -60,8 +116,9 @@ func (ps *PluginServer) Start(address string) error {
 		ps.logger.Fatal("Failed to initialize plugin", zap.Error(err))
 	}
 
-	ps.engine.POST("/configure", ps.configurePlugin)
-	ps.engine.POST("/actions/:action", ps.executeAction)
+	// only the plugin manager may configure the plugin and run its actions
+	ps.engine.POST("/configure", ps.verifier.Require(PluginsInvokeScope), ps.configurePlugin)
+	ps.engine.POST("/actions/:action", ps.verifier.Require(PluginsInvokeScope), ps.executeAction)
 	ps.engine.GET("/health", ps.healthCheck)
 
 	if err := ps.engine.Run(ps.address); err != nil {
@@ -105,8 +162,7 @@ func (ps *PluginServer) registerPluginWithManager(managerURL string) error {
 	ps.logger.Debug("HTTP request", zap.Any("request", req))
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := ServiceClient().Do(req)
 	if err != nil {
 		ps.logger.Error("HTTP request failed", zap.Error(err))
 		return fmt.Errorf("HTTP request failed: %v", err)
@@ -138,7 +194,7 @@ func (ps *PluginServer) initRabbitMQ() error {
 	consumer, err := rabbitmq.NewConsumer(
 		conn,
 		func(d rabbitmq.Delivery) rabbitmq.Action {
-			ps.handleEvent(d.Body)
+			ps.handleEvent(d)
 			return rabbitmq.Ack
 		},
 		ps.plugin.Get().Name,
@@ -154,29 +210,36 @@ func (ps *PluginServer) initRabbitMQ() error {
 	return nil
 }
 
-func (ps *PluginServer) handleEvent(eventRawData []byte) {
-	ps.logger.Debug("Entering handleEvent Function")
+// handleEvent runs the handler of the event in a span of the trace of the
+// request the event comes from, logging with its request ID and trace.
+func (ps *PluginServer) handleEvent(d rabbitmq.Delivery) {
+	ctx, span := startConsume(ps.plugin.Get().Name, d)
+	defer span.End()
+	logger := ps.logger.With(correlationFromTable(d.Headers).withSpan(ctx).fields()...)
+	logger.Debug("Entering handleEvent Function")
 	var eventData map[string]interface{}
-	if err := json.Unmarshal(eventRawData, &eventData); err != nil {
-		ps.logger.Error("Failed to unmarshal event data", zap.Error(err))
+	if err := json.Unmarshal(d.Body, &eventData); err != nil {
+		logger.Error("Failed to unmarshal event data", zap.Error(err))
 		return
 	}
 
 	eventName, ok := eventData["event"].(string)
 	if !ok {
-		ps.logger.Error("Invalid event data format", zap.Any("event", eventData))
+		logger.Error("Invalid event data format", zap.Any("event", eventData))
 		return
 	}
 
-	ps.logger.Debug("Event received", zap.String("event", eventName))
+	logger.Debug("Event received", zap.String("event", eventName))
 	var message interface{} = eventData
 	data, err := ps.plugin.GetEventHandlers()[eventName](message)
 	if err != nil {
-		ps.logger.Error("Event handler failed", zap.Error(err))
+		logger.Error("Event handler failed", zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return
 	}
-	ps.logger.Debug("Event data", zap.Any("data", data))
-	ps.logger.Debug("Exiting handleEvent Function")
+	logger.Debug("Event data", zap.Any("data", data))
+	logger.Debug("Exiting handleEvent Function")
 }
 
 func (ps *PluginServer) Close() error {
@@ -190,29 +253,34 @@ func (ps *PluginServer) Close() error {
 			return err
 		}
 	}
+	if err := ps.shutdownTracing(context.Background()); err != nil {
+		ps.logger.Error("Failed to flush spans", zap.Error(err))
+		return err
+	}
 	return nil
 }
 
 func (ps *PluginServer) configurePlugin(c *gin.Context) {
+	logger := ps.logger.With(correlationFromContext(c.Request.Context()).fields()...)
 	var configData map[string]interface{}
 
 	if err := c.BindJSON(&configData); err != nil {
-		ps.logger.Error("Failed to bind JSON data", zap.Error(err))
+		logger.Error("Failed to bind JSON data", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "Invalid JSON data",
 		})
 		return
 	}
-	ps.logger.Debug("Plugin configuration", zap.Any("configData", configData))
+	logger.Debug("Plugin configuration", zap.Any("configData", configData))
 
 	if err := ps.plugin.Configure(configData); err != nil {
-		ps.logger.Error("Plugin configuration failed", zap.Error(err))
+		logger.Error("Plugin configuration failed", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Plugin configuration failed",
 		})
 		return
 	}
-	ps.logger.Debug("Plugin configuration successful")
+	logger.Debug("Plugin configuration successful")
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Plugin configured successfully",
@@ -220,45 +288,46 @@ func (ps *PluginServer) configurePlugin(c *gin.Context) {
 }
 
 func (ps *PluginServer) executeAction(c *gin.Context) {
-	ps.logger.Debug("Entering executeAction Function")
+	logger := ps.logger.With(correlationFromContext(c.Request.Context()).fields()...)
+	logger.Debug("Entering executeAction Function")
 	actions := ps.plugin.Get().Actions
-	ps.logger.Debug("Available actions", zap.Any("actions", actions))
+	logger.Debug("Available actions", zap.Any("actions", actions))
 
 	if !slices.Contains(actions, c.Param("action")) {
-		ps.logger.Error("Invalid action", zap.String("action", c.Param("action")))
+		logger.Error("Invalid action", zap.String("action", c.Param("action")))
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error":   "Invalid action",
 			"actions": actions,
 		})
 		return
 	}
-	ps.logger.Debug("Executing action", zap.String("action", c.Param("action")))
+	logger.Debug("Executing action", zap.String("action", c.Param("action")))
 
 	var actionData map[string]interface{}
 	if err := c.BindJSON(&actionData); err != nil {
-		ps.logger.Error("Failed to bind JSON data", zap.Error(err))
+		logger.Error("Failed to bind JSON data", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "Invalid JSON data",
 		})
 		return
 	}
-	ps.logger.Debug("Action data parsed", zap.Any("actionData", actionData))
+	logger.Debug("Action data parsed", zap.Any("actionData", actionData))
 
 	actionResult, err := ps.plugin.Do(c.Param("action"), actionData)
 	if err != nil {
-		ps.logger.Error("Action failed", zap.Error(err))
+		logger.Error("Action failed", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
 		})
 		return
 	}
-	ps.logger.Debug("Action result", zap.Any("actionResult", actionResult))
+	logger.Debug("Action result", zap.Any("actionResult", actionResult))
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": c.Param("action") + " executed successfully",
 		"result":  actionResult,
 	})
-	ps.logger.Debug("Exiting executeAction function")
+	logger.Debug("Exiting executeAction function")
 }
 
 func (ps *PluginServer) healthCheck(c *gin.Context) {